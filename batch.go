@@ -0,0 +1,144 @@
+package wechat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+const (
+	// 批量操作中每一项最多重试的次数
+	batchMaxRetries = 2
+)
+
+var (
+	ErrRetryBudgetExhausted = errors.New("[gowechat] retry budget exhausted")
+
+	errSystemBusy = errors.New("[gowechat] system busy")
+)
+
+// RetryBudget 一批操作共享的重试次数，用完之后不再重试，剩下的项也不再请求
+// 避免微信故障时每一项都重试导致请求量成倍放大
+type RetryBudget struct {
+	mu     sync.Mutex
+	tokens int
+}
+
+func NewRetryBudget(retries int) *RetryBudget {
+	return &RetryBudget{tokens: retries}
+}
+
+// 剩余的重试次数
+func (b *RetryBudget) Remaining() int {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tokens
+}
+
+// 取一次重试机会，没有剩余时返回false
+func (b *RetryBudget) take() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens <= 0 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// 业务错误和配置错误重试也不会成功，不消耗重试次数
+func retryable(err error) bool {
+	for _, target := range []error{
+		context.Canceled, context.DeadlineExceeded,
+		ErrSignError, ErrIPNotWhitelisted, ErrInvalidConfig, ErrMerchantMismatch, ErrMissingApiKey,
+		ErrMissingSubMchId, ErrCertRequired,
+		ErrTokenMissing, ErrTokenExpired,
+	} {
+		if errors.Is(err, target) {
+			return false
+		}
+	}
+	return true
+}
+
+// 依次执行n项操作，失败时使用budget重试，budget用完后剩下的项直接返回 ErrRetryBudgetExhausted
+func runBatch(ctx context.Context, n int, budget *RetryBudget, do func(i int) error) []error {
+	errs := make([]error, n)
+	exhausted := false
+	for i := 0; i < n; i++ {
+		if exhausted {
+			errs[i] = ErrRetryBudgetExhausted
+			continue
+		}
+		for attempt := 0; ; attempt++ {
+			err := do(i)
+			if err == nil || !retryable(err) || ctx.Err() != nil || attempt >= batchMaxRetries {
+				errs[i] = err
+				break
+			}
+			if !budget.take() {
+				errs[i] = err
+				exhausted = budget != nil
+				break
+			}
+		}
+	}
+	return errs
+}
+
+// 批量查询订单的结果
+type BatchQueryResult struct {
+	TradeNo string
+	Resp    *QueryOrderResp
+	Err     error
+}
+
+// 批量查询订单，失败的查询共用budget重试，budget为nil时不重试
+// 微信返回可以重试的错误码（见 IsRetryable）时也会重试
+func (w wxPay) BatchQueryOrders(ctx context.Context, tradeNos []string, budget *RetryBudget) []BatchQueryResult {
+	results := make([]BatchQueryResult, len(tradeNos))
+	errs := runBatch(ctx, len(tradeNos), budget, func(i int) (err error) {
+		results[i].Resp, err = w.ReqQueryOrder(ctx, tradeNos[i])
+		if err == nil && !results[i].Resp.result().success() && IsRetryable(results[i].Resp.ErrCode) {
+			return fmt.Errorf("%w: %s", errSystemBusy, Describe(results[i].Resp.ErrCode))
+		}
+		return err
+	})
+	for i := range results {
+		results[i].TradeNo = tradeNos[i]
+		results[i].Err = errs[i]
+	}
+	return results
+}
+
+// 批量发送订阅消息的结果
+type BatchSendResult struct {
+	Req  *SubscribeMessageReq
+	Resp *ErrorResp
+	Err  error
+}
+
+// 批量发送订阅消息，失败的发送共用budget重试，budget为nil时不重试
+// 微信返回系统繁忙（errcode为-1）时也会重试
+func (w wxMini) SendSubscribeMessages(ctx context.Context, reqs []*SubscribeMessageReq, budget *RetryBudget) []BatchSendResult {
+	results := make([]BatchSendResult, len(reqs))
+	errs := runBatch(ctx, len(reqs), budget, func(i int) (err error) {
+		results[i].Resp, err = w.SendSubscribeMessage(ctx, reqs[i])
+		if err == nil && results[i].Resp.ErrCode == -1 {
+			return errSystemBusy
+		}
+		return err
+	})
+	for i := range results {
+		results[i].Req = reqs[i]
+		results[i].Err = errs[i]
+	}
+	return results
+}
@@ -0,0 +1,86 @@
+package wechat
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWxPay_BatchQueryOrders_Outage(t *testing.T) {
+	// 没有预设响应，每次请求都解析失败，模拟微信完全不可用
+	client := newStubHttp()
+	client.status = 502
+	budget := NewRetryBudget(3)
+	tradeNos := []string{"T1", "T2", "T3", "T4", "T5", "T6", "T7", "T8", "T9", "T10"}
+	results := newTestPay(client).BatchQueryOrders(context.Background(), tradeNos, budget)
+
+	// T1: 1次请求 + 2次重试，T2: 1次请求 + 1次重试，之后budget用完不再请求
+	assert.Len(t, client.requests, 5)
+	assert.Equal(t, 0, budget.Remaining())
+	assert.Len(t, results, len(tradeNos))
+	for i, result := range results {
+		assert.Equal(t, tradeNos[i], result.TradeNo)
+		assert.NotNil(t, result.Err)
+	}
+	for _, result := range results[2:] {
+		assert.Equal(t, ErrRetryBudgetExhausted, result.Err)
+	}
+}
+
+func TestWxPay_BatchQueryOrders(t *testing.T) {
+	ok := `<xml><return_code>SUCCESS</return_code><result_code>SUCCESS</result_code><trade_state>SUCCESS</trade_state></xml>`
+	client := newStubHttp(ok, "", ok, ok)
+	budget := NewRetryBudget(3)
+	results := newTestPay(client).BatchQueryOrders(context.Background(), []string{"T1", "T2", "T3"}, budget)
+	assert.Len(t, client.requests, 4)
+	assert.Equal(t, 2, budget.Remaining())
+	for _, result := range results {
+		assert.Nil(t, result.Err)
+		assert.Equal(t, TradeStateSuccess, result.Resp.TradeState)
+	}
+
+	// 业务错误不重试
+	client = newStubHttp(`<xml><return_code>FAIL</return_code><return_msg>签名错误</return_msg></xml>`)
+	results = newTestPay(client).BatchQueryOrders(context.Background(), []string{"T1", "T2"}, budget)
+	assert.Len(t, client.requests, 2)
+	assert.True(t, errors.Is(results[0].Err, ErrSignError))
+	assert.Equal(t, 2, budget.Remaining())
+
+	// 可以重试的错误码会重试，不可重试的直接返回
+	systemError := `<xml><return_code>SUCCESS</return_code><result_code>FAIL</result_code><err_code>SYSTEMERROR</err_code></xml>`
+	notExist := `<xml><return_code>SUCCESS</return_code><result_code>FAIL</result_code><err_code>ORDERNOTEXIST</err_code></xml>`
+	client = newStubHttp(systemError, ok, notExist)
+	results = newTestPay(client).BatchQueryOrders(context.Background(), []string{"T1", "T2"}, budget)
+	assert.Len(t, client.requests, 3)
+	assert.Equal(t, 1, budget.Remaining())
+	assert.Nil(t, results[0].Err)
+	assert.Equal(t, TradeStateSuccess, results[0].Resp.TradeState)
+	assert.Nil(t, results[1].Err)
+	assert.Equal(t, ErrCodeOrderNotExist, results[1].Resp.ErrCode)
+
+	// 没有budget时不重试，但是每一项都会请求
+	client = newStubHttp()
+	results = newTestPay(client).BatchQueryOrders(context.Background(), []string{"T1", "T2"}, nil)
+	assert.Len(t, client.requests, 2)
+	assert.NotEqual(t, ErrRetryBudgetExhausted, results[1].Err)
+}
+
+func TestWxMini_SendSubscribeMessages_Outage(t *testing.T) {
+	client := newStubHttp(`{"errcode":-1,"errmsg":"system error"}`)
+	budget := NewRetryBudget(2)
+	reqs := []*SubscribeMessageReq{
+		{Touser: "OPENID1", TemplateId: "TEMPLATE_ID"},
+		{Touser: "OPENID2", TemplateId: "TEMPLATE_ID"},
+		{Touser: "OPENID3", TemplateId: "TEMPLATE_ID"},
+	}
+	results := newTestMini(client).SendSubscribeMessages(context.Background(), reqs, budget)
+	// OPENID1: 1次请求 + 2次重试，OPENID2: 请求失败后没有重试次数，OPENID3不再请求
+	assert.Len(t, client.requests, 4)
+	assert.NotNil(t, results[0].Err)
+	assert.NotNil(t, results[1].Err)
+	assert.NotEqual(t, ErrRetryBudgetExhausted, results[1].Err)
+	assert.Equal(t, ErrRetryBudgetExhausted, results[2].Err)
+	assert.Same(t, reqs[2], results[2].Req)
+}
@@ -0,0 +1,53 @@
+package wechat
+
+import (
+	"context"
+	"time"
+)
+
+// CallResult 一次请求的Http状态码、微信返回码和耗时，便于调用方统计
+// 通过 WithCallResult 放入context，请求结束后填充
+type CallResult struct {
+	Url        string
+	StatusCode int
+	ReturnCode string
+	ReturnMsg  string
+	ResultCode string
+	ErrCode    string
+	ErrCodeDes string
+	Duration   time.Duration
+}
+
+type callResultCtxKey struct{}
+
+// 返回带有CallResult的context，使用该context发出的请求结束后会填充返回的CallResult
+// 同一个context发出多个请求时，CallResult记录的是最后一个请求
+func WithCallResult(ctx context.Context) (context.Context, *CallResult) {
+	r := &CallResult{}
+	return context.WithValue(ctx, callResultCtxKey{}, r), r
+}
+
+func callResultFromContext(ctx context.Context) *CallResult {
+	r, _ := ctx.Value(callResultCtxKey{}).(*CallResult)
+	return r
+}
+
+// context中已有CallResult时直接使用，否则添加一个
+func ensureCallResult(ctx context.Context) (context.Context, *CallResult) {
+	if r := callResultFromContext(ctx); r != nil {
+		return ctx, r
+	}
+	return WithCallResult(ctx)
+}
+
+// 记录支付接口的返回码
+func (r *CallResult) setPayResult(result payResult) {
+	if r == nil {
+		return
+	}
+	r.ReturnCode = result.ReturnCode
+	r.ReturnMsg = result.ReturnMsg
+	r.ResultCode = result.ResultCode
+	r.ErrCode = result.ErrCode
+	r.ErrCodeDes = result.ErrCodeDes
+}
@@ -0,0 +1,73 @@
+package wechat
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestCallResult(t *testing.T) {
+	client := newStubHttp(`<xml>
+<return_code><![CDATA[SUCCESS]]></return_code>
+<return_msg><![CDATA[OK]]></return_msg>
+<result_code><![CDATA[FAIL]]></result_code>
+<err_code><![CDATA[ORDERNOTEXIST]]></err_code>
+<err_code_des><![CDATA[订单不存在]]></err_code_des>
+</xml>`)
+	ctx, result := WithCallResult(context.Background())
+	// 业务失败不作为错误返回，调用方从CallResult中也能拿到错误码
+	_, err := newTestPay(client).ReqQueryOrder(ctx, "1217752501201407033233368018")
+	assert.Nil(t, err)
+	assert.Equal(t, queryOrderUrl, result.Url)
+	assert.Equal(t, 200, result.StatusCode)
+	assert.Equal(t, "SUCCESS", result.ReturnCode)
+	assert.Equal(t, "OK", result.ReturnMsg)
+	assert.Equal(t, "FAIL", result.ResultCode)
+	assert.Equal(t, "ORDERNOTEXIST", result.ErrCode)
+	assert.Equal(t, "订单不存在", result.ErrCodeDes)
+	assert.True(t, result.Duration > 0)
+
+	// 没有CallResult的context不受影响
+	_, err = newTestPay(client).ReqQueryOrder(context.Background(), "1217752501201407033233368018")
+	assert.Nil(t, err)
+}
+
+func TestWxService_OutcomeLog(t *testing.T) {
+	client := newStubHttp(`<xml>
+<return_code><![CDATA[SUCCESS]]></return_code>
+<result_code><![CDATA[FAIL]]></result_code>
+<err_code><![CDATA[ORDERNOTEXIST]]></err_code>
+<err_code_des><![CDATA[订单不存在]]></err_code_des>
+</xml>`)
+	core, logs := observer.New(zap.InfoLevel)
+	s := newTestPay(client)
+	s.logger = zap.New(core)
+
+	_, err := s.ReqQueryOrder(context.Background(), "1217752501201407033233368018")
+	assert.Nil(t, err)
+	entries := logs.FilterMessage("[wx] outcome").All()
+	assert.Len(t, entries, 1)
+	assert.Equal(t, zap.InfoLevel, entries[0].Level)
+	fields := entries[0].ContextMap()
+	assert.Equal(t, queryOrderUrl, fields["endpoint"])
+	assert.EqualValues(t, 200, fields["http_status"])
+	assert.Equal(t, "SUCCESS", fields["return_code"])
+	assert.Equal(t, "FAIL", fields["result_code"])
+	assert.Equal(t, "ORDERNOTEXIST", fields["err_code"])
+	assert.True(t, fields["duration"].(time.Duration) > 0)
+	assert.NotContains(t, fields, "body")
+
+	// 查询参数不输出
+	logs.TakeAll()
+	assert.Nil(t, s.DoReq(context.Background(), "GET", "https://api.weixin.qq.com/cgi-bin/token?access_token=TOKEN", "", nil, func(response *http.Response, err error) error {
+		return err
+	}))
+	entries = logs.FilterMessage("[wx] outcome").All()
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "https://api.weixin.qq.com/cgi-bin/token", entries[0].ContextMap()["endpoint"])
+}
@@ -0,0 +1,114 @@
+package wechat
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrInvalidKeyLength  = errors.New("[gowechat] invalid aes key length")
+	ErrInvalidCiphertext = errors.New("[gowechat] invalid ciphertext")
+	ErrInvalidPadding    = errors.New("[gowechat] invalid pkcs7 padding")
+)
+
+// AES密钥只能是16、24、32字节
+func checkAESKey(key []byte) error {
+	switch len(key) {
+	case 16, 24, 32:
+		return nil
+	}
+	return fmt.Errorf("%w: %d bytes", ErrInvalidKeyLength, len(key))
+}
+
+// PKCS#7填充
+func pkcs7Pad(data []byte, blockSize int) []byte {
+	n := blockSize - len(data)%blockSize
+	padded := make([]byte, len(data), len(data)+n)
+	copy(padded, data)
+	return append(padded, bytes.Repeat([]byte{byte(n)}, n)...)
+}
+
+// 去掉PKCS#7填充，填充不合法时返回 ErrInvalidPadding
+func pkcs7Unpad(data []byte, blockSize int) ([]byte, error) {
+	if len(data) == 0 || len(data)%blockSize != 0 {
+		return nil, fmt.Errorf("%w: data length %d", ErrInvalidPadding, len(data))
+	}
+	n := int(data[len(data)-1])
+	if n == 0 || n > blockSize {
+		return nil, fmt.Errorf("%w: pad length %d", ErrInvalidPadding, n)
+	}
+	for _, b := range data[len(data)-n:] {
+		if int(b) != n {
+			return nil, ErrInvalidPadding
+		}
+	}
+	return data[:len(data)-n], nil
+}
+
+// AES-ECB解密并去掉PKCS#7填充，用于退款结果通知中的req_info
+func aesECBDecrypt(key, ciphertext []byte) ([]byte, error) {
+	if err := checkAESKey(key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("%w: length %d is not a multiple of the block size", ErrInvalidCiphertext, len(ciphertext))
+	}
+	plaintext := make([]byte, len(ciphertext))
+	for i := 0; i < len(ciphertext); i += aes.BlockSize {
+		block.Decrypt(plaintext[i:i+aes.BlockSize], ciphertext[i:i+aes.BlockSize])
+	}
+	return pkcs7Unpad(plaintext, aes.BlockSize)
+}
+
+// AES-CBC解密并去掉PKCS#7填充，用于小程序的加密数据
+func aesCBCDecrypt(key, iv, ciphertext []byte) ([]byte, error) {
+	if err := checkAESKey(key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != aes.BlockSize {
+		return nil, fmt.Errorf("%w: iv length %d", ErrInvalidCiphertext, len(iv))
+	}
+	if len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("%w: length %d is not a multiple of the block size", ErrInvalidCiphertext, len(ciphertext))
+	}
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+	return pkcs7Unpad(plaintext, aes.BlockSize)
+}
+
+// AES-GCM解密，ciphertext末尾带16字节的认证标签，用于v3接口的加密数据
+func aesGCMDecrypt(key, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if err := checkAESKey(key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) == 0 {
+		return nil, fmt.Errorf("%w: empty nonce", ErrInvalidCiphertext)
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(nonce))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCiphertext, err)
+	}
+	if len(ciphertext) < gcm.Overhead() {
+		return nil, fmt.Errorf("%w: length %d is shorter than the tag", ErrInvalidCiphertext, len(ciphertext))
+	}
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCiphertext, err)
+	}
+	return plaintext, nil
+}
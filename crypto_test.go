@@ -0,0 +1,113 @@
+package wechat
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	buf, err := hex.DecodeString(s)
+	assert.Nil(t, err)
+	return buf
+}
+
+func TestPKCS7(t *testing.T) {
+	for n := 0; n <= 32; n++ {
+		data := bytes.Repeat([]byte("a"), n)
+		padded := pkcs7Pad(data, 16)
+		assert.Equal(t, 0, len(padded)%16)
+		assert.True(t, len(padded) > n, "always adds padding")
+		unpadded, err := pkcs7Unpad(padded, 16)
+		assert.Nil(t, err)
+		assert.Equal(t, data, unpadded)
+	}
+
+	tests := []struct {
+		Name string
+		Data []byte
+	}{
+		{"empty", nil},
+		{"not block aligned", bytes.Repeat([]byte{1}, 15)},
+		{"zero pad", append(bytes.Repeat([]byte("a"), 15), 0)},
+		{"pad too long", append(bytes.Repeat([]byte("a"), 15), 17)},
+		{"inconsistent pad", append(bytes.Repeat([]byte("a"), 13), 2, 3, 3)},
+	}
+	for _, test := range tests {
+		_, err := pkcs7Unpad(test.Data, 16)
+		assert.True(t, errors.Is(err, ErrInvalidPadding), "%s: err = %v", test.Name, err)
+	}
+}
+
+func TestAESECBDecrypt(t *testing.T) {
+	key := mustHex(t, "2b7e151628aed2a6abf7158809cf4f3c")
+	// openssl enc -aes-128-ecb -K 2b7e151628aed2a6abf7158809cf4f3c
+	plaintext, err := aesECBDecrypt(key, mustHex(t, "f4b94d0283d44960a96c0b659a69a0caa254be88e037ddd9d79fb6411c3f9df8"))
+	assert.Nil(t, err)
+	assert.Equal(t, "hello wechat pay", string(plaintext))
+
+	// NIST SP 800-38A F.1.1，明文没有填充，解密后填充校验失败
+	_, err = aesECBDecrypt(key, mustHex(t, "3ad77bb40d7a3660a89ecaf32466ef97"))
+	assert.True(t, errors.Is(err, ErrInvalidPadding), "err = %v", err)
+
+	_, err = aesECBDecrypt(key, mustHex(t, "f4b94d0283d44960a96c0b659a69a0"))
+	assert.True(t, errors.Is(err, ErrInvalidCiphertext), "err = %v", err)
+
+	_, err = aesECBDecrypt(key[:15], mustHex(t, "3ad77bb40d7a3660a89ecaf32466ef97"))
+	assert.True(t, errors.Is(err, ErrInvalidKeyLength), "err = %v", err)
+}
+
+func TestAESCBCDecrypt(t *testing.T) {
+	key := mustHex(t, "2b7e151628aed2a6abf7158809cf4f3c")
+	iv := mustHex(t, "000102030405060708090a0b0c0d0e0f")
+	// openssl enc -aes-128-cbc -K 2b7e151628aed2a6abf7158809cf4f3c -iv 000102030405060708090a0b0c0d0e0f
+	ciphertext := mustHex(t, "30053fbafa104a872efaf202a838e659")
+	plaintext, err := aesCBCDecrypt(key, iv, ciphertext)
+	assert.Nil(t, err)
+	assert.Equal(t, "gowechat", string(plaintext))
+
+	wrongKey := mustHex(t, "000102030405060708090a0b0c0d0e0f")
+	_, err = aesCBCDecrypt(wrongKey, iv, ciphertext)
+	assert.True(t, errors.Is(err, ErrInvalidPadding), "err = %v", err)
+
+	_, err = aesCBCDecrypt(key, iv[:8], ciphertext)
+	assert.True(t, errors.Is(err, ErrInvalidCiphertext), "err = %v", err)
+
+	_, err = aesCBCDecrypt(key, iv, ciphertext[:10])
+	assert.True(t, errors.Is(err, ErrInvalidCiphertext), "err = %v", err)
+
+	_, err = aesCBCDecrypt(append(key, 1), iv, ciphertext)
+	assert.True(t, errors.Is(err, ErrInvalidKeyLength), "err = %v", err)
+}
+
+func TestAESGCMDecrypt(t *testing.T) {
+	// The Galois/Counter Mode of Operation (GCM) 附录B Test Case 4
+	key := mustHex(t, "feffe9928665731c6d6a8f9467308308")
+	nonce := mustHex(t, "cafebabefacedbaddecaf888")
+	additionalData := mustHex(t, "feedfacedeadbeeffeedfacedeadbeefabaddad2")
+	ciphertext := mustHex(t, "42831ec2217774244b7221b784d0d49ce3aa212f2c02a4e035c17e2329aca12e21d514b25466931c7d8f6a5aac84aa051ba30b396a0aac973d58e091"+
+		"5bc94fbc3221a5db94fae95ae7121a47")
+	plaintext, err := aesGCMDecrypt(key, nonce, ciphertext, additionalData)
+	assert.Nil(t, err)
+	assert.Equal(t, mustHex(t, "d9313225f88406e5a55909c5aff5269a86a7a9531534f7da2e4c303d8a318a721c3c0c95956809532fcf0e2449a6b525b16aedf5aa0de657ba637b39"), plaintext)
+
+	_, err = aesGCMDecrypt(key, nonce, ciphertext, []byte("other"))
+	assert.True(t, errors.Is(err, ErrInvalidCiphertext), "err = %v", err)
+
+	tampered := append([]byte{}, ciphertext...)
+	tampered[0] ^= 1
+	_, err = aesGCMDecrypt(key, nonce, tampered, additionalData)
+	assert.True(t, errors.Is(err, ErrInvalidCiphertext), "err = %v", err)
+
+	_, err = aesGCMDecrypt(key, nonce, ciphertext[:15], additionalData)
+	assert.True(t, errors.Is(err, ErrInvalidCiphertext), "err = %v", err)
+
+	_, err = aesGCMDecrypt(key, nil, ciphertext, additionalData)
+	assert.True(t, errors.Is(err, ErrInvalidCiphertext), "err = %v", err)
+
+	_, err = aesGCMDecrypt(key[:10], nonce, ciphertext, additionalData)
+	assert.True(t, errors.Is(err, ErrInvalidKeyLength), "err = %v", err)
+}
@@ -0,0 +1,95 @@
+package wechat
+
+// 支付接口返回的err_code
+const (
+	ErrCodeSystemError         = "SYSTEMERROR"
+	ErrCodeBizErrNeedRetry     = "BIZERR_NEED_RETRY"
+	ErrCodeFrequencyLimited    = "FREQUENCY_LIMITED"
+	ErrCodeBankError           = "BANKERROR"
+	ErrCodeUserPaying          = "USERPAYING"
+	ErrCodeProcessing          = "PROCESSING"
+	ErrCodeSendFailed          = "SEND_FAILED"
+	ErrCodeOrderNotExist       = "ORDERNOTEXIST"
+	ErrCodeOrderPaid           = "ORDERPAID"
+	ErrCodeOrderClosed         = "ORDERCLOSED"
+	ErrCodeOutTradeNoUsed      = "OUT_TRADE_NO_USED"
+	ErrCodeNoAuth              = "NOAUTH"
+	ErrCodeNotEnough           = "NOTENOUGH"
+	ErrCodeSignError           = "SIGNERROR"
+	ErrCodeInvalidRequest      = "INVALID_REQUEST"
+	ErrCodeParamError          = "PARAM_ERROR"
+	ErrCodeLackParams          = "LACK_PARAMS"
+	ErrCodeAppIdNotExist       = "APPID_NOT_EXIST"
+	ErrCodeMchIdNotExist       = "MCHID_NOT_EXIST"
+	ErrCodeAppIdMchIdNotMatch  = "APPID_MCHID_NOT_MATCH"
+	ErrCodeXMLFormatError      = "XML_FORMAT_ERROR"
+	ErrCodeRequirePostMethod   = "REQUIRE_POST_METHOD"
+	ErrCodePostDataEmpty       = "POST_DATA_EMPTY"
+	ErrCodeNotUTF8             = "NOT_UTF8"
+	ErrCodeTradeError          = "TRADE_ERROR"
+	ErrCodeInvalidTransaction  = "INVALID_TRANSACTIONID"
+	ErrCodeRefundNotExist      = "REFUNDNOTEXIST"
+	ErrCodeUserAccountAbnormal = "USER_ACCOUNT_ABNORMAL"
+	ErrCodeAmountLimit         = "AMOUNT_LIMIT"
+	ErrCodeMoneyLimit          = "MONEY_LIMIT"
+	ErrCodeSendNumLimit        = "SENDNUM_LIMIT"
+	ErrCodeAuthCodeExpire      = "AUTHCODEEXPIRE"
+	ErrCodeAuthCodeError       = "AUTH_CODE_ERROR"
+	ErrCodeAuthCodeInvalid     = "AUTH_CODE_INVALID"
+)
+
+type errCodeInfo struct {
+	description string
+	retryable   bool
+}
+
+// 错误码的描述和是否可以重试，可以重试的错误使用相同的参数再次请求可能成功
+var errCodeCatalog = map[string]errCodeInfo{
+	ErrCodeSystemError:         {"系统错误，请使用相同参数重试", true},
+	ErrCodeBizErrNeedRetry:     {"业务处理错误，请使用相同参数重试", true},
+	ErrCodeFrequencyLimited:    {"请求频率超限，请降低频率后重试", true},
+	ErrCodeBankError:           {"银行系统异常，请使用相同参数重试", true},
+	ErrCodeUserPaying:          {"用户支付中，需要用户输入密码", true},
+	ErrCodeProcessing:          {"请求已受理，请稍后使用相同参数查询", true},
+	ErrCodeSendFailed:          {"发放失败，请使用相同的商户单号重试", true},
+	ErrCodeOrderNotExist:       {"此交易订单号不存在", false},
+	ErrCodeOrderPaid:           {"商户订单已支付，无需重复操作", false},
+	ErrCodeOrderClosed:         {"当前订单已关闭，无法支付", false},
+	ErrCodeOutTradeNoUsed:      {"商户订单号重复", false},
+	ErrCodeNoAuth:              {"商户无此接口权限", false},
+	ErrCodeNotEnough:           {"余额不足", false},
+	ErrCodeSignError:           {"签名错误", false},
+	ErrCodeInvalidRequest:      {"参数错误或者请求不合法", false},
+	ErrCodeParamError:          {"参数错误", false},
+	ErrCodeLackParams:          {"缺少参数", false},
+	ErrCodeAppIdNotExist:       {"appid不存在", false},
+	ErrCodeMchIdNotExist:       {"商户号不存在", false},
+	ErrCodeAppIdMchIdNotMatch:  {"appid和mch_id不匹配", false},
+	ErrCodeXMLFormatError:      {"XML格式错误", false},
+	ErrCodeRequirePostMethod:   {"请使用post方法", false},
+	ErrCodePostDataEmpty:       {"post数据为空", false},
+	ErrCodeNotUTF8:             {"编码格式错误，请使用UTF-8编码", false},
+	ErrCodeTradeError:          {"交易错误，用户账号异常或者交易受限", false},
+	ErrCodeInvalidTransaction:  {"无效transaction_id", false},
+	ErrCodeRefundNotExist:      {"退款订单查询失败", false},
+	ErrCodeUserAccountAbnormal: {"退款请求失败，用户帐号已注销", false},
+	ErrCodeAmountLimit:         {"金额超出限制", false},
+	ErrCodeMoneyLimit:          {"已经达到今日付款总额上限或已达到付款给此用户额度上限", false},
+	ErrCodeSendNumLimit:        {"该用户今日领取次数超过限制", false},
+	ErrCodeAuthCodeExpire:      {"付款码已过期，请用户刷新付款码后重新扫码", false},
+	ErrCodeAuthCodeError:       {"付款码参数错误", false},
+	ErrCodeAuthCodeInvalid:     {"付款码检验错误，请用户重新出示付款码", false},
+}
+
+// 错误码是否可以使用相同的参数重试，未知的错误码不重试
+func IsRetryable(code string) bool {
+	return errCodeCatalog[code].retryable
+}
+
+// 错误码的描述，未知的错误码原样返回
+func Describe(code string) string {
+	if info, ok := errCodeCatalog[code]; ok {
+		return info.description
+	}
+	return code
+}
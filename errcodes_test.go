@@ -0,0 +1,38 @@
+package wechat
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrCodes(t *testing.T) {
+	tests := []struct {
+		Code      string
+		Retryable bool
+	}{
+		{ErrCodeSystemError, true},
+		{ErrCodeBizErrNeedRetry, true},
+		{ErrCodeFrequencyLimited, true},
+		{ErrCodeUserPaying, true},
+		{ErrCodeOrderNotExist, false},
+		{ErrCodeNoAuth, false},
+		{ErrCodeNotEnough, false},
+		{ErrCodeSignError, false},
+		{ErrCodeOrderPaid, false},
+		{ErrCodeAuthCodeExpire, false},
+		{ErrCodeAuthCodeInvalid, false},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.Retryable, IsRetryable(test.Code), test.Code)
+		assert.NotEqual(t, test.Code, Describe(test.Code), test.Code)
+	}
+	assert.Equal(t, "此交易订单号不存在", Describe(ErrCodeOrderNotExist))
+	assert.Equal(t, "余额不足", Describe(ErrCodeNotEnough))
+
+	// 未知的错误码不重试，描述为错误码本身
+	assert.False(t, IsRetryable("SOME_NEW_CODE"))
+	assert.Equal(t, "SOME_NEW_CODE", Describe("SOME_NEW_CODE"))
+	assert.False(t, IsRetryable(""))
+	assert.Equal(t, "", Describe(""))
+}
@@ -2,16 +2,38 @@ package wechat
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/http/httptrace"
+	"runtime/debug"
+	"strconv"
 )
 
 const (
 	contentTypeXML  = "application/xml"
 	contentTypeJSON = "application/json"
+
+	// panic转换成error时保留的调用栈长度
+	maxPanicStack = 2048
 )
 
+var (
+	ErrPanic = errors.New("[gowechat] panic")
+
+	// 默认的http客户端，在标准库默认配置的基础上要求TLS 1.2及以上
+	defaultHttpClient = &http.Client{Transport: newDefaultTransport()}
+)
+
+func newDefaultTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{MinVersion: defaultMinTLSVersion}
+	return transport
+}
+
 type HandlerFunc = func(response *http.Response, err error) error
 
 type Http interface {
@@ -28,13 +50,13 @@ type ctxHttp struct {
 
 func NewCtxHttp() *ctxHttp {
 	return &ctxHttp{
-		client: http.DefaultClient,
+		client: defaultHttpClient,
 	}
 }
 
 func NewCtxHttpWithClient(client *http.Client) *ctxHttp {
 	if client == nil {
-		client = http.DefaultClient
+		client = defaultHttpClient
 	}
 	return &ctxHttp{
 		client: client,
@@ -69,32 +91,70 @@ func (h *ctxHttp) Do(ctx context.Context, method, url string, headers map[string
 	if err != nil {
 		return err
 	}
-	if headers != nil {
-		for k, v := range headers {
-			req.Header.Set(k, v)
+	for k, v := range headers {
+		// http.Client 不使用Header中的Content-Length，需要设置到请求上，
+		// body不是bytes.Buffer之类能自动识别长度的类型时也能正确发送
+		if http.CanonicalHeaderKey(k) == "Content-Length" {
+			length, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return err
+			}
+			req.ContentLength = length
+			continue
 		}
+		req.Header.Set(k, v)
 	}
 	return h.do(ctx, req, f)
 }
 
 func (h *ctxHttp) do(ctx context.Context, req *http.Request, f HandlerFunc) error {
 	c := make(chan error)
+	trace := requestTraceFromContext(ctx)
+	var recorder *traceRecorder
+	if trace != nil {
+		recorder = newTraceRecorder()
+		ctx = httptrace.WithClientTrace(ctx, recorder.clientTrace())
+	}
 	req = req.WithContext(ctx)
 
 	go func() {
+		var err error
 		defer func() {
-			if err := recover(); err != nil {
-				log.Printf("ctx http goroutine panic, error=%v", err)
+			c <- err
+		}()
+		defer func() {
+			// 返回的error带有调用栈，由调用方的日志输出
+			if r := recover(); r != nil {
+				err = panicError(r)
 			}
 		}()
 		select {
 		case <-ctx.Done():
 			log.Println("ctx http goroutine quit...")
-			c <- ctx.Err()
-			return
+			err = ctx.Err()
 		default:
-			c <- f(h.client.Do(req))
+			response, doErr := h.client.Do(req)
+			if recorder != nil {
+				recorder.copyTo(trace)
+			}
+			err = f(response, doErr)
 		}
 	}()
 	return <-c
 }
+
+// 将panic转换成error，附带部分调用栈方便定位
+func panicError(r interface{}) error {
+	stack := debug.Stack()
+	if len(stack) > maxPanicStack {
+		stack = stack[:maxPanicStack]
+	}
+	return fmt.Errorf("%w: %v\n%s", ErrPanic, r, stack)
+}
+
+// 在defer中调用，将panic转换成error赋值给err
+func recoverPanic(err *error) {
+	if r := recover(); r != nil {
+		*err = panicError(r)
+	}
+}
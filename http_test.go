@@ -0,0 +1,91 @@
+package wechat
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 记录服务端收到的请求长度和传输编码
+func newLengthServer() (*httptest.Server, *int64, *[]string, *[]byte) {
+	var (
+		length   int64
+		encoding []string
+		received []byte
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		length = r.ContentLength
+		encoding = r.TransferEncoding
+		received, _ = ioutil.ReadAll(r.Body)
+		rw.Write([]byte("<xml><return_code>SUCCESS</return_code></xml>"))
+	}))
+	return server, &length, &encoding, &received
+}
+
+func TestWxService_DoReq_ContentLength(t *testing.T) {
+	server, length, encoding, received := newLengthServer()
+	defer server.Close()
+
+	w := wxService{client: NewCtxHttp(), logger: zapLogger}
+	req := &CloseOrderReq{OutTradeNo: "T1"}
+	assert.Nil(t, w.PostXML(context.Background(), server.URL, req, func(response *http.Response, err error) error {
+		return err
+	}))
+	assert.Equal(t, int64(len(*received)), *length)
+	assert.Empty(t, *encoding)
+	assert.Contains(t, string(*received), "<out_trade_no>T1</out_trade_no>")
+}
+
+func TestCtxHttp_Do_WrappedBody(t *testing.T) {
+	server, length, encoding, received := newLengthServer()
+	defer server.Close()
+
+	// 包装之后http.NewRequest无法识别长度，依赖传入的Content-Length
+	payload := []byte("<xml><a>1</a></xml>")
+	body := io.MultiReader(bytes.NewReader(payload))
+	headers := map[string]string{"Content-Type": contentTypeXML, "Content-Length": "19"}
+	assert.Nil(t, NewCtxHttp().Do(context.Background(), http.MethodPost, server.URL, headers, body, func(response *http.Response, err error) error {
+		return err
+	}))
+	assert.Equal(t, int64(len(payload)), *length)
+	assert.Empty(t, *encoding)
+	assert.Equal(t, payload, *received)
+}
+
+func TestCtxHttp_Do_HandlerPanic(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	err := NewCtxHttp().Get(context.Background(), server.URL, func(response *http.Response, err error) error {
+		var resp *ErrorResp
+		_ = resp.ErrMsg
+		return nil
+	})
+	assert.True(t, errors.Is(err, ErrPanic), "err = %v", err)
+	assert.Contains(t, err.Error(), "nil pointer dereference")
+}
+
+func TestWxService_DoReq_HandlerPanic(t *testing.T) {
+	w := wxService{client: newStubHttp("{}"), logger: zapLogger}
+	err := w.Get(context.Background(), "https://example.com", func(response *http.Response, err error) error {
+		panic("decode failed")
+	})
+	assert.True(t, errors.Is(err, ErrPanic), "err = %v", err)
+	assert.Contains(t, err.Error(), "decode failed")
+}
+
+func TestNewCtxHttp_MinTLSVersion(t *testing.T) {
+	transport, ok := NewCtxHttp().client.Transport.(*http.Transport)
+	assert.True(t, ok)
+	assert.EqualValues(t, tls.VersionTLS12, transport.TLSClientConfig.MinVersion)
+}
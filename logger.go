@@ -2,4 +2,29 @@ package wechat
 
 import "go.uber.org/zap"
 
+// 默认的logger，没有通过 WithLogger 或 SetLogger 指定时使用
 var zapLogger, _ = zap.NewDevelopment()
+
+// 创建服务时的可选配置
+type ServiceOption func(s *wxService)
+
+// 指定服务使用的logger，传入 zap.NewNop() 时不输出任何日志，为nil时使用默认的logger
+// 默认的logger会在Info级别记录请求和响应的内容，其中包含openid、prepay_id和金额等信息，生产环境中建议替换
+func WithLogger(log *zap.Logger) ServiceOption {
+	return func(s *wxService) {
+		s.SetLogger(log)
+	}
+}
+
+func (w *wxService) applyOptions(opts []ServiceOption) {
+	for _, opt := range opts {
+		opt(w)
+	}
+}
+
+// 在日志中记录请求和响应的内容，见 SetLogBodies
+func WithLogBodies(enable bool) ServiceOption {
+	return func(s *wxService) {
+		s.SetLogBodies(enable)
+	}
+}
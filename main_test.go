@@ -0,0 +1,25 @@
+package wechat
+
+import (
+	"os"
+	"testing"
+)
+
+// 调用微信线上接口的测试需要真实的账号，设置 WECHAT_LIVE=1 时才运行，
+// 账号通过 WECHAT_APP_ID、WECHAT_APP_SECRET、WECHAT_ACCESS_TOKEN 传入
+var live bool
+
+func TestMain(m *testing.M) {
+	live = os.Getenv("WECHAT_LIVE") == "1"
+	os.Exit(m.Run())
+}
+
+func liveEnabled() bool {
+	return live
+}
+
+func skipIfNotLive(t *testing.T) {
+	if !liveEnabled() {
+		t.Skip("live test, set WECHAT_LIVE=1 to run")
+	}
+}
@@ -0,0 +1,262 @@
+package wechat
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+const (
+	NotifyCodeSuccess = "SUCCESS"
+	NotifyCodeFail    = "FAIL"
+)
+
+const (
+	// 微信支付默认的币种
+	defaultFeeType = "CNY"
+)
+
+var (
+	ErrInvalidAmount  = errors.New("[gowechat] invalid amount")
+	ErrNotifyMismatch = errors.New("[gowechat] notify does not match order")
+)
+
+// 解析支付结果通知的内容，同时保留所有原始字段用于 VerifySign
+func ParseNotify(body []byte) (*NotifyReq, error) {
+	var req NotifyReq
+	if err := xml.Unmarshal(body, &req); err != nil {
+		return nil, err
+	}
+	fields, err := xmlFields(body)
+	if err != nil {
+		return nil, err
+	}
+	req.fields = fields
+	return &req, nil
+}
+
+// 订单金额，单位为分
+func (r *NotifyReq) TotalFeeFen() (int64, error) {
+	return parseFen("total_fee", r.TotalFee)
+}
+
+// 现金支付金额，单位为分
+func (r *NotifyReq) CashFeeFen() (int64, error) {
+	return parseFen("cash_fee", r.CashFee)
+}
+
+// 应结订单金额，单位为分，只有使用了非充值代金券时才有，没有时返回 ErrInvalidAmount
+func (r *NotifyReq) SettlementTotalFeeFen() (int64, error) {
+	return parseFen("settlement_total_fee", r.SettlementTotalFee)
+}
+
+// 检查通知中的订单金额与商户系统中的订单金额一致，防止伪造的通知，单位为分
+// 金额无效时返回 ErrInvalidAmount，不一致时返回 ErrNotifyMismatch
+func (r *NotifyReq) Validate(expectedTotalFee int64) error {
+	totalFee, err := r.TotalFeeFen()
+	if err != nil {
+		return err
+	}
+	if totalFee != expectedTotalFee {
+		return fmt.Errorf("%w: out_trade_no %s, total_fee %d, expected %d", ErrNotifyMismatch, r.OutTradeNo, totalFee, expectedTotalFee)
+	}
+	return nil
+}
+
+// 解析以分为单位的金额，空值或者不是整数时返回 ErrInvalidAmount
+func parseFen(name, value string) (int64, error) {
+	if value == "" {
+		return 0, fmt.Errorf("%w: %s is empty", ErrInvalidAmount, name)
+	}
+	fen, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s %q", ErrInvalidAmount, name, value)
+	}
+	return fen, nil
+}
+
+// 向微信查询订单，确认支付结果通知与订单一致，防止伪造或者篡改的通知
+// 订单没有支付成功，或订单号、微信订单号、金额、币种任意一项不一致时返回 ErrNotifyMismatch
+func (w wxPay) ConfirmNotify(ctx context.Context, req *NotifyReq) (*QueryOrderResp, error) {
+	totalFee, err := req.TotalFeeFen()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := w.ReqQueryOrder(ctx, req.OutTradeNo)
+	if err != nil {
+		return nil, err
+	}
+	if resp.TradeState != TradeStateSuccess {
+		return resp, fmt.Errorf("%w: trade state %s", ErrNotifyMismatch, resp.TradeState)
+	}
+	if resp.OutTradeNo != req.OutTradeNo {
+		return resp, fmt.Errorf("%w: out_trade_no %s, notify %s", ErrNotifyMismatch, resp.OutTradeNo, req.OutTradeNo)
+	}
+	if resp.TransactionId != req.TransactionId {
+		return resp, fmt.Errorf("%w: transaction_id %s, notify %s", ErrNotifyMismatch, resp.TransactionId, req.TransactionId)
+	}
+	// 不同币种的金额单位不同，只比较金额没有意义，币种为空时为CNY
+	if feeType, notifyFeeType := normalizeFeeType(resp.FeeType), normalizeFeeType(req.FeeType); feeType != notifyFeeType {
+		return resp, fmt.Errorf("%w: fee_type %s, notify %s", ErrNotifyMismatch, feeType, notifyFeeType)
+	}
+	if resp.TotalFee != totalFee {
+		return resp, fmt.Errorf("%w: total_fee %d, notify %d", ErrNotifyMismatch, resp.TotalFee, totalFee)
+	}
+	return resp, nil
+}
+
+func normalizeFeeType(feeType string) string {
+	if feeType == "" {
+		return defaultFeeType
+	}
+	return strings.ToUpper(feeType)
+}
+
+// 退款结果通知中req_info解密后的内容
+type RefundNotifyInfo struct {
+	XMLName             xml.Name `xml:"root"`
+	TransactionId       string   `xml:"transaction_id"`
+	OutTradeNo          string   `xml:"out_trade_no"`
+	RefundId            string   `xml:"refund_id"`
+	OutRefundNo         string   `xml:"out_refund_no"`
+	TotalFee            int64    `xml:"total_fee"`
+	SettlementTotalFee  int64    `xml:"settlement_total_fee"`
+	RefundFee           int64    `xml:"refund_fee"`
+	SettlementRefundFee int64    `xml:"settlement_refund_fee"`
+	RefundStatus        string   `xml:"refund_status"` //SUCCESS、CHANGE、REFUNDCLOSE
+	SuccessTime         string   `xml:"success_time"`
+	RefundRecvAccout    string   `xml:"refund_recv_accout"`
+	RefundAccount       string   `xml:"refund_account"`
+	RefundRequestSource string   `xml:"refund_request_source"`
+}
+
+// 解密退款结果通知中的req_info
+// 解密步骤：base64解码，对商户key做md5得到32位小写的AES密钥，用AES-256-ECB解密
+// 接口文档：https://pay.weixin.qq.com/wiki/doc/api/jsapi.php?chapter=9_16&index=10
+func (w wxService) DecryptRefundNotify(reqInfo string) (*RefundNotifyInfo, error) {
+	if w.key == "" {
+		return nil, ErrMissingApiKey
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(reqInfo)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCiphertext, err)
+	}
+	plaintext, err := aesECBDecrypt([]byte(strings.ToLower(HashMd5(w.key))), ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	var info RefundNotifyInfo
+	if err := xml.Unmarshal(plaintext, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// NotifySink 保存收到的通知原始内容，用于在测试或预发环境重放线上的通知，排查签名不一致等问题
+type NotifySink interface {
+	// 在解析和校验签名之前调用，body为收到的原始内容，返回的error只记录日志，不影响通知的处理
+	Save(ctx context.Context, body []byte) error
+}
+
+// NotifySinkFunc 使用函数实现 NotifySink
+type NotifySinkFunc func(ctx context.Context, body []byte) error
+
+func (f NotifySinkFunc) Save(ctx context.Context, body []byte) error {
+	return f(ctx, body)
+}
+
+type notifyCtxKey struct{}
+
+// 获取 NotifyMiddleware 解析并校验过的通知
+func NotifyFromContext(ctx context.Context) (*NotifyReq, bool) {
+	req, ok := ctx.Value(notifyCtxKey{}).(*NotifyReq)
+	return req, ok
+}
+
+// 支付结果通知的处理器，读取通知内容并校验签名后交给handle处理，
+// 根据处理结果给微信返回 SUCCESS 或 FAIL，handle返回error时微信会重新发送通知
+// 接口文档：https://pay.weixin.qq.com/wiki/doc/api/jsapi.php?chapter=9_7&index=8
+func (w wxPay) NotifyHandler(handle func(req *NotifyReq) error) http.Handler {
+	return w.NotifyMiddleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		req, _ := NotifyFromContext(r.Context())
+		if err := handle(req); err != nil {
+			w.logger.Error("[wxpay] handle notify", zap.String("out_trade_no", req.OutTradeNo), zap.Error(err))
+			w.writeNotifyResp(rw, NotifyCodeFail, err.Error())
+			return
+		}
+		w.writeNotifyResp(rw, NotifyCodeSuccess, "OK")
+	}))
+}
+
+// 读取通知内容并校验签名，校验失败时直接给微信返回 FAIL，
+// 成功时把解析后的通知放到请求的context中交给next处理，请求的Body会被重置，next中仍然可以读取
+func (w wxPay) NotifyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		limit := w.maxBodySize
+		if limit <= 0 {
+			limit = defaultMaxBodySize
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, limit))
+		if err != nil {
+			w.logger.Error("[wxpay] read notify", zap.Error(err))
+			w.writeNotifyResp(rw, NotifyCodeFail, "read body failed")
+			return
+		}
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if w.notifySink != nil {
+			if err := w.notifySink.Save(r.Context(), body); err != nil {
+				w.logger.Warn("[wxpay] save notify", zap.Error(err))
+			}
+		}
+
+		req, err := ParseNotify(body)
+		if err != nil {
+			w.logger.Error("[wxpay] parse notify", zap.Error(err))
+			w.writeNotifyResp(rw, NotifyCodeFail, "invalid body")
+			return
+		}
+		if !w.VerifySign(r.Context(), req) {
+			w.logger.Error("[wxpay] notify sign mismatch", zap.String("out_trade_no", req.OutTradeNo))
+			w.writeNotifyResp(rw, NotifyCodeFail, "invalid sign")
+			return
+		}
+		next.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), notifyCtxKey{}, req)))
+	})
+}
+
+// 设置回复支付结果通知时的Content-Type，默认为application/xml
+// 部分网关要求text/plain等其他类型，为空时不带Content-Type
+func (w *wxPay) SetNotifyContentType(contentType string) {
+	w.notifyContentType = contentType
+}
+
+// 设置保存通知原始内容的 NotifySink，签名校验失败的通知也会保存，为nil时不保存
+func (w *wxPay) SetNotifySink(sink NotifySink) {
+	w.notifySink = sink
+}
+
+func (w wxPay) writeNotifyResp(rw http.ResponseWriter, code, msg string) {
+	buf, err := xml.Marshal(NotifyResp{ReturnCode: code, ReturnMsg: msg})
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if w.notifyContentType != "" {
+		rw.Header().Set("Content-Type", w.notifyContentType)
+	} else {
+		// 设置为nil时net/http不会根据内容自动检测Content-Type
+		rw.Header()["Content-Type"] = nil
+	}
+	rw.Write(buf)
+}
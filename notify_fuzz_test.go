@@ -0,0 +1,55 @@
+//go:build go1.18
+// +build go1.18
+
+package wechat
+
+import (
+	"context"
+	"encoding/xml"
+	"testing"
+)
+
+func FuzzParseNotify(f *testing.F) {
+	s := newTestPay(nil)
+	valid := newTestNotify()
+	sign, err := s.sign(context.Background(), valid)
+	if err != nil {
+		f.Fatal(err)
+	}
+	valid.Sign = sign
+	buf, err := xml.Marshal(valid)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(buf)
+	for _, seed := range []string{
+		`<xml><return_code><![CDATA[SUCCESS]]></return_code><sign>C380BEC2BFD727A4B6845133519F3AD6</sign></xml>`,
+		`<xml><sign_type>HMAC-SHA256</sign_type><total_fee>1</total_fee></xml>`,
+		`<xml><total_fee>abc</total_fee>`,
+		`<?xml version="1.0" encoding="GBK"?><xml></xml>`,
+		`<!DOCTYPE xml [<!ENTITY a "b">]><xml>&a;</xml>`,
+		"",
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, body []byte) {
+		req, err := ParseNotify(body)
+		if err != nil {
+			if req != nil {
+				t.Fatalf("ParseNotify returned both a request and error %v", err)
+			}
+			return
+		}
+		if req == nil {
+			t.Fatal("ParseNotify returned neither a request nor an error")
+		}
+		oldSign := req.Sign
+		s.VerifySign(context.Background(), req)
+		if req.Sign != oldSign {
+			t.Fatalf("VerifySign changed sign from %q to %q", oldSign, req.Sign)
+		}
+		req.TotalFeeFen()
+		req.CashFeeFen()
+		req.SettlementTotalFeeFen()
+	})
+}
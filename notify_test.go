@@ -0,0 +1,382 @@
+package wechat
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestNotify() *NotifyReq {
+	return &NotifyReq{
+		ReturnCode:    "SUCCESS",
+		AppID:         "wx2421b1c4370ec43b",
+		MchID:         "10000100",
+		NonceStr:      "5d2b6c2a8db53831f7eda20af46e531c",
+		ResultCode:    "SUCCESS",
+		OpenId:        "oUpF8uMEb4qRXf22hE3X68TekukE",
+		IsSubscribe:   "Y",
+		TradeType:     "JSAPI",
+		BankType:      "CFT",
+		TotalFee:      "1",
+		FeeType:       "CNY",
+		CashFee:       "1",
+		TransactionId: "1004400740201409030005092168",
+		OutTradeNo:    "1409811653",
+		TimeEnd:       "20140903131540",
+	}
+}
+
+// 用服务的key签名后编码成通知内容
+func signedNotifyBody(t *testing.T, s *wxPay, req *NotifyReq) []byte {
+	sign, err := s.sign(context.Background(), req)
+	assert.Nil(t, err)
+	req.Sign = sign
+	buf, err := xml.Marshal(req)
+	assert.Nil(t, err)
+	return buf
+}
+
+func postNotify(handler http.Handler, body []byte) (*httptest.ResponseRecorder, NotifyResp) {
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/notify", bytes.NewReader(body)))
+	var resp NotifyResp
+	xml.Unmarshal(rec.Body.Bytes(), &resp)
+	return rec, resp
+}
+
+func TestWxPay_NotifyHandler(t *testing.T) {
+	s := newTestPay(nil)
+
+	var handled *NotifyReq
+	handler := s.NotifyHandler(func(req *NotifyReq) error {
+		handled = req
+		return nil
+	})
+	rec, resp := postNotify(handler, signedNotifyBody(t, s, newTestNotify()))
+	assert.Equal(t, contentTypeXML, rec.Header().Get("Content-Type"))
+	assert.Equal(t, NotifyCodeSuccess, resp.ReturnCode)
+	if assert.NotNil(t, handled) {
+		assert.Equal(t, "1409811653", handled.OutTradeNo)
+		assert.NotEmpty(t, handled.Sign)
+	}
+}
+
+func TestWxPay_NotifyHandler_Coupon(t *testing.T) {
+	s := newTestPay(nil)
+	buf, err := xml.Marshal(newTestNotify())
+	assert.Nil(t, err)
+	params := parseXMLParams(t, buf)
+	// 代金券字段没有对应的结构体字段，但也参与了签名
+	params["total_fee"] = "100"
+	params["cash_fee"] = "90"
+	params["coupon_fee"] = "10"
+	params["coupon_count"] = "1"
+	params["coupon_id_0"] = "10000"
+	params["coupon_fee_0"] = "10"
+	sign, err := s.sign(context.Background(), params)
+	assert.Nil(t, err)
+	params["sign"] = sign
+
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var body bytes.Buffer
+	body.WriteString("<xml>")
+	for _, k := range keys {
+		fmt.Fprintf(&body, "<%s><![CDATA[%s]]></%s>", k, params[k], k)
+	}
+	body.WriteString("</xml>")
+
+	req, err := ParseNotify(body.Bytes())
+	if assert.Nil(t, err) {
+		assert.True(t, s.VerifySign(context.Background(), req))
+	}
+
+	var handled *NotifyReq
+	_, resp := postNotify(s.NotifyHandler(func(req *NotifyReq) error {
+		handled = req
+		return nil
+	}), body.Bytes())
+	assert.Equal(t, NotifyCodeSuccess, resp.ReturnCode)
+	if assert.NotNil(t, handled) {
+		assert.Equal(t, "100", handled.TotalFee)
+	}
+
+	// 篡改没有结构体字段的代金券金额也无法通过校验
+	tampered := bytes.Replace(body.Bytes(), []byte("<coupon_fee_0><![CDATA[10]]>"), []byte("<coupon_fee_0><![CDATA[50]]>"), 1)
+	_, resp = postNotify(s.NotifyHandler(func(req *NotifyReq) error { return nil }), tampered)
+	assert.Equal(t, NotifyCodeFail, resp.ReturnCode)
+}
+
+func TestWxPay_NotifyHandler_InvalidSign(t *testing.T) {
+	s := newTestPay(nil)
+	req := newTestNotify()
+	body := signedNotifyBody(t, s, req)
+	// 签名之后篡改金额
+	body = bytes.Replace(body, []byte("<total_fee>1</total_fee>"), []byte("<total_fee>100</total_fee>"), 1)
+
+	called := false
+	_, resp := postNotify(s.NotifyHandler(func(req *NotifyReq) error {
+		called = true
+		return nil
+	}), body)
+	assert.Equal(t, NotifyCodeFail, resp.ReturnCode)
+	assert.False(t, called)
+
+	_, resp = postNotify(s.NotifyHandler(func(req *NotifyReq) error { return nil }), []byte("not xml"))
+	assert.Equal(t, NotifyCodeFail, resp.ReturnCode)
+}
+
+func TestWxPay_NotifyHandler_PreviousKey(t *testing.T) {
+	previous := newTestPay(nil)
+	body := signedNotifyBody(t, previous, newTestNotify())
+
+	s := newTestPay(nil)
+	s.key = "a1b2c3d4e5f60718293a4b5c6d7e8f90"
+	handler := s.NotifyHandler(func(req *NotifyReq) error { return nil })
+	_, resp := postNotify(handler, body)
+	assert.Equal(t, NotifyCodeFail, resp.ReturnCode)
+
+	// 更换密钥期间旧密钥签名的通知也能通过校验
+	s.SetPreviousKeys("00000000000000000000000000000000", previous.key)
+	handler = s.NotifyHandler(func(req *NotifyReq) error { return nil })
+	_, resp = postNotify(handler, body)
+	assert.Equal(t, NotifyCodeSuccess, resp.ReturnCode)
+	_, resp = postNotify(handler, signedNotifyBody(t, s, newTestNotify()))
+	assert.Equal(t, NotifyCodeSuccess, resp.ReturnCode)
+
+	// 请求签名仍然使用当前密钥
+	sign, err := s.sign(context.Background(), newTestNotify())
+	assert.Nil(t, err)
+	assert.Equal(t, hashSignWithKey("appid=wx2421b1c4370ec43b&bank_type=CFT&cash_fee=1&fee_type=CNY&is_subscribe=Y&mch_id=10000100&nonce_str=5d2b6c2a8db53831f7eda20af46e531c&openid=oUpF8uMEb4qRXf22hE3X68TekukE&out_trade_no=1409811653&result_code=SUCCESS&return_code=SUCCESS&time_end=20140903131540&total_fee=1&trade_type=JSAPI&transaction_id=1004400740201409030005092168", "", s.key), sign)
+}
+
+func TestWxPay_NotifyHandler_CallbackError(t *testing.T) {
+	s := newTestPay(nil)
+	_, resp := postNotify(s.NotifyHandler(func(req *NotifyReq) error {
+		return errors.New("order locked")
+	}), signedNotifyBody(t, s, newTestNotify()))
+	assert.Equal(t, NotifyCodeFail, resp.ReturnCode)
+	assert.Equal(t, "order locked", resp.ReturnMsg)
+}
+
+func TestWxPay_NotifyMiddleware(t *testing.T) {
+	s := newTestPay(nil)
+	body := signedNotifyBody(t, s, newTestNotify())
+
+	var (
+		downstreamBody []byte
+		notify         *NotifyReq
+	)
+	handler := s.NotifyMiddleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		downstreamBody, _ = ioutil.ReadAll(r.Body)
+		notify, _ = NotifyFromContext(r.Context())
+		s.writeNotifyResp(rw, NotifyCodeSuccess, "OK")
+	}))
+	_, resp := postNotify(handler, body)
+	assert.Equal(t, NotifyCodeSuccess, resp.ReturnCode)
+	assert.Equal(t, body, downstreamBody)
+	if assert.NotNil(t, notify) {
+		assert.Equal(t, "1004400740201409030005092168", notify.TransactionId)
+	}
+
+	_, ok := NotifyFromContext(context.Background())
+	assert.False(t, ok)
+}
+
+func TestNotifyReq_FeeFen(t *testing.T) {
+	req := &NotifyReq{TotalFee: "888", CashFee: "800", SettlementTotalFee: "0"}
+	fen, err := req.TotalFeeFen()
+	assert.Nil(t, err)
+	assert.EqualValues(t, 888, fen)
+	fen, err = req.CashFeeFen()
+	assert.Nil(t, err)
+	assert.EqualValues(t, 800, fen)
+	fen, err = req.SettlementTotalFeeFen()
+	assert.Nil(t, err)
+	assert.EqualValues(t, 0, fen)
+
+	empty := &NotifyReq{}
+	for _, f := range []func() (int64, error){empty.TotalFeeFen, empty.CashFeeFen, empty.SettlementTotalFeeFen} {
+		_, err := f()
+		assert.True(t, errors.Is(err, ErrInvalidAmount), "err = %v", err)
+	}
+
+	invalid := &NotifyReq{TotalFee: "8.88", CashFee: "abc", SettlementTotalFee: " 1"}
+	for _, f := range []func() (int64, error){invalid.TotalFeeFen, invalid.CashFeeFen, invalid.SettlementTotalFeeFen} {
+		_, err := f()
+		assert.True(t, errors.Is(err, ErrInvalidAmount), "err = %v", err)
+	}
+}
+
+func TestNotifyReq_Validate(t *testing.T) {
+	req := &NotifyReq{OutTradeNo: "1409811653", TotalFee: "888"}
+	assert.Nil(t, req.Validate(888))
+
+	err := req.Validate(8880)
+	assert.True(t, errors.Is(err, ErrNotifyMismatch), "err = %v", err)
+	assert.Contains(t, err.Error(), "total_fee 888, expected 8880")
+	assert.Contains(t, err.Error(), "1409811653")
+
+	err = (&NotifyReq{TotalFee: "8.88"}).Validate(888)
+	assert.True(t, errors.Is(err, ErrInvalidAmount), "err = %v", err)
+}
+
+func TestWxService_DecryptRefundNotify(t *testing.T) {
+	s := newTestPay(nil)
+	// 使用 md5(key) 作为密钥的 AES-256-ECB 加密
+	reqInfo := "WBzGpzQuNpcFxIlFjUUD9BZv+lpBMzd2SHiKCkwfALWid5G8ZvfOussfMIHLbKJmI/uKTSu1206Pv8FVtDW3T06pYa1/HmXN2h1zd07OZRodZ6wJEKB1uc7xpcuyUPewPexbNc2XhVjkEW6ZrdFEl79UlSNDDe5lTpVmTpudwpnJMlMkYxT/xCMEUsal6E4IyLLB0atlSAmPR5+qDfnGOAu9y183uYi/eIefgDeCbq96YeSDYOrqMR0EZm3jxb7TJCQhrWzHgzBAaiCJX5wsCHU3kHkc3s7ld78jrwmpOOIVKK89u5E0JcYO8aRqfBJ4LJ/hxKGpqYpsQkrYkh9aRqJ1f+m8OVpq/2Gl9vHJjPp2v2OkMlxe3YIM0Y+AtiIC/nkmmgzidg4V+rlk+l35PWe5c1iSrdyV3H5oM7w+rcicAWY5h8wb+2D8LCK9UWA9l4zPq5SMq4Dg8+4FqlfJUc/N0UICa2lodyl44nBrbP3amju/Zm6yyyFr74jl2GUsGO3PBrqfP1mbX96WiG09BU7z2izuAeHmSGPEVd1prk1Lx7DdRIWuS+hkxtic98ck3mpGiu9uiBlNToYkg4R0i2uFe4xgT6lVi9Z4txA8+ewgAzic10AxRBJwCj0RGVTcX7idsg9Fp/kS0plkEQun7iNcWERc3npClOM3/nf1izpNjapRswkcePPJjl4flCbIAE/i48Sxk0kTr0oP61AORkKpZ2+tf4j9rhnGBeRZbprwiKl3OLqGjgzPJlBA2Q+V+7tcSIs8wv0CEt8Orp5QI4HeE+vr57CKTJsAOhQhPl0GgogYfHxW3B3bH3yivazptiM0Elqzwm7uPrBlP7bdmsiSs23HmmtBXkYrdvUtIAXp5JGx56nDyvnBe13+BeKVMGpjfLKidKBFioZroJDfQsX7PSDds44036kI+f6ccjKCkFEy30Xk2WORkYA1yd7qnOkE+070fDHfVG3hmxaHY3TD4DRaCRBIkVPKAxs32uDeirk5h6UZNF53tbQ7D9i9"
+	info, err := s.DecryptRefundNotify(reqInfo)
+	assert.Nil(t, err)
+	assert.Equal(t, "R1", info.OutRefundNo)
+	assert.Equal(t, "T1", info.OutTradeNo)
+	assert.Equal(t, "SUCCESS", info.RefundStatus)
+	assert.EqualValues(t, 100, info.RefundFee)
+	assert.EqualValues(t, 300, info.TotalFee)
+	assert.Equal(t, "支付用户零钱", info.RefundRecvAccout)
+
+	_, err = s.DecryptRefundNotify("not base64!")
+	assert.True(t, errors.Is(err, ErrInvalidCiphertext), "err = %v", err)
+}
+
+func TestWxPay_ConfirmNotify(t *testing.T) {
+	order := func(totalFee, feeType string) string {
+		return `<xml>
+<return_code><![CDATA[SUCCESS]]></return_code>
+<result_code><![CDATA[SUCCESS]]></result_code>
+<trade_state><![CDATA[SUCCESS]]></trade_state>
+<out_trade_no><![CDATA[1409811653]]></out_trade_no>
+<transaction_id><![CDATA[1004400740201409030005092168]]></transaction_id>
+<total_fee>` + totalFee + `</total_fee>
+<fee_type><![CDATA[` + feeType + `]]></fee_type>
+</xml>`
+	}
+	tests := []struct {
+		Name          string
+		Order         string
+		NotifyFeeType string
+		Err           error
+	}{
+		{"cny", order("1", "CNY"), "CNY", nil},
+		{"default fee type", order("1", ""), "CNY", nil},
+		{"fee type mismatch", order("1", "USD"), "CNY", ErrNotifyMismatch},
+		{"notify fee type mismatch", order("1", "CNY"), "HKD", ErrNotifyMismatch},
+		{"total fee mismatch", order("100", "CNY"), "CNY", ErrNotifyMismatch},
+		{"not paid", `<xml><return_code>SUCCESS</return_code><result_code>SUCCESS</result_code><trade_state>NOTPAY</trade_state></xml>`, "CNY", ErrNotifyMismatch},
+	}
+	for _, test := range tests {
+		client := newStubHttp(test.Order)
+		notify := newTestNotify()
+		notify.FeeType = test.NotifyFeeType
+		resp, err := newTestPay(client).ConfirmNotify(context.Background(), notify)
+		if test.Err == nil {
+			assert.Nil(t, err, test.Name)
+			assert.EqualValues(t, 1, resp.TotalFee, test.Name)
+		} else {
+			assert.True(t, errors.Is(err, test.Err), "%s: err = %v", test.Name, err)
+		}
+		assert.Equal(t, "1409811653", parseXMLParams(t, client.last().body)["out_trade_no"], test.Name)
+	}
+
+	notify := newTestNotify()
+	notify.TotalFee = ""
+	_, err := newTestPay(newStubHttp()).ConfirmNotify(context.Background(), notify)
+	assert.True(t, errors.Is(err, ErrInvalidAmount))
+}
+
+func TestWxPay_NotifyAttach(t *testing.T) {
+	client := newStubHttp(`<xml><return_code>SUCCESS</return_code><result_code>SUCCESS</result_code><prepay_id>wx201410272009395522657a690389285100</prepay_id></xml>`)
+	s := newTestPay(client)
+	attach := "order=1409811653&channel=mini"
+	_, err := s.ReqUnifiedOrder(context.Background(), &UnifiedOrderReq{OutTradeNo: "1409811653", TotalFee: 1, Body: "body", Attach: attach})
+	assert.Nil(t, err)
+	params := parseXMLParams(t, client.last().body)
+	assert.Equal(t, attach, params["attach"])
+	assert.Equal(t, expectedSign(params, s.key), params["sign"])
+
+	// 空的attach不参与签名
+	_, err = s.ReqUnifiedOrder(context.Background(), &UnifiedOrderReq{OutTradeNo: "1409811654", TotalFee: 1, Body: "body"})
+	assert.Nil(t, err)
+	params = parseXMLParams(t, client.last().body)
+	assert.Equal(t, "", params["attach"])
+	assert.Equal(t, expectedSign(params, s.key), params["sign"])
+
+	notify := newTestNotify()
+	notify.Attach = attach
+	var handled *NotifyReq
+	_, resp := postNotify(s.NotifyHandler(func(req *NotifyReq) error {
+		handled = req
+		return nil
+	}), signedNotifyBody(t, s, notify))
+	assert.Equal(t, NotifyCodeSuccess, resp.ReturnCode)
+	if assert.NotNil(t, handled) {
+		assert.Equal(t, attach, handled.Attach)
+	}
+}
+
+func TestWxPay_NotifyContentType(t *testing.T) {
+	s := newTestPay(nil)
+	handler := s.NotifyHandler(func(req *NotifyReq) error { return nil })
+	rec, resp := postNotify(handler, signedNotifyBody(t, s, newTestNotify()))
+	assert.Equal(t, contentTypeXML, rec.Header().Get("Content-Type"))
+	assert.Equal(t, NotifyCodeSuccess, resp.ReturnCode)
+
+	s.SetNotifyContentType("text/plain")
+	handler = s.NotifyHandler(func(req *NotifyReq) error { return nil })
+	rec, resp = postNotify(handler, signedNotifyBody(t, s, newTestNotify()))
+	assert.Equal(t, "text/plain", rec.Header().Get("Content-Type"))
+	assert.Equal(t, NotifyCodeSuccess, resp.ReturnCode)
+	rec, _ = postNotify(handler, []byte("not xml"))
+	assert.Equal(t, "text/plain", rec.Header().Get("Content-Type"), "failure ack uses the same content type")
+
+	// 不带Content-Type时也不会被自动检测
+	s.SetNotifyContentType("")
+	handler = s.NotifyHandler(func(req *NotifyReq) error { return nil })
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	response, err := http.Post(server.URL, contentTypeXML, bytes.NewReader(signedNotifyBody(t, s, newTestNotify())))
+	assert.Nil(t, err)
+	defer response.Body.Close()
+	_, ok := response.Header["Content-Type"]
+	assert.False(t, ok)
+	ack, _ := ioutil.ReadAll(response.Body)
+	assert.Contains(t, string(ack), NotifyCodeSuccess)
+}
+
+func TestWxPay_NotifySink(t *testing.T) {
+	s := newTestPay(nil)
+	var saved [][]byte
+	s.SetNotifySink(NotifySinkFunc(func(ctx context.Context, body []byte) error {
+		saved = append(saved, body)
+		return errors.New("disk full")
+	}))
+	handled := 0
+	handler := s.NotifyHandler(func(req *NotifyReq) error {
+		handled++
+		return nil
+	})
+
+	body := signedNotifyBody(t, s, newTestNotify())
+	_, resp := postNotify(handler, body)
+	assert.Equal(t, NotifyCodeSuccess, resp.ReturnCode, "sink errors do not fail the notify")
+	assert.Equal(t, 1, handled)
+
+	// 签名错误的通知也原样保存
+	tampered := bytes.Replace(body, []byte("<total_fee>1</total_fee>"), []byte("<total_fee>100</total_fee>"), 1)
+	assert.NotEqual(t, body, tampered)
+	_, resp = postNotify(handler, tampered)
+	assert.Equal(t, NotifyCodeFail, resp.ReturnCode)
+	assert.Equal(t, [][]byte{body, tampered}, saved)
+	assert.Equal(t, 1, handled)
+}
@@ -0,0 +1,161 @@
+package wechat
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// v3通知资源的加密算法
+	algorithmAEADAES256GCM = "AEAD_AES_256_GCM"
+
+	// v3通知资源解密后的对象类型
+	notifyV3TypeTransaction = "transaction"
+	notifyV3TypeRefund      = "refund"
+)
+
+var (
+	ErrUnsupportedNotify = errors.New("[gowechat] unsupported v3 notify")
+)
+
+type (
+	// v3的回调通知，支付通知和退款通知的格式相同，resource解密后根据类型填充 Transaction 或 Refund
+	// 文档地址：https://pay.weixin.qq.com/wiki/doc/apiv3/apis/chapter3_5_5.shtml
+	NotifyV3 struct {
+		Id           string           `json:"id"`            //通知ID
+		CreateTime   string           `json:"create_time"`   //通知创建时间，rfc3339格式
+		EventType    string           `json:"event_type"`    //通知类型，如 TRANSACTION.SUCCESS、REFUND.SUCCESS
+		ResourceType string           `json:"resource_type"` //通知数据类型，为encrypt-resource
+		Summary      string           `json:"summary"`       //回调摘要
+		Resource     NotifyV3Resource `json:"resource"`
+
+		Transaction *TransactionV3  `json:"-"` //支付通知解密后的交易信息
+		Refund      *RefundNotifyV3 `json:"-"` //退款通知解密后的退款信息
+	}
+
+	NotifyV3Resource struct {
+		Algorithm      string `json:"algorithm"`       //加密算法，为AEAD_AES_256_GCM
+		Ciphertext     string `json:"ciphertext"`      //base64编码的密文
+		AssociatedData string `json:"associated_data"` //附加数据
+		Nonce          string `json:"nonce"`           //随机串
+		OriginalType   string `json:"original_type"`   //原始类型：transaction、refund
+	}
+
+	// v3退款通知解密后的退款信息
+	RefundNotifyV3 struct {
+		MchId               string             `json:"mchid"`
+		OutTradeNo          string             `json:"out_trade_no"`
+		TransactionId       string             `json:"transaction_id"`
+		OutRefundNo         string             `json:"out_refund_no"`
+		RefundId            string             `json:"refund_id"`
+		RefundStatus        string             `json:"refund_status"`         //退款状态：SUCCESS、CLOSED、ABNORMAL
+		SuccessTime         string             `json:"success_time"`          //退款成功时间，rfc3339格式
+		UserReceivedAccount string             `json:"user_received_account"` //退款入账账户
+		Amount              RefundV3RespAmount `json:"amount"`
+	}
+
+	// 回复v3通知失败时的内容，成功时只返回状态码，不需要内容
+	notifyV3Resp struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+)
+
+// 验证v3通知的签名，使用APIv3密钥解密resource，根据resource的类型解析成 TransactionV3 或 RefundNotifyV3
+func (w wxPay) ParseNotifyV3(header http.Header, body []byte) (*NotifyV3, error) {
+	keys, err := w.v3()
+	if err != nil {
+		return nil, err
+	}
+	if w.cfg.V3.ApiV3Key == "" {
+		return nil, fmt.Errorf("%w: empty ApiV3Key", ErrMissingV3Config)
+	}
+	if err := keys.verify(header, body, w.now()); err != nil {
+		return nil, err
+	}
+	var notify NotifyV3
+	if err := json.Unmarshal(body, &notify); err != nil {
+		return nil, err
+	}
+	resource := notify.Resource
+	if resource.Algorithm != algorithmAEADAES256GCM {
+		return nil, fmt.Errorf("%w: algorithm %q", ErrUnsupportedNotify, resource.Algorithm)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(resource.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCiphertext, err)
+	}
+	plaintext, err := aesGCMDecrypt([]byte(w.cfg.V3.ApiV3Key), []byte(resource.Nonce), ciphertext, []byte(resource.AssociatedData))
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resource.OriginalType == notifyV3TypeTransaction || strings.HasPrefix(notify.EventType, "TRANSACTION."):
+		notify.Transaction = &TransactionV3{}
+		err = json.Unmarshal(plaintext, notify.Transaction)
+	case resource.OriginalType == notifyV3TypeRefund || strings.HasPrefix(notify.EventType, "REFUND."):
+		notify.Refund = &RefundNotifyV3{}
+		err = json.Unmarshal(plaintext, notify.Refund)
+	default:
+		err = fmt.Errorf("%w: event %q of %q", ErrUnsupportedNotify, notify.EventType, resource.OriginalType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &notify, nil
+}
+
+// v3支付通知和退款通知的处理器，验证签名并解密后交给handle处理，是 NotifyHandler 的v3版本
+// handle返回nil时给微信返回204，返回error或者验证失败时返回失败的状态码，微信会重新发送通知
+func (w wxPay) NotifyHandlerV3(handle func(ctx context.Context, notify *NotifyV3) error) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		limit := w.maxBodySize
+		if limit <= 0 {
+			limit = defaultMaxBodySize
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, limit))
+		if err != nil {
+			w.logger.Error("[wxpay] read v3 notify", zap.Error(err))
+			writeNotifyV3Resp(rw, http.StatusBadRequest, "read body failed")
+			return
+		}
+		if w.notifySink != nil {
+			if err := w.notifySink.Save(r.Context(), body); err != nil {
+				w.logger.Warn("[wxpay] save notify", zap.Error(err))
+			}
+		}
+
+		notify, err := w.ParseNotifyV3(r.Header, body)
+		if err != nil {
+			w.logger.Error("[wxpay] parse v3 notify", zap.Error(err))
+			writeNotifyV3Resp(rw, http.StatusBadRequest, "invalid notify")
+			return
+		}
+		if err := handle(r.Context(), notify); err != nil {
+			w.logger.Error("[wxpay] handle v3 notify", zap.String("id", notify.Id), zap.String("event_type", notify.EventType), zap.Error(err))
+			writeNotifyV3Resp(rw, http.StatusInternalServerError, "handle notify failed")
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func writeNotifyV3Resp(rw http.ResponseWriter, status int, msg string) {
+	buf, err := json.Marshal(notifyV3Resp{Code: NotifyCodeFail, Message: msg})
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", contentTypeJSON)
+	rw.WriteHeader(status)
+	rw.Write(buf)
+}
@@ -0,0 +1,164 @@
+package wechat
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 用APIv3密钥加密resource，生成微信支付的v3通知内容
+func (k *testV3Keys) encryptNotify(t *testing.T, eventType, originalType, plaintext string) string {
+	block, err := aes.NewCipher([]byte(k.cfg.ApiV3Key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce, associatedData := "fdasflkja484", originalType
+	body, err := json.Marshal(map[string]interface{}{
+		"id":            "EV-2018022511223320873",
+		"create_time":   "2015-05-20T13:29:35+08:00",
+		"resource_type": "encrypt-resource",
+		"event_type":    eventType,
+		"summary":       "支付成功",
+		"resource": map[string]string{
+			"original_type":   originalType,
+			"algorithm":       algorithmAEADAES256GCM,
+			"ciphertext":      base64.StdEncoding.EncodeToString(gcm.Seal(nil, []byte(nonce), []byte(plaintext), []byte(associatedData))),
+			"associated_data": associatedData,
+			"nonce":           nonce,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func postNotifyV3(handler http.Handler, header http.Header, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/notify", bytes.NewReader([]byte(body)))
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	handler.ServeHTTP(rec, r)
+	return rec
+}
+
+func TestWxPay_ParseNotifyV3(t *testing.T) {
+	keys, cleanup := writeTestV3Keys(t)
+	defer cleanup()
+	s := newTestV3Pay(nil, keys)
+
+	body := keys.encryptNotify(t, "REFUND.SUCCESS", "refund", `{"mchid":"1900000100","transaction_id":"1008450740201411110005820873","out_trade_no":"20150806125346","refund_id":"50200207182018070300011301001","out_refund_no":"7752501201407033233368018","refund_status":"SUCCESS","success_time":"2018-06-08T10:34:56+08:00","user_received_account":"招商银行信用卡0403","amount":{"total":999,"refund":999,"payer_total":999,"payer_refund":999}}`)
+	notify, err := s.ParseNotifyV3(keys.signResponse(t, body), []byte(body))
+	assert.Nil(t, err)
+	assert.Equal(t, "REFUND.SUCCESS", notify.EventType)
+	assert.Nil(t, notify.Transaction)
+	if assert.NotNil(t, notify.Refund) {
+		assert.Equal(t, "7752501201407033233368018", notify.Refund.OutRefundNo)
+		assert.Equal(t, RefundV3Success, notify.Refund.RefundStatus)
+		assert.EqualValues(t, 999, notify.Refund.Amount.PayerRefund)
+	}
+
+	// 签名不对时不解密
+	_, err = s.ParseNotifyV3(keys.signResponse(t, "{}"), []byte(body))
+	assert.True(t, errors.Is(err, ErrInvalidV3Signature), "err = %v", err)
+
+	// APIv3密钥不对时解密失败
+	other := *keys.cfg
+	other.ApiV3Key = "00000000000000000000000000000000"
+	s.cfg.V3 = &other
+	_, err = s.ParseNotifyV3(keys.signResponse(t, body), []byte(body))
+	assert.True(t, errors.Is(err, ErrInvalidCiphertext), "err = %v", err)
+
+	other.ApiV3Key = ""
+	_, err = s.ParseNotifyV3(keys.signResponse(t, body), []byte(body))
+	assert.True(t, errors.Is(err, ErrMissingV3Config), "err = %v", err)
+}
+
+func TestWxPay_ParseNotifyV3_Timestamp(t *testing.T) {
+	keys, cleanup := writeTestV3Keys(t)
+	defer cleanup()
+	s := newTestV3Pay(nil, keys)
+	body := keys.encryptNotify(t, "REFUND.SUCCESS", "refund", `{"out_refund_no":"7752501201407033233368018"}`)
+	signed := time.Unix(1554208460, 0)
+
+	// 5分钟以内的时间差可以接受
+	for _, d := range []time.Duration{-v3TimestampSkew, v3TimestampSkew} {
+		s.SetClock(fixedClock(signed.Add(d)))
+		_, err := s.ParseNotifyV3(keys.signResponse(t, body), []byte(body))
+		assert.Nil(t, err, d)
+	}
+
+	// 签名正确但时间戳过期的通知可能是重放，拒绝
+	for _, d := range []time.Duration{-v3TimestampSkew - time.Second, v3TimestampSkew + time.Second, 24 * time.Hour} {
+		s.SetClock(fixedClock(signed.Add(d)))
+		_, err := s.ParseNotifyV3(keys.signResponse(t, body), []byte(body))
+		assert.True(t, errors.Is(err, ErrV3TimestampExpired), "err = %v", err)
+	}
+
+	s.SetClock(fixedClock(signed))
+	header := keys.signResponse(t, body)
+	header.Set(headerWechatpayTimestamp, "")
+	_, err := s.ParseNotifyV3(header, []byte(body))
+	assert.True(t, errors.Is(err, ErrV3TimestampExpired), "err = %v", err)
+}
+
+func TestWxPay_NotifyHandlerV3(t *testing.T) {
+	keys, cleanup := writeTestV3Keys(t)
+	defer cleanup()
+	s := newTestV3Pay(nil, keys)
+
+	var handled *NotifyV3
+	handler := s.NotifyHandlerV3(func(ctx context.Context, notify *NotifyV3) error {
+		handled = notify
+		if notify.Transaction.OutTradeNo == "fail" {
+			return errors.New("db error")
+		}
+		return nil
+	})
+
+	body := keys.encryptNotify(t, "TRANSACTION.SUCCESS", "transaction", `{"appid":"wxd678efh567hg6787","mchid":"1230000109","out_trade_no":"1217752501201407033233368018","transaction_id":"1217752501201407033233368018","trade_type":"JSAPI","trade_state":"SUCCESS","trade_state_desc":"支付成功","bank_type":"CMC","success_time":"2018-06-08T10:34:56+08:00","payer":{"openid":"oUpF8uMuAJO_M2pxb1Q9zNjWeS6o"},"amount":{"total":100,"payer_total":100,"currency":"CNY","payer_currency":"CNY"}}`)
+	rec := postNotifyV3(handler, keys.signResponse(t, body), body)
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Empty(t, rec.Body.String())
+	if assert.NotNil(t, handled) && assert.NotNil(t, handled.Transaction) {
+		assert.Equal(t, "EV-2018022511223320873", handled.Id)
+		assert.Equal(t, TradeStateSuccess, handled.Transaction.TradeState)
+		assert.Equal(t, "1217752501201407033233368018", handled.Transaction.OutTradeNo)
+		assert.EqualValues(t, 100, handled.Transaction.Amount.PayerTotal)
+	}
+
+	// 处理失败时返回失败的状态码，微信会重新发送
+	body = keys.encryptNotify(t, "TRANSACTION.SUCCESS", "transaction", `{"out_trade_no":"fail"}`)
+	rec = postNotifyV3(handler, keys.signResponse(t, body), body)
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	// 不把内部错误返回给调用方
+	assert.JSONEq(t, `{"code":"FAIL","message":"handle notify failed"}`, rec.Body.String())
+
+	// 签名校验失败时不调用handle
+	handled = nil
+	rec = postNotifyV3(handler, keys.signResponse(t, body), body+" ")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, contentTypeJSON, rec.Header().Get("Content-Type"))
+	assert.Nil(t, handled)
+
+	// 不支持的通知类型
+	body = keys.encryptNotify(t, "PROFITSHARING.SUCCESS", "profitsharing", `{}`)
+	rec = postNotifyV3(handler, keys.signResponse(t, body), body)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Nil(t, handled)
+}
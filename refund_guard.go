@@ -0,0 +1,94 @@
+package wechat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+var (
+	ErrRefundNoReused = errors.New("[gowechat] out_refund_no reused by another order")
+)
+
+// RefundGuard 检查商户退款单号是否被其他订单使用过
+// 微信要求out_refund_no唯一，同一个退款单号用于另一个订单时不会报错，而是返回原来的退款结果
+// 订单统一按out_trade_no记录，按transaction_id退款时使用微信返回的out_trade_no
+type RefundGuard interface {
+	// 发出退款请求前检查，退款单号已经记录为其他订单时返回 ErrRefundNoReused，不记录
+	Check(ctx context.Context, outRefundNo, outTradeNo string) error
+	// 退款成功后记录退款单号对应的订单，已经记录为其他订单时返回 ErrRefundNoReused
+	Record(ctx context.Context, outRefundNo, outTradeNo string) error
+}
+
+// 保存在内存中的 RefundGuard，只能检查同一个进程内的退款，多实例部署时需要使用共享存储实现
+type memoryRefundGuard struct {
+	mu     sync.Mutex
+	orders map[string]string
+}
+
+func NewMemoryRefundGuard() RefundGuard {
+	return &memoryRefundGuard{orders: make(map[string]string)}
+}
+
+func (g *memoryRefundGuard) Check(ctx context.Context, outRefundNo, outTradeNo string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.check(outRefundNo, outTradeNo)
+}
+
+func (g *memoryRefundGuard) Record(ctx context.Context, outRefundNo, outTradeNo string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err := g.check(outRefundNo, outTradeNo); err != nil {
+		return err
+	}
+	g.orders[outRefundNo] = outTradeNo
+	return nil
+}
+
+func (g *memoryRefundGuard) check(outRefundNo, outTradeNo string) error {
+	if recorded, ok := g.orders[outRefundNo]; ok && recorded != outTradeNo {
+		return fmt.Errorf("%w: %s belongs to %s, not %s", ErrRefundNoReused, outRefundNo, recorded, outTradeNo)
+	}
+	return nil
+}
+
+// 设置退款单号的检查，为nil时不检查
+// 请求中有out_trade_no时在发出请求前检查，只有transaction_id时在退款成功后按返回的out_trade_no检查
+// 只在退款成功后记录退款单号，请求失败时不占用退款单号
+// 退款成功但返回的订单号和请求中的不一致时返回 ErrRefundNoReused 和微信的响应
+func (w *wxMch) SetRefundGuard(guard RefundGuard) {
+	w.refundGuard = guard
+}
+
+func (w wxMch) checkRefundNo(ctx context.Context, req *MchPayRefundReq) error {
+	if w.refundGuard == nil || req.OutTradeNo == "" {
+		return nil
+	}
+	return w.refundGuard.Check(ctx, req.OutRefundNo, req.OutTradeNo)
+}
+
+func (w wxMch) recordRefundNo(ctx context.Context, req *MchPayRefundReq, resp *MchPayRefundResp) error {
+	if w.refundGuard == nil || !resp.result().success() {
+		return nil
+	}
+	// 退款单号已经用于其他订单时微信返回原来的退款结果，订单号和请求中的不一致
+	if req.TransactionId != "" && resp.TransactionId != "" && resp.TransactionId != req.TransactionId {
+		return fmt.Errorf("%w: %s belongs to transaction %s, not %s", ErrRefundNoReused, req.OutRefundNo, resp.TransactionId, req.TransactionId)
+	}
+	if req.OutTradeNo != "" && resp.OutTradeNo != "" && resp.OutTradeNo != req.OutTradeNo {
+		return fmt.Errorf("%w: %s belongs to %s, not %s", ErrRefundNoReused, req.OutRefundNo, resp.OutTradeNo, req.OutTradeNo)
+	}
+	outTradeNo := resp.OutTradeNo
+	if outTradeNo == "" {
+		outTradeNo = req.OutTradeNo
+	}
+	if outTradeNo == "" {
+		w.logger.Warn("[wxmch] refund without out_trade_no, skip refund guard", zap.String("out_refund_no", req.OutRefundNo))
+		return nil
+	}
+	return w.refundGuard.Record(ctx, req.OutRefundNo, outTradeNo)
+}
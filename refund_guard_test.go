@@ -0,0 +1,100 @@
+package wechat
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testRefundSuccessT1 = `<xml><return_code>SUCCESS</return_code><result_code>SUCCESS</result_code><out_trade_no>T1</out_trade_no><transaction_id>4200000252201811190604084104</transaction_id><refund_id>50000408942018111907145868882</refund_id></xml>`
+	testRefundSuccessT2 = `<xml><return_code>SUCCESS</return_code><result_code>SUCCESS</result_code><out_trade_no>T2</out_trade_no><transaction_id>4200000252201811190604084105</transaction_id><refund_id>50000408942018111907145868883</refund_id></xml>`
+)
+
+func TestWxMch_RefundGuard(t *testing.T) {
+	client := newStubHttp(testRefundSuccessT1)
+	s := newTestMch(client)
+	s.SetRefundGuard(NewMemoryRefundGuard())
+	ctx := context.Background()
+
+	_, err := s.ReqPayRefund(ctx, &MchPayRefundReq{OutTradeNo: "T1", OutRefundNo: "R1", TotalFee: 100, RefundFee: 50})
+	assert.Nil(t, err)
+	params := parseXMLParams(t, client.last().body)
+	assert.Equal(t, "T1", params["out_trade_no"])
+	assert.NotContains(t, params, "transaction_id")
+
+	// 同一个订单重试退款可以复用退款单号
+	_, err = s.ReqPayRefund(ctx, &MchPayRefundReq{OutTradeNo: "T1", OutRefundNo: "R1", TotalFee: 100, RefundFee: 50})
+	assert.Nil(t, err)
+	assert.Len(t, client.requests, 2)
+
+	// 其他订单使用同一个退款单号在发出请求前拒绝
+	_, err = s.ReqPayRefund(ctx, &MchPayRefundReq{OutTradeNo: "T2", OutRefundNo: "R1", TotalFee: 100, RefundFee: 50})
+	assert.True(t, errors.Is(err, ErrRefundNoReused), "err = %v", err)
+	assert.Len(t, client.requests, 2)
+
+	// 只有transaction_id时按返回的out_trade_no检查
+	s.client = newStubHttp(testRefundSuccessT2)
+	_, err = s.ReqPayRefund(ctx, &MchPayRefundReq{TransactionId: "4200000252201811190604084105", OutRefundNo: "R1", TotalFee: 100, RefundFee: 50})
+	assert.True(t, errors.Is(err, ErrRefundNoReused), "err = %v", err)
+
+	// 新的退款单号第一次使用，但微信返回的是其他订单的退款结果
+	s.SetRefundGuard(NewMemoryRefundGuard())
+	s.client = newStubHttp(testRefundSuccessT2, testRefundSuccessT2)
+	resp, err := s.ReqPayRefund(ctx, &MchPayRefundReq{TransactionId: "4200000252201811190604084104", OutRefundNo: "R3", TotalFee: 100, RefundFee: 50})
+	assert.True(t, errors.Is(err, ErrRefundNoReused), "err = %v", err)
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, "T2", resp.OutTradeNo)
+	}
+	resp, err = s.ReqPayRefund(ctx, &MchPayRefundReq{OutTradeNo: "T1", OutRefundNo: "R4", TotalFee: 100, RefundFee: 50})
+	assert.True(t, errors.Is(err, ErrRefundNoReused), "err = %v", err)
+	assert.NotNil(t, resp)
+
+	// 不设置时不检查
+	s.SetRefundGuard(nil)
+	_, err = s.ReqPayRefund(ctx, &MchPayRefundReq{OutTradeNo: "T2", OutRefundNo: "R1", TotalFee: 100, RefundFee: 50})
+	assert.Nil(t, err)
+}
+
+func TestWxMch_RefundGuard_MixedIds(t *testing.T) {
+	s := newTestMch(newStubHttp(testRefundSuccessT1))
+	s.SetRefundGuard(NewMemoryRefundGuard())
+	ctx := context.Background()
+
+	// 同一个订单先按transaction_id退款，再按out_trade_no重试，不是复用
+	_, err := s.ReqPayRefund(ctx, &MchPayRefundReq{TransactionId: "4200000252201811190604084104", OutRefundNo: "R1", TotalFee: 100, RefundFee: 50})
+	assert.Nil(t, err)
+	_, err = s.ReqPayRefund(ctx, &MchPayRefundReq{OutTradeNo: "T1", OutRefundNo: "R1", TotalFee: 100, RefundFee: 50})
+	assert.Nil(t, err)
+
+	// 反过来也一样
+	_, err = s.ReqPayRefund(ctx, &MchPayRefundReq{OutTradeNo: "T1", OutRefundNo: "R2", TotalFee: 100, RefundFee: 50})
+	assert.Nil(t, err)
+	_, err = s.ReqPayRefund(ctx, &MchPayRefundReq{TransactionId: "4200000252201811190604084104", OutRefundNo: "R2", TotalFee: 100, RefundFee: 50})
+	assert.Nil(t, err)
+}
+
+func TestWxMch_RefundGuard_RecordOnSuccess(t *testing.T) {
+	client := newStubHttp(`<xml><return_code>SUCCESS</return_code><result_code>FAIL</result_code><err_code>NOTENOUGH</err_code><err_code_des>基本账户余额不足</err_code_des></xml>`)
+	s := newTestMch(client)
+	s.SetRefundGuard(NewMemoryRefundGuard())
+	ctx := context.Background()
+
+	// 退款失败时不记录，退款单号可以用于其他订单
+	resp, err := s.ReqPayRefund(ctx, &MchPayRefundReq{OutTradeNo: "T1", OutRefundNo: "R1", TotalFee: 100, RefundFee: 50})
+	assert.Nil(t, err)
+	assert.Equal(t, ErrCodeNotEnough, resp.ErrCode)
+
+	// 请求失败时也不记录
+	s.client = newStubHttp(`<xml><return_code>SUCCESS</return_code><result_`)
+	_, err = s.ReqPayRefund(ctx, &MchPayRefundReq{OutTradeNo: "T1", OutRefundNo: "R2", TotalFee: 100, RefundFee: 50})
+	assert.NotNil(t, err)
+
+	s.client = newStubHttp(testRefundSuccessT2)
+	_, err = s.ReqPayRefund(ctx, &MchPayRefundReq{OutTradeNo: "T2", OutRefundNo: "R1", TotalFee: 100, RefundFee: 50})
+	assert.Nil(t, err)
+	_, err = s.ReqPayRefund(ctx, &MchPayRefundReq{OutTradeNo: "T2", OutRefundNo: "R2", TotalFee: 100, RefundFee: 50})
+	assert.Nil(t, err)
+}
@@ -2,30 +2,256 @@ package wechat
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"encoding/xml"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"mime/multipart"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 
 	"go.uber.org/zap"
 )
 
 const (
-	SignTypeMD5 = "MD5"
-	TradeType   = "JSAPI"
+	SignTypeMD5        = "MD5"
+	SignTypeHMACSHA256 = "HMAC-SHA256"
+	TradeType          = "JSAPI"
+
+	// 默认的响应内容大小上限，正常接口的响应远小于这个值
+	defaultMaxBodySize = 10 << 20
+
+	acceptEncodingGzip     = "gzip"
+	acceptEncodingIdentity = "identity"
+)
+
+var (
+	ErrIPNotWhitelisted = errors.New("[gowechat] ip not in whitelist")
+	ErrResponseTooLarge = errors.New("[gowechat] response too large")
+	ErrInvalidConfig    = errors.New("[gowechat] invalid config")
+	ErrNotSignable      = errors.New("[gowechat] request is not signable")
+	ErrSignError        = errors.New("[gowechat] sign error")
+	ErrMerchantMismatch = errors.New("[gowechat] merchant mismatch")
+	ErrTruncatedXML     = errors.New("[gowechat] truncated xml response")
+	ErrMissingApiKey    = errors.New("[gowechat] missing api key")
+	ErrJSONResponse     = errors.New("[gowechat] json error on xml endpoint")
+	ErrRandUnavailable  = errors.New("[gowechat] crypto/rand unavailable")
 )
 
+// JSONError XML接口在部分网关错误时返回的JSON错误，如 {"errcode":...,"errmsg":...}
+type JSONError struct {
+	ErrCode int    `json:"errcode"`
+	ErrMsg  string `json:"errmsg"`
+}
+
+func (e *JSONError) Error() string {
+	return fmt.Sprintf("%s: errcode %d, %s", ErrJSONResponse, e.ErrCode, e.ErrMsg)
+}
+
+func (e *JSONError) Unwrap() error {
+	return ErrJSONResponse
+}
+
+// Signable 需要签名的支付请求，prepare 通过这些方法填充公共参数和签名
+type Signable interface {
+	SetAppId(appId string)
+	SetMchId(mchId string)
+	SetNonceStr(nonceStr string)
+	SetSign(sign string)
+}
+
+// Clock 提供当前时间，测试时可以替换成固定的时间
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+// 请求可以设置签名类型时实现，prepare 会把context中指定的签名类型写入请求
+type signTypeSetter interface {
+	SetSignType(signType string)
+}
+
+// SignTypeCtxKey 在context中指定签名类型使用的key，通过 WithSignType 设置
+type SignTypeCtxKey struct{}
+
+// 在context中指定本次请求使用的签名类型，覆盖请求和配置中的默认值
+// 用于同一个服务需要按请求使用不同签名类型的场景
+func WithSignType(ctx context.Context, signType string) context.Context {
+	return context.WithValue(ctx, SignTypeCtxKey{}, signType)
+}
+
+// 获取context中指定的签名类型
+func SignTypeFromContext(ctx context.Context) (string, bool) {
+	signType, ok := ctx.Value(SignTypeCtxKey{}).(string)
+	return signType, ok && signType != ""
+}
+
+// Signer 根据参数串和签名算法计算签名，参数串不包含key
+// 通过 WithSigner 放入context后替换默认使用API密钥的签名方法，如密钥保存在单独的签名服务中
+type Signer interface {
+	Sign(ctx context.Context, paramStr, signType string) (string, error)
+}
+
+// SignerFunc 将普通函数转换成 Signer
+type SignerFunc func(ctx context.Context, paramStr, signType string) (string, error)
+
+func (f SignerFunc) Sign(ctx context.Context, paramStr, signType string) (string, error) {
+	return f(ctx, paramStr, signType)
+}
+
+type signerCtxKey struct{}
+
+// 在context中指定本次请求使用的签名方法
+func WithSigner(ctx context.Context, signer Signer) context.Context {
+	return context.WithValue(ctx, signerCtxKey{}, signer)
+}
+
+// 获取context中指定的签名方法
+func SignerFromContext(ctx context.Context) (Signer, bool) {
+	signer, ok := ctx.Value(signerCtxKey{}).(Signer)
+	return signer, ok && signer != nil
+}
+
+type gzipRequestCtxKey struct{}
+
+// 标记本次请求的内容可以按 SetGzipThreshold 压缩，只在支持压缩请求的接口中使用
+func withGzipRequest(ctx context.Context) context.Context {
+	return context.WithValue(ctx, gzipRequestCtxKey{}, true)
+}
+
+func gzipRequestFromContext(ctx context.Context) bool {
+	gzip, _ := ctx.Value(gzipRequestCtxKey{}).(bool)
+	return gzip
+}
+
 type wxService struct {
-	client Http
-	key    string
-	logger *zap.Logger
+	client      Http
+	appId       string
+	mchId       string
+	key         string
+	logger      *zap.Logger
+	maxBodySize int64
+	debug       bool
+	// 检查响应中的appid和商户号与配置一致
+	verifyMerchant bool
+	// 请求内容达到这个大小时使用gzip压缩，为0时不压缩
+	gzipThreshold int
+	// 对账单、资金账单不完整时重新下载的次数
+	billRetries int
+	// 为空时使用系统时间
+	clock Clock
+	// 在Debug日志中记录的响应内容的最大字节数，为0时不记录
+	maxLoggedBodyBytes int
+	// 更换API密钥期间仍然接受的旧密钥，只用于校验签名
+	previousKeys []string
+	// XML请求中使用CDATA包裹的字段
+	cdataFields map[string]bool
+	// 限制同时进行中的请求数，为nil时不限制
+	limiter chan struct{}
+	// 在日志中记录请求和响应的内容，默认只记录地址和结果
+	logBodies bool
 }
 
-func (w wxService) SetLogger(log *zap.Logger) {
+// 设置记录日志的logger，为nil时使用默认的logger
+func (w *wxService) SetLogger(log *zap.Logger) {
+	if log == nil {
+		log = zapLogger
+	}
 	w.logger = log
 }
 
+// 开启后在Info日志中记录完整的请求内容和解析后的响应，其中包含openid、prepay_id和金额等信息
+// 默认关闭，只记录接口地址和请求结果（见 [wx] outcome），只建议在排查问题时开启
+func (w *wxService) SetLogBodies(enable bool) {
+	w.logBodies = enable
+}
+
+// 开启 SetLogBodies 时返回记录内容的字段，否则返回空字段
+func (w wxService) bodyField(key string, body interface{}) zap.Field {
+	if !w.logBodies {
+		return zap.Skip()
+	}
+	return zap.Any(key, body)
+}
+
+// 设置读取响应内容的大小上限，小于等于0时使用默认值
+func (w *wxService) SetMaxBodySize(n int64) {
+	w.maxBodySize = n
+}
+
+// 开启调试模式，签名错误时在返回的error中附带签名原串（不含key）
+func (w *wxService) SetDebug(debug bool) {
+	w.debug = debug
+}
+
+// 开启后支付接口响应中的appid或商户号与配置不一致时返回 ErrMerchantMismatch
+func (w *wxService) SetVerifyMerchant(verify bool) {
+	w.verifyMerchant = verify
+}
+
+// 设置请求内容gzip压缩的阈值，编码后的内容达到n字节时压缩发送并带上 Content-Encoding: gzip
+// 只对v3接口生效，v2的XML接口总是不压缩；签名总是基于压缩前的内容计算，小于等于0时不压缩
+func (w *wxService) SetGzipThreshold(n int) {
+	w.gzipThreshold = n
+}
+
+// 设置生成时间戳等使用的时钟，为nil时使用系统时间
+func (w *wxService) SetClock(clock Clock) {
+	w.clock = clock
+}
+
+// 设置在Debug日志中记录响应内容的最大字节数，超过的部分截断并注明总长度，小于等于0时不记录
+func (w *wxService) SetMaxLoggedBodyBytes(n int) {
+	w.maxLoggedBodyBytes = n
+}
+
+// 设置更换API密钥期间仍然接受的旧密钥，校验通知签名时当前密钥不匹配会依次尝试这些密钥
+// 请求签名总是使用当前密钥，更换完成后应清空
+func (w *wxService) SetPreviousKeys(keys ...string) {
+	w.previousKeys = keys
+}
+
+// 设置XML请求中使用CDATA包裹的字段，如 body、attach、refund_desc，避免 &、< 等字符转义后微信解析出错
+// 只影响发送的内容，签名总是基于原始的值计算，不传参数时恢复普通的转义
+func (w *wxService) SetCDATAFields(fields ...string) {
+	w.cdataFields = nil
+	if len(fields) == 0 {
+		return
+	}
+	w.cdataFields = make(map[string]bool, len(fields))
+	for _, field := range fields {
+		w.cdataFields[field] = true
+	}
+}
+
+// 设置同时进行中的请求数上限，达到上限时等待其他请求结束，context结束时返回context的错误
+// 服务的副本共享同一个上限，小于等于0时不限制
+func (w *wxService) SetMaxConcurrency(n int) {
+	w.limiter = nil
+	if n > 0 {
+		w.limiter = make(chan struct{}, n)
+	}
+}
+
+func (w wxService) now() time.Time {
+	if w.clock == nil {
+		return realClock{}.Now()
+	}
+	return w.clock.Now()
+}
+
+// 系统随机数不可用时panic，同 RandStringBytesMaskImprSrc
 func (w wxService) RandString(n int) string {
 	return RandStringBytesMaskImprSrc(n)
 }
@@ -34,8 +260,9 @@ func (w wxService) Get(ctx context.Context, url string, f HandlerFunc) error {
 	return w.DoReq(ctx, http.MethodGet, url, "", nil, f)
 }
 
+// JSON接口不协商压缩，避免微信部分接口返回的压缩内容与响应头不一致
 func (w wxService) PostJSON(ctx context.Context, url string, req interface{}, f HandlerFunc) (err error) {
-	return w.DoReq(ctx, http.MethodPost, url, contentTypeJSON, req, f)
+	return w.doReq(ctx, http.MethodPost, url, contentTypeJSON, req, map[string]string{"Accept-Encoding": acceptEncodingIdentity}, f)
 }
 
 func (w wxService) PostXML(ctx context.Context, url string, req interface{}, f HandlerFunc) (err error) {
@@ -43,57 +270,592 @@ func (w wxService) PostXML(ctx context.Context, url string, req interface{}, f H
 }
 
 func (w wxService) DoReq(ctx context.Context, method, url string, contentType string, req interface{}, f HandlerFunc) (err error) {
-	w.logger.Info("[wx] request", zap.String("url", url), zap.String("contentType", contentType), zap.Any("body", req))
+	return w.doReq(ctx, method, url, contentType, req, nil, f)
+}
+
+// 同 DoReq，extraHeaders为接口需要额外设置的请求头，如 Accept-Encoding
+func (w wxService) doReq(ctx context.Context, method, url string, contentType string, req interface{}, extraHeaders map[string]string, f HandlerFunc) (err error) {
+	w.logger.Info("[wx] request", zap.String("url", url), zap.String("contentType", contentType), w.bodyField("body", req))
 	defer func() {
 		if err != nil {
 			w.logger.Error("[wx] request", zap.Error(err))
 		}
 	}()
+	defer recoverPanic(&err)
+	// 没有CallResult时也记录，用于输出每次请求的结果
+	ctx, result := ensureCallResult(ctx)
+	*result = CallResult{Url: url}
+	start := time.Now()
+	defer func() {
+		result.Duration = time.Since(start)
+		w.logOutcome(result)
+	}()
+	handler := f
+	f = func(response *http.Response, err error) error {
+		if response != nil {
+			result.StatusCode = response.StatusCode
+		}
+		return handler(response, err)
+	}
 	var (
-		body    io.Reader
-		headers map[string]string
+		buf  []byte
+		body io.Reader
 	)
-	switch contentType {
-	case contentTypeXML:
-		buf, err := xml.Marshal(&req)
-		if err != nil {
+	headers := make(map[string]string, len(extraHeaders)+3)
+	for k, v := range extraHeaders {
+		headers[k] = v
+	}
+	if contentType != "" {
+		headers["Content-Type"] = contentType
+	}
+	switch v := req.(type) {
+	case []byte:
+		// 已经编码好的请求内容直接发送
+		buf = v
+	case *streamBody:
+		// 流式的请求内容不做编码和压缩，边读边发送
+		body = v
+		headers["Content-Length"] = strconv.FormatInt(v.size, 10)
+	default:
+		switch contentType {
+		case contentTypeXML:
+			if buf, err = xml.Marshal(req); err != nil {
+				return err
+			}
+			if len(w.cdataFields) > 0 {
+				if buf, err = wrapCDATA(buf, w.cdataFields); err != nil {
+					return err
+				}
+			}
+		case contentTypeJSON:
+			if buf, err = json.Marshal(req); err != nil {
+				return err
+			}
+		}
+	}
+
+	if buf != nil && w.gzipThreshold > 0 && len(buf) >= w.gzipThreshold && gzipRequestFromContext(ctx) {
+		if buf, err = gzipBytes(buf); err != nil {
 			return err
 		}
-		body = bytes.NewBuffer(buf)
-	case contentTypeJSON:
-		buf, err := json.Marshal(&req)
+		headers["Content-Encoding"] = "gzip"
+	}
+	if buf != nil {
+		// 请求内容已经完整编码，明确带上长度，Http的实现包装body后也不会变成chunked传输
+		body = bytes.NewReader(buf)
+		headers["Content-Length"] = strconv.Itoa(len(buf))
+	}
+	if w.limiter != nil {
+		select {
+		case w.limiter <- struct{}{}:
+			defer func() { <-w.limiter }()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return w.client.Do(ctx, method, url, headers, body, f)
+}
+
+// 每次请求输出一行结果，只包含接口地址、耗时和返回码，不包含请求和响应内容
+func (w wxService) logOutcome(r *CallResult) {
+	endpoint := r.Url
+	// 查询参数中可能有access_token
+	if i := strings.IndexByte(endpoint, '?'); i >= 0 {
+		endpoint = endpoint[:i]
+	}
+	w.logger.Info("[wx] outcome",
+		zap.String("endpoint", endpoint),
+		zap.Duration("duration", r.Duration),
+		zap.Int("http_status", r.StatusCode),
+		zap.String("return_code", r.ReturnCode),
+		zap.String("result_code", r.ResultCode),
+		zap.String("err_code", r.ErrCode),
+	)
+}
+
+// 把fields中字段的文本内容改用CDATA包裹，其他内容原样保留
+func wrapCDATA(buf []byte, fields map[string]bool) ([]byte, error) {
+	var out bytes.Buffer
+	d := xml.NewDecoder(bytes.NewReader(buf))
+	var current string
+	for {
+		token, err := d.Token()
+		if err == io.EOF {
+			return out.Bytes(), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch tok := token.(type) {
+		case xml.StartElement:
+			current = tok.Name.Local
+			out.WriteString("<" + current + ">")
+		case xml.EndElement:
+			current = ""
+			out.WriteString("</" + tok.Name.Local + ">")
+		case xml.CharData:
+			if !fields[current] {
+				if err := xml.EscapeText(&out, tok); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			// 内容中的 ]]> 需要拆成两段CDATA
+			out.WriteString("<![CDATA[")
+			out.WriteString(strings.Replace(string(tok), "]]>", "]]]]><![CDATA[>", -1))
+			out.WriteString("]]>")
+		}
+	}
+}
+
+func gzipBytes(buf []byte) ([]byte, error) {
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	if _, err := zw.Write(buf); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return compressed.Bytes(), nil
+}
+
+// 已知长度的流式请求内容，DoReq直接发送，不会读入内存再编码
+type streamBody struct {
+	io.Reader
+	size int64
+}
+
+// 生成带有一个文件字段的multipart请求内容，文件内容从r中流式读取
+// fields为文件之前的普通表单字段，可以为nil
+func newMultipartFile(field, filename string, r io.Reader, size int64, fields map[string]string) (string, *streamBody, error) {
+	var head bytes.Buffer
+	writer := multipart.NewWriter(&head)
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := writer.WriteField(k, fields[k]); err != nil {
+			return "", nil, err
+		}
+	}
+	if _, err := writer.CreateFormFile(field, filename); err != nil {
+		return "", nil, err
+	}
+	// 与 multipart.Writer.Close 写入的结束边界相同
+	tail := "\r\n--" + writer.Boundary() + "--\r\n"
+	return writer.FormDataContentType(), &streamBody{
+		Reader: io.MultiReader(bytes.NewReader(head.Bytes()), io.LimitReader(r, size), strings.NewReader(tail)),
+		size:   int64(head.Len()) + size + int64(len(tail)),
+	}, nil
+}
+
+// 填充随机字符串并签名，返回可以直接提交的XML内容，不会发送请求
+// 适用于签名和提交分开的场景，提交方使用 ReqRaw 发送
+func (w wxService) SignRequest(ctx context.Context, req interface{}) ([]byte, error) {
+	signable, ok := req.(Signable)
+	if !ok {
+		return nil, ErrNotSignable
+	}
+	if err := w.prepare(ctx, signable); err != nil {
+		return nil, err
+	}
+	return xml.Marshal(req)
+}
+
+// 发送已经签名好的XML请求，并将响应解析到resp中
+// resp为支付接口的响应类型时会同时检查返回结果
+func (w wxService) ReqRaw(ctx context.Context, url string, signedXML []byte, resp interface{}) error {
+	ctx, result := ensureCallResult(ctx)
+	if err := w.DoReq(ctx, http.MethodPost, url, contentTypeXML, signedXML, func(response *http.Response, err error) error {
 		if err != nil {
 			return err
 		}
-		body = bytes.NewBuffer(buf)
-	default:
-		if buf, ok := req.([]byte); ok {
-			body = bytes.NewBuffer(buf)
+		if err := w.decodeXML(response, resp); err != nil {
+			return err
+		}
+		if r, ok := resp.(payResponse); ok {
+			result.setPayResult(r.result())
 		}
+		return nil
+	}); err != nil {
+		return err
 	}
+	if r, ok := resp.(payResponse); ok {
+		if err := checkPayResult(r.result()); err != nil {
+			return err
+		}
+		if w.verifyMerchant {
+			return w.checkMerchant(r.result())
+		}
+	}
+	return nil
+}
 
-	if contentType != "" {
-		headers = map[string]string{
-			"Content-Type": contentType,
+// 读取响应内容，超过大小上限时返回 ErrResponseTooLarge
+func (w wxService) readBody(response *http.Response) ([]byte, error) {
+	limit := w.maxBodySize
+	if limit <= 0 {
+		limit = defaultMaxBodySize
+	}
+	body := io.Reader(response.Body)
+	// 显式协商了gzip时http.Transport不会自动解压，大小上限按解压后的内容计算
+	if strings.EqualFold(response.Header.Get("Content-Encoding"), acceptEncodingGzip) {
+		zr, err := gzip.NewReader(response.Body)
+		if err != nil {
+			return nil, err
 		}
+		defer zr.Close()
+		body = zr
 	}
-	return w.client.Do(ctx, method, url, headers, body, f)
+	buf, err := ioutil.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(buf)) > limit {
+		return nil, fmt.Errorf("%w: exceeds %d bytes", ErrResponseTooLarge, limit)
+	}
+	if w.maxLoggedBodyBytes > 0 {
+		w.logger.Debug("[wx] response", zap.Int("status", response.StatusCode), zap.String("body", bodySnippet(buf, w.maxLoggedBodyBytes)))
+	}
+	return buf, nil
+}
+
+// 截取响应内容用于日志，二进制内容（如图片）只记录长度
+func bodySnippet(buf []byte, max int) string {
+	if !utf8.Valid(buf) || bytes.IndexByte(buf, 0) >= 0 {
+		return fmt.Sprintf("<%d bytes, binary>", len(buf))
+	}
+	if len(buf) <= max {
+		return string(buf)
+	}
+	// 不在多字节字符的中间截断
+	n := max
+	for n > 0 && !utf8.RuneStart(buf[n]) {
+		n--
+	}
+	return fmt.Sprintf("%s...<truncated, %d bytes>", buf[:n], len(buf))
+}
+
+func (w wxService) decodeXML(response *http.Response, v interface{}) error {
+	buf, err := w.readBody(response)
+	if err != nil {
+		return err
+	}
+	// 返回的是JSON时直接解析成错误，否则会得到难以理解的XML解析错误
+	if trimmed := bytes.TrimSpace(buf); len(trimmed) > 0 && trimmed[0] == '{' {
+		jsonErr := &JSONError{}
+		if err := json.Unmarshal(trimmed, jsonErr); err != nil {
+			jsonErr.ErrMsg = bodySnippet(trimmed, 256)
+		}
+		return jsonErr
+	}
+	if err := checkXMLComplete(buf); err != nil {
+		return err
+	}
+	return xml.Unmarshal(buf, v)
+}
+
+// 检查根元素是否完整闭合，网络异常时响应可能被截断，直接解析会得到缺少字段的结果
+func checkXMLComplete(buf []byte) error {
+	d := xml.NewDecoder(bytes.NewReader(buf))
+	depth, closed := 0, false
+	for {
+		token, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if closed {
+				return err
+			}
+			return fmt.Errorf("%w: %v", ErrTruncatedXML, err)
+		}
+		switch token.(type) {
+		case xml.StartElement:
+			depth++
+		case xml.EndElement:
+			depth--
+			if depth == 0 {
+				closed = true
+			}
+		}
+	}
+	if !closed {
+		return fmt.Errorf("%w: root element not closed, %d bytes received", ErrTruncatedXML, len(buf))
+	}
+	return nil
+}
+
+func (w wxService) decodeJSON(response *http.Response, v interface{}) error {
+	buf, err := w.readBody(response)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, v)
 }
 
 func (w wxService) sign(ctx context.Context, req interface{}) (string, error) {
-	buf, err := json.Marshal(req)
+	paramStr, signType, err := signString(ctx, req)
 	if err != nil {
 		return "", err
 	}
-	var params map[string]string
-	if err := json.Unmarshal(buf, &params); err != nil {
-		return "", err
+	return w.signParamStr(ctx, paramStr, signType)
+}
+
+// 优先使用context中的 Signer，没有时使用API密钥签名
+func (w wxService) signParamStr(ctx context.Context, paramStr, signType string) (string, error) {
+	signer, ok := SignerFromContext(ctx)
+	w.logger.Debug("[wx] sign", zap.String("signType", signType), w.bodyField("params", paramStr), zap.Bool("customSigner", ok))
+	if ok {
+		return signer.Sign(ctx, paramStr, signType)
 	}
+	// 空的key也能算出签名，但微信一定返回签名错误，提前返回更明确的错误
+	if w.key == "" {
+		return "", ErrMissingApiKey
+	}
+	return w.hashSign(paramStr, signType), nil
+}
 
+// 返回参与签名的参数串和签名算法
+func signString(ctx context.Context, req interface{}) (string, string, error) {
+	params, err := signParams(req)
+	if err != nil {
+		return "", "", err
+	}
 	paramStr, err := GenParamStr(params)
 	if err != nil {
-		return "", err
+		return "", "", err
+	}
+	// 按请求中的sign_type选择签名算法，未指定时使用context中的签名类型，都没有时为MD5
+	// 请求中指定了sign_type时不使用context中的值，避免签名算法和请求中的sign_type不一致
+	signType := params["sign_type"]
+	if override, ok := SignTypeFromContext(ctx); ok && signType == "" {
+		signType = override
+	}
+	return paramStr, signType, nil
+}
+
+func (w wxService) hashSign(paramStr, signType string) string {
+	return hashSignWithKey(paramStr, signType, w.key)
+}
+
+func hashSignWithKey(paramStr, signType, key string) string {
+	stringSignTemp := paramStr + "&key=" + key
+	if signType == SignTypeHMACSHA256 {
+		return HashHmacSha256(stringSignTemp, key)
+	}
+	return HashMd5(stringSignTemp)
+}
+
+// 校验签名时依次尝试的密钥，当前密钥在前
+func (w wxService) verifyKeys() []string {
+	return append([]string{w.key}, w.previousKeys...)
+}
+
+// 对参数签名，返回按参数名排序的参数串并在最后附加 &sign=签名，用于以查询字符串提交参数的接口
+// params中的sign和空值不参与签名
+func (w wxService) SignQuery(params map[string]string) string {
+	values, _ := signParams(params)
+	if w.key == "" {
+		w.logger.Error("[wx] sign query", zap.Error(ErrMissingApiKey))
+		return ""
+	}
+	paramStr, err := GenParamStr(values)
+	if err != nil {
+		w.logger.Error("[wx] sign query", zap.Error(err))
+		return ""
+	}
+	return paramStr + "&sign=" + w.hashSign(paramStr, values["sign_type"])
+}
+
+// 签名字段本身不参与签名，不管请求中是否已经有值
+var signFields = map[string]bool{"sign": true, "paySign": true}
+
+// 参与签名的参数，取自 xml.Marshal 的结果，保证参与签名的参数名和值与实际发送的完全一致
+// 参数名使用xml标签，json标签不影响签名，map[string]string直接作为参数
+// 所有签名和校验签名都通过这里取参数，结果中不包括签名字段和空值
+func signParams(req interface{}) (map[string]string, error) {
+	fields, ok := req.(map[string]string)
+	if !ok {
+		buf, err := xml.Marshal(req)
+		if err != nil {
+			return nil, err
+		}
+		if fields, err = xmlFields(buf); err != nil {
+			return nil, err
+		}
+	}
+	params := make(map[string]string, len(fields))
+	for k, v := range fields {
+		if v != "" && !signFields[k] {
+			params[k] = v
+		}
+	}
+	return params, nil
+}
+
+// 返回请求中参与签名的参数，不包括sign和空值，可以和 DiffSignParams 一起用于排查签名错误
+func SignParams(req interface{}) (map[string]string, error) {
+	return signParams(req)
+}
+
+// 调试用的签名原串，key用***代替
+func debugSignString(req interface{}) string {
+	params, err := signParams(req)
+	if err != nil {
+		return err.Error()
+	}
+	paramStr, err := GenParamStr(params)
+	if err != nil {
+		return err.Error()
+	}
+	return paramStr + "&key=***"
+}
+
+// 填充appid、商户号、随机字符串并计算签名
+// 配置中appid或商户号为空时保留请求中原有的值
+func (w wxService) prepare(ctx context.Context, req Signable) error {
+	if w.appId != "" {
+		req.SetAppId(w.appId)
+	}
+	if w.mchId != "" {
+		req.SetMchId(w.mchId)
+	}
+	nonceStr, err := randString(32)
+	if err != nil {
+		return err
+	}
+	req.SetNonceStr(nonceStr)
+	if signType, ok := SignTypeFromContext(ctx); ok {
+		if setter, ok := req.(signTypeSetter); ok {
+			setter.SetSignType(signType)
+		}
+	}
+	req.SetSign("")
+	sign, err := w.sign(ctx, req)
+	if err != nil {
+		return err
+	}
+	req.SetSign(sign)
+	return nil
+}
+
+// 支付接口响应中的公共返回字段
+type payResult struct {
+	ReturnCode string
+	ReturnMsg  string
+	ResultCode string
+	ErrCode    string
+	ErrCodeDes string
+	AppId      string
+	MchId      string
+}
+
+// 业务处理是否成功，部分旧接口成功时不返回result_code，没有错误码时也认为成功
+func (r payResult) success() bool {
+	if r.ReturnCode != "SUCCESS" {
+		return false
+	}
+	return r.ResultCode == "SUCCESS" || r.ResultCode == "" && r.ErrCode == ""
+}
+
+type payResponse interface {
+	result() payResult
+}
+
+// 发送支付类XML请求，解析响应并检查返回结果
+func (w wxService) postPayXML(ctx context.Context, url string, req interface{}, resp payResponse) error {
+	if err := w.sendPayXML(ctx, url, req, resp); err != nil {
+		return err
+	}
+	return w.checkPayResp(url, req, resp)
+}
+
+// 发送支付接口请求并解析响应，返回的error是网络或者解析错误，不检查返回码
+func (w wxService) sendPayXML(ctx context.Context, url string, req interface{}, resp payResponse) error {
+	// 解析后就记录返回码，请求结束时输出的结果中才有返回码
+	ctx, result := ensureCallResult(ctx)
+	return w.PostXML(ctx, url, req, func(response *http.Response, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := w.decodeXML(response, resp); err != nil {
+			return err
+		}
+		result.setPayResult(resp.result())
+		return nil
+	})
+}
+
+// 检查已经解析的支付接口响应的返回码和商户信息
+func (w wxService) checkPayResp(url string, req interface{}, resp payResponse) error {
+	if err := checkPayResult(resp.result()); err != nil {
+		if w.debug && errors.Is(err, ErrSignError) {
+			err = fmt.Errorf("%w, sign string: %s", err, debugSignString(req))
+		}
+		w.logger.Error("[wx] pay result", zap.String("url", url), zap.Error(err))
+		return err
+	}
+	if w.verifyMerchant {
+		if err := w.checkMerchant(resp.result()); err != nil {
+			w.logger.Error("[wx] pay result", zap.String("url", url), zap.Error(err))
+			return err
+		}
+	}
+	return nil
+}
+
+// 响应中带有appid或商户号时，检查是否与配置一致，防止配置错误时处理了其他商户的数据
+func (w wxService) checkMerchant(r payResult) error {
+	if r.AppId != "" && w.appId != "" && r.AppId != w.appId {
+		return fmt.Errorf("%w: appid %s, expected %s", ErrMerchantMismatch, r.AppId, w.appId)
+	}
+	if r.MchId != "" && w.mchId != "" && r.MchId != w.mchId {
+		return fmt.Errorf("%w: mch id %s, expected %s", ErrMerchantMismatch, r.MchId, w.mchId)
+	}
+	return nil
+}
+
+// 检查支付接口的返回结果，识别出的特定错误会转换成对应的error
+// return_code为SUCCESS且没有result_code和错误码时认为成功
+func checkPayResult(r payResult) error {
+	if r.success() {
+		return nil
+	}
+	if r.ErrCode == ErrCodeSignError || strings.Contains(r.ReturnMsg, "签名错误") {
+		msg := r.ReturnMsg
+		if r.ErrCodeDes != "" {
+			msg = r.ErrCodeDes
+		}
+		return fmt.Errorf("%w: %s", ErrSignError, msg)
+	}
+	for _, msg := range []string{r.ReturnMsg, r.ErrCodeDes} {
+		// 微信没有单独的错误码，只能通过描述识别，如：该IP不在白名单中
+		if strings.Contains(msg, "白名单") && strings.Contains(strings.ToUpper(msg), "IP") {
+			return fmt.Errorf("%w: %s", ErrIPNotWhitelisted, msg)
+		}
+	}
+	return nil
+}
+
+// 校验商户号和API密钥，商户号为纯数字，API密钥为32位
+func validateMerchant(mchId, apiKey string) error {
+	if mchId == "" {
+		return fmt.Errorf("%w: mch id is required", ErrInvalidConfig)
+	}
+	for _, c := range mchId {
+		if c < '0' || c > '9' {
+			return fmt.Errorf("%w: mch id must be numeric", ErrInvalidConfig)
+		}
+	}
+	if apiKey == "" {
+		return fmt.Errorf("%w: api key is required", ErrInvalidConfig)
+	}
+	if len(apiKey) != 32 {
+		return fmt.Errorf("%w: api key must be 32 characters", ErrInvalidConfig)
 	}
-	stringSignTemp := paramStr + "&key=" + w.key
-	return HashMd5(stringSignTemp), nil
+	return nil
 }
@@ -0,0 +1,600 @@
+package wechat
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// stubHttp 按顺序返回预设的响应，并记录发出的请求，用于离线测试
+type stubHttp struct {
+	status    int
+	header    http.Header
+	responses []string
+	// 并发测试中多个goroutine同时发出请求
+	mu       sync.Mutex
+	requests []stubRequest
+}
+
+type stubRequest struct {
+	method  string
+	url     string
+	headers map[string]string
+	body    []byte
+}
+
+// 固定时间的时钟
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time { return time.Time(c) }
+
+func newStubHttp(responses ...string) *stubHttp {
+	return &stubHttp{status: http.StatusOK, responses: responses}
+}
+
+func (s *stubHttp) Get(ctx context.Context, url string, f HandlerFunc) error {
+	return s.Do(ctx, http.MethodGet, url, nil, nil, f)
+}
+
+func (s *stubHttp) Post(ctx context.Context, url, contentType string, body io.Reader, f HandlerFunc) error {
+	return s.Do(ctx, http.MethodPost, url, map[string]string{"Content-Type": contentType}, body, f)
+}
+
+func (s *stubHttp) PostJSON(ctx context.Context, url string, body io.Reader, f HandlerFunc) error {
+	return s.Post(ctx, url, contentTypeJSON, body, f)
+}
+
+func (s *stubHttp) PostXML(ctx context.Context, url string, body io.Reader, f HandlerFunc) error {
+	return s.Post(ctx, url, contentTypeXML, body, f)
+}
+
+func (s *stubHttp) Do(ctx context.Context, method, url string, headers map[string]string, body io.Reader, f HandlerFunc) error {
+	req := stubRequest{method: method, url: url, headers: headers}
+	if body != nil {
+		buf, err := ioutil.ReadAll(body)
+		if err != nil {
+			return err
+		}
+		req.body = buf
+	}
+	s.mu.Lock()
+	s.requests = append(s.requests, req)
+	var resp string
+	if n := len(s.requests); n <= len(s.responses) {
+		resp = s.responses[n-1]
+	} else if len(s.responses) > 0 {
+		resp = s.responses[len(s.responses)-1]
+	}
+	s.mu.Unlock()
+	header := s.header
+	if header == nil {
+		header = http.Header{}
+	}
+	return f(&http.Response{
+		StatusCode: s.status,
+		Header:     header,
+		Body:       ioutil.NopCloser(bytes.NewBufferString(resp)),
+	}, nil)
+}
+
+func (s *stubHttp) last() stubRequest {
+	return s.requests[len(s.requests)-1]
+}
+
+// 将一层的XML解析成参数表，用于校验发出的请求内容
+func parseXMLParams(t *testing.T, buf []byte) map[string]string {
+	params := make(map[string]string)
+	decoder := xml.NewDecoder(bytes.NewReader(buf))
+	var name string
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return params
+		}
+		if !assert.Nil(t, err) {
+			return params
+		}
+		switch tok := token.(type) {
+		case xml.StartElement:
+			name = tok.Name.Local
+		case xml.CharData:
+			if name != "" && name != "xml" {
+				params[name] += string(tok)
+			}
+		case xml.EndElement:
+			name = ""
+		}
+	}
+}
+
+// 按微信的签名规则计算签名：去掉sign和空值，按参数名排序后拼接key，
+// 根据sign_type做MD5或HMAC-SHA256
+func expectedSign(params map[string]string, key string) string {
+	values := make(map[string]string, len(params))
+	for k, v := range params {
+		if k != "sign" {
+			values[k] = v
+		}
+	}
+	paramStr, _ := GenParamStr(values)
+	if params["sign_type"] == SignTypeHMACSHA256 {
+		return HashHmacSha256(paramStr+"&key="+key, key)
+	}
+	return HashMd5(paramStr + "&key=" + key)
+}
+
+// 解析发出的XML请求并校验签名与请求内容一致，返回请求参数
+func assertSignedRequest(t *testing.T, req stubRequest, key string) map[string]string {
+	params := parseXMLParams(t, req.body)
+	assert.NotEmpty(t, params["sign"], "%s: missing sign", req.url)
+	assert.Equal(t, expectedSign(params, key), params["sign"], "%s: sign mismatch", req.url)
+	return params
+}
+
+func TestWxService_Prepare(t *testing.T) {
+	w := wxService{appId: "wx123", mchId: "1230000109", key: "key", logger: zapLogger}
+
+	unified := &UnifiedOrderReq{OutTradeNo: "T1", TotalFee: 1, Sign: "stale"}
+	query := &QueryOrderReq{OutTradeNo: "T1"}
+	closeReq := &CloseOrderReq{OutTradeNo: "T1"}
+	pay := &MchPayReq{PartnerTradeNO: "T1", Amount: 100}
+	payment := &mchPaymentQueryReq{PartnerTradeNO: "T1"}
+	refund := &MchPayRefundReq{OutRefundNo: "R1", TotalFee: 100, RefundFee: 100}
+
+	// fields 返回请求中的 appid、商户号、随机字符串和签名
+	tests := []struct {
+		name   string
+		req    Signable
+		fields func() (string, string, string, string)
+	}{
+		{"UnifiedOrderReq", unified, func() (string, string, string, string) {
+			return unified.AppId, unified.MchId, unified.NonceStr, unified.Sign
+		}},
+		{"QueryOrderReq", query, func() (string, string, string, string) {
+			return query.AppID, query.MchID, query.NonceStr, query.Sign
+		}},
+		{"CloseOrderReq", closeReq, func() (string, string, string, string) {
+			return closeReq.AppId, closeReq.MchId, closeReq.NonceStr, closeReq.Sign
+		}},
+		{"MchPayReq", pay, func() (string, string, string, string) {
+			return pay.MchAppID, pay.MchID, pay.NonceStr, pay.Sign
+		}},
+		{"mchPaymentQueryReq", payment, func() (string, string, string, string) {
+			return payment.MchAppID, payment.MchID, payment.NonceStr, payment.Sign
+		}},
+		{"MchPayRefundReq", refund, func() (string, string, string, string) {
+			return refund.AppID, refund.MchID, refund.NonceStr, refund.Sign
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Nil(t, w.prepare(context.Background(), test.req))
+			appId, mchId, nonceStr, sign := test.fields()
+			assert.Equal(t, "wx123", appId)
+			assert.Equal(t, "1230000109", mchId)
+			assert.Len(t, nonceStr, 32)
+			assertSigned(t, w, test.req, sign)
+		})
+	}
+}
+
+func TestWxService_SignXMLFieldNames(t *testing.T) {
+	// QueryOrderReq的xml标签为mch_id，json标签为mchid，签名需要和发送的XML一致
+	client := newStubHttp(`<xml><return_code>SUCCESS</return_code><result_code>SUCCESS</result_code></xml>`)
+	s := newTestPay(client)
+	_, err := s.ReqQueryOrder(context.Background(), "1217752501201407033233368018")
+	assert.Nil(t, err)
+	params := assertSignedRequest(t, client.last(), s.key)
+	assert.Equal(t, "10000100", params["mch_id"])
+	assert.NotContains(t, params, "mchid")
+
+	signParams, err := SignParams(&QueryOrderReq{AppID: "wx2421b1c4370ec43b", MchID: "10000100", OutTradeNo: "T1", Sign: "stale"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"appid": "wx2421b1c4370ec43b", "mch_id": "10000100", "out_trade_no": "T1"}, signParams)
+
+	// 整数字段没有json的string选项时也按发送的值签名
+	signParams, err = SignParams(&struct {
+		XMLName  xml.Name `xml:"xml"`
+		TotalFee int64    `xml:"total_fee"`
+		Body     string   `xml:"body"`
+	}{TotalFee: 1, Body: "a&b"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"total_fee": "1", "body": "a&b"}, signParams)
+}
+
+// 清空签名后重新计算，确认与请求中的签名一致
+func assertSigned(t *testing.T, w wxService, req Signable, sign string) {
+	assert.NotEmpty(t, sign)
+	req.SetSign("")
+	expected, err := w.sign(context.Background(), req)
+	req.SetSign(sign)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, sign)
+}
+
+func TestWxService_GzipRequest(t *testing.T) {
+	client := newStubHttp(`<xml><return_code>SUCCESS</return_code><result_code>SUCCESS</result_code></xml>`)
+	s := newTestMch(client)
+	s.SetGzipThreshold(1024)
+
+	// v2的XML接口即使超过阈值也不压缩
+	req := &ProfitSharingAddReceiverReq{}
+	assert.Nil(t, req.SetReceiver(ProfitSharingReceiver{
+		Type:           ReceiverTypeMerchantId,
+		Account:        "190001001",
+		Name:           strings.Repeat("示例商户", 100),
+		RelationType:   "CUSTOM",
+		CustomRelation: strings.Repeat("合作方", 50),
+	}))
+	_, err := s.ReqProfitSharingAddReceiver(context.Background(), req)
+	assert.Nil(t, err)
+
+	sent := client.last()
+	assert.True(t, len(sent.body) > 1024)
+	assert.NotContains(t, sent.headers, "Content-Encoding")
+	assert.Equal(t, strconv.Itoa(len(sent.body)), sent.headers["Content-Length"])
+	params := parseXMLParams(t, sent.body)
+	assert.Equal(t, req.Receiver, params["receiver"])
+	assert.Equal(t, expectedSign(params, s.key), params["sign"])
+}
+
+func TestWxService_SignQuery(t *testing.T) {
+	s := newTestPay(nil)
+	// 微信签名文档中的示例
+	query := s.SignQuery(map[string]string{
+		"appid":       "wxd930ea5d5a258f4f",
+		"mch_id":      "10000100",
+		"device_info": "1000",
+		"body":        "test",
+		"nonce_str":   "ibuaiVcKdpRxkhJA",
+		"sign":        "IGNORED",
+		"attach":      "",
+	})
+	assert.Equal(t, "appid=wxd930ea5d5a258f4f&body=test&device_info=1000&mch_id=10000100&nonce_str=ibuaiVcKdpRxkhJA&sign=9A0A8659F005D6984697E2CA0A9CF3B7", query)
+}
+
+func TestWxService_SignIgnoresSignField(t *testing.T) {
+	w := wxService{key: "192006250b4c09247ec02edce69f6a2d", logger: zapLogger}
+	tests := []struct {
+		name       string
+		clean, old interface{}
+	}{
+		{"UnifiedOrderReq", &UnifiedOrderReq{OutTradeNo: "T1", TotalFee: 1}, &UnifiedOrderReq{OutTradeNo: "T1", TotalFee: 1, Sign: "STALE"}},
+		{"QueryOrderReq", &QueryOrderReq{OutTradeNo: "T1"}, &QueryOrderReq{OutTradeNo: "T1", Sign: "STALE"}},
+		{"MchPayRefundReq", &MchPayRefundReq{OutRefundNo: "R1", TotalFee: 100, RefundFee: 100}, &MchPayRefundReq{OutRefundNo: "R1", TotalFee: 100, RefundFee: 100, Sign: "STALE"}},
+		{"PrepayReturn", &PrepayReturn{AppId: "wx2421b1c4370ec43b", Package: "prepay_id=1"}, &PrepayReturn{AppId: "wx2421b1c4370ec43b", Package: "prepay_id=1", PaySign: "STALE"}},
+		{"map", map[string]string{"appid": "wx2421b1c4370ec43b"}, map[string]string{"appid": "wx2421b1c4370ec43b", "sign": "STALE"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			paramStr, _, err := signString(context.Background(), test.old)
+			assert.Nil(t, err)
+			assert.NotContains(t, paramStr, "STALE")
+			expected, err := w.sign(context.Background(), test.clean)
+			assert.Nil(t, err)
+			sign, err := w.sign(context.Background(), test.old)
+			assert.Nil(t, err)
+			assert.Equal(t, expected, sign)
+			assert.NotContains(t, debugSignString(test.old), "STALE")
+		})
+	}
+}
+
+func TestWxService_WithSignType(t *testing.T) {
+	client := newStubHttp(`<xml><return_code>SUCCESS</return_code><result_code>SUCCESS</result_code></xml>`)
+	s := newTestPay(client)
+
+	_, err := s.ReqQueryOrder(context.Background(), "T1")
+	assert.Nil(t, err)
+	params := parseXMLParams(t, client.last().body)
+	assert.Equal(t, SignTypeMD5, params["sign_type"])
+	assert.Equal(t, expectedSign(params, s.key), params["sign"])
+
+	ctx := WithSignType(context.Background(), SignTypeHMACSHA256)
+	_, err = s.ReqQueryOrder(ctx, "T1")
+	assert.Nil(t, err)
+	params = parseXMLParams(t, client.last().body)
+	assert.Equal(t, SignTypeHMACSHA256, params["sign_type"])
+	assert.Equal(t, expectedSign(params, s.key), params["sign"])
+
+	// 通知中没有sign_type时按context中的签名类型校验
+	notify := &NotifyReq{ReturnCode: "SUCCESS", OutTradeNo: "T1", TotalFee: "1"}
+	notify.Sign = HashHmacSha256("out_trade_no=T1&return_code=SUCCESS&total_fee=1&key="+s.key, s.key)
+	assert.False(t, s.VerifySign(context.Background(), notify))
+	assert.True(t, s.VerifySign(ctx, notify))
+
+	prepay, err := s.GenPrepay(ctx, "wx201410272009395522657a690389285100", "5K8264ILTKCH16CQ2502SI8ZNMTM67VS")
+	assert.Nil(t, err)
+	assert.Equal(t, SignTypeHMACSHA256, prepay.SignType)
+}
+
+func TestWxService_TruncatedXML(t *testing.T) {
+	full := `<xml><return_code>SUCCESS</return_code><result_code>SUCCESS</result_code><trade_state>SUCCESS</trade_state></xml>`
+	for _, body := range []string{
+		"",
+		full[:len(full)-6],
+		full[:len(full)-1],
+		`<xml><return_code>SUCCESS</return_code><result_code>SUCC`,
+	} {
+		_, err := newTestPay(newStubHttp(body)).ReqQueryOrder(context.Background(), "T1")
+		assert.True(t, errors.Is(err, ErrTruncatedXML), "body %q: err = %v", body, err)
+	}
+
+	resp, err := newTestPay(newStubHttp(full+"\n")).ReqQueryOrder(context.Background(), "T1")
+	assert.Nil(t, err)
+	assert.Equal(t, TradeStateSuccess, resp.TradeState)
+}
+
+func TestWxService_JSONErrorOnXMLEndpoint(t *testing.T) {
+	client := newStubHttp(` {"errcode":-1,"errmsg":"system error"}`)
+	_, err := newTestPay(client).ReqQueryOrder(context.Background(), "T1")
+	assert.True(t, errors.Is(err, ErrJSONResponse), "err = %v", err)
+	assert.False(t, errors.Is(err, ErrTruncatedXML))
+	var jsonErr *JSONError
+	assert.True(t, errors.As(err, &jsonErr))
+	assert.Equal(t, -1, jsonErr.ErrCode)
+	assert.Equal(t, "system error", jsonErr.ErrMsg)
+
+	// 不是合法的JSON时保留响应内容
+	_, err = newTestPay(newStubHttp(`{"errcode":`)).ReqQueryOrder(context.Background(), "T1")
+	assert.True(t, errors.As(err, &jsonErr), "err = %v", err)
+	assert.Equal(t, `{"errcode":`, jsonErr.ErrMsg)
+}
+
+// 记录同时进行中的请求数
+type concurrentHttp struct {
+	*stubHttp
+	inFlight, maxInFlight int32
+}
+
+func (c *concurrentHttp) Do(ctx context.Context, method, url string, headers map[string]string, body io.Reader, f HandlerFunc) error {
+	n := atomic.AddInt32(&c.inFlight, 1)
+	defer atomic.AddInt32(&c.inFlight, -1)
+	for {
+		max := atomic.LoadInt32(&c.maxInFlight)
+		if n <= max || atomic.CompareAndSwapInt32(&c.maxInFlight, max, n) {
+			break
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+	return c.stubHttp.Do(ctx, method, url, headers, body, f)
+}
+
+func TestWxService_MaxConcurrency(t *testing.T) {
+	client := &concurrentHttp{stubHttp: newStubHttp(`<xml><return_code>SUCCESS</return_code><result_code>SUCCESS</result_code><prepay_id>wx201410272009395522657a690389285100</prepay_id></xml>`)}
+	s := newTestPay(client)
+	s.SetMaxConcurrency(2)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := &UnifiedOrderReq{OutTradeNo: "T" + strconv.Itoa(i), TotalFee: 1}
+			_, err := s.ReqUnifiedOrder(context.Background(), req)
+			assert.Nil(t, err)
+		}(i)
+	}
+	wg.Wait()
+	assert.Len(t, client.requests, 10)
+	assert.EqualValues(t, 2, client.maxInFlight)
+	// 并发请求各自生成随机字符串并签名
+	nonces := make(map[string]bool)
+	for _, sent := range client.requests {
+		nonces[assertSignedRequest(t, sent, s.key)["nonce_str"]] = true
+	}
+	assert.Len(t, nonces, 10)
+
+	// 达到上限时等待，context结束后返回
+	s.limiter <- struct{}{}
+	s.limiter <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := s.ReqQueryOrder(ctx, "T1")
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Len(t, client.requests, 10)
+}
+
+func TestWxService_LogResponseBody(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+	s := newTestPay(newStubHttp())
+	s.logger = zap.New(core)
+	read := func(body string) {
+		_, err := s.readBody(&http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(body))})
+		assert.Nil(t, err)
+	}
+
+	// 默认不记录
+	read("<xml></xml>")
+	assert.Equal(t, 0, logs.Len())
+
+	s.SetMaxLoggedBodyBytes(19)
+	read("<xml></xml>")
+	read("<xml><return_msg>签名错误</return_msg></xml>")
+	read("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	entries := logs.TakeAll()
+	assert.Len(t, entries, 3)
+	assert.Equal(t, "<xml></xml>", entries[0].ContextMap()["body"])
+	assert.Equal(t, "<xml><return_msg>...<truncated, 48 bytes>", entries[1].ContextMap()["body"], "cut before a multi-byte rune")
+	assert.Equal(t, "<16 bytes, binary>", entries[2].ContextMap()["body"])
+	assert.Equal(t, zap.DebugLevel, entries[2].Level)
+}
+
+func TestWxService_SetLogger(t *testing.T) {
+	// 通过导出的构造函数创建，确认设置的logger在各个服务上生效
+	core, logs := observer.New(zap.InfoLevel)
+	pay := NewWxPayService(&PayConfig{AppId: "wx2421b1c4370ec43b", MchId: "10000100", ApiKey: "192006250b4c09247ec02edce69f6a2d"}, newStubHttp(`<xml><return_code>SUCCESS</return_code><result_code>SUCCESS</result_code></xml>`))
+	pay.SetLogger(zap.New(core))
+	_, err := pay.ReqQueryOrder(context.Background(), "1217752501201407033233368018")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, logs.FilterMessage("[wx] request").Len())
+
+	mini := NewWxMiniService(&MiniConfig{AppId: "wx2421b1c4370ec43b", AppSecret: "secret"}, newStubHttp(`{"openid":"oUpF8uMuAJO_M2pxb1Q9zNjWeS6o","session_key":"key"}`))
+	mini.SetLogger(zap.New(core))
+	_, err = mini.ReqCode2Session(context.Background(), "code")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, logs.FilterMessage("[wx] request").Len())
+
+	mch := newTestMch(newStubHttp(`<xml><return_code>SUCCESS</return_code><result_code>SUCCESS</result_code></xml>`))
+	mch.SetLogger(zap.New(core))
+	_, err = mch.ReqMchPayment(context.Background(), "1217752501201407033233368018")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, logs.FilterMessage("[wx] request").Len())
+
+	// 为nil时恢复默认的logger
+	pay.SetLogger(nil)
+	assert.Equal(t, zapLogger, pay.logger)
+}
+
+func TestWithLogger(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	cfg := &PayConfig{AppId: "wx2421b1c4370ec43b", MchId: "10000100", ApiKey: "192006250b4c09247ec02edce69f6a2d"}
+	pay := NewWxPayService(cfg, newStubHttp(`<xml><return_code>SUCCESS</return_code><result_code>SUCCESS</result_code></xml>`), WithLogger(zap.New(core)))
+	// 构造函数中的日志也使用指定的logger
+	assert.Equal(t, 1, logs.FilterMessage("init wx pay service success...").Len())
+	_, err := pay.ReqQueryOrder(context.Background(), "1217752501201407033233368018")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, logs.FilterMessage("[wx] request").Len())
+
+	nop := zap.NewNop()
+	assert.Equal(t, nop, NewWxPayService(cfg, nil, WithLogger(nop)).logger)
+	assert.Equal(t, nop, NewWxMiniService(&MiniConfig{AppId: "wx2421b1c4370ec43b", AppSecret: "secret"}, nil, WithLogger(nop)).logger)
+	assert.Equal(t, nop, NewWxMchService(&MchConfig{AppId: "wx2421b1c4370ec43b", MchId: "10000100", ApiKey: "192006250b4c09247ec02edce69f6a2d"}, WithLogger(nop)).logger)
+
+	// 没有指定时使用默认的logger
+	assert.Equal(t, zapLogger, NewWxPayService(cfg, nil).logger)
+	assert.Equal(t, zapLogger, NewWxPayService(cfg, nil, WithLogger(nil)).logger)
+}
+
+func TestWxService_SetLogBodies(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+	body := `<xml><return_code>SUCCESS</return_code><result_code>SUCCESS</result_code><openid>oUpF8uMuAJO_M2pxb1Q9zNjWeS6o</openid></xml>`
+	s := newTestPay(newStubHttp(body, body))
+	s.SetLogger(zap.New(core))
+
+	// 默认不记录请求和响应的内容
+	_, err := s.ReqQueryOrder(context.Background(), "1217752501201407033233368018")
+	assert.Nil(t, err)
+	request := logs.FilterMessage("[wx] request").TakeAll()
+	if assert.Len(t, request, 1) {
+		assert.Equal(t, queryOrderUrl, request[0].ContextMap()["url"])
+		assert.NotContains(t, request[0].ContextMap(), "body")
+	}
+	query := logs.FilterMessage("[wxpay] query order").TakeAll()
+	if assert.Len(t, query, 1) {
+		assert.NotContains(t, query[0].ContextMap(), "resp")
+	}
+	for _, entry := range logs.TakeAll() {
+		assert.NotContains(t, fmt.Sprint(entry.ContextMap()), "1217752501201407033233368018", entry.Message)
+	}
+
+	s.SetLogBodies(true)
+	_, err = s.ReqQueryOrder(context.Background(), "1217752501201407033233368018")
+	assert.Nil(t, err)
+	request = logs.FilterMessage("[wx] request").TakeAll()
+	if assert.Len(t, request, 1) {
+		assert.Contains(t, request[0].ContextMap(), "body")
+	}
+	query = logs.FilterMessage("[wxpay] query order").TakeAll()
+	if assert.Len(t, query, 1) {
+		assert.Contains(t, fmt.Sprint(query[0].ContextMap()["resp"]), "return_code=SUCCESS")
+	}
+
+	assert.True(t, NewWxPayService(&PayConfig{}, nil, WithLogger(zap.NewNop()), WithLogBodies(true)).logBodies)
+}
+
+func TestWxService_WithSigner(t *testing.T) {
+	client := newStubHttp(`<xml><return_code>SUCCESS</return_code><result_code>SUCCESS</result_code></xml>`)
+	s := newTestPay(client)
+
+	var signed []string
+	ctx := WithSigner(context.Background(), SignerFunc(func(ctx context.Context, paramStr, signType string) (string, error) {
+		assert.NotContains(t, paramStr, "key=")
+		signed = append(signed, paramStr)
+		return "REMOTE" + signType, nil
+	}))
+	_, err := s.ReqQueryOrder(ctx, "T1")
+	assert.Nil(t, err)
+	params := parseXMLParams(t, client.last().body)
+	assert.Equal(t, "REMOTE"+SignTypeMD5, params["sign"])
+	if assert.Len(t, signed, 1) {
+		assert.Contains(t, signed[0], "out_trade_no=T1")
+	}
+
+	// Signer返回的错误直接返回，不发送请求
+	ctx = WithSigner(context.Background(), SignerFunc(func(ctx context.Context, paramStr, signType string) (string, error) {
+		return "", errors.New("signer unavailable")
+	}))
+	_, err = s.ReqQueryOrder(ctx, "T1")
+	assert.EqualError(t, err, "signer unavailable")
+	assert.Len(t, client.requests, 1)
+
+	// 没有Signer时使用API密钥
+	_, err = s.ReqQueryOrder(context.Background(), "T1")
+	assert.Nil(t, err)
+	params = parseXMLParams(t, client.last().body)
+	assert.Equal(t, expectedSign(params, s.key), params["sign"])
+}
+
+func TestWxService_MissingApiKey(t *testing.T) {
+	client := newStubHttp(`<xml><return_code>SUCCESS</return_code><result_code>SUCCESS</result_code></xml>`)
+	s := NewWxPayService(&PayConfig{AppId: "wx2421b1c4370ec43b", MchId: "10000100"}, client)
+
+	_, err := s.ReqQueryOrder(context.Background(), "T1")
+	assert.True(t, errors.Is(err, ErrMissingApiKey), "err = %v", err)
+	_, err = s.GenPrepay(context.Background(), "wx201410272009395522657a690389285100", "")
+	assert.True(t, errors.Is(err, ErrMissingApiKey), "err = %v", err)
+	assert.Len(t, client.requests, 0)
+	assert.Equal(t, "", s.SignQuery(map[string]string{"mch_id": "10000100"}))
+
+	mch := newTestMch(client)
+	mch.key = ""
+	_, err = mch.SignRequest(context.Background(), &MchPayReq{PartnerTradeNO: "T1"})
+	assert.True(t, errors.Is(err, ErrMissingApiKey), "err = %v", err)
+
+	// 通知签名无法校验
+	notify := newTestNotify()
+	notify.Sign = HashMd5("appid=wx2421b1c4370ec43b&key=")
+	assert.False(t, s.VerifySign(context.Background(), notify))
+}
+
+func TestWxService_CDATAFields(t *testing.T) {
+	ok := `<xml><return_code>SUCCESS</return_code><result_code>SUCCESS</result_code><prepay_id>wx201410272009395522657a690389285100</prepay_id></xml>`
+	client := newStubHttp(ok)
+	s := newTestPay(client)
+	s.SetCDATAFields("body", "attach")
+
+	req := &UnifiedOrderReq{OutTradeNo: "T1", TotalFee: 1, Body: "腾讯充值中心-QQ会员充值 <VIP> & more", Attach: "a]]>b"}
+	_, err := s.ReqUnifiedOrder(context.Background(), req)
+	assert.Nil(t, err)
+	body := string(client.last().body)
+	assert.Contains(t, body, "<body><![CDATA[腾讯充值中心-QQ会员充值 <VIP> & more]]></body>")
+	assert.Contains(t, body, "<attach><![CDATA[a]]]]><![CDATA[>b]]></attach>")
+	assert.Contains(t, body, "<out_trade_no>T1</out_trade_no>")
+
+	// 签名基于原始的值
+	params := parseXMLParams(t, client.last().body)
+	assert.Equal(t, req.Body, params["body"])
+	assert.Equal(t, req.Attach, params["attach"])
+	assert.Equal(t, expectedSign(params, s.key), params["sign"])
+
+	s.SetCDATAFields()
+	_, err = s.ReqUnifiedOrder(context.Background(), &UnifiedOrderReq{OutTradeNo: "T2", TotalFee: 1, Body: "a&b"})
+	assert.Nil(t, err)
+	assert.Contains(t, string(client.last().body), "<body>a&amp;b</body>")
+}
@@ -0,0 +1,433 @@
+package wechat
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	downloadBillUrl = "https://api.mch.weixin.qq.com/pay/downloadbill"
+
+	BillTypeAll     = "ALL"
+	BillTypeSuccess = "SUCCESS"
+	BillTypeRefund  = "REFUND"
+
+	// 压缩账单
+	TarTypeGZIP = "GZIP"
+
+	billDateLayout = "20060102"
+	// 微信只保留最近三个月的对账单
+	billRetentionMonths = 3
+	// 对账单不完整时默认重新下载的次数
+	defaultBillRetries = 2
+	// 对账单汇总部分的第一列标题
+	billSummaryTitle = "总交易单数"
+)
+
+var (
+	ErrInvalidBillDate  = errors.New("[gowechat] invalid bill date")
+	ErrDownloadBillFail = errors.New("[gowechat] download bill failed")
+	ErrBillIncomplete   = errors.New("[gowechat] bill incomplete")
+)
+
+type (
+	DownloadBillReq struct {
+		XMLName  xml.Name `xml:"xml" json:"-"`
+		AppId    string   `xml:"appid" json:"appid"`
+		MchId    string   `xml:"mch_id" json:"mch_id"`
+		NonceStr string   `xml:"nonce_str" json:"nonce_str"`
+		Sign     string   `xml:"sign" json:"sign"`
+		SignType string   `xml:"sign_type" json:"sign_type"`
+		BillDate string   `xml:"bill_date" json:"bill_date"` //对账单日期，格式：20140603
+		BillType string   `xml:"bill_type" json:"bill_type"` //账单类型，ALL、SUCCESS、REFUND
+		TarType  string   `xml:"tar_type" json:"tar_type"`   //压缩账单，传GZIP时返回.gzip格式的压缩包
+	}
+
+	// 解析后的对账单，金额单位为分
+	BillResult struct {
+		Header  []string    //明细的表头
+		Rows    []BillRow   //明细
+		Summary BillSummary //汇总
+	}
+
+	// 对账单中的一笔明细，不同bill_type的列不完全相同，没有的列为零值
+	// 所有列按表头保存在Fields中，值去掉了微信加在前面的`
+	BillRow struct {
+		TradeTime          string //交易时间
+		AppId              string //公众账号ID
+		MchId              string //商户号
+		SubMchId           string //特约商户号
+		DeviceInfo         string //设备号
+		TransactionId      string //微信订单号
+		OutTradeNo         string //商户订单号
+		OpenId             string //用户标识
+		TradeType          string //交易类型
+		TradeState         string //交易状态
+		BankType           string //付款银行
+		FeeType            string //货币种类
+		SettlementTotalFee int64  //应结订单金额
+		CouponFee          int64  //代金券金额
+		RefundId           string //微信退款单号
+		OutRefundNo        string //商户退款单号
+		RefundFee          int64  //退款金额
+		RefundStatus       string //退款状态
+		Body               string //商品名称
+		Attach             string //商户数据包
+		PoundageFee        int64  //手续费
+		Rate               string //费率
+		TotalFee           int64  //订单金额
+		ApplyRefundFee     int64  //申请退款金额
+		Fields             map[string]string
+	}
+
+	// 对账单的汇总
+	BillSummary struct {
+		TotalCount         int64 //总交易单数
+		SettlementTotalFee int64 //应结订单总金额
+		RefundFee          int64 //退款总金额
+		CouponRefundFee    int64 //充值券退款总金额
+		PoundageFee        int64 //手续费总金额
+		TotalFee           int64 //订单总金额
+		ApplyRefundFee     int64 //申请退款总金额
+		Fields             map[string]string
+	}
+
+	// 下载失败时微信返回XML格式的错误信息
+	downloadBillErrorResp struct {
+		XMLName    xml.Name `xml:"xml"`
+		ReturnCode string   `xml:"return_code"`
+		ReturnMsg  string   `xml:"return_msg"`
+		ErrCode    string   `xml:"error_code"`
+	}
+)
+
+func (r *DownloadBillReq) SetAppId(appId string)       { r.AppId = appId }
+func (r *DownloadBillReq) SetMchId(mchId string)       { r.MchId = mchId }
+func (r *DownloadBillReq) SetNonceStr(nonceStr string) { r.NonceStr = nonceStr }
+func (r *DownloadBillReq) SetSign(sign string)         { r.Sign = sign }
+func (r *DownloadBillReq) SetSignType(signType string) { r.SignType = signType }
+
+// 设置对账单日期，参数说明见 NormalizeBillDate
+func (r *DownloadBillReq) SetBillDate(date interface{}) error {
+	billDate, err := NormalizeBillDate(date)
+	if err != nil {
+		return err
+	}
+	r.BillDate = billDate
+	return nil
+}
+
+// 将对账单日期转换成微信要求的 yyyyMMdd 格式（北京时间）
+// date 可以是 time.Time，或者 20060102、2006-01-02 格式的字符串
+// 晚于今天或者超出微信保留期限（三个月）的日期会返回 ErrInvalidBillDate
+func NormalizeBillDate(date interface{}) (string, error) {
+	loc := wxLocation()
+
+	var (
+		day time.Time
+		err error
+	)
+	switch v := date.(type) {
+	case time.Time:
+		day = v.In(loc)
+	case string:
+		for _, layout := range []string{billDateLayout, "2006-01-02"} {
+			if day, err = time.ParseInLocation(layout, v, loc); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return "", fmt.Errorf("%w: %q", ErrInvalidBillDate, v)
+		}
+	default:
+		return "", fmt.Errorf("%w: unsupported type %T", ErrInvalidBillDate, date)
+	}
+	day = time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, loc)
+
+	now := time.Now().In(loc)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	if day.After(today) {
+		return "", fmt.Errorf("%w: %s is in the future", ErrInvalidBillDate, day.Format(billDateLayout))
+	}
+	if day.Before(today.AddDate(0, -billRetentionMonths, 0)) {
+		return "", fmt.Errorf("%w: %s is older than %d months", ErrInvalidBillDate, day.Format(billDateLayout), billRetentionMonths)
+	}
+	return day.Format(billDateLayout), nil
+}
+
+func (r *downloadBillErrorResp) result() payResult {
+	return payResult{r.ReturnCode, r.ReturnMsg, "", r.ErrCode, "", "", ""}
+}
+
+// 下载对账单，返回CSV格式的原始内容，bill_type为空时下载所有订单
+// 下载时和微信协商gzip压缩传输，返回的是解压后的内容
+// 微信不支持断点续传，汇总中的总交易单数和实际行数不一致时认为下载不完整，重新下载，次数见 SetBillRetries
+// 接口文档：https://pay.weixin.qq.com/wiki/doc/api/jsapi.php?chapter=9_6
+func (w wxPay) ReqDownloadBillData(ctx context.Context, req *DownloadBillReq) ([]byte, error) {
+	if req.BillType == "" {
+		req.BillType = BillTypeAll
+	}
+	if err := w.prepare(ctx, req); err != nil {
+		return nil, err
+	}
+	return w.downloadBill(ctx, downloadBillUrl, req, req.BillDate, func(data []byte) error {
+		// 压缩账单是gzip文件，不检查内容
+		if req.TarType != "" {
+			return nil
+		}
+		return checkBillComplete(data)
+	})
+}
+
+// 设置对账单、资金账单不完整时重新下载的次数，默认2次，为0时不重试
+func (w *wxService) SetBillRetries(n int) {
+	w.billRetries = n
+}
+
+// 下载对账单或资金账单，req是已经签名的请求，check检查下载的内容是否完整
+// 下载不完整（ErrBillIncomplete）时重新下载，次数见 SetBillRetries
+func (w wxService) downloadBill(ctx context.Context, url string, req interface{}, billDate string, check func(data []byte) error) ([]byte, error) {
+	for attempt := 0; ; attempt++ {
+		data, err := w.downloadBillOnce(ctx, url, req, billDate, check)
+		if err == nil || !errors.Is(err, ErrBillIncomplete) || ctx.Err() != nil || attempt >= w.billRetries {
+			return data, err
+		}
+		w.logger.Warn("[wx] download bill incomplete, retry", zap.String("url", url), zap.String("bill_date", billDate), zap.Int("attempt", attempt+1), zap.Error(err))
+	}
+}
+
+func (w wxService) downloadBillOnce(ctx context.Context, url string, req interface{}, billDate string, check func(data []byte) error) ([]byte, error) {
+	var data []byte
+	if err := w.doReq(ctx, http.MethodPost, url, contentTypeXML, req, map[string]string{"Accept-Encoding": acceptEncodingGzip}, func(response *http.Response, err error) error {
+		if err != nil {
+			return err
+		}
+		data, err = w.readBody(response)
+		return err
+	}); err != nil {
+		// 压缩传输中断时解压会返回 io.ErrUnexpectedEOF
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, fmt.Errorf("%w: %v", ErrBillIncomplete, err)
+		}
+		return nil, err
+	}
+	if err := checkBillData(data); err != nil {
+		w.logger.Error("[wx] download bill", zap.String("url", url), zap.String("bill_date", billDate), zap.Error(err))
+		return nil, err
+	}
+	if err := check(data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// 成功时返回的是CSV，失败时是XML格式的错误信息
+func checkBillData(data []byte) error {
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("<xml>")) {
+		return nil
+	}
+	var resp downloadBillErrorResp
+	if err := xml.Unmarshal(data, &resp); err != nil {
+		return err
+	}
+	if err := checkPayResult(resp.result()); err != nil {
+		return err
+	}
+	// 当日没有交易时返回：No Bill Exist
+	return fmt.Errorf("%w: %s %s", ErrDownloadBillFail, resp.ErrCode, resp.ReturnMsg)
+}
+
+// 对账单由表头、明细、汇总表头和汇总组成，汇总的第一列是总交易单数
+// 缺少汇总、明细列数不对或者总交易单数和明细行数不一致时返回 ErrBillIncomplete
+func checkBillComplete(data []byte) error {
+	_, err := splitBill(data, billSummaryTitle)
+	return err
+}
+
+// 拆分后的账单，对账单和资金账单的格式相同
+type billSections struct {
+	header        []string
+	rows          [][]string
+	summaryHeader []string
+	summary       []string
+}
+
+// 把CSV格式的账单拆分成表头、明细、汇总表头和汇总，汇总表头的第一列为summaryTitle，对应的值是总笔数
+// 缺少汇总、明细列数不对或者总笔数和明细行数不一致时返回 ErrBillIncomplete
+func splitBill(data []byte, summaryTitle string) (*billSections, error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBillIncomplete, err)
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("%w: empty bill", ErrBillIncomplete)
+	}
+	bill := &billSections{header: records[0]}
+	for i := 1; i < len(records); i++ {
+		if records[i][0] != summaryTitle {
+			if len(records[i]) != len(bill.header) {
+				return nil, fmt.Errorf("%w: line %d has %d fields, want %d", ErrBillIncomplete, i+1, len(records[i]), len(bill.header))
+			}
+			bill.rows = append(bill.rows, records[i])
+			continue
+		}
+		if i+1 >= len(records) {
+			break
+		}
+		total, err := strconv.Atoi(strings.TrimPrefix(records[i+1][0], "`"))
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid summary %q", ErrBillIncomplete, records[i+1][0])
+		}
+		if rows := len(bill.rows); total != rows {
+			return nil, fmt.Errorf("%w: summary has %d rows, got %d", ErrBillIncomplete, total, rows)
+		}
+		bill.summaryHeader, bill.summary = records[i], records[i+1]
+		return bill, nil
+	}
+	return nil, fmt.Errorf("%w: missing summary", ErrBillIncomplete)
+}
+
+// 下载对账单并解析成明细和汇总，bill_type为空时下载所有订单
+// tar_type为GZIP时下载压缩账单，解压后解析，压缩账单不完整时不重新下载
+// 当日没有账单等失败情况返回 ErrDownloadBillFail
+func (w wxPay) ReqDownloadBill(ctx context.Context, req *DownloadBillReq) (*BillResult, error) {
+	data, err := w.ReqDownloadBillData(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if req.TarType == TarTypeGZIP {
+		if data, err = gunzipBill(data); err != nil {
+			return nil, err
+		}
+	}
+	return ParseBill(data)
+}
+
+func gunzipBill(data []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBillIncomplete, err)
+	}
+	defer zr.Close()
+	buf, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBillIncomplete, err)
+	}
+	return buf, nil
+}
+
+// 解析CSV格式的对账单，对账单的格式见 checkBillComplete
+// 缺少汇总或者总交易单数和明细行数不一致时返回 ErrBillIncomplete
+func ParseBill(data []byte) (*BillResult, error) {
+	bill, err := splitBill(data, billSummaryTitle)
+	if err != nil {
+		return nil, err
+	}
+	result := &BillResult{Header: bill.header}
+	for i, record := range bill.rows {
+		var row BillRow
+		if err := row.parse(bill.header, record); err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+2, err)
+		}
+		result.Rows = append(result.Rows, row)
+	}
+	if err := result.Summary.parse(bill.summaryHeader, bill.summary); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (r *BillRow) parse(header, record []string) error {
+	r.Fields = billFields(header, record)
+	for title, v := range map[string]*string{
+		"交易时间":   &r.TradeTime,
+		"公众账号ID": &r.AppId,
+		"商户号":    &r.MchId,
+		"特约商户号":  &r.SubMchId,
+		"设备号":    &r.DeviceInfo,
+		"微信订单号":  &r.TransactionId,
+		"商户订单号":  &r.OutTradeNo,
+		"用户标识":   &r.OpenId,
+		"交易类型":   &r.TradeType,
+		"交易状态":   &r.TradeState,
+		"付款银行":   &r.BankType,
+		"货币种类":   &r.FeeType,
+		"微信退款单号": &r.RefundId,
+		"商户退款单号": &r.OutRefundNo,
+		"退款状态":   &r.RefundStatus,
+		"商品名称":   &r.Body,
+		"商户数据包":  &r.Attach,
+		"费率":     &r.Rate,
+	} {
+		*v = r.Fields[title]
+	}
+	return parseBillFees(r.Fields, map[string]*int64{
+		"应结订单金额": &r.SettlementTotalFee,
+		"代金券金额":  &r.CouponFee,
+		"退款金额":   &r.RefundFee,
+		"手续费":    &r.PoundageFee,
+		"订单金额":   &r.TotalFee,
+		"申请退款金额": &r.ApplyRefundFee,
+	})
+}
+
+func (s *BillSummary) parse(header, record []string) error {
+	s.Fields = billFields(header, record)
+	total, err := strconv.ParseInt(s.Fields[billSummaryTitle], 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: invalid summary %q", ErrBillIncomplete, s.Fields[billSummaryTitle])
+	}
+	s.TotalCount = total
+	return parseBillFees(s.Fields, map[string]*int64{
+		"应结订单总金额":  &s.SettlementTotalFee,
+		"退款总金额":    &s.RefundFee,
+		"充值券退款总金额": &s.CouponRefundFee,
+		"手续费总金额":   &s.PoundageFee,
+		"订单总金额":    &s.TotalFee,
+		"申请退款总金额":  &s.ApplyRefundFee,
+	})
+}
+
+// 按表头整理一行的值，去掉微信为了防止Excel转换格式加在前面的`
+func billFields(header, record []string) map[string]string {
+	fields := make(map[string]string, len(header))
+	for i, title := range header {
+		if i < len(record) {
+			fields[title] = strings.TrimPrefix(record[i], "`")
+		}
+	}
+	return fields
+}
+
+// 对账单中的金额单位为元，转换成分，没有的列为0
+func parseBillFees(fields map[string]string, fees map[string]*int64) error {
+	for title, fee := range fees {
+		value, ok := fields[title]
+		if !ok || value == "" {
+			continue
+		}
+		yuan, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("%w: %s %q", ErrInvalidAmount, title, value)
+		}
+		*fee = int64(math.Round(yuan * 100))
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package wechat
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeBillDate(t *testing.T) {
+	loc, err := time.LoadLocation("Asia/Shanghai")
+	assert.Nil(t, err)
+	yesterday := time.Now().In(loc).AddDate(0, 0, -1)
+	expected := yesterday.Format("20060102")
+
+	for _, date := range []interface{}{yesterday, yesterday.UTC(), expected, yesterday.Format("2006-01-02")} {
+		billDate, err := NormalizeBillDate(date)
+		assert.Nil(t, err, "date = %v", date)
+		assert.Equal(t, expected, billDate)
+	}
+
+	tests := []struct {
+		Name string
+		Date interface{}
+	}{
+		{"future date", time.Now().In(loc).AddDate(0, 0, 2)},
+		{"too old date", time.Now().In(loc).AddDate(0, -4, 0).Format("20060102")},
+		{"malformed string", "2020/01/02"},
+		{"unsupported type", 20200102},
+	}
+	for _, test := range tests {
+		_, err := NormalizeBillDate(test.Date)
+		assert.True(t, errors.Is(err, ErrInvalidBillDate), "%s: err = %v", test.Name, err)
+	}
+}
+
+func TestDownloadBillReq_SetBillDate(t *testing.T) {
+	var req DownloadBillReq
+	assert.NotNil(t, req.SetBillDate("2000-01-01"))
+	assert.Equal(t, "", req.BillDate)
+
+	loc, err := time.LoadLocation("Asia/Shanghai")
+	assert.Nil(t, err)
+	assert.Nil(t, req.SetBillDate(time.Now().In(loc).Format("2006-01-02")))
+	assert.Len(t, req.BillDate, 8)
+}
+
+const testBillCSV = "交易时间,公众账号ID,商户号,特约商户号,设备号,微信订单号,商户订单号,用户标识,交易类型,交易状态,付款银行,货币种类,应结订单金额,代金券金额,微信退款单号,商户退款单号,退款金额,充值券退款金额,退款类型,退款状态,商品名称,商户数据包,手续费,费率,订单金额,申请退款金额,费率备注\r\n" +
+	"`2014-11-10 16:33:45,`wx2421b1c4370ec43b,`10000100,`0,`1000,`1001690740201411100005734289,`1415640626,`085e9858e3ba5186aafcbaed1,`JSAPI,`SUCCESS,`CFT,`CNY,`0.01,`0.0,`0,`0,`0,`0,`,`,`被扫支付测试,`订单额外描述,`0,`0.60%,`0.01,`0.00,`\r\n" +
+	"总交易单数,应结订单总金额,退款总金额,充值券退款总金额,手续费总金额,订单总金额,申请退款总金额\r\n" +
+	"`1,`0.01,`0.00,`0.00,`0,`0.01,`0.00\r\n"
+
+func TestWxPay_ReqDownloadBillData(t *testing.T) {
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write([]byte(testBillCSV))
+	zw.Close()
+
+	client := newStubHttp(compressed.String())
+	client.header = http.Header{"Content-Encoding": []string{"gzip"}}
+	s := newTestPay(client)
+	req := &DownloadBillReq{BillDate: "20141110"}
+	data, err := s.ReqDownloadBillData(context.Background(), req)
+	assert.Nil(t, err)
+	assert.Equal(t, testBillCSV, string(data))
+
+	sent := client.last()
+	assert.Equal(t, downloadBillUrl, sent.url)
+	assert.Equal(t, "gzip", sent.headers["Accept-Encoding"])
+	params := parseXMLParams(t, sent.body)
+	assert.Equal(t, BillTypeAll, params["bill_type"])
+	assert.Equal(t, expectedSign(params, s.key), params["sign"])
+
+	// 服务端没有压缩时直接读取
+	client = newStubHttp(testBillCSV)
+	data, err = newTestPay(client).ReqDownloadBillData(context.Background(), &DownloadBillReq{BillDate: "20141110"})
+	assert.Nil(t, err)
+	assert.Equal(t, testBillCSV, string(data))
+
+	client = newStubHttp(`<xml><return_code><![CDATA[FAIL]]></return_code><return_msg><![CDATA[No Bill Exist]]></return_msg><error_code><![CDATA[20002]]></error_code></xml>`)
+	_, err = newTestPay(client).ReqDownloadBillData(context.Background(), &DownloadBillReq{BillDate: "20141110"})
+	assert.True(t, errors.Is(err, ErrDownloadBillFail), "err = %v", err)
+	assert.Contains(t, err.Error(), "No Bill Exist")
+
+	// JSON接口不协商压缩
+	client = newStubHttp(`{"errcode":0,"errmsg":"ok"}`)
+	_, err = newTestMini(client).CheckMessage(context.Background(), "hello")
+	assert.Nil(t, err)
+	assert.Equal(t, "identity", client.last().headers["Accept-Encoding"])
+}
+
+func TestWxPay_ReqDownloadBillData_Incomplete(t *testing.T) {
+	// 第一次下载在明细中间中断，第二次下载完整
+	truncated := testBillCSV[:strings.Index(testBillCSV, "\r\n")+40]
+	client := newStubHttp(truncated, testBillCSV)
+	s := newTestPay(client)
+	data, err := s.ReqDownloadBillData(context.Background(), &DownloadBillReq{BillDate: "20141110"})
+	assert.Nil(t, err)
+	assert.Equal(t, testBillCSV, string(data))
+	assert.Len(t, client.requests, 2)
+	assert.Equal(t, client.requests[0].body, client.requests[1].body)
+
+	// 汇总的总交易单数和明细行数不一致
+	mismatch := strings.Replace(testBillCSV, "`1,`0.01", "`2,`0.01", 1)
+	client = newStubHttp(mismatch)
+	s = newTestPay(client)
+	_, err = s.ReqDownloadBillData(context.Background(), &DownloadBillReq{BillDate: "20141110"})
+	assert.True(t, errors.Is(err, ErrBillIncomplete), "err = %v", err)
+	assert.Len(t, client.requests, 1+defaultBillRetries)
+
+	client = newStubHttp(truncated)
+	s = newTestPay(client)
+	s.SetBillRetries(0)
+	_, err = s.ReqDownloadBillData(context.Background(), &DownloadBillReq{BillDate: "20141110"})
+	assert.True(t, errors.Is(err, ErrBillIncomplete), "err = %v", err)
+	assert.Len(t, client.requests, 1)
+}
+
+func TestWxPay_ReqDownloadBill(t *testing.T) {
+	client := newStubHttp(testBillCSV)
+	s := newTestPay(client)
+	bill, err := s.ReqDownloadBill(context.Background(), &DownloadBillReq{BillDate: "20141110", BillType: BillTypeSuccess})
+	assert.Nil(t, err)
+	assert.Equal(t, BillTypeSuccess, parseXMLParams(t, client.last().body)["bill_type"])
+	assert.Len(t, bill.Header, 27)
+	if assert.Len(t, bill.Rows, 1) {
+		row := bill.Rows[0]
+		assert.Equal(t, "2014-11-10 16:33:45", row.TradeTime)
+		assert.Equal(t, "wx2421b1c4370ec43b", row.AppId)
+		assert.Equal(t, "1001690740201411100005734289", row.TransactionId)
+		assert.Equal(t, "1415640626", row.OutTradeNo)
+		assert.Equal(t, "085e9858e3ba5186aafcbaed1", row.OpenId)
+		assert.Equal(t, "JSAPI", row.TradeType)
+		assert.Equal(t, "SUCCESS", row.TradeState)
+		assert.Equal(t, "被扫支付测试", row.Body)
+		assert.Equal(t, "0.60%", row.Rate)
+		assert.EqualValues(t, 1, row.SettlementTotalFee)
+		assert.EqualValues(t, 1, row.TotalFee)
+		assert.EqualValues(t, 0, row.RefundFee)
+		assert.Equal(t, "订单额外描述", row.Fields["商户数据包"])
+	}
+	assert.EqualValues(t, 1, bill.Summary.TotalCount)
+	assert.EqualValues(t, 1, bill.Summary.SettlementTotalFee)
+	assert.EqualValues(t, 1, bill.Summary.TotalFee)
+	assert.EqualValues(t, 0, bill.Summary.ApplyRefundFee)
+
+	// 压缩账单是gzip文件，解压后解析
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write([]byte(testBillCSV))
+	zw.Close()
+	client = newStubHttp(compressed.String())
+	bill, err = newTestPay(client).ReqDownloadBill(context.Background(), &DownloadBillReq{BillDate: "20141110", TarType: TarTypeGZIP})
+	assert.Nil(t, err)
+	assert.Equal(t, TarTypeGZIP, parseXMLParams(t, client.last().body)["tar_type"])
+	assert.Len(t, bill.Rows, 1)
+
+	_, err = newTestPay(newStubHttp(compressed.String()[:compressed.Len()/2])).ReqDownloadBill(context.Background(), &DownloadBillReq{BillDate: "20141110", TarType: TarTypeGZIP})
+	assert.True(t, errors.Is(err, ErrBillIncomplete), "err = %v", err)
+
+	// 压缩账单解压后由 ParseBill 检查总交易单数
+	compressed.Reset()
+	zw = gzip.NewWriter(&compressed)
+	zw.Write([]byte(strings.Replace(testBillCSV, "`1,`0.01", "`2,`0.01", 1)))
+	zw.Close()
+	_, err = newTestPay(newStubHttp(compressed.String())).ReqDownloadBill(context.Background(), &DownloadBillReq{BillDate: "20141110", TarType: TarTypeGZIP})
+	assert.True(t, errors.Is(err, ErrBillIncomplete), "err = %v", err)
+
+	// 失败时返回XML格式的错误信息
+	client = newStubHttp(`<xml><return_code><![CDATA[FAIL]]></return_code><return_msg><![CDATA[No Bill Exist]]></return_msg><error_code><![CDATA[20002]]></error_code></xml>`)
+	_, err = newTestPay(client).ReqDownloadBill(context.Background(), &DownloadBillReq{BillDate: "20141110"})
+	assert.True(t, errors.Is(err, ErrDownloadBillFail), "err = %v", err)
+}
+
+func TestParseBill(t *testing.T) {
+	bill, err := ParseBill([]byte("交易时间,退款金额,费率\r\n" +
+		"`2014-11-10 16:33:45,`12.34,`0.60%\r\n" +
+		"`2014-11-10 16:35:00,`0.5,`0.60%\r\n" +
+		"总交易单数,退款总金额\r\n" +
+		"`2,`12.84\r\n"))
+	assert.Nil(t, err)
+	assert.Len(t, bill.Rows, 2)
+	assert.EqualValues(t, 1234, bill.Rows[0].RefundFee)
+	assert.EqualValues(t, 50, bill.Rows[1].RefundFee)
+	assert.EqualValues(t, 0, bill.Rows[1].TotalFee)
+	assert.EqualValues(t, 2, bill.Summary.TotalCount)
+	assert.EqualValues(t, 1284, bill.Summary.RefundFee)
+
+	_, err = ParseBill([]byte("交易时间,退款金额\r\n`2014-11-10 16:33:45,`abc\r\n总交易单数\r\n`1\r\n"))
+	assert.True(t, errors.Is(err, ErrInvalidAmount), "err = %v", err)
+	_, err = ParseBill([]byte("交易时间,退款金额\r\n`2014-11-10 16:33:45,`1.00\r\n"))
+	assert.True(t, errors.Is(err, ErrBillIncomplete), "err = %v", err)
+	// 和 ParseFundFlow 一样检查总交易单数
+	_, err = ParseBill([]byte("交易时间,退款金额\r\n`2014-11-10 16:33:45,`1.00\r\n总交易单数\r\n`2\r\n"))
+	assert.True(t, errors.Is(err, ErrBillIncomplete), "err = %v", err)
+}
+
+func TestCheckBillComplete(t *testing.T) {
+	assert.Nil(t, checkBillComplete([]byte(testBillCSV)))
+	empty := "交易时间,公众账号ID\r\n总交易单数,应结订单总金额\r\n`0,`0.00\r\n"
+	assert.Nil(t, checkBillComplete([]byte(empty)))
+
+	for _, data := range []string{
+		"",
+		testBillCSV[:strings.Index(testBillCSV, billSummaryTitle)],
+		testBillCSV[:strings.LastIndex(testBillCSV, "`1,")],
+		strings.Replace(testBillCSV, "`1,`0.01", "`x,`0.01", 1),
+		strings.Replace(testBillCSV, "`0.60%,", "", 1),
+	} {
+		err := checkBillComplete([]byte(data))
+		assert.True(t, errors.Is(err, ErrBillIncomplete), "data = %q, err = %v", data, err)
+	}
+}
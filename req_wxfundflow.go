@@ -0,0 +1,180 @@
+package wechat
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+const (
+	downloadFundFlowUrl = "https://api.mch.weixin.qq.com/pay/downloadfundflow"
+
+	// 资金账户类型
+	AccountTypeBasic     = "Basic"     //基本账户
+	AccountTypeOperation = "Operation" //运营账户
+	AccountTypeFees      = "Fees"      //手续费账户
+
+	// 资金账单汇总部分的第一列标题
+	fundFlowSummaryTitle = "资金流水总笔数"
+)
+
+var (
+	ErrInvalidAccountType = errors.New("[gowechat] invalid account_type")
+)
+
+type (
+	// 下载资金账单请求，微信要求使用HMAC-SHA256签名，sign_type总是HMAC-SHA256
+	DownloadFundFlowReq struct {
+		XMLName     xml.Name `xml:"xml" json:"-"`
+		AppId       string   `xml:"appid" json:"appid"`
+		MchId       string   `xml:"mch_id" json:"mch_id"`
+		NonceStr    string   `xml:"nonce_str" json:"nonce_str"`
+		Sign        string   `xml:"sign" json:"sign"`
+		SignType    string   `xml:"sign_type" json:"sign_type"`
+		BillDate    string   `xml:"bill_date" json:"bill_date"`                   //资金账单日期，格式：20140603
+		AccountType string   `xml:"account_type" json:"account_type"`             //资金账户类型：Basic、Operation、Fees
+		TarType     string   `xml:"tar_type,omitempty" json:"tar_type,omitempty"` //压缩账单，传GZIP时返回.gzip格式的压缩包
+	}
+
+	// 资金账单，Data是微信返回的原始内容，可用于归档，压缩账单时为gzip文件
+	FundFlowResult struct {
+		Data    []byte
+		Header  []string        //明细的表头
+		Rows    []FundFlowRow   //明细
+		Summary FundFlowSummary //汇总
+	}
+
+	// 资金账单中的一笔资金流水，金额单位为分，所有列按表头保存在Fields中
+	FundFlowRow struct {
+		AccountingTime string //记账时间
+		TransactionId  string //微信支付业务单号
+		FundFlowId     string //资金流水单号
+		BizName        string //业务名称
+		BizType        string //业务类型
+		FinancialType  string //收支类型：收入、支出
+		Amount         int64  //收支金额
+		Balance        int64  //账户结余
+		Applicant      string //资金变更提交申请人
+		Remark         string //备注
+		BizVoucherId   string //业务凭证号
+		Fields         map[string]string
+	}
+
+	// 资金账单的汇总
+	FundFlowSummary struct {
+		TotalCount   int64 //资金流水总笔数
+		IncomeCount  int64 //收入笔数
+		IncomeAmount int64 //收入金额
+		ExpendCount  int64 //支出笔数
+		ExpendAmount int64 //支出金额
+		Fields       map[string]string
+	}
+)
+
+func (r *DownloadFundFlowReq) SetAppId(appId string)       { r.AppId = appId }
+func (r *DownloadFundFlowReq) SetMchId(mchId string)       { r.MchId = mchId }
+func (r *DownloadFundFlowReq) SetNonceStr(nonceStr string) { r.NonceStr = nonceStr }
+func (r *DownloadFundFlowReq) SetSign(sign string)         { r.Sign = sign }
+
+// 下载资金账单，需要证书，解析成资金流水和汇总，同时返回原始内容
+// tar_type为GZIP时下载压缩账单，解压后解析
+// 接口文档：https://pay.weixin.qq.com/wiki/doc/api/jsapi.php?chapter=9_18&index=7
+func (w wxMch) ReqDownloadFundFlow(ctx context.Context, req *DownloadFundFlowReq) (*FundFlowResult, error) {
+	if err := w.requireCert(); err != nil {
+		return nil, err
+	}
+	switch req.AccountType {
+	case AccountTypeBasic, AccountTypeOperation, AccountTypeFees:
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrInvalidAccountType, req.AccountType)
+	}
+	// 没有实现 SetSignType，context中指定的签名类型不会覆盖
+	req.SignType = SignTypeHMACSHA256
+	if err := w.prepare(ctx, req); err != nil {
+		return nil, err
+	}
+
+	// 解析的同时检查账单是否完整，不完整时重新下载
+	var result *FundFlowResult
+	data, err := w.downloadBill(ctx, downloadFundFlowUrl, req, req.BillDate, func(data []byte) error {
+		var err error
+		csvData := data
+		if req.TarType == TarTypeGZIP {
+			if csvData, err = gunzipBill(data); err != nil {
+				return err
+			}
+		}
+		result, err = ParseFundFlow(csvData)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.Data = data
+	return result, nil
+}
+
+// 解析CSV格式的资金账单，格式和对账单相同，汇总的第一列是资金流水总笔数
+// 缺少汇总或者总笔数和明细行数不一致时返回 ErrBillIncomplete
+func ParseFundFlow(data []byte) (*FundFlowResult, error) {
+	bill, err := splitBill(data, fundFlowSummaryTitle)
+	if err != nil {
+		return nil, err
+	}
+	result := &FundFlowResult{Header: bill.header}
+	for i, record := range bill.rows {
+		var row FundFlowRow
+		if err := row.parse(bill.header, record); err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+2, err)
+		}
+		result.Rows = append(result.Rows, row)
+	}
+	if err := result.Summary.parse(bill.summaryHeader, bill.summary); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (r *FundFlowRow) parse(header, record []string) error {
+	r.Fields = billFields(header, record)
+	for title, v := range map[string]*string{
+		"记账时间":      &r.AccountingTime,
+		"微信支付业务单号":  &r.TransactionId,
+		"资金流水单号":    &r.FundFlowId,
+		"业务名称":      &r.BizName,
+		"业务类型":      &r.BizType,
+		"收支类型":      &r.FinancialType,
+		"资金变更提交申请人": &r.Applicant,
+		"备注":        &r.Remark,
+		"业务凭证号":     &r.BizVoucherId,
+	} {
+		*v = r.Fields[title]
+	}
+	return parseBillFees(r.Fields, map[string]*int64{
+		"收支金额（元）": &r.Amount,
+		"账户结余（元）": &r.Balance,
+	})
+}
+
+func (s *FundFlowSummary) parse(header, record []string) error {
+	s.Fields = billFields(header, record)
+	for title, v := range map[string]*int64{
+		fundFlowSummaryTitle: &s.TotalCount,
+		"收入笔数":               &s.IncomeCount,
+		"支出笔数":               &s.ExpendCount,
+	} {
+		if value := s.Fields[title]; value != "" {
+			count, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("%w: invalid summary %s %q", ErrBillIncomplete, title, value)
+			}
+			*v = count
+		}
+	}
+	return parseBillFees(s.Fields, map[string]*int64{
+		"收入金额": &s.IncomeAmount,
+		"支出金额": &s.ExpendAmount,
+	})
+}
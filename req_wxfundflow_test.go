@@ -0,0 +1,122 @@
+package wechat
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testFundFlowCSV = "记账时间,微信支付业务单号,资金流水单号,业务名称,业务类型,收支类型,收支金额（元）,账户结余（元）,资金变更提交申请人,备注,业务凭证号\r\n" +
+	"`2018-06-03 10:20:45,`4200000145201806033743299645,`4200000145201806033743299645,`交易,`交易,`收入,`0.01,`100.01,`system,`缺省,`4200000145201806033743299645\r\n" +
+	"`2018-06-03 11:05:12,`50000506952018060300871359513,`1900000100201806031105129307,`退款,`退款,`支出,`0.01,`100.00,`system,`缺省,`100000000000201806030000000001\r\n" +
+	"资金流水总笔数,收入笔数,收入金额,支出笔数,支出金额\r\n" +
+	"`2,`1,`0.01,`1,`0.01\r\n"
+
+func TestWxMch_ReqDownloadFundFlow(t *testing.T) {
+	client := newStubHttp(testFundFlowCSV)
+	s := newTestMch(client)
+	ctx := WithSignType(context.Background(), SignTypeMD5)
+	result, err := s.ReqDownloadFundFlow(ctx, &DownloadFundFlowReq{BillDate: "20180603", AccountType: AccountTypeBasic})
+	assert.Nil(t, err)
+	assert.Equal(t, testFundFlowCSV, string(result.Data))
+
+	sent := client.last()
+	assert.Equal(t, downloadFundFlowUrl, sent.url)
+	assert.Equal(t, "gzip", sent.headers["Accept-Encoding"])
+	// context中的签名类型不会覆盖HMAC-SHA256
+	params := assertSignedRequest(t, sent, s.key)
+	assert.Equal(t, SignTypeHMACSHA256, params["sign_type"])
+	assert.Equal(t, AccountTypeBasic, params["account_type"])
+	assert.Equal(t, "20180603", params["bill_date"])
+	assert.NotContains(t, params, "tar_type")
+
+	assert.Len(t, result.Header, 11)
+	if assert.Len(t, result.Rows, 2) {
+		row := result.Rows[0]
+		assert.Equal(t, "2018-06-03 10:20:45", row.AccountingTime)
+		assert.Equal(t, "4200000145201806033743299645", row.TransactionId)
+		assert.Equal(t, "交易", row.BizName)
+		assert.Equal(t, "收入", row.FinancialType)
+		assert.EqualValues(t, 1, row.Amount)
+		assert.EqualValues(t, 10001, row.Balance)
+		assert.Equal(t, "system", row.Applicant)
+		assert.Equal(t, "支出", result.Rows[1].FinancialType)
+		assert.EqualValues(t, 10000, result.Rows[1].Balance)
+	}
+	assert.EqualValues(t, 2, result.Summary.TotalCount)
+	assert.EqualValues(t, 1, result.Summary.IncomeCount)
+	assert.EqualValues(t, 1, result.Summary.IncomeAmount)
+	assert.EqualValues(t, 1, result.Summary.ExpendCount)
+	assert.EqualValues(t, 1, result.Summary.ExpendAmount)
+
+	// 压缩账单解压后解析，Data保留gzip文件
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write([]byte(testFundFlowCSV))
+	zw.Close()
+	client = newStubHttp(compressed.String())
+	result, err = newTestMch(client).ReqDownloadFundFlow(context.Background(), &DownloadFundFlowReq{BillDate: "20180603", AccountType: AccountTypeFees, TarType: TarTypeGZIP})
+	assert.Nil(t, err)
+	assert.Equal(t, TarTypeGZIP, parseXMLParams(t, client.last().body)["tar_type"])
+	assert.Equal(t, compressed.Bytes(), result.Data)
+	assert.Len(t, result.Rows, 2)
+
+	// 失败时返回XML格式的错误信息
+	client = newStubHttp(`<xml><return_code><![CDATA[FAIL]]></return_code><return_msg><![CDATA[No Bill Exist]]></return_msg><error_code><![CDATA[20002]]></error_code></xml>`)
+	_, err = newTestMch(client).ReqDownloadFundFlow(context.Background(), &DownloadFundFlowReq{BillDate: "20180603", AccountType: AccountTypeOperation})
+	assert.True(t, errors.Is(err, ErrDownloadBillFail), "err = %v", err)
+
+	client = newStubHttp()
+	_, err = newTestMch(client).ReqDownloadFundFlow(context.Background(), &DownloadFundFlowReq{BillDate: "20180603", AccountType: "basic"})
+	assert.True(t, errors.Is(err, ErrInvalidAccountType), "err = %v", err)
+	assert.Empty(t, client.requests)
+}
+
+func TestWxMch_ReqDownloadFundFlow_Incomplete(t *testing.T) {
+	// 第一次下载在明细中间中断，第二次下载完整
+	truncated := testFundFlowCSV[:strings.Index(testFundFlowCSV, "\r\n")+40]
+	client := newStubHttp(truncated, testFundFlowCSV)
+	s := newTestMch(client)
+	result, err := s.ReqDownloadFundFlow(context.Background(), &DownloadFundFlowReq{BillDate: "20180603", AccountType: AccountTypeBasic})
+	assert.Nil(t, err)
+	assert.Equal(t, testFundFlowCSV, string(result.Data))
+	assert.Len(t, result.Rows, 2)
+	assert.Len(t, client.requests, 2)
+	assert.Equal(t, client.requests[0].body, client.requests[1].body)
+
+	// 压缩账单不完整时同样重新下载
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write([]byte(testFundFlowCSV))
+	zw.Close()
+	client = newStubHttp(compressed.String()[:compressed.Len()/2])
+	_, err = newTestMch(client).ReqDownloadFundFlow(context.Background(), &DownloadFundFlowReq{BillDate: "20180603", AccountType: AccountTypeBasic, TarType: TarTypeGZIP})
+	assert.True(t, errors.Is(err, ErrBillIncomplete), "err = %v", err)
+	assert.Len(t, client.requests, 1+defaultBillRetries)
+
+	client = newStubHttp(truncated)
+	s = newTestMch(client)
+	s.SetBillRetries(0)
+	_, err = s.ReqDownloadFundFlow(context.Background(), &DownloadFundFlowReq{BillDate: "20180603", AccountType: AccountTypeBasic})
+	assert.True(t, errors.Is(err, ErrBillIncomplete), "err = %v", err)
+	assert.Len(t, client.requests, 1)
+}
+
+func TestParseFundFlow(t *testing.T) {
+	mismatch := strings.Replace(testFundFlowCSV, "`2,`1,", "`3,`1,", 1)
+	_, err := ParseFundFlow([]byte(mismatch))
+	assert.True(t, errors.Is(err, ErrBillIncomplete), "err = %v", err)
+
+	truncated := testFundFlowCSV[:strings.Index(testFundFlowCSV, "资金流水总笔数")]
+	_, err = ParseFundFlow([]byte(truncated))
+	assert.True(t, errors.Is(err, ErrBillIncomplete), "err = %v", err)
+
+	invalid := strings.Replace(testFundFlowCSV, "`100.01", "`abc", 1)
+	_, err = ParseFundFlow([]byte(invalid))
+	assert.True(t, errors.Is(err, ErrInvalidAmount), "err = %v", err)
+}
@@ -5,22 +5,47 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/xml"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"strconv"
+	"sync"
 
 	"go.uber.org/zap"
 )
 
 const (
-	mchPayUrl    = "https://api.mch.weixin.qq.com/mmpaymkttransfers/promotion/transfers"
-	mchReqUrl    = "https://api.mch.weixin.qq.com/mmpaymkttransfers/gettransferinfo"
-	mchRefundUrl = "https://api.mch.weixin.qq.com/secapi/pay/refund"
+	mchPayUrl     = "https://api.mch.weixin.qq.com/mmpaymkttransfers/promotion/transfers"
+	mchReqUrl     = "https://api.mch.weixin.qq.com/mmpaymkttransfers/gettransferinfo"
+	mchRefundUrl  = "https://api.mch.weixin.qq.com/secapi/pay/refund"
+	mchReverseUrl = "https://api.mch.weixin.qq.com/secapi/pay/reverse"
+	// 查询退款不需要证书
+	mchRefundQueryUrl = "https://api.mch.weixin.qq.com/pay/refundquery"
+
+	defaultMinTLSVersion = tls.VersionTLS12
+)
+
+var (
+	ErrMissingSubMchId = errors.New("[gowechat] missing sub_mch_id")
+	ErrCertRequired    = errors.New("[gowechat] this operation requires client certificates")
+	ErrInvalidIP       = errors.New("[gowechat] invalid spbill_create_ip")
+	ErrMissingRefundNo = errors.New("[gowechat] one of refund_id, out_refund_no, transaction_id and out_trade_no is required")
+	ErrNotRefundable   = errors.New("[gowechat] order is not refundable")
 )
 
 type MchService interface {
 	ReqWxToMchPay(ctx context.Context, req *MchPayReq) (*MchPayResp, error)
 	ReqMchPayment(ctx context.Context, tradeNo string) (*MchPaymentQueryResp, error)
 	ReqPayRefund(ctx context.Context, req *MchPayRefundReq) (*MchPayRefundResp, error)
+	ReqRefundQuery(ctx context.Context, req *RefundQueryReq) (*RefundQueryResp, error)
+	ReqReverseOrder(ctx context.Context, tradeNo string) (*ReverseOrderResp, error)
+	ReqDownloadFundFlow(ctx context.Context, req *DownloadFundFlowReq) (*FundFlowResult, error)
+	ReqProfitSharingAddReceiver(ctx context.Context, req *ProfitSharingAddReceiverReq) (*ProfitSharingAddReceiverResp, error)
+	ReqProfitSharingFinish(ctx context.Context, req *ProfitSharingFinishReq) (*ProfitSharingFinishResp, error)
+	ReqProfitSharingReturn(ctx context.Context, req *ProfitSharingReturnReq) (*ProfitSharingReturnResp, error)
+	ReqSendRedPack(ctx context.Context, req *SendRedPackReq) (*SendRedPackResp, error)
 }
 
 type (
@@ -31,12 +56,20 @@ type (
 		CaCertFile  string
 		ApiCertFile string
 		ApiKeyFile  string
+		// 证书连接允许的最低TLS版本，为0时使用TLS 1.2
+		MinTLSVersion uint16
+		// 允许的加密套件，为空时使用Go的默认配置（只对TLS 1.2及以下生效）
+		CipherSuites []uint16
+		// 服务商模式，退款和企业付款必须指定子商户号
+		ServiceProvider bool
 	}
 
 	MchPayReq struct {
 		XMLName        xml.Name `xml:"xml" json:"-"`
 		MchAppID       string   `xml:"mch_appid" json:"mch_appid"`
 		MchID          string   `xml:"mchid" json:"mchid"`
+		SubAppId       string   `xml:"sub_appid,omitempty" json:"sub_appid"`   //服务商模式下子商户的appid
+		SubMchId       string   `xml:"sub_mch_id,omitempty" json:"sub_mch_id"` //服务商模式下的子商户号
 		NonceStr       string   `xml:"nonce_str" json:"nonce_str"`
 		Sign           string   `xml:"sign" json:"sign"`
 		PartnerTradeNO string   `xml:"partner_trade_no" json:"partner_trade_no"`
@@ -97,12 +130,16 @@ type (
 		XMLName       xml.Name `xml:"xml" json:"-"`
 		AppID         string   `xml:"appid" json:"appid"`
 		MchID         string   `xml:"mch_id" json:"mch_id"`
+		SubAppId      string   `xml:"sub_appid,omitempty" json:"sub_appid"`   //服务商模式下子商户的appid
+		SubMchId      string   `xml:"sub_mch_id,omitempty" json:"sub_mch_id"` //服务商模式下的子商户号
 		NonceStr      string   `xml:"nonce_str" json:"nonce_str"`
 		Sign          string   `xml:"sign" json:"sign"`
-		TransactionId string   `xml:"transaction_id" json:"transaction_id"`
+		TransactionId string   `xml:"transaction_id,omitempty" json:"transaction_id"` //微信订单号，和商户订单号二选一
+		OutTradeNo    string   `xml:"out_trade_no,omitempty" json:"out_trade_no"`     //商户订单号
 		OutRefundNo   string   `xml:"out_refund_no" json:"out_refund_no"`
 		TotalFee      int64    `xml:"total_fee" json:"total_fee,string"`
 		RefundFee     int64    `xml:"refund_fee" json:"refund_fee,string"`
+		RefundFeeType string   `xml:"refund_fee_type,omitempty" json:"refund_fee_type"` //退款货币种类，需要和支付一致，默认为CNY
 		RefundDesc    string   `xml:"refund_desc" json:"refund_desc"`
 	}
 
@@ -125,119 +162,518 @@ type (
 		CashFee       int64    `xml:"cash_fee"`
 	}
 
+	// 查询退款请求，四个单号任选一个，优先级为：refund_id > out_refund_no > transaction_id > out_trade_no
+	RefundQueryReq struct {
+		XMLName       xml.Name `xml:"xml" json:"-"`
+		AppID         string   `xml:"appid" json:"appid"`
+		MchID         string   `xml:"mch_id" json:"mch_id"`
+		SubAppId      string   `xml:"sub_appid,omitempty" json:"sub_appid"`   //服务商模式下子商户的appid
+		SubMchId      string   `xml:"sub_mch_id,omitempty" json:"sub_mch_id"` //服务商模式下的子商户号
+		NonceStr      string   `xml:"nonce_str" json:"nonce_str"`
+		Sign          string   `xml:"sign" json:"sign"`
+		TransactionId string   `xml:"transaction_id,omitempty" json:"transaction_id"` //微信订单号
+		OutTradeNo    string   `xml:"out_trade_no,omitempty" json:"out_trade_no"`     //商户订单号
+		OutRefundNo   string   `xml:"out_refund_no,omitempty" json:"out_refund_no"`   //商户退款单号
+		RefundId      string   `xml:"refund_id,omitempty" json:"refund_id"`           //微信退款单号
+		Offset        int64    `xml:"offset,omitempty" json:"offset,string"`          //订单的退款超过10笔时分页查询的偏移量
+	}
+
+	RefundQueryResp struct {
+		XMLName            xml.Name `xml:"xml"`
+		ReturnCode         string   `xml:"return_code"`
+		ReturnMsg          string   `xml:"return_msg"`
+		AppID              string   `xml:"appid"`
+		MchID              string   `xml:"mch_id"`
+		NonceStr           string   `xml:"nonce_str"`
+		Sign               string   `xml:"sign"`
+		ResultCode         string   `xml:"result_code"`
+		ErrCode            string   `xml:"err_code"`
+		ErrCodeDes         string   `xml:"err_code_des"`
+		TotalRefundCount   int64    `xml:"total_refund_count"`
+		TransactionId      string   `xml:"transaction_id"`
+		OutTradeNo         string   `xml:"out_trade_no"`
+		TotalFee           int64    `xml:"total_fee"`
+		SettlementTotalFee int64    `xml:"settlement_total_fee"`
+		FeeType            string   `xml:"fee_type"`
+		CashFee            int64    `xml:"cash_fee"`
+		RefundCount        int64    `xml:"refund_count"`
+		refunds            []RefundEntry
+	}
+
+	// 退款查询结果中的一笔退款，对应响应中序号为$n的字段
+	RefundEntry struct {
+		OutRefundNo         string //商户退款单号
+		RefundId            string //微信退款单号
+		RefundChannel       string //退款渠道
+		RefundFee           int64  //申请退款金额
+		SettlementRefundFee int64  //退款金额
+		CouponRefundFee     int64  //代金券退款总金额
+		RefundStatus        string //退款状态：SUCCESS、REFUNDCLOSE、PROCESSING、CHANGE
+		RefundAccount       string //退款资金来源
+		RefundRecvAccout    string //退款入账账户
+		RefundSuccessTime   string //退款成功时间
+	}
+
+	reverseOrderReq struct {
+		XMLName    xml.Name `xml:"xml" json:"-"`
+		AppID      string   `xml:"appid" json:"appid"`
+		MchID      string   `xml:"mch_id" json:"mch_id"`
+		OutTradeNo string   `xml:"out_trade_no" json:"out_trade_no"`
+		NonceStr   string   `xml:"nonce_str" json:"nonce_str"`
+		Sign       string   `xml:"sign" json:"sign"`
+		SignType   string   `xml:"sign_type" json:"sign_type"`
+	}
+
+	ReverseOrderResp struct {
+		XMLName    xml.Name `xml:"xml"`
+		ReturnCode string   `xml:"return_code"`
+		ReturnMsg  string   `xml:"return_msg"`
+		AppID      string   `xml:"appid"`
+		MchID      string   `xml:"mch_id"`
+		NonceStr   string   `xml:"nonce_str"`
+		Sign       string   `xml:"sign"`
+		ResultCode string   `xml:"result_code"`
+		ErrCode    string   `xml:"err_code"`
+		ErrCodeDes string   `xml:"err_code_des"`
+		Recall     string   `xml:"recall"` //是否需要继续调用撤销：Y、N，见 NeedRecall
+	}
+
 	wxMch struct {
 		cfg *MchConfig
+		tls *mchTransport
+		// 检查退款单号是否被其他订单使用过，为nil时不检查
+		refundGuard RefundGuard
 		wxService
 	}
+
+	// 带证书的连接，首次使用时加载证书，之后复用，重新加载时替换内部的Transport
+	mchTransport struct {
+		once      sync.Once
+		client    *http.Client
+		err       error
+		mu        sync.RWMutex
+		transport *http.Transport
+	}
 )
 
-func NewWxMchService(cfg *MchConfig) *wxMch {
+// 读取证书文件，测试时替换
+var readFile = ioutil.ReadFile
+
+// 获取本机出口IP，测试时替换
+var outboundIP = OutboundIP
+
+// 校验配置中的必填项，证书文件在创建客户端时检查
+func (c *MchConfig) Validate() error {
+	if c.AppId == "" {
+		return fmt.Errorf("%w: app id is required", ErrInvalidConfig)
+	}
+	return validateMerchant(c.MchId, c.ApiKey)
+}
+
+// 是否配置了证书，没有证书时只能调用不需要证书的接口，需要证书的接口返回 ErrCertRequired
+func (c *MchConfig) HasCerts() bool {
+	return c.CaCertFile != "" && c.ApiCertFile != "" && c.ApiKeyFile != ""
+}
+
+func (r *MchPayReq) SetAppId(appId string)       { r.MchAppID = appId }
+func (r *MchPayReq) SetMchId(mchId string)       { r.MchID = mchId }
+func (r *MchPayReq) SetNonceStr(nonceStr string) { r.NonceStr = nonceStr }
+func (r *MchPayReq) SetSign(sign string)         { r.Sign = sign }
+
+func (r *mchPaymentQueryReq) SetAppId(appId string)       { r.MchAppID = appId }
+func (r *mchPaymentQueryReq) SetMchId(mchId string)       { r.MchID = mchId }
+func (r *mchPaymentQueryReq) SetNonceStr(nonceStr string) { r.NonceStr = nonceStr }
+func (r *mchPaymentQueryReq) SetSign(sign string)         { r.Sign = sign }
+
+func (r *MchPayRefundReq) SetAppId(appId string)       { r.AppID = appId }
+func (r *MchPayRefundReq) SetMchId(mchId string)       { r.MchID = mchId }
+func (r *MchPayRefundReq) SetNonceStr(nonceStr string) { r.NonceStr = nonceStr }
+func (r *MchPayRefundReq) SetSign(sign string)         { r.Sign = sign }
+
+func (r *RefundQueryReq) SetAppId(appId string)       { r.AppID = appId }
+func (r *RefundQueryReq) SetMchId(mchId string)       { r.MchID = mchId }
+func (r *RefundQueryReq) SetNonceStr(nonceStr string) { r.NonceStr = nonceStr }
+func (r *RefundQueryReq) SetSign(sign string)         { r.Sign = sign }
+
+func (r *reverseOrderReq) SetAppId(appId string)       { r.AppID = appId }
+func (r *reverseOrderReq) SetMchId(mchId string)       { r.MchID = mchId }
+func (r *reverseOrderReq) SetNonceStr(nonceStr string) { r.NonceStr = nonceStr }
+func (r *reverseOrderReq) SetSign(sign string)         { r.Sign = sign }
+func (r *reverseOrderReq) SetSignType(signType string) { r.SignType = signType }
+
+// 输出关键字段，签名用***代替，用于日志
+func (r MchPayReq) String() string {
+	return fmt.Sprintf("MchPayReq{partner_trade_no=%s, openid=%s, amount=%d, check_name=%s, sign=%s}",
+		r.PartnerTradeNO, r.OpenID, r.Amount, r.CheckName, maskSecret(r.Sign))
+}
+
+func (r *MchPayResp) result() payResult {
+	return payResult{r.ReturnCode, r.ReturnMsg, r.ResultCode, r.ErrCode, r.ErrCodeDes, r.MchAppID, r.MchID}
+}
+
+func (r *MchPaymentQueryResp) result() payResult {
+	return payResult{r.ReturnCode, r.ReturnMsg, r.ResultCode, r.ErrCode, r.ErrCodeDes, r.MchAppID, r.MchID}
+}
+
+func (r *MchPayRefundResp) result() payResult {
+	return payResult{r.ReturnCode, r.ReturnMsg, r.ResultCode, r.ErrCode, r.ErrCodeDes, r.MchAppID, r.MchID}
+}
+
+func (r *RefundQueryResp) result() payResult {
+	return payResult{r.ReturnCode, r.ReturnMsg, r.ResultCode, r.ErrCode, r.ErrCodeDes, r.AppID, r.MchID}
+}
+
+func (r *ReverseOrderResp) result() payResult {
+	return payResult{r.ReturnCode, r.ReturnMsg, r.ResultCode, r.ErrCode, r.ErrCodeDes, r.AppID, r.MchID}
+}
+
+// 撤销是否需要重试，为true时需要使用相同的订单号再次调用 ReqReverseOrder
+func (r *ReverseOrderResp) NeedRecall() bool {
+	return r.Recall == "Y"
+}
+
+// 解析普通字段的同时，把 out_refund_no_$n 等带序号的字段整理成退款列表
+func (r *RefundQueryResp) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	type plain RefundQueryResp
+	fields, err := decodeFlatXML(d, start, (*plain)(r))
+	if err != nil {
+		return err
+	}
+
+	r.refunds = nil
+	for n := 0; ; n++ {
+		suffix := "_" + strconv.Itoa(n)
+		outRefundNo, ok := fields["out_refund_no"+suffix]
+		if !ok {
+			return nil
+		}
+		entry := RefundEntry{
+			OutRefundNo:       outRefundNo,
+			RefundId:          fields["refund_id"+suffix],
+			RefundChannel:     fields["refund_channel"+suffix],
+			RefundStatus:      fields["refund_status"+suffix],
+			RefundAccount:     fields["refund_account"+suffix],
+			RefundRecvAccout:  fields["refund_recv_accout"+suffix],
+			RefundSuccessTime: fields["refund_success_time"+suffix],
+		}
+		for name, v := range map[string]*int64{
+			"refund_fee":            &entry.RefundFee,
+			"settlement_refund_fee": &entry.SettlementRefundFee,
+			"coupon_refund_fee":     &entry.CouponRefundFee,
+		} {
+			if value := fields[name+suffix]; value != "" {
+				if *v, err = strconv.ParseInt(value, 10, 64); err != nil {
+					return fmt.Errorf("[gowechat] invalid %s%s: %w", name, suffix, err)
+				}
+			}
+		}
+		r.refunds = append(r.refunds, entry)
+	}
+}
+
+// 订单下的所有退款，按序号排列
+func (r *RefundQueryResp) Refunds() []RefundEntry {
+	return r.refunds
+}
+
+// 按商户退款单号查找退款
+func (r *RefundQueryResp) Refund(outRefundNo string) (*RefundEntry, bool) {
+	for i := range r.refunds {
+		if r.refunds[i].OutRefundNo == outRefundNo {
+			return &r.refunds[i], true
+		}
+	}
+	return nil, false
+}
+
+// 根据订单查询结果生成全额退款的请求，只有支付成功（SUCCESS）或转入退款（REFUND）的订单可以退款
+// total_fee必须是订单总金额而不是退款金额，全额退款时refund_fee等于total_fee
+func FullRefund(query *QueryOrderResp, outRefundNo string) (*MchPayRefundReq, error) {
+	if query == nil {
+		return nil, fmt.Errorf("%w: nil query", ErrNotRefundable)
+	}
+	switch query.TradeState {
+	case TradeStateSuccess, TradeStateRefund:
+	default:
+		return nil, fmt.Errorf("%w: trade state %q", ErrNotRefundable, query.TradeState)
+	}
+	return &MchPayRefundReq{
+		SubMchId:      query.SubMchId,
+		TransactionId: query.TransactionId,
+		OutTradeNo:    query.OutTradeNo,
+		OutRefundNo:   outRefundNo,
+		TotalFee:      query.TotalFee,
+		RefundFee:     query.TotalFee,
+		RefundFeeType: query.FeeType,
+	}, nil
+}
+
+func NewWxMchService(cfg *MchConfig, opts ...ServiceOption) *wxMch {
 	s := &wxMch{
-		cfg,
-		wxService{
-			client: nil,
-			key:    cfg.ApiKey,
-			logger: zapLogger,
+		cfg: cfg,
+		tls: &mchTransport{},
+		wxService: wxService{
+			client:      nil,
+			appId:       cfg.AppId,
+			mchId:       cfg.MchId,
+			key:         cfg.ApiKey,
+			logger:      zapLogger,
+			billRetries: defaultBillRetries,
 		},
 	}
-	s.client = NewCtxHttpWithClient(s.TLSClient())
-	zapLogger.Info("init wx mch service success...")
+	s.applyOptions(opts)
+	if err := cfg.Validate(); err != nil {
+		s.logger.Warn("init wx mch service with invalid config", zap.Error(err))
+	}
+	if !cfg.HasCerts() {
+		// 没有证书时不需要证书的接口仍然可以使用
+		s.logger.Warn("init wx mch service without client certificates, methods requiring them return ErrCertRequired")
+		s.client = NewCtxHttp()
+		return s
+	}
+	client, err := s.TLSClient()
+	if err != nil {
+		s.logger.Error("init wx mch service tls client", zap.Error(err))
+	}
+	s.client = NewCtxHttpWithClient(client)
+	s.logger.Info("init wx mch service success...")
 	return s
 }
 
 // 企业付款到零钱接口
 // 接口文档：https://pay.weixin.qq.com/wiki/doc/api/tools/mch_pay.php?chapter=14_2
 func (w wxMch) ReqWxToMchPay(ctx context.Context, req *MchPayReq) (*MchPayResp, error) {
-	sign, err := w.sign(ctx, &req)
-	if err != nil {
+	if err := w.requireCert(); err != nil {
+		return nil, err
+	}
+	if err := w.checkSubMerchant(req.SubMchId); err != nil {
+		return nil, err
+	}
+	if err := fillSpbillCreateIP(req); err != nil {
+		return nil, err
+	}
+	if err := w.prepare(ctx, req); err != nil {
 		return nil, err
 	}
-	req.Sign = sign
 
 	var resp MchPayResp
-	if err := w.PostXML(ctx, mchPayUrl, &req, func(response *http.Response, err error) error {
-		if err != nil {
-			return err
-		}
-		return xml.NewDecoder(response.Body).Decode(&resp)
-	}); err != nil {
+	if err := w.postPayXML(ctx, mchPayUrl, req, &resp); err != nil {
 		return nil, err
 	}
-	w.logger.Info("[wxmch] req wx to mch pay", zap.Any("body", resp))
+	w.logger.Info("[wxmch] req wx to mch pay", w.bodyField("body", resp))
 	return &resp, nil
 }
 
 // 企业付款到零钱查询接口
 // 接口文档：https://pay.weixin.qq.com/wiki/doc/api/tools/mch_pay.php?chapter=14_3
 func (w wxMch) ReqMchPayment(ctx context.Context, tradeNo string) (*MchPaymentQueryResp, error) {
+	if err := w.requireCert(); err != nil {
+		return nil, err
+	}
 	req := mchPaymentQueryReq{
-		MchAppID:       w.cfg.AppId,
-		MchID:          w.cfg.MchId,
-		NonceStr:       w.RandString(32),
-		Sign:           "",
 		PartnerTradeNO: tradeNo,
 	}
-	sign, err := w.sign(ctx, &req)
-	if err != nil {
+	if err := w.prepare(ctx, &req); err != nil {
 		return nil, err
 	}
-	req.Sign = sign
 
 	var resp MchPaymentQueryResp
-	if err := w.PostXML(ctx, mchReqUrl, &req, func(response *http.Response, err error) error {
-		if err != nil {
-			return err
-		}
-		return xml.NewDecoder(response.Body).Decode(&resp)
-	}); err != nil {
+	if err := w.postPayXML(ctx, mchReqUrl, &req, &resp); err != nil {
 		return nil, err
 	}
-	w.logger.Info("[wxmch] req mch payment", zap.Any("body", resp))
+	w.logger.Info("[wxmch] req mch payment", w.bodyField("body", resp))
 	return &resp, nil
 }
 
 // 申请退款接口
 // 接口文档：https://pay.weixin.qq.com/wiki/doc/api/jsapi.php?chapter=9_4
 func (w wxMch) ReqPayRefund(ctx context.Context, req *MchPayRefundReq) (*MchPayRefundResp, error) {
-	sign, err := w.sign(ctx, &req)
-	if err != nil {
+	if err := w.requireCert(); err != nil {
+		return nil, err
+	}
+	if err := w.checkSubMerchant(req.SubMchId); err != nil {
+		return nil, err
+	}
+	if err := w.checkRefundNo(ctx, req); err != nil {
+		return nil, err
+	}
+	if err := w.prepare(ctx, req); err != nil {
 		return nil, err
 	}
-	req.Sign = sign
 
 	var resp MchPayRefundResp
-	if err := w.PostXML(ctx, mchRefundUrl, &req, func(response *http.Response, err error) error {
-		if err != nil {
-			return err
-		}
-		return xml.NewDecoder(response.Body).Decode(&resp)
-	}); err != nil {
+	if err := w.postPayXML(ctx, mchRefundUrl, req, &resp); err != nil {
 		return nil, err
 	}
-	w.logger.Info("[wxmch] req mch pay refund", zap.Any("body", resp))
+	w.logger.Info("[wxmch] req mch pay refund", w.bodyField("body", resp))
+	if err := w.recordRefundNo(ctx, req, &resp); err != nil {
+		w.logger.Error("[wxmch] record refund no", zap.String("out_refund_no", req.OutRefundNo), zap.Error(err))
+		return &resp, err
+	}
 	return &resp, nil
 }
 
-func (w wxMch) TLSClient() *http.Client {
+// 查询退款接口，不需要证书，退款列表通过 RefundQueryResp.Refunds 获取
+// 接口文档：https://pay.weixin.qq.com/wiki/doc/api/jsapi.php?chapter=9_5
+func (w wxMch) ReqRefundQuery(ctx context.Context, req *RefundQueryReq) (*RefundQueryResp, error) {
+	if req.RefundId == "" && req.OutRefundNo == "" && req.TransactionId == "" && req.OutTradeNo == "" {
+		return nil, ErrMissingRefundNo
+	}
+	if err := w.checkSubMerchant(req.SubMchId); err != nil {
+		return nil, err
+	}
+	if err := w.prepare(ctx, req); err != nil {
+		return nil, err
+	}
+
+	var resp RefundQueryResp
+	if err := w.postPayXML(ctx, mchRefundQueryUrl, req, &resp); err != nil {
+		return nil, err
+	}
+	w.logger.Info("[wxmch] req refund query", w.bodyField("body", resp))
+	return &resp, nil
+}
+
+// 撤销订单，需要证书，付款码支付的结果未知或者失败时调用，订单未支付时关单，已支付时退款
+// 返回 recall=Y 时撤销没有完成，需要再次调用，见 ReverseOrderResp.NeedRecall
+// 接口文档：https://pay.weixin.qq.com/wiki/doc/api/micropay.php?chapter=9_11&index=3
+func (w wxMch) ReqReverseOrder(ctx context.Context, tradeNo string) (*ReverseOrderResp, error) {
+	if err := w.requireCert(); err != nil {
+		return nil, err
+	}
+	if err := validateTradeNo(tradeNo); err != nil {
+		return nil, err
+	}
+	req := reverseOrderReq{
+		OutTradeNo: tradeNo,
+		SignType:   SignTypeMD5,
+	}
+	if err := w.prepare(ctx, &req); err != nil {
+		return nil, err
+	}
+
+	var resp ReverseOrderResp
+	if err := w.postPayXML(ctx, mchReverseUrl, &req, &resp); err != nil {
+		return nil, err
+	}
+	w.logger.Info("[wxmch] req reverse order", w.bodyField("body", resp))
+	if resp.NeedRecall() {
+		w.logger.Warn("[wxmch] reverse order need recall", zap.String("out_trade_no", tradeNo), zap.String("err_code", resp.ErrCode))
+	}
+	return &resp, nil
+}
+
+// 服务商模式下必须指定子商户号
+func (w wxMch) checkSubMerchant(subMchId string) error {
+	if w.cfg.ServiceProvider && subMchId == "" {
+		return fmt.Errorf("%w: required in service provider mode", ErrMissingSubMchId)
+	}
+	return nil
+}
+
+// 企业付款是服务端发起的调用，spbill_create_ip为空时使用本机出口IP，否则必须是合法的IP
+func fillSpbillCreateIP(req *MchPayReq) error {
+	if req.SpbillCreateIP == "" {
+		ip, err := outboundIP()
+		if err != nil {
+			return fmt.Errorf("%w: get outbound ip: %v", ErrInvalidIP, err)
+		}
+		req.SpbillCreateIP = ip
+		return nil
+	}
+	if net.ParseIP(req.SpbillCreateIP) == nil {
+		return fmt.Errorf("%w: %q", ErrInvalidIP, req.SpbillCreateIP)
+	}
+	return nil
+}
+
+// 需要证书的接口在发送请求之前检查证书配置
+func (w wxMch) requireCert() error {
+	if !w.cfg.HasCerts() {
+		return ErrCertRequired
+	}
+	return nil
+}
+
+// 带证书的客户端，证书只在第一次调用时加载，之后返回同一个客户端
+// 证书加载失败时返回error，客户端发出的请求也会返回这个error
+func (w wxMch) TLSClient() (*http.Client, error) {
+	w.tls.once.Do(func() {
+		w.tls.client = &http.Client{Transport: w.tls}
+		transport, err := w.loadTransport()
+		w.tls.err = err
+		if err == nil {
+			w.tls.set(transport)
+		}
+	})
+	return w.tls.client, w.tls.err
+}
+
+// 重新加载证书，用于证书更新后替换客户端使用的连接，加载失败时继续使用原来的证书
+func (w wxMch) ReloadTLSClient() error {
+	w.TLSClient()
+	transport, err := w.loadTransport()
+	if err != nil {
+		return err
+	}
+	w.tls.set(transport)
+	return nil
+}
+
+func (w wxMch) loadTransport() (*http.Transport, error) {
+	if !w.cfg.HasCerts() {
+		return nil, fmt.Errorf("%w: CaCertFile, ApiCertFile and ApiKeyFile are required", ErrCertRequired)
+	}
 	pool := x509.NewCertPool()
-	caCrt, err := ioutil.ReadFile(w.cfg.CaCertFile)
+	caCrt, err := readFile(w.cfg.CaCertFile)
 	if err != nil {
-		w.logger.Panic("[wx] read CACertFile", zap.Error(err))
+		return nil, fmt.Errorf("[wx] read CACertFile: %w", err)
 	}
 	pool.AppendCertsFromPEM(caCrt)
 
-	cliCrt, err := tls.LoadX509KeyPair(w.cfg.ApiCertFile, w.cfg.ApiKeyFile)
+	certPEM, err := readFile(w.cfg.ApiCertFile)
 	if err != nil {
-		w.logger.Panic("[wx] LoadX509KeyPair", zap.Error(err))
+		return nil, fmt.Errorf("[wx] read ApiCertFile: %w", err)
+	}
+	keyPEM, err := readFile(w.cfg.ApiKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("[wx] read ApiKeyFile: %w", err)
+	}
+	cliCrt, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("[wx] X509KeyPair: %w", err)
 	}
 
-	tr := &http.Transport{
+	minVersion := w.cfg.MinTLSVersion
+	if minVersion == 0 {
+		minVersion = defaultMinTLSVersion
+	}
+	return &http.Transport{
 		TLSClientConfig: &tls.Config{
 			RootCAs:      pool,
 			Certificates: []tls.Certificate{cliCrt},
+			MinVersion:   minVersion,
+			CipherSuites: w.cfg.CipherSuites,
 		},
+	}, nil
+}
+
+func (t *mchTransport) set(transport *http.Transport) {
+	t.mu.Lock()
+	old := t.transport
+	t.transport = transport
+	t.mu.Unlock()
+	if old != nil {
+		old.CloseIdleConnections()
 	}
-	return &http.Client{
-		Transport: tr,
+}
+
+func (t *mchTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.RLock()
+	transport := t.transport
+	t.mu.RUnlock()
+	if transport == nil {
+		return nil, t.err
 	}
+	return transport.RoundTrip(req)
 }
@@ -0,0 +1,539 @@
+package wechat
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 不加载证书，直接使用传入的client构造服务
+func newTestMch(client Http) *wxMch {
+	cfg := &MchConfig{
+		AppId:  "wx2421b1c4370ec43b",
+		MchId:  "10000100",
+		ApiKey: "192006250b4c09247ec02edce69f6a2d",
+		// 请求由client处理，不会读取证书
+		CaCertFile:  "rootca.pem",
+		ApiCertFile: "apiclient_cert.pem",
+		ApiKeyFile:  "apiclient_key.pem",
+	}
+	return &wxMch{
+		cfg: cfg,
+		wxService: wxService{
+			client:      client,
+			appId:       cfg.AppId,
+			mchId:       cfg.MchId,
+			key:         cfg.ApiKey,
+			logger:      zapLogger,
+			billRetries: defaultBillRetries,
+		},
+	}
+}
+
+func TestWxMch_ReqMchPayment_IPNotWhitelisted(t *testing.T) {
+	client := newStubHttp(`<xml>
+<return_code><![CDATA[SUCCESS]]></return_code>
+<return_msg><![CDATA[OK]]></return_msg>
+<result_code><![CDATA[FAIL]]></result_code>
+<err_code><![CDATA[NO_AUTH]]></err_code>
+<err_code_des><![CDATA[调用IP不在白名单内]]></err_code_des>
+</xml>`)
+	resp, err := newTestMch(client).ReqMchPayment(context.Background(), "T1")
+	assert.Nil(t, resp)
+	assert.True(t, errors.Is(err, ErrIPNotWhitelisted), "err = %v", err)
+}
+
+func TestMchConfig_Validate(t *testing.T) {
+	valid := MchConfig{AppId: "wx2421b1c4370ec43b", MchId: "10000100", ApiKey: "192006250b4c09247ec02edce69f6a2d"}
+	assert.Nil(t, valid.Validate())
+
+	tests := []struct {
+		Name   string
+		Modify func(c *MchConfig)
+	}{
+		{"missing app id", func(c *MchConfig) { c.AppId = "" }},
+		{"missing mch id", func(c *MchConfig) { c.MchId = "" }},
+		{"non-numeric mch id", func(c *MchConfig) { c.MchId = "mch-1" }},
+		{"missing api key", func(c *MchConfig) { c.ApiKey = "" }},
+		{"short api key", func(c *MchConfig) { c.ApiKey = "key" }},
+	}
+	for _, test := range tests {
+		cfg := valid
+		test.Modify(&cfg)
+		assert.True(t, errors.Is(cfg.Validate(), ErrInvalidConfig), test.Name)
+	}
+}
+
+// 生成自签名证书，同时作为CA证书和客户端证书使用，返回的函数用于清理证书目录
+func writeTestCerts(t *testing.T) (*MchConfig, func()) {
+	dir, err := ioutil.TempDir("", "wxmch")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "10000100"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, "apiclient_cert.pem")
+	keyFile := filepath.Join(dir, "apiclient_key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return &MchConfig{
+		AppId:       "wx2421b1c4370ec43b",
+		MchId:       "10000100",
+		ApiKey:      "192006250b4c09247ec02edce69f6a2d",
+		CaCertFile:  certFile,
+		ApiCertFile: certFile,
+		ApiKeyFile:  keyFile,
+	}, func() { os.RemoveAll(dir) }
+}
+
+func TestWxMch_TLSClient_Cached(t *testing.T) {
+	cfg, cleanup := writeTestCerts(t)
+	defer cleanup()
+	reads := 0
+	readFile = func(name string) ([]byte, error) {
+		reads++
+		return ioutil.ReadFile(name)
+	}
+	defer func() { readFile = ioutil.ReadFile }()
+
+	s := NewWxMchService(cfg)
+	client, err := s.TLSClient()
+	assert.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		again, _ := s.TLSClient()
+		assert.Same(t, client, again)
+	}
+	assert.Equal(t, 3, reads, "ca cert, api cert and api key are read once")
+
+	assert.Nil(t, s.ReloadTLSClient())
+	assert.Equal(t, 6, reads)
+	again, _ := s.TLSClient()
+	assert.Same(t, client, again)
+}
+
+func TestWxMch_MissingCerts(t *testing.T) {
+	s := NewWxMchService(&MchConfig{
+		AppId:       "wx2421b1c4370ec43b",
+		MchId:       "10000100",
+		ApiKey:      "192006250b4c09247ec02edce69f6a2d",
+		CaCertFile:  "/nonexistent/rootca.pem",
+		ApiCertFile: "/nonexistent/apiclient_cert.pem",
+		ApiKeyFile:  "/nonexistent/apiclient_key.pem",
+	})
+	_, err := s.TLSClient()
+	assert.NotNil(t, err)
+
+	_, err = s.ReqMchPayment(context.Background(), "T1")
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "read CACertFile")
+}
+
+func TestRefundQueryResp_Refunds(t *testing.T) {
+	body := `<xml>
+<return_code>SUCCESS</return_code>
+<result_code>SUCCESS</result_code>
+<out_trade_no>T1</out_trade_no>
+<total_fee>300</total_fee>
+<refund_count>3</refund_count>
+<out_refund_no_0>R0</out_refund_no_0>
+<refund_id_0>50000000000</refund_id_0>
+<refund_fee_0>100</refund_fee_0>
+<refund_status_0>SUCCESS</refund_status_0>
+<out_refund_no_1>R1</out_refund_no_1>
+<refund_id_1>50000000001</refund_id_1>
+<refund_fee_1>120</refund_fee_1>
+<refund_status_1>PROCESSING</refund_status_1>
+<out_refund_no_2><![CDATA[R2]]></out_refund_no_2>
+<refund_id_2>50000000002</refund_id_2>
+<refund_fee_2>80</refund_fee_2>
+<refund_status_2>REFUNDCLOSE</refund_status_2>
+</xml>`
+	var resp RefundQueryResp
+	assert.Nil(t, xml.Unmarshal([]byte(body), &resp))
+	assert.Equal(t, "T1", resp.OutTradeNo)
+	assert.EqualValues(t, 300, resp.TotalFee)
+	assert.EqualValues(t, 3, resp.RefundCount)
+	assert.Len(t, resp.Refunds(), 3)
+
+	refund, ok := resp.Refund("R1")
+	assert.True(t, ok)
+	assert.Equal(t, "50000000001", refund.RefundId)
+	assert.EqualValues(t, 120, refund.RefundFee)
+	assert.Equal(t, "PROCESSING", refund.RefundStatus)
+
+	refund, ok = resp.Refund("R2")
+	assert.True(t, ok)
+	assert.Equal(t, "REFUNDCLOSE", refund.RefundStatus)
+
+	_, ok = resp.Refund("R3")
+	assert.False(t, ok)
+}
+
+func TestWxMch_ReqRefundQuery(t *testing.T) {
+	client := newStubHttp(`<xml>
+<return_code><![CDATA[SUCCESS]]></return_code>
+<result_code><![CDATA[SUCCESS]]></result_code>
+<appid><![CDATA[wx2421b1c4370ec43b]]></appid>
+<mch_id><![CDATA[10000100]]></mch_id>
+<transaction_id><![CDATA[1008450740201411110005820873]]></transaction_id>
+<out_trade_no><![CDATA[1415757673]]></out_trade_no>
+<total_fee>200</total_fee>
+<cash_fee>200</cash_fee>
+<refund_count>2</refund_count>
+<out_refund_no_0><![CDATA[1415701182]]></out_refund_no_0>
+<refund_id_0><![CDATA[2008450740201411110000174436]]></refund_id_0>
+<refund_fee_0>100</refund_fee_0>
+<refund_status_0><![CDATA[SUCCESS]]></refund_status_0>
+<refund_account_0><![CDATA[REFUND_SOURCE_RECHARGE_FUNDS]]></refund_account_0>
+<refund_recv_accout_0><![CDATA[招商银行信用卡0403]]></refund_recv_accout_0>
+<out_refund_no_1><![CDATA[1415701183]]></out_refund_no_1>
+<refund_id_1><![CDATA[2008450740201411110000174437]]></refund_id_1>
+<refund_fee_1>50</refund_fee_1>
+<refund_status_1><![CDATA[PROCESSING]]></refund_status_1>
+<refund_account_1><![CDATA[REFUND_SOURCE_UNSETTLED_FUNDS]]></refund_account_1>
+</xml>`)
+	// 查询退款不需要证书
+	s := NewWxMchService(&MchConfig{
+		AppId:  "wx2421b1c4370ec43b",
+		MchId:  "10000100",
+		ApiKey: "192006250b4c09247ec02edce69f6a2d",
+	})
+	s.client = client
+
+	resp, err := s.ReqRefundQuery(context.Background(), &RefundQueryReq{OutTradeNo: "1415757673"})
+	assert.Nil(t, err)
+	assert.Equal(t, mchRefundQueryUrl, client.last().url)
+	params := assertSignedRequest(t, client.last(), s.key)
+	assert.Equal(t, "1415757673", params["out_trade_no"])
+	assert.Equal(t, "10000100", params["mch_id"])
+	assert.NotContains(t, params, "refund_id")
+	assert.NotContains(t, params, "offset")
+
+	refunds := resp.Refunds()
+	if assert.Len(t, refunds, 2) {
+		assert.Equal(t, "1415701182", refunds[0].OutRefundNo)
+		assert.EqualValues(t, 100, refunds[0].RefundFee)
+		assert.Equal(t, "SUCCESS", refunds[0].RefundStatus)
+		assert.Equal(t, "REFUND_SOURCE_RECHARGE_FUNDS", refunds[0].RefundAccount)
+		assert.Equal(t, "PROCESSING", refunds[1].RefundStatus)
+		assert.Equal(t, "REFUND_SOURCE_UNSETTLED_FUNDS", refunds[1].RefundAccount)
+	}
+
+	_, err = s.ReqRefundQuery(context.Background(), &RefundQueryReq{})
+	assert.Equal(t, ErrMissingRefundNo, err)
+	assert.Len(t, client.requests, 1)
+
+	// 退款单不存在时和其他接口一样通过result_code和err_code返回
+	client = newStubHttp(`<xml>
+<return_code><![CDATA[SUCCESS]]></return_code>
+<result_code><![CDATA[FAIL]]></result_code>
+<err_code><![CDATA[REFUNDNOTEXIST]]></err_code>
+<err_code_des><![CDATA[not exist]]></err_code_des>
+</xml>`)
+	s.client = client
+	resp, err = s.ReqRefundQuery(context.Background(), &RefundQueryReq{OutRefundNo: "1415701184"})
+	assert.Nil(t, err)
+	assert.Equal(t, "REFUNDNOTEXIST", resp.ErrCode)
+	assert.Empty(t, resp.Refunds())
+	assert.Equal(t, "1415701184", assertSignedRequest(t, client.last(), s.key)["out_refund_no"])
+}
+
+func TestWxMch_ReqReverseOrder(t *testing.T) {
+	// 撤销没有完成，recall=Y时需要再次撤销
+	client := newStubHttp(`<xml>
+<return_code><![CDATA[SUCCESS]]></return_code>
+<result_code><![CDATA[FAIL]]></result_code>
+<appid><![CDATA[wx2421b1c4370ec43b]]></appid>
+<mch_id><![CDATA[10000100]]></mch_id>
+<err_code><![CDATA[SYSTEMERROR]]></err_code>
+<err_code_des><![CDATA[系统超时]]></err_code_des>
+<recall><![CDATA[Y]]></recall>
+</xml>`, `<xml>
+<return_code><![CDATA[SUCCESS]]></return_code>
+<result_code><![CDATA[SUCCESS]]></result_code>
+<recall><![CDATA[N]]></recall>
+</xml>`)
+	s := newTestMch(client)
+	resp, err := s.ReqReverseOrder(context.Background(), "1415757673")
+	assert.Nil(t, err)
+	assert.True(t, resp.NeedRecall())
+	assert.Equal(t, ErrCodeSystemError, resp.ErrCode)
+
+	sent := client.last()
+	assert.Equal(t, mchReverseUrl, sent.url)
+	params := assertSignedRequest(t, sent, s.key)
+	assert.Equal(t, "1415757673", params["out_trade_no"])
+	assert.Equal(t, SignTypeMD5, params["sign_type"])
+
+	resp, err = s.ReqReverseOrder(context.Background(), "1415757673")
+	assert.Nil(t, err)
+	assert.False(t, resp.NeedRecall())
+	assert.Equal(t, "SUCCESS", resp.ResultCode)
+
+	_, err = s.ReqReverseOrder(context.Background(), "")
+	assert.True(t, errors.Is(err, ErrInvalidTradeNo), "err = %v", err)
+	assert.Len(t, client.requests, 2)
+}
+
+func TestFullRefund(t *testing.T) {
+	body := `<xml>
+<return_code>SUCCESS</return_code>
+<result_code>SUCCESS</result_code>
+<transaction_id>1008450740201411110005820873</transaction_id>
+<out_trade_no>T1</out_trade_no>
+<trade_state>SUCCESS</trade_state>
+<total_fee>300</total_fee>
+<fee_type>CNY</fee_type>
+<cash_fee>200</cash_fee>
+<coupon_fee>100</coupon_fee>
+<coupon_count>1</coupon_count>
+<coupon_id_0>10000</coupon_id_0>
+<coupon_fee_0>100</coupon_fee_0>
+</xml>`
+	var query QueryOrderResp
+	assert.Nil(t, xml.Unmarshal([]byte(body), &query))
+
+	req, err := FullRefund(&query, "R1")
+	assert.Nil(t, err)
+	assert.Equal(t, "1008450740201411110005820873", req.TransactionId)
+	assert.Equal(t, "T1", req.OutTradeNo)
+	assert.Equal(t, "R1", req.OutRefundNo)
+	assert.Equal(t, "CNY", req.RefundFeeType)
+	// 使用订单总金额，而不是现金支付金额
+	assert.EqualValues(t, 300, req.TotalFee)
+	assert.EqualValues(t, 300, req.RefundFee)
+
+	client := newStubHttp(`<xml><return_code>SUCCESS</return_code><result_code>SUCCESS</result_code><refund_id>50000408942018111907145868882</refund_id></xml>`)
+	s := newTestMch(client)
+	_, err = s.ReqPayRefund(context.Background(), req)
+	assert.Nil(t, err)
+	params := assertSignedRequest(t, client.last(), s.key)
+	assert.Equal(t, "300", params["total_fee"])
+	assert.Equal(t, "300", params["refund_fee"])
+	assert.Equal(t, "T1", params["out_trade_no"])
+	assert.Equal(t, "CNY", params["refund_fee_type"])
+
+	// 服务商模式下使用订单的子商户号
+	query.SubMchId = "1900000109"
+	req, err = FullRefund(&query, "R1")
+	assert.Nil(t, err)
+	assert.Equal(t, "1900000109", req.SubMchId)
+
+	// 未支付或者已关闭的订单不能退款
+	for _, state := range []TradeState{TradeStateNotPay, TradeStateClosed, TradeStatePayError, ""} {
+		query.TradeState = state
+		_, err = FullRefund(&query, "R1")
+		assert.True(t, errors.Is(err, ErrNotRefundable), "err = %v", err)
+	}
+	query.TradeState = TradeStateRefund
+	_, err = FullRefund(&query, "R1")
+	assert.Nil(t, err)
+	_, err = FullRefund(nil, "R1")
+	assert.True(t, errors.Is(err, ErrNotRefundable), "err = %v", err)
+}
+
+func TestWxMch_WithoutCerts(t *testing.T) {
+	s := NewWxMchService(&MchConfig{
+		AppId:  "wx2421b1c4370ec43b",
+		MchId:  "10000100",
+		ApiKey: "192006250b4c09247ec02edce69f6a2d",
+	})
+	_, err := s.ReqPayRefund(context.Background(), &MchPayRefundReq{TransactionId: "4200000252201811190604084104", OutRefundNo: "R1", TotalFee: 100, RefundFee: 100})
+	assert.True(t, errors.Is(err, ErrCertRequired), "err = %v", err)
+	assert.Contains(t, err.Error(), "requires client certificates")
+	_, err = s.ReqWxToMchPay(context.Background(), &MchPayReq{PartnerTradeNO: "T1", OpenID: "OPENID", Amount: 100})
+	assert.True(t, errors.Is(err, ErrCertRequired), "err = %v", err)
+	_, err = s.ReqReverseOrder(context.Background(), "1415757673")
+	assert.True(t, errors.Is(err, ErrCertRequired), "err = %v", err)
+	_, err = s.ReqDownloadFundFlow(context.Background(), &DownloadFundFlowReq{BillDate: "20180603", AccountType: AccountTypeBasic})
+	assert.True(t, errors.Is(err, ErrCertRequired), "err = %v", err)
+	_, err = s.TLSClient()
+	assert.True(t, errors.Is(err, ErrCertRequired), "err = %v", err)
+
+	// 不需要证书的接口正常发送
+	client := newStubHttp(`<xml><return_code>SUCCESS</return_code><result_code>SUCCESS</result_code></xml>`)
+	s.client = client
+	req := &ProfitSharingAddReceiverReq{}
+	assert.Nil(t, req.SetReceiver(ProfitSharingReceiver{Type: ReceiverTypeMerchantId, Account: "190001001", Name: "示例商户", RelationType: "SERVICE_PROVIDER"}))
+	_, err = s.ReqProfitSharingAddReceiver(context.Background(), req)
+	assert.Nil(t, err)
+	assert.Len(t, client.requests, 1)
+}
+
+func TestWxMch_ReqWxToMchPay_SpbillCreateIP(t *testing.T) {
+	outboundIP = func() (string, error) { return "10.0.0.8", nil }
+	defer func() { outboundIP = OutboundIP }()
+	client := newStubHttp(`<xml><return_code>SUCCESS</return_code><result_code>SUCCESS</result_code><payment_no>1000018301201505190181489473</payment_no></xml>`)
+	s := newTestMch(client)
+
+	req := &MchPayReq{PartnerTradeNO: "T1", OpenID: "OPENID", CheckName: "NO_CHECK", Amount: 100, Desc: "desc"}
+	_, err := s.ReqWxToMchPay(context.Background(), req)
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.8", req.SpbillCreateIP)
+	params := assertSignedRequest(t, client.last(), s.key)
+	assert.Equal(t, "10.0.0.8", params["spbill_create_ip"])
+
+	// 设置了IP时不会替换
+	req = &MchPayReq{PartnerTradeNO: "T2", OpenID: "OPENID", CheckName: "NO_CHECK", Amount: 100, Desc: "desc", SpbillCreateIP: "2001:db8::1"}
+	_, err = s.ReqWxToMchPay(context.Background(), req)
+	assert.Nil(t, err)
+	assert.Equal(t, "2001:db8::1", parseXMLParams(t, client.last().body)["spbill_create_ip"])
+
+	for _, ip := range []string{"192.168.0", "192.168.0.1:80", "localhost"} {
+		req = &MchPayReq{PartnerTradeNO: "T3", OpenID: "OPENID", CheckName: "NO_CHECK", Amount: 100, Desc: "desc", SpbillCreateIP: ip}
+		_, err = s.ReqWxToMchPay(context.Background(), req)
+		assert.True(t, errors.Is(err, ErrInvalidIP), "ip = %q, err = %v", ip, err)
+	}
+	assert.Len(t, client.requests, 2)
+
+	outboundIP = func() (string, error) { return "", errors.New("network is unreachable") }
+	_, err = s.ReqWxToMchPay(context.Background(), &MchPayReq{PartnerTradeNO: "T4", OpenID: "OPENID", Amount: 100})
+	assert.True(t, errors.Is(err, ErrInvalidIP), "err = %v", err)
+	assert.Len(t, client.requests, 2)
+}
+
+func TestWxMch_MinTLSVersion(t *testing.T) {
+	cfg, cleanup := writeTestCerts(t)
+	defer cleanup()
+
+	s := &wxMch{cfg: cfg}
+	transport, err := s.loadTransport()
+	assert.Nil(t, err)
+	assert.EqualValues(t, tls.VersionTLS12, transport.TLSClientConfig.MinVersion)
+	assert.Nil(t, transport.TLSClientConfig.CipherSuites)
+
+	cfg.MinTLSVersion = tls.VersionTLS13
+	cfg.CipherSuites = []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}
+	transport, err = s.loadTransport()
+	assert.Nil(t, err)
+	assert.EqualValues(t, tls.VersionTLS13, transport.TLSClientConfig.MinVersion)
+	assert.Equal(t, cfg.CipherSuites, transport.TLSClientConfig.CipherSuites)
+}
+
+func TestWxMch_SignedRequests(t *testing.T) {
+	ok := `<xml><return_code>SUCCESS</return_code><result_code>SUCCESS</result_code></xml>`
+	client := newStubHttp(ok)
+	s := newTestMch(client)
+	ctx := context.Background()
+
+	calls := map[string]func() error{
+		mchPayUrl: func() error {
+			_, err := s.ReqWxToMchPay(ctx, &MchPayReq{PartnerTradeNO: "T1", OpenID: "OPENID", CheckName: "NO_CHECK", Amount: 100, Desc: "desc", SpbillCreateIP: "192.168.0.1"})
+			return err
+		},
+		mchReqUrl: func() error {
+			_, err := s.ReqMchPayment(ctx, "T1")
+			return err
+		},
+		mchRefundUrl: func() error {
+			_, err := s.ReqPayRefund(ctx, &MchPayRefundReq{TransactionId: "4200000252201811190604084104", OutRefundNo: "R1", TotalFee: 100, RefundFee: 100})
+			return err
+		},
+		profitSharingFinishUrl: func() error {
+			_, err := s.ReqProfitSharingFinish(ctx, &ProfitSharingFinishReq{TransactionId: "4208450740201411110007820472", OutOrderNo: "P1", Description: "分账已完成"})
+			return err
+		},
+		profitSharingReturnUrl: func() error {
+			_, err := s.ReqProfitSharingReturn(ctx, &ProfitSharingReturnReq{OutOrderNo: "P1", OutReturnNo: "R1", ReturnAccountType: "MERCHANT_ID", ReturnAccount: "86693852", ReturnAmount: 888, Description: "用户退款"})
+			return err
+		},
+	}
+	for url, call := range calls {
+		assert.Nil(t, call(), url)
+		assert.Equal(t, url, client.last().url)
+		assertSignedRequest(t, client.last(), s.key)
+	}
+
+	// 签名与传值还是传指针无关
+	req := MchPayReq{MchAppID: "wx2421b1c4370ec43b", MchID: "10000100", NonceStr: "5K8264ILTKCH16CQ2502SI8ZNMTM67VS", PartnerTradeNO: "T1", Amount: 100}
+	ptr := &req
+	byValue, err := s.sign(ctx, req)
+	assert.Nil(t, err)
+	byPointer, err := s.sign(ctx, ptr)
+	assert.Nil(t, err)
+	byDoublePointer, err := s.sign(ctx, &ptr)
+	assert.Nil(t, err)
+	assert.Equal(t, byValue, byPointer)
+	assert.Equal(t, byValue, byDoublePointer)
+}
+
+func TestMchPayReq_String(t *testing.T) {
+	sign := "0CB01533B8C1EF103065174F50BCA001"
+	req := MchPayReq{PartnerTradeNO: "10000098201411111234567890", OpenID: "oxTWIuGaIt6gTKsQRLau2M0yL16E", Amount: 100, Sign: sign}
+	assert.Contains(t, req.String(), "partner_trade_no=10000098201411111234567890")
+	assert.Contains(t, req.String(), "amount=100")
+	assert.Contains(t, req.String(), "sign=***")
+	assert.NotContains(t, req.String(), sign)
+}
+
+func TestWxMch_ReqPayRefund_SubMerchant(t *testing.T) {
+	client := newStubHttp(`<xml><return_code>SUCCESS</return_code><result_code>SUCCESS</result_code><refund_id>50000408942018111907145868882</refund_id></xml>`)
+	s := newTestMch(client)
+	s.cfg.ServiceProvider = true
+
+	_, err := s.ReqPayRefund(context.Background(), &MchPayRefundReq{TransactionId: "4200000252201811190604084104", OutRefundNo: "R1", TotalFee: 100, RefundFee: 100})
+	assert.True(t, errors.Is(err, ErrMissingSubMchId), "err = %v", err)
+	_, err = s.ReqWxToMchPay(context.Background(), &MchPayReq{PartnerTradeNO: "T1", OpenID: "OPENID", CheckName: "NO_CHECK", Amount: 100, Desc: "desc", SpbillCreateIP: "192.168.0.1"})
+	assert.True(t, errors.Is(err, ErrMissingSubMchId), "err = %v", err)
+	assert.Len(t, client.requests, 0)
+
+	resp, err := s.ReqPayRefund(context.Background(), &MchPayRefundReq{
+		SubAppId:      "wx8888888888888888",
+		SubMchId:      "1900000109",
+		TransactionId: "4200000252201811190604084104",
+		OutRefundNo:   "R1",
+		TotalFee:      100,
+		RefundFee:     100,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "50000408942018111907145868882", resp.RefundId)
+	params := parseXMLParams(t, client.last().body)
+	assert.Equal(t, "wx8888888888888888", params["sub_appid"])
+	assert.Equal(t, "1900000109", params["sub_mch_id"])
+	assert.Equal(t, "10000100", params["mch_id"])
+	assert.Equal(t, expectedSign(params, s.key), params["sign"])
+
+	// 非服务商模式不发送子商户字段
+	s.cfg.ServiceProvider = false
+	_, err = s.ReqPayRefund(context.Background(), &MchPayRefundReq{TransactionId: "4200000252201811190604084104", OutRefundNo: "R2", TotalFee: 100, RefundFee: 100})
+	assert.Nil(t, err)
+	assert.NotContains(t, string(client.last().body), "sub_mch_id")
+}
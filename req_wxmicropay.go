@@ -0,0 +1,233 @@
+package wechat
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+const (
+	microPayUrl         = "https://api.mch.weixin.qq.com/pay/micropay"
+	authCodeToOpenIdUrl = "https://api.mch.weixin.qq.com/tools/authcodetoopenid"
+
+	// 付款码支付返回的交易类型，请求中不需要传trade_type
+	TradeTypeMicroPay = "MICROPAY"
+)
+
+var (
+	ErrMissingAuthCode = errors.New("[gowechat] missing auth_code")
+	ErrMicroPayUnknown = errors.New("[gowechat] micro pay result unknown")
+)
+
+type (
+	// 付款码支付请求，商户扫描用户的付款码，没有通知地址，支付结果在响应中返回
+	MicroPayReq struct {
+		XMLName        xml.Name `json:"-" xml:"xml"`
+		AppId          string   `json:"appid" xml:"appid"`
+		MchId          string   `json:"mch_id" xml:"mch_id"`
+		DeviceInfo     string   `json:"device_info" xml:"device_info"` //终端设备号
+		NonceStr       string   `json:"nonce_str" xml:"nonce_str"`
+		Sign           string   `json:"sign" xml:"sign"`
+		SignType       string   `json:"sign_type" xml:"sign_type"` //签名类型，为空时使用配置中的值，默认为MD5
+		Body           string   `json:"body" xml:"body"`           //商品描述
+		Detail         string   `json:"detail" xml:"detail"`
+		Attach         string   `json:"attach" xml:"attach"`
+		OutTradeNo     string   `json:"out_trade_no" xml:"out_trade_no"`
+		TotalFee       int64    `json:"total_fee,string" xml:"total_fee"` //订单金额，单位为分
+		FeeType        string   `json:"fee_type" xml:"fee_type"`
+		SpbillCreateIp string   `json:"spbill_create_ip" xml:"spbill_create_ip"`
+		GoodsTag       string   `json:"goods_tag" xml:"goods_tag,omitempty"`
+		LimitPay       string   `json:"limit_pay" xml:"limit_pay,omitempty"` //no_credit：不能使用信用卡支付
+		TimeStart      string   `json:"time_start" xml:"time_start,omitempty"`
+		TimeExpire     string   `json:"time_expire" xml:"time_expire,omitempty"`
+		AuthCode       string   `json:"auth_code" xml:"auth_code"`             //扫码得到的付款码
+		SceneInfo      string   `json:"scene_info" xml:"scene_info,omitempty"` //场景信息，使用 SetSceneInfo 设置
+	}
+
+	// 付款码支付的场景信息，编码成JSON后放在scene_info中
+	MicroPaySceneInfo struct {
+		StoreInfo *MicroPayStoreInfo `json:"store_info,omitempty"`
+	}
+
+	// 门店信息
+	MicroPayStoreInfo struct {
+		Id       string `json:"id"`                  //门店编号
+		Name     string `json:"name,omitempty"`      //门店名称
+		AreaCode string `json:"area_code,omitempty"` //门店行政区划码
+		Address  string `json:"address,omitempty"`   //门店详细地址
+	}
+
+	MicroPayResp struct {
+		XMLName            xml.Name `xml:"xml" json:"-"`
+		ReturnCode         string   `xml:"return_code" json:"return_code"`
+		ReturnMsg          string   `xml:"return_msg" json:"return_msg"`
+		AppID              string   `xml:"appid" json:"appid"`
+		MchID              string   `xml:"mch_id" json:"mch_id"`
+		DeviceInfo         string   `xml:"device_info" json:"device_info"`
+		NonceStr           string   `xml:"nonce_str" json:"nonce_str"`
+		Sign               string   `xml:"sign" json:"sign"`
+		ResultCode         string   `xml:"result_code" json:"result_code"`
+		ErrCode            string   `xml:"err_code" json:"err_code"` //USERPAYING、SYSTEMERROR、BANKERROR时需要查询订单确认结果，见 NeedQuery
+		ErrCodeDes         string   `xml:"err_code_des" json:"err_code_des"`
+		OpenId             string   `xml:"openid" json:"openid"`
+		IsSubscribe        string   `xml:"is_subscribe" json:"is_subscribe"`
+		TradeType          string   `xml:"trade_type" json:"trade_type"` //为MICROPAY
+		BankType           string   `xml:"bank_type" json:"bank_type"`
+		FeeType            string   `xml:"fee_type" json:"fee_type"`
+		TotalFee           int64    `xml:"total_fee" json:"total_fee"`
+		SettlementTotalFee int64    `xml:"settlement_total_fee" json:"settlement_total_fee"`
+		CouponFee          int64    `xml:"coupon_fee" json:"coupon_fee"`
+		CashFeeType        string   `xml:"cash_fee_type" json:"cash_fee_type"`
+		CashFee            int64    `xml:"cash_fee" json:"cash_fee"`
+		TransactionId      string   `xml:"transaction_id" json:"transaction_id"`
+		OutTradeNo         string   `xml:"out_trade_no" json:"out_trade_no"`
+		Attach             string   `xml:"attach" json:"attach"`
+		TimeEnd            string   `xml:"time_end" json:"time_end"`
+	}
+
+	authCodeToOpenIdReq struct {
+		XMLName  xml.Name `xml:"xml" json:"-"`
+		AppID    string   `xml:"appid" json:"appid"`
+		MchID    string   `xml:"mch_id" json:"mch_id"`
+		AuthCode string   `xml:"auth_code" json:"auth_code"`
+		NonceStr string   `xml:"nonce_str" json:"nonce_str"`
+		Sign     string   `xml:"sign" json:"sign"`
+		SignType string   `xml:"sign_type" json:"sign_type"`
+	}
+
+	AuthCodeToOpenIdResp struct {
+		XMLName    xml.Name `xml:"xml" json:"-"`
+		ReturnCode string   `xml:"return_code" json:"return_code"`
+		ReturnMsg  string   `xml:"return_msg" json:"return_msg"`
+		AppID      string   `xml:"appid" json:"appid"`
+		MchID      string   `xml:"mch_id" json:"mch_id"`
+		NonceStr   string   `xml:"nonce_str" json:"nonce_str"`
+		Sign       string   `xml:"sign" json:"sign"`
+		ResultCode string   `xml:"result_code" json:"result_code"`
+		ErrCode    string   `xml:"err_code" json:"err_code"` //AUTHCODEEXPIRE：付款码已过期，AUTH_CODE_INVALID：付款码错误
+		ErrCodeDes string   `xml:"err_code_des" json:"err_code_des"`
+		OpenId     string   `xml:"openid" json:"openid"`
+	}
+)
+
+func (r *MicroPayReq) SetAppId(appId string)       { r.AppId = appId }
+func (r *MicroPayReq) SetMchId(mchId string)       { r.MchId = mchId }
+func (r *MicroPayReq) SetNonceStr(nonceStr string) { r.NonceStr = nonceStr }
+func (r *MicroPayReq) SetSign(sign string)         { r.Sign = sign }
+func (r *MicroPayReq) SetSignType(signType string) { r.SignType = signType }
+
+func (r *authCodeToOpenIdReq) SetAppId(appId string)       { r.AppID = appId }
+func (r *authCodeToOpenIdReq) SetMchId(mchId string)       { r.MchID = mchId }
+func (r *authCodeToOpenIdReq) SetNonceStr(nonceStr string) { r.NonceStr = nonceStr }
+func (r *authCodeToOpenIdReq) SetSign(sign string)         { r.Sign = sign }
+func (r *authCodeToOpenIdReq) SetSignType(signType string) { r.SignType = signType }
+
+// 将场景信息编码成接口需要的JSON字符串
+func (r *MicroPayReq) SetSceneInfo(info MicroPaySceneInfo) error {
+	buf, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	r.SceneInfo = string(buf)
+	return nil
+}
+
+// 输出关键字段，付款码和签名用***代替，用于日志
+func (r MicroPayReq) String() string {
+	return fmt.Sprintf("MicroPayReq{out_trade_no=%s, total_fee=%d, auth_code=%s, sign_type=%s, sign=%s}",
+		r.OutTradeNo, r.TotalFee, maskSecret(r.AuthCode), r.SignType, maskSecret(r.Sign))
+}
+
+func (r MicroPayResp) String() string {
+	return fmt.Sprintf("MicroPayResp{return_code=%s, result_code=%s, err_code=%s, out_trade_no=%s, transaction_id=%s, total_fee=%d, sign=%s}",
+		r.ReturnCode, r.ResultCode, r.ErrCode, r.OutTradeNo, r.TransactionId, r.TotalFee, maskSecret(r.Sign))
+}
+
+func (r *MicroPayResp) result() payResult {
+	return payResult{r.ReturnCode, r.ReturnMsg, r.ResultCode, r.ErrCode, r.ErrCodeDes, r.AppID, r.MchID}
+}
+
+// 是否已经支付成功
+func (r *MicroPayResp) Paid() bool {
+	return r.result().success()
+}
+
+// 支付结果是否未知，用户支付中（需要输入密码）或者系统、银行错误时需要调用 ReqQueryOrder 查询支付结果
+func (r *MicroPayResp) NeedQuery() bool {
+	if r.ReturnCode != "SUCCESS" || r.ResultCode == "SUCCESS" {
+		return false
+	}
+	switch r.ErrCode {
+	case ErrCodeUserPaying, ErrCodeSystemError, ErrCodeBankError:
+		return true
+	}
+	return false
+}
+
+func (r *AuthCodeToOpenIdResp) result() payResult {
+	return payResult{r.ReturnCode, r.ReturnMsg, r.ResultCode, r.ErrCode, r.ErrCodeDes, r.AppID, r.MchID}
+}
+
+// 付款码支付，用户支付中或者系统错误时不返回error，通过 MicroPayResp.NeedQuery 判断是否需要查询订单
+// 网络错误或者响应无法解析时返回 ErrMicroPayUnknown，用户可能已经付款，调用方必须用 ReqQueryOrder 查询，或者用 ReqReverseOrder 撤销订单
+// 接口文档：https://pay.weixin.qq.com/wiki/doc/api/micropay.php?chapter=9_10&index=1
+func (w wxPay) ReqMicroPay(ctx context.Context, req *MicroPayReq) (*MicroPayResp, error) {
+	if strings.TrimSpace(req.AuthCode) == "" {
+		return nil, ErrMissingAuthCode
+	}
+	if err := validateTradeNo(req.OutTradeNo); err != nil {
+		return nil, err
+	}
+	if len(req.GoodsTag) > maxGoodsTagLength {
+		return nil, fmt.Errorf("%w: %q is longer than %d", ErrInvalidGoodsTag, req.GoodsTag, maxGoodsTagLength)
+	}
+	if req.SignType == "" {
+		req.SignType = w.signType(ctx)
+	}
+	if err := w.prepare(ctx, req); err != nil {
+		return nil, err
+	}
+
+	var resp MicroPayResp
+	if err := w.sendPayXML(ctx, microPayUrl, req, &resp); err != nil {
+		w.logger.Error("[wxpay] micro pay result unknown", zap.String("out_trade_no", req.OutTradeNo), zap.Error(err))
+		return nil, fmt.Errorf("%w: %v", ErrMicroPayUnknown, err)
+	}
+	if err := w.checkPayResp(microPayUrl, req, &resp); err != nil {
+		return nil, err
+	}
+	w.logger.Info("[wxpay] micro pay", w.bodyField("resp", resp))
+	if resp.NeedQuery() {
+		w.logger.Warn("[wxpay] micro pay need query", zap.String("out_trade_no", req.OutTradeNo), zap.String("err_code", resp.ErrCode))
+	}
+	return &resp, nil
+}
+
+// 付款码查询openid，付款码无效时不返回error，通过 err_code 区分付款码过期（AUTHCODEEXPIRE）和错误（AUTH_CODE_INVALID）
+// 接口文档：https://pay.weixin.qq.com/wiki/doc/api/micropay.php?chapter=9_13&index=9
+func (w wxPay) ReqAuthCodeToOpenId(ctx context.Context, authCode string) (*AuthCodeToOpenIdResp, error) {
+	if strings.TrimSpace(authCode) == "" {
+		return nil, ErrMissingAuthCode
+	}
+	req := authCodeToOpenIdReq{
+		AuthCode: authCode,
+		SignType: SignTypeMD5,
+	}
+	if err := w.prepare(ctx, &req); err != nil {
+		return nil, err
+	}
+
+	var resp AuthCodeToOpenIdResp
+	if err := w.postPayXML(ctx, authCodeToOpenIdUrl, &req, &resp); err != nil {
+		return nil, err
+	}
+	if !resp.result().success() {
+		w.logger.Warn("[wxpay] auth code to openid", zap.String("err_code", resp.ErrCode), zap.String("err_code_des", resp.ErrCodeDes))
+	}
+	return &resp, nil
+}
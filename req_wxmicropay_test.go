@@ -0,0 +1,127 @@
+package wechat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWxPay_ReqMicroPay(t *testing.T) {
+	client := newStubHttp(`<xml>
+<return_code><![CDATA[SUCCESS]]></return_code>
+<return_msg><![CDATA[OK]]></return_msg>
+<appid><![CDATA[wx2421b1c4370ec43b]]></appid>
+<mch_id><![CDATA[10000100]]></mch_id>
+<result_code><![CDATA[SUCCESS]]></result_code>
+<openid><![CDATA[oUpF8uN95-Ptaags6E_roPHg7AG0]]></openid>
+<trade_type><![CDATA[MICROPAY]]></trade_type>
+<bank_type><![CDATA[CCB_DEBIT]]></bank_type>
+<total_fee>1</total_fee>
+<cash_fee>1</cash_fee>
+<transaction_id><![CDATA[1008450740201411110005820873]]></transaction_id>
+<out_trade_no><![CDATA[1415757673]]></out_trade_no>
+<time_end><![CDATA[20141111170043]]></time_end>
+</xml>`)
+	s := newTestPay(client)
+	req := &MicroPayReq{
+		Body:           "刷卡支付测试",
+		OutTradeNo:     "1415757673",
+		TotalFee:       1,
+		SpbillCreateIp: "14.17.22.52",
+		AuthCode:       "120061098828009406",
+	}
+	assert.Nil(t, req.SetSceneInfo(MicroPaySceneInfo{StoreInfo: &MicroPayStoreInfo{Id: "SZTX001", Name: "腾大餐厅"}}))
+	resp, err := s.ReqMicroPay(context.Background(), req)
+	assert.Nil(t, err)
+	assert.True(t, resp.Paid())
+	assert.False(t, resp.NeedQuery())
+	assert.Equal(t, TradeTypeMicroPay, resp.TradeType)
+	assert.EqualValues(t, 1, resp.TotalFee)
+
+	sent := client.last()
+	assert.Equal(t, microPayUrl, sent.url)
+	params := assertSignedRequest(t, sent, s.key)
+	assert.Equal(t, "120061098828009406", params["auth_code"])
+	assert.Equal(t, SignTypeMD5, params["sign_type"])
+	assert.NotContains(t, params, "trade_type")
+	assert.NotContains(t, params, "notify_url")
+	var scene MicroPaySceneInfo
+	assert.Nil(t, json.Unmarshal([]byte(params["scene_info"]), &scene))
+	if assert.NotNil(t, scene.StoreInfo) {
+		assert.Equal(t, "SZTX001", scene.StoreInfo.Id)
+	}
+}
+
+func TestWxPay_ReqMicroPay_NeedQuery(t *testing.T) {
+	for _, errCode := range []string{ErrCodeUserPaying, ErrCodeSystemError, ErrCodeBankError} {
+		client := newStubHttp(`<xml><return_code>SUCCESS</return_code><result_code>FAIL</result_code><err_code>` + errCode + `</err_code><err_code_des>需要用户输入支付密码</err_code_des></xml>`)
+		resp, err := newTestPay(client).ReqMicroPay(context.Background(), &MicroPayReq{OutTradeNo: "T1", TotalFee: 1, AuthCode: "120061098828009406"})
+		assert.Nil(t, err)
+		assert.False(t, resp.Paid(), errCode)
+		assert.True(t, resp.NeedQuery(), errCode)
+		assert.Equal(t, errCode, resp.ErrCode)
+	}
+
+	// 明确失败的错误不需要查询
+	client := newStubHttp(`<xml><return_code>SUCCESS</return_code><result_code>FAIL</result_code><err_code>AUTH_CODE_INVALID</err_code><err_code_des>授权码检验错误</err_code_des></xml>`)
+	resp, err := newTestPay(client).ReqMicroPay(context.Background(), &MicroPayReq{OutTradeNo: "T1", TotalFee: 1, AuthCode: "120061098828009406"})
+	assert.Nil(t, err)
+	assert.False(t, resp.Paid())
+	assert.False(t, resp.NeedQuery())
+
+	// 响应不完整时结果未知，需要查询或者撤销
+	client = newStubHttp(`<xml><return_code>SUCCESS</return_code><result_`)
+	_, err = newTestPay(client).ReqMicroPay(context.Background(), &MicroPayReq{OutTradeNo: "T1", TotalFee: 1, AuthCode: "120061098828009406"})
+	assert.True(t, errors.Is(err, ErrMicroPayUnknown), "err = %v", err)
+	assert.Len(t, client.requests, 1)
+
+	// 通信失败时微信没有受理，不是结果未知
+	client = newStubHttp(`<xml><return_code>FAIL</return_code><return_msg>签名错误</return_msg></xml>`)
+	_, err = newTestPay(client).ReqMicroPay(context.Background(), &MicroPayReq{OutTradeNo: "T1", TotalFee: 1, AuthCode: "120061098828009406"})
+	assert.True(t, errors.Is(err, ErrSignError), "err = %v", err)
+	assert.False(t, errors.Is(err, ErrMicroPayUnknown), "err = %v", err)
+
+	client = newStubHttp()
+	_, err = newTestPay(client).ReqMicroPay(context.Background(), &MicroPayReq{OutTradeNo: "T1", TotalFee: 1})
+	assert.True(t, errors.Is(err, ErrMissingAuthCode), "err = %v", err)
+	_, err = newTestPay(client).ReqMicroPay(context.Background(), &MicroPayReq{TotalFee: 1, AuthCode: "120061098828009406"})
+	assert.True(t, errors.Is(err, ErrInvalidTradeNo), "err = %v", err)
+	assert.Empty(t, client.requests)
+}
+
+func TestWxPay_ReqAuthCodeToOpenId(t *testing.T) {
+	client := newStubHttp(`<xml>
+<return_code><![CDATA[SUCCESS]]></return_code>
+<return_msg><![CDATA[OK]]></return_msg>
+<appid><![CDATA[wx2421b1c4370ec43b]]></appid>
+<mch_id><![CDATA[10000100]]></mch_id>
+<result_code><![CDATA[SUCCESS]]></result_code>
+<openid><![CDATA[oUpF8uMuAJO_M2pxb1Q9zNjWeS6o]]></openid>
+</xml>`)
+	s := newTestPay(client)
+	resp, err := s.ReqAuthCodeToOpenId(context.Background(), "120061098828009406")
+	assert.Nil(t, err)
+	assert.Equal(t, "oUpF8uMuAJO_M2pxb1Q9zNjWeS6o", resp.OpenId)
+
+	sent := client.last()
+	assert.Equal(t, authCodeToOpenIdUrl, sent.url)
+	params := assertSignedRequest(t, sent, s.key)
+	assert.Equal(t, "120061098828009406", params["auth_code"])
+	assert.Equal(t, SignTypeMD5, params["sign_type"])
+
+	// 付款码过期和错误通过err_code区分
+	for _, errCode := range []string{ErrCodeAuthCodeExpire, ErrCodeAuthCodeInvalid} {
+		client = newStubHttp(`<xml><return_code>SUCCESS</return_code><result_code>FAIL</result_code><err_code>` + errCode + `</err_code><err_code_des>` + Describe(errCode) + `</err_code_des></xml>`)
+		resp, err = newTestPay(client).ReqAuthCodeToOpenId(context.Background(), "120061098828009406")
+		assert.Nil(t, err)
+		assert.Equal(t, errCode, resp.ErrCode)
+		assert.Equal(t, Describe(errCode), resp.ErrCodeDes)
+		assert.Empty(t, resp.OpenId)
+	}
+
+	_, err = newTestPay(client).ReqAuthCodeToOpenId(context.Background(), " ")
+	assert.Equal(t, ErrMissingAuthCode, err)
+}
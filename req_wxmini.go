@@ -3,12 +3,20 @@ package wechat
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"mime/multipart"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
 )
 
 const (
@@ -16,21 +24,89 @@ const (
 	accessTokenUrl      = "https://api.weixin.qq.com/cgi-bin/token"
 	subscribeMessageUrl = "https://api.weixin.qq.com/cgi-bin/message/subscribe/send"
 	wxCodeUnlimitedUrl  = "https://api.weixin.qq.com/wxa/getwxacodeunlimit"
+	wxCodeUrl           = "https://api.weixin.qq.com/wxa/getwxacode"
 	checkImageUrl       = "https://api.weixin.qq.com/wxa/img_sec_check"
 	checkMsgUrl         = "https://api.weixin.qq.com/wxa/msg_sec_check"
+	templateListUrl     = "https://api.weixin.qq.com/wxaapi/newtmpl/gettemplate"
+)
+
+// 小程序码对应的小程序版本
+const (
+	EnvVersionRelease = "release"
+	EnvVersionTrial   = "trial"
+	EnvVersionDevelop = "develop"
+
+	// 订阅消息跳转的小程序类型
+	MiniprogramStateDeveloper = "developer"
+	MiniprogramStateTrial     = "trial"
+	MiniprogramStateFormal    = "formal"
+
+	// 订阅消息的语言
+	LangZhCN = "zh_CN"
+	LangEnUS = "en_US"
+	LangZhHK = "zh_HK"
+	LangZhTW = "zh_TW"
+
+	// scene最多32个可见字符
+	maxSceneLength = 32
+	// 数量有限的小程序码的path最多1024个字符
+	maxCodePathLength = 1024
+	// scene中除数字、大小写字母外允许的字符
+	sceneSpecialChars = "!#$&'()*+,/:;=?@-._~"
+
+	// 文本内容检查最多2500个字符
+	maxMessageLength = 2500
+
+	// 内容安全检查2.0版本的场景值
+	SecCheckSceneProfile = 1 //资料
+	SecCheckSceneComment = 2 //评论
+	SecCheckSceneForum   = 3 //论坛
+	SecCheckSceneSocial  = 4 //社交日志
+
+	SecCheckSuggestRisky  = "risky"
+	SecCheckSuggestPass   = "pass"
+	SecCheckSuggestReview = "review"
+
+	// code2Session的错误码
+	errCodeInvalidCode = 40029 //code无效
+	errCodeCodeUsed    = 40163 //code已经被使用
 )
 
 var (
-	ErrTokenMissing = errors.New("[gowechat] token missing")
+	ErrTokenMissing      = errors.New("[gowechat] token missing")
+	ErrTokenExpired      = errors.New("[gowechat] token expired")
+	ErrInvalidEnvVersion = errors.New("[gowechat] invalid env version")
+	ErrInvalidScene      = errors.New("[gowechat] invalid scene")
+	ErrInvalidPage       = errors.New("[gowechat] invalid page")
+	ErrInvalidMiniCode   = errors.New("[gowechat] invalid mini code options")
+	ErrInvalidContent    = errors.New("[gowechat] invalid content")
+	ErrInvalidState      = errors.New("[gowechat] invalid miniprogram state")
+	ErrInvalidLang       = errors.New("[gowechat] invalid lang")
+	ErrTemplateNotFound  = errors.New("[gowechat] template not found")
+	ErrInvalidCheckScene = errors.New("[gowechat] invalid sec check scene")
+	ErrInvalidCode       = errors.New("[gowechat] invalid js code")
+	ErrLoginFailed       = errors.New("[gowechat] login failed")
+	// code已经使用过，通常是客户端重复提交了同一个code，也是 ErrInvalidCode
+	ErrCodeUsed = fmt.Errorf("%w: code been used", ErrInvalidCode)
 )
 
 type MiniService interface {
 	SetAccessToken(token string)
+	SetAccessTokenWithExpiry(token string, expiresAt time.Time)
+	SetTokenStore(store TokenStore)
+	StartTokenRefresher(ctx context.Context) <-chan struct{}
 	ReqCode2Session(ctx context.Context, code string) (*SessionResp, error)
+	Login(ctx context.Context, jsCode string) (*SessionResp, error)
 	ReqAccessToken(ctx context.Context) (*AccessTokenResp, error)
 	SendSubscribeMessage(ctx context.Context, req *SubscribeMessageReq) (*ErrorResp, error)
+	SendSubscribeMessages(ctx context.Context, reqs []*SubscribeMessageReq, budget *RetryBudget) []BatchSendResult
+	GetTemplateList(ctx context.Context) ([]Template, error)
+	TokenStats() TokenStats
 	ReqWxCodeUnlimited(ctx context.Context, req *WxCodeUnlimitedReq) ([]byte, error)
+	GetMiniCode(ctx context.Context, opts MiniCodeOptions) ([]byte, error)
 	CheckImage(ctx context.Context, media []byte) (*ErrorResp, error)
+	CheckImageReader(ctx context.Context, media io.Reader, size int64) (*ErrorResp, error)
+	CheckImageV2(ctx context.Context, media io.Reader, size int64, scene int, openid string) (*SecCheckResp, error)
 	CheckMessage(ctx context.Context, msg string) (*ErrorResp, error)
 }
 
@@ -61,8 +137,40 @@ type (
 		TemplateId       string                 `json:"template_id"`
 		Page             string                 `json:"page"`
 		Data             map[string]interface{} `json:"data"`
-		MiniprogramState string                 `json:"miniprogram_state"`
-		Lang             string                 `json:"lang"`
+		MiniprogramState string                 `json:"miniprogram_state"` //跳转小程序类型：developer、trial、formal，为空时使用formal
+		Lang             string                 `json:"lang"`              //语言类型：zh_CN、en_US、zh_HK、zh_TW，为空时微信默认为zh_CN
+	}
+
+	// 帐号下的订阅消息模板
+	Template struct {
+		PriTmplId string `json:"priTmplId"` //模板id，发送订阅消息时使用
+		Title     string `json:"title"`     //模板标题
+		Content   string `json:"content"`   //模板内容
+		Example   string `json:"example"`   //模板内容示例
+		Type      int    `json:"type"`      //模板类型，2为一次性订阅，3为长期订阅
+	}
+	// 内容安全检查2.0版本的结果
+	SecCheckResp struct {
+		ErrorResp
+		TraceId string           `json:"trace_id"`
+		Result  SecCheckResult   `json:"result"` //综合结果
+		Detail  []SecCheckDetail `json:"detail"` //详细检测结果
+	}
+	SecCheckResult struct {
+		Suggest string `json:"suggest"` //建议：risky、pass、review
+		Label   int    `json:"label"`   //命中标签枚举值，100为正常
+	}
+	SecCheckDetail struct {
+		Strategy string `json:"strategy"` //策略类型
+		ErrCode  int    `json:"errcode"`  //错误码，仅当该值为0时，该项结果有效
+		Suggest  string `json:"suggest"`
+		Label    int    `json:"label"`
+		Prob     int    `json:"prob"`    //0-100，代表置信度，越高代表越有可能属于当前返回的标签
+		Keyword  string `json:"keyword"` //命中的自定义关键词
+	}
+	templateListResp struct {
+		ErrorResp
+		Data []Template `json:"data"`
 	}
 
 	WxCodeUnlimitedReq struct {
@@ -75,31 +183,152 @@ type (
 			G int `json:"g"`
 			B int `json:"b"`
 		} `json:"line_color"`
-		IsHyaline bool `json:"is_hyaline"`
+		IsHyaline  bool   `json:"is_hyaline"`
+		EnvVersion string `json:"env_version,omitempty"` //要打开的小程序版本，为空时默认为正式版 release
+		CheckPath  *bool  `json:"check_path,omitempty"`  //是否检查page是否存在，为空时默认为true
+	}
+
+	// 生成小程序码的参数，Path不为空时生成数量有限的小程序码，否则按Scene生成不限数量的小程序码
+	MiniCodeOptions struct {
+		Scene      string         //不限数量的小程序码携带的参数，最多32个字符
+		Page       string         //不限数量的小程序码打开的页面，不能携带参数，为空时打开首页
+		CheckPath  *bool          //生成不限数量的小程序码时是否检查page是否存在，为空时默认为true
+		Path       string         //数量有限的小程序码打开的页面，可以携带参数，最多1024个字符
+		Width      int            //二维码的宽度，单位px
+		AutoColor  bool           //自动配置线条颜色
+		LineColor  *MiniCodeColor //AutoColor为false时线条的颜色
+		IsHyaline  bool           //是否需要透明底色
+		EnvVersion string         //要打开的小程序版本，为空时默认为正式版 release
+	}
+
+	MiniCodeColor struct {
+		R int `json:"r"`
+		G int `json:"g"`
+		B int `json:"b"`
+	}
+
+	// 数量有限的小程序码的请求
+	wxCodeReq struct {
+		Path       string         `json:"path"`
+		Width      int            `json:"width,omitempty"`
+		AutoColor  bool           `json:"auto_color"`
+		LineColor  *MiniCodeColor `json:"line_color,omitempty"`
+		IsHyaline  bool           `json:"is_hyaline"`
+		EnvVersion string         `json:"env_version,omitempty"`
 	}
 )
 
+// 校验配置中的必填项
+func (c *MiniConfig) Validate() error {
+	if c.AppId == "" {
+		return fmt.Errorf("%w: app id is required", ErrInvalidConfig)
+	}
+	if c.AppSecret == "" {
+		return fmt.Errorf("%w: app secret is required", ErrInvalidConfig)
+	}
+	return nil
+}
+
 type wxMini struct {
-	cfg   *MiniConfig
-	token string
+	cfg *MiniConfig
+	// 当前的access_token，所有副本共享同一个
+	token *tokenHolder
+	// 发送订阅消息前检查模板id是否存在
+	verifyTemplate bool
+	templates      *templateCache
+	tokenCounters  *tokenCounters
+	tokenStore     TokenStore
 	wxService
 }
 
-func NewWxMiniService(cfg *MiniConfig, client Http) *wxMini {
+// access_token和它的过期时间，过期时间为零值时表示未知，不做检查
+// 后台刷新和调用接口在不同的goroutine中读写，需要加锁
+type tokenHolder struct {
+	mu        sync.RWMutex
+	token     string
+	expiresAt time.Time
+}
+
+func (h *tokenHolder) set(token string, expiresAt time.Time) {
+	h.mu.Lock()
+	h.token, h.expiresAt = token, expiresAt
+	h.mu.Unlock()
+}
+
+func (h *tokenHolder) get() (string, time.Time) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.token, h.expiresAt
+}
+
+// access_token的使用计数，使用atomic读写，uint64字段放在最前面保证32位平台上的对齐
+type tokenCounters struct {
+	hits      uint64
+	misses    uint64
+	refreshes uint64
+}
+
+// TokenStats access_token缓存的统计数据
+type TokenStats struct {
+	Hits      uint64        //调用接口时token有效的次数
+	Misses    uint64        //调用接口时token缺失或过期的次数
+	Refreshes uint64        //设置token的次数
+	ExpiresIn time.Duration //当前token的剩余有效时间，过期时间未知或已过期时为0
+}
+
+// 缓存帐号下的模板id
+type templateCache struct {
+	mu  sync.Mutex
+	ids map[string]bool
+}
+
+func NewWxMiniService(cfg *MiniConfig, client Http, opts ...ServiceOption) *wxMini {
 	s := &wxMini{
-		cfg: cfg,
+		cfg:           cfg,
+		token:         &tokenHolder{},
+		templates:     &templateCache{},
+		tokenCounters: &tokenCounters{},
 		wxService: wxService{
 			client: client,
 			logger: zapLogger,
 		},
 	}
-	zapLogger.Info("init wx mini service success...")
+	s.applyOptions(opts)
+	if err := cfg.Validate(); err != nil {
+		s.logger.Warn("init wx mini service with invalid config", zap.Error(err))
+	}
+	s.logger.Info("init wx mini service success...")
 	return s
 }
 
 //设置access_token
 func (w *wxMini) SetAccessToken(token string) {
-	w.token = token
+	w.SetAccessTokenWithExpiry(token, time.Time{})
+}
+
+// 设置access_token和它的过期时间，过期后调用接口直接返回 ErrTokenExpired
+// 过期时间可以通过 AccessTokenResp.ExpiresIn 计算
+func (w *wxMini) SetAccessTokenWithExpiry(token string, expiresAt time.Time) {
+	w.token.set(token, expiresAt)
+	if w.tokenCounters != nil {
+		atomic.AddUint64(&w.tokenCounters.refreshes, 1)
+	}
+}
+
+// 返回access_token缓存的命中、未命中和刷新次数，以及当前token的剩余有效时间
+func (w wxMini) TokenStats() TokenStats {
+	var stats TokenStats
+	if w.tokenCounters != nil {
+		stats.Hits = atomic.LoadUint64(&w.tokenCounters.hits)
+		stats.Misses = atomic.LoadUint64(&w.tokenCounters.misses)
+		stats.Refreshes = atomic.LoadUint64(&w.tokenCounters.refreshes)
+	}
+	if token, expiresAt := w.token.get(); token != "" && !expiresAt.IsZero() {
+		if d := expiresAt.Sub(w.now()); d > 0 {
+			stats.ExpiresIn = d
+		}
+	}
+	return stats
 }
 
 // 登录凭证校验。通过 wx.login 接口获得临时登录凭证 code 后传到开发者服务器调用此接口完成登录流程
@@ -111,7 +340,7 @@ func (w wxMini) ReqCode2Session(ctx context.Context, jsCode string) (*SessionRes
 		if err != nil {
 			return err
 		}
-		return json.NewDecoder(response.Body).Decode(&sessionResp)
+		return w.decodeJSON(response, &sessionResp)
 	}); err != nil {
 		return nil, err
 	}
@@ -119,6 +348,27 @@ func (w wxMini) ReqCode2Session(ctx context.Context, jsCode string) (*SessionRes
 	return &sessionResp, nil
 }
 
+// 登录，调用 ReqCode2Session 并检查errcode
+// code无效时返回 ErrInvalidCode，已经使用过时返回 ErrCodeUsed（同时也是 ErrInvalidCode），其他错误返回 ErrLoginFailed
+func (w wxMini) Login(ctx context.Context, jsCode string) (*SessionResp, error) {
+	resp, err := w.ReqCode2Session(ctx, jsCode)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.ErrCode {
+	case 0:
+		if resp.OpenId == "" || resp.SessionKey == "" {
+			return nil, fmt.Errorf("%w: empty session", ErrLoginFailed)
+		}
+		return resp, nil
+	case errCodeInvalidCode:
+		return nil, fmt.Errorf("%w: errcode %d, %s", ErrInvalidCode, resp.ErrCode, resp.ErrMsg)
+	case errCodeCodeUsed:
+		return nil, fmt.Errorf("%w: errcode %d, %s", ErrCodeUsed, resp.ErrCode, resp.ErrMsg)
+	}
+	return nil, fmt.Errorf("%w: errcode %d, %s", ErrLoginFailed, resp.ErrCode, resp.ErrMsg)
+}
+
 // 获取小程序全局唯一后台接口调用凭据（access_token）
 // 接口文档：https://developers.weixin.qq.com/miniprogram/dev/api-backend/open-api/access-token/auth.getAccessToken.html
 func (w wxMini) ReqAccessToken(ctx context.Context) (*AccessTokenResp, error) {
@@ -128,7 +378,7 @@ func (w wxMini) ReqAccessToken(ctx context.Context) (*AccessTokenResp, error) {
 		if err != nil {
 			return err
 		}
-		return json.NewDecoder(response.Body).Decode(&resp)
+		return w.decodeJSON(response, &resp)
 	}); err != nil {
 		return nil, err
 	}
@@ -142,34 +392,182 @@ func (w wxMini) SendSubscribeMessage(ctx context.Context, req *SubscribeMessageR
 	if err := w.checkToken(); err != nil {
 		return nil, err
 	}
-	url := fmt.Sprintf("%s?access_token=%s", subscribeMessageUrl, w.token)
+	switch req.MiniprogramState {
+	case "":
+		req.MiniprogramState = MiniprogramStateFormal
+	case MiniprogramStateDeveloper, MiniprogramStateTrial, MiniprogramStateFormal:
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrInvalidState, req.MiniprogramState)
+	}
+	switch req.Lang {
+	case "", LangZhCN, LangEnUS, LangZhHK, LangZhTW:
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrInvalidLang, req.Lang)
+	}
+	if w.verifyTemplate {
+		if err := w.checkTemplate(ctx, req.TemplateId); err != nil {
+			return nil, err
+		}
+	}
+	url := fmt.Sprintf("%s?access_token=%s", subscribeMessageUrl, w.accessToken())
 	var resp ErrorResp
 	if err := w.PostJSON(ctx, url, req, func(response *http.Response, err error) error {
 		if err != nil {
 			return err
 		}
 
-		return json.NewDecoder(response.Body).Decode(&resp)
+		return w.decodeJSON(response, &resp)
 	}); err != nil {
 		return nil, err
 	}
 	return &resp, nil
 }
 
+// 开启后发送订阅消息前检查模板id是否存在于帐号下，避免模板id写错时才由微信返回40037
+// 模板列表会被缓存，模板id不在缓存中时会重新获取一次
+func (w *wxMini) SetVerifyTemplate(verify bool) {
+	w.verifyTemplate = verify
+}
+
+// 获取帐号下的订阅消息模板列表
+// 接口文档：https://developers.weixin.qq.com/miniprogram/dev/api-backend/open-api/subscribe-message/subscribeMessage.getTemplateList.html
+func (w wxMini) GetTemplateList(ctx context.Context) ([]Template, error) {
+	if err := w.checkToken(); err != nil {
+		return nil, err
+	}
+	url := fmt.Sprintf("%s?access_token=%s", templateListUrl, w.accessToken())
+	var resp templateListResp
+	if err := w.Get(ctx, url, func(response *http.Response, err error) error {
+		if err != nil {
+			return err
+		}
+		return w.decodeJSON(response, &resp)
+	}); err != nil {
+		return nil, err
+	}
+	if resp.ErrCode != 0 {
+		return nil, fmt.Errorf("[gowechat] get template list: %d %s", resp.ErrCode, resp.ErrMsg)
+	}
+	if w.templates != nil {
+		w.templates.set(resp.Data)
+	}
+	return resp.Data, nil
+}
+
+// 检查模板id是否存在，优先使用缓存的模板列表
+func (w wxMini) checkTemplate(ctx context.Context, templateId string) error {
+	if w.templates != nil && w.templates.has(templateId) {
+		return nil
+	}
+	templates, err := w.GetTemplateList(ctx)
+	if err != nil {
+		return err
+	}
+	for _, template := range templates {
+		if template.PriTmplId == templateId {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrTemplateNotFound, templateId)
+}
+
+func (c *templateCache) has(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ids[id]
+}
+
+func (c *templateCache) set(templates []Template) {
+	ids := make(map[string]bool, len(templates))
+	for _, template := range templates {
+		ids[template.PriTmplId] = true
+	}
+	c.mu.Lock()
+	c.ids = ids
+	c.mu.Unlock()
+}
+
 // 获取小程序码，适用于需要的码数量极多的业务场景。通过该接口生成的小程序码，永久有效，数量暂无限制
 // 接口文档：https://developers.weixin.qq.com/miniprogram/dev/api-backend/open-api/qr-code/wxacode.getUnlimited.html
+//
+// Deprecated: 使用 GetMiniCode
 func (w wxMini) ReqWxCodeUnlimited(ctx context.Context, req *WxCodeUnlimitedReq) ([]byte, error) {
+	opts := MiniCodeOptions{
+		Scene:      req.Scene,
+		Page:       req.Page,
+		CheckPath:  req.CheckPath,
+		Width:      req.Width,
+		AutoColor:  req.AutoColor,
+		LineColor:  &MiniCodeColor{R: req.LineColor.R, G: req.LineColor.G, B: req.LineColor.B},
+		IsHyaline:  req.IsHyaline,
+		EnvVersion: req.EnvVersion,
+	}
+	return w.GetMiniCode(ctx, opts)
+}
+
+// 获取小程序码，返回图片内容
+// opts.Path不为空时生成数量有限的小程序码（getQRCode），可以携带参数，和 CheckPath、Scene、Page 不能同时使用
+// 否则按scene生成不限数量的小程序码（getUnlimitedQRCode）
+// 接口文档：https://developers.weixin.qq.com/miniprogram/dev/OpenApiDoc/qrcode-link/qr-code/getQRCode.html
+// https://developers.weixin.qq.com/miniprogram/dev/OpenApiDoc/qrcode-link/qr-code/getUnlimitedQRCode.html
+func (w wxMini) GetMiniCode(ctx context.Context, opts MiniCodeOptions) ([]byte, error) {
 	if err := w.checkToken(); err != nil {
 		return nil, err
 	}
+	switch opts.EnvVersion {
+	case "", EnvVersionRelease, EnvVersionTrial, EnvVersionDevelop:
+	default:
+		return nil, ErrInvalidEnvVersion
+	}
+
+	if opts.Path != "" {
+		if opts.Scene != "" || opts.Page != "" || opts.CheckPath != nil {
+			return nil, fmt.Errorf("%w: path can not be used with scene, page or check_path", ErrInvalidMiniCode)
+		}
+		if n := utf8.RuneCountInString(opts.Path); n > maxCodePathLength {
+			return nil, fmt.Errorf("%w: path length %d exceeds %d", ErrInvalidPage, n, maxCodePathLength)
+		}
+		req := wxCodeReq{
+			Path:       opts.Path,
+			Width:      opts.Width,
+			AutoColor:  opts.AutoColor,
+			LineColor:  opts.LineColor,
+			IsHyaline:  opts.IsHyaline,
+			EnvVersion: opts.EnvVersion,
+		}
+		return w.postMiniCode(ctx, wxCodeUrl, &req)
+	}
+
+	if err := validateScene(opts.Scene); err != nil {
+		return nil, err
+	}
+	if err := validatePage(opts.Page); err != nil {
+		return nil, err
+	}
+	req := WxCodeUnlimitedReq{
+		Scene:      opts.Scene,
+		Page:       opts.Page,
+		Width:      opts.Width,
+		AutoColor:  opts.AutoColor,
+		IsHyaline:  opts.IsHyaline,
+		EnvVersion: opts.EnvVersion,
+		CheckPath:  opts.CheckPath,
+	}
+	if opts.LineColor != nil {
+		req.LineColor.R, req.LineColor.G, req.LineColor.B = opts.LineColor.R, opts.LineColor.G, opts.LineColor.B
+	}
+	return w.postMiniCode(ctx, wxCodeUnlimitedUrl, &req)
+}
 
-	url := fmt.Sprintf("%s?access_token=%s", wxCodeUnlimitedUrl, w.token)
+// 成功时返回图片内容，失败时返回JSON格式的错误信息
+func (w wxMini) postMiniCode(ctx context.Context, codeUrl string, req interface{}) ([]byte, error) {
+	url := fmt.Sprintf("%s?access_token=%s", codeUrl, w.accessToken())
 	var buff []byte
 	if err := w.PostJSON(ctx, url, req, func(response *http.Response, err error) error {
 		if err != nil {
 			return err
 		}
-		buff, err = ioutil.ReadAll(response.Body)
+		buff, err = w.readBody(response)
 		if err != nil {
 			return err
 		}
@@ -190,23 +588,63 @@ func (w wxMini) ReqWxCodeUnlimited(ctx context.Context, req *WxCodeUnlimitedReq)
 // 校验一张图片是否含有违法违规内容
 // 接口文档：https://developers.weixin.qq.com/miniprogram/dev/api-backend/open-api/sec-check/security.imgSecCheck.html
 func (w wxMini) CheckImage(ctx context.Context, media []byte) (*ErrorResp, error) {
+	return w.CheckImageReader(ctx, bytes.NewReader(media), int64(len(media)))
+}
+
+// 同 CheckImage，图片内容从media中流式读取，不会整个读入内存，size为图片的字节数
+func (w wxMini) CheckImageReader(ctx context.Context, media io.Reader, size int64) (*ErrorResp, error) {
 	if err := w.checkToken(); err != nil {
 		return nil, err
 	}
-	url := fmt.Sprintf("%s?access_token=%s", checkImageUrl, w.token)
+	url := fmt.Sprintf("%s?access_token=%s", checkImageUrl, w.accessToken())
 
-	var bodyBuff bytes.Buffer
-	bodyWriter := multipart.NewWriter(&bodyBuff)
-	if err := bodyWriter.WriteField("media", string(media)); err != nil {
+	contentType, body, err := newMultipartFile("media", "media", media, size, nil)
+	if err != nil {
 		return nil, err
 	}
 	var resp ErrorResp
-	if err := w.DoReq(ctx, http.MethodPost, url, bodyWriter.FormDataContentType(), bodyBuff.Bytes(), func(response *http.Response, err error) error {
+	if err := w.DoReq(ctx, http.MethodPost, url, contentType, body, func(response *http.Response, err error) error {
+		if err != nil {
+			return err
+		}
+
+		return w.decodeJSON(response, &resp)
+	}); err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
+}
+
+// 使用2.0版本校验一张图片是否含有违法违规内容，返回建议和命中的标签
+// scene为场景值，取值为 SecCheckScene*，openid为用户的openid，需要用户近两小时访问过小程序
+func (w wxMini) CheckImageV2(ctx context.Context, media io.Reader, size int64, scene int, openid string) (*SecCheckResp, error) {
+	if err := w.checkToken(); err != nil {
+		return nil, err
+	}
+	if scene < SecCheckSceneProfile || scene > SecCheckSceneSocial {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidCheckScene, scene)
+	}
+	if openid == "" {
+		return nil, fmt.Errorf("%w: openid is required", ErrInvalidCheckScene)
+	}
+	url := fmt.Sprintf("%s?access_token=%s", checkImageUrl, w.accessToken())
+
+	contentType, body, err := newMultipartFile("media", "media", media, size, map[string]string{
+		"version": "2",
+		"scene":   strconv.Itoa(scene),
+		"openid":  openid,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var resp SecCheckResp
+	if err := w.DoReq(ctx, http.MethodPost, url, contentType, body, func(response *http.Response, err error) error {
 		if err != nil {
 			return err
 		}
 
-		return json.NewDecoder(response.Body).Decode(&resp)
+		return w.decodeJSON(response, &resp)
 	}); err != nil {
 		return nil, err
 	}
@@ -214,33 +652,115 @@ func (w wxMini) CheckImage(ctx context.Context, media []byte) (*ErrorResp, error
 	return &resp, nil
 }
 
+// 检查结果是否有风险，需要人工审核的结果不算有风险
+func (r SecCheckResp) Risky() bool {
+	return r.Result.Suggest == SecCheckSuggestRisky
+}
+
 // 检查一段文本是否含有违法违规内容
 // 接口文档：https://developers.weixin.qq.com/miniprogram/dev/api-backend/open-api/sec-check/security.msgSecCheck.html
 func (w wxMini) CheckMessage(ctx context.Context, msg string) (*ErrorResp, error) {
 	if err := w.checkToken(); err != nil {
 		return nil, err
 	}
+	if err := validateMessage(msg); err != nil {
+		return nil, err
+	}
 	req := map[string]string{
 		"content": msg,
 	}
-	url := fmt.Sprintf("%s?access_token=%s", checkMsgUrl, w.token)
+	url := fmt.Sprintf("%s?access_token=%s", checkMsgUrl, w.accessToken())
 	var resp ErrorResp
 	if err := w.PostJSON(ctx, url, req, func(response *http.Response, err error) error {
 		if err != nil {
 			return err
 		}
 
-		return json.NewDecoder(response.Body).Decode(&resp)
+		return w.decodeJSON(response, &resp)
 	}); err != nil {
 		return nil, err
 	}
 	return &resp, nil
 }
 
+// 解密小程序 wx.getUserInfo、wx.getPhoneNumber 等接口返回的加密数据，返回解密后的JSON
+// sessionKey、encryptedData、iv均为base64编码，使用AES-128-CBC解密
+// 文档地址：https://developers.weixin.qq.com/miniprogram/dev/framework/open-ability/signature.html
+func DecryptMiniData(sessionKey, encryptedData, iv string) ([]byte, error) {
+	var decoded [3][]byte
+	for i, value := range []string{sessionKey, encryptedData, iv} {
+		buf, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidCiphertext, err)
+		}
+		decoded[i] = buf
+	}
+	return aesCBCDecrypt(decoded[0], decoded[2], decoded[1])
+}
+
 ////////////////////////////////////////////////////////////////////////////////////////////////
+// 校验scene：最多32个字符，只能包含数字、大小写英文字母以及 !#$&'()*+,/:;=?@-._~
+func validateScene(scene string) error {
+	if len(scene) > maxSceneLength {
+		return fmt.Errorf("%w: length %d exceeds %d", ErrInvalidScene, len(scene), maxSceneLength)
+	}
+	for _, c := range scene {
+		if c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || strings.ContainsRune(sceneSpecialChars, c) {
+			continue
+		}
+		return fmt.Errorf("%w: forbidden character %q", ErrInvalidScene, c)
+	}
+	return nil
+}
+
+// 校验文本内容：必须是合法的UTF-8，长度按字符计算不超过2500
+func validateMessage(msg string) error {
+	if !utf8.ValidString(msg) {
+		return fmt.Errorf("%w: not valid utf-8", ErrInvalidContent)
+	}
+	if n := utf8.RuneCountInString(msg); n > maxMessageLength {
+		return fmt.Errorf("%w: length %d exceeds %d", ErrInvalidContent, n, maxMessageLength)
+	}
+	return nil
+}
+
+// 校验page：必须是已经发布的小程序页面，根路径前不要加/，不能携带参数
+// 页面是否已发布只能由微信检查，这里只检查格式
+func validatePage(page string) error {
+	if strings.HasPrefix(page, "/") {
+		return fmt.Errorf("%w: %q must not start with /", ErrInvalidPage, page)
+	}
+	if strings.ContainsAny(page, "?#") {
+		return fmt.Errorf("%w: %q must not carry parameters, use scene instead", ErrInvalidPage, page)
+	}
+	return nil
+}
+
 func (w wxMini) checkToken() error {
-	if w.token == "" {
+	err := w.validToken()
+	if w.tokenCounters != nil {
+		if err != nil {
+			atomic.AddUint64(&w.tokenCounters.misses, 1)
+		} else {
+			atomic.AddUint64(&w.tokenCounters.hits, 1)
+		}
+	}
+	return err
+}
+
+func (w wxMini) validToken() error {
+	token, expiresAt := w.token.get()
+	if token == "" {
 		return ErrTokenMissing
 	}
+	if !expiresAt.IsZero() && !w.now().Before(expiresAt) {
+		return fmt.Errorf("%w: expired at %s", ErrTokenExpired, expiresAt.Format(time.RFC3339))
+	}
 	return nil
 }
+
+// 当前的access_token
+func (w wxMini) accessToken() string {
+	token, _ := w.token.get()
+	return token
+}
@@ -1,21 +1,32 @@
 package wechat
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
 var (
-	token       = ""
+	token       = os.Getenv("WECHAT_ACCESS_TOKEN")
 	miniService MiniService
 )
 
 func init() {
 	cfg := MiniConfig{
-		AppId:     "",
-		AppSecret: "",
+		AppId:     os.Getenv("WECHAT_APP_ID"),
+		AppSecret: os.Getenv("WECHAT_APP_SECRET"),
 		SignType:  "",
 		TradeType: "",
 	}
@@ -23,6 +34,7 @@ func init() {
 }
 
 func TestWxMini_ReqAccessToken(t *testing.T) {
+	skipIfNotLive(t)
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
@@ -34,6 +46,7 @@ func TestWxMini_ReqAccessToken(t *testing.T) {
 }
 
 func TestWxMini_ReqWxCodeUnlimited(t *testing.T) {
+	skipIfNotLive(t)
 	miniService.SetAccessToken(token)
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
@@ -45,6 +58,7 @@ func TestWxMini_ReqWxCodeUnlimited(t *testing.T) {
 }
 
 func TestWxMini_CheckMessage(t *testing.T) {
+	skipIfNotLive(t)
 	miniService.SetAccessToken(token)
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
@@ -70,6 +84,7 @@ func TestWxMini_CheckMessage(t *testing.T) {
 }
 
 func TestWxMini_ReqCode2Session(t *testing.T) {
+	skipIfNotLive(t)
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
@@ -77,3 +92,442 @@ func TestWxMini_ReqCode2Session(t *testing.T) {
 	assert.Nil(t, err)
 	t.Logf("ReqCode2Session resp: %+v", resp)
 }
+
+func TestWxMini_Login(t *testing.T) {
+	client := newStubHttp(`{"openid":"OPENID","session_key":"SESSIONKEY","unionid":"UNIONID"}`)
+	resp, err := newTestMini(client).Login(context.Background(), "CODE")
+	assert.Nil(t, err)
+	assert.Equal(t, "OPENID", resp.OpenId)
+	assert.Equal(t, "SESSIONKEY", resp.SessionKey)
+	assert.Equal(t, code2sessionUrl+"?appid=wx2421b1c4370ec43b&secret=secret&js_code=CODE&grant_type=authorization_code", client.last().url)
+
+	client = newStubHttp(`{"errcode":40029,"errmsg":"invalid code"}`)
+	resp, err = newTestMini(client).Login(context.Background(), "CODE")
+	assert.Nil(t, resp)
+	assert.True(t, errors.Is(err, ErrInvalidCode), "err = %v", err)
+	assert.False(t, errors.Is(err, ErrCodeUsed))
+
+	// 已经使用过的code单独区分，调用方可以判断是否是客户端重复提交
+	client = newStubHttp(`{"errcode":40163,"errmsg":"code been used, rid: 5f6b1e2a-1c2b3d4e"}`)
+	resp, err = newTestMini(client).Login(context.Background(), "CODE")
+	assert.Nil(t, resp)
+	assert.True(t, errors.Is(err, ErrCodeUsed), "err = %v", err)
+	assert.True(t, errors.Is(err, ErrInvalidCode))
+	assert.Contains(t, err.Error(), "errcode 40163")
+
+	client = newStubHttp(`{"errcode":45011,"errmsg":"api minute-quota reach limit"}`)
+	_, err = newTestMini(client).Login(context.Background(), "CODE")
+	assert.True(t, errors.Is(err, ErrLoginFailed), "err = %v", err)
+	assert.False(t, errors.Is(err, ErrInvalidCode))
+}
+
+func newTestMini(client Http) *wxMini {
+	s := NewWxMiniService(&MiniConfig{AppId: "wx2421b1c4370ec43b", AppSecret: "secret"}, client)
+	s.SetAccessToken("ACCESS_TOKEN")
+	return s
+}
+
+func TestWxMini_ReqWxCodeUnlimited_TrialVersion(t *testing.T) {
+	client := newStubHttp("\x89PNG\r\n")
+	checkPath := false
+	codeBuff, err := newTestMini(client).ReqWxCodeUnlimited(context.Background(), &WxCodeUnlimitedReq{
+		Scene:      "a=1",
+		Page:       "pages/index/index",
+		EnvVersion: EnvVersionTrial,
+		CheckPath:  &checkPath,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("\x89PNG\r\n"), codeBuff)
+
+	var body map[string]interface{}
+	assert.Nil(t, json.Unmarshal(client.last().body, &body))
+	assert.Equal(t, "trial", body["env_version"])
+	assert.Equal(t, false, body["check_path"])
+
+	// 未设置时不传，由微信使用默认值
+	_, err = newTestMini(client).ReqWxCodeUnlimited(context.Background(), &WxCodeUnlimitedReq{Scene: "a=1"})
+	assert.Nil(t, err)
+	body = nil
+	assert.Nil(t, json.Unmarshal(client.last().body, &body))
+	assert.NotContains(t, body, "env_version")
+	assert.NotContains(t, body, "check_path")
+
+	_, err = newTestMini(client).ReqWxCodeUnlimited(context.Background(), &WxCodeUnlimitedReq{EnvVersion: "beta"})
+	assert.Equal(t, ErrInvalidEnvVersion, err)
+}
+
+func TestWxMini_GetMiniCode(t *testing.T) {
+	client := newStubHttp("\x89PNG\r\n")
+	s := newTestMini(client)
+
+	// scene模式
+	checkPath := false
+	codeBuff, err := s.GetMiniCode(context.Background(), MiniCodeOptions{
+		Scene:      "id=1",
+		Page:       "pages/index/index",
+		CheckPath:  &checkPath,
+		Width:      280,
+		LineColor:  &MiniCodeColor{R: 255},
+		EnvVersion: EnvVersionDevelop,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("\x89PNG\r\n"), codeBuff)
+	assert.Equal(t, wxCodeUnlimitedUrl+"?access_token=ACCESS_TOKEN", client.last().url)
+	var body map[string]interface{}
+	assert.Nil(t, json.Unmarshal(client.last().body, &body))
+	assert.Equal(t, "id=1", body["scene"])
+	assert.Equal(t, "pages/index/index", body["page"])
+	assert.Equal(t, false, body["check_path"])
+	assert.Equal(t, "develop", body["env_version"])
+	assert.EqualValues(t, 280, body["width"])
+	assert.Equal(t, map[string]interface{}{"r": 255.0, "g": 0.0, "b": 0.0}, body["line_color"])
+	assert.NotContains(t, body, "path")
+
+	// path模式，可以携带参数
+	codeBuff, err = s.GetMiniCode(context.Background(), MiniCodeOptions{Path: "pages/goods/detail?id=1&from=share", IsHyaline: true, EnvVersion: EnvVersionTrial})
+	assert.Nil(t, err)
+	assert.NotEmpty(t, codeBuff)
+	assert.Equal(t, wxCodeUrl+"?access_token=ACCESS_TOKEN", client.last().url)
+	body = nil
+	assert.Nil(t, json.Unmarshal(client.last().body, &body))
+	assert.Equal(t, "pages/goods/detail?id=1&from=share", body["path"])
+	assert.Equal(t, true, body["is_hyaline"])
+	assert.Equal(t, "trial", body["env_version"])
+	assert.NotContains(t, body, "scene")
+	assert.NotContains(t, body, "width")
+	assert.NotContains(t, body, "line_color")
+
+	_, err = s.GetMiniCode(context.Background(), MiniCodeOptions{Path: "pages/index/index", Scene: "id=1"})
+	assert.True(t, errors.Is(err, ErrInvalidMiniCode), "err = %v", err)
+	_, err = s.GetMiniCode(context.Background(), MiniCodeOptions{Path: "pages/index/index", CheckPath: &checkPath})
+	assert.True(t, errors.Is(err, ErrInvalidMiniCode), "err = %v", err)
+	_, err = s.GetMiniCode(context.Background(), MiniCodeOptions{Path: strings.Repeat("a", 1025)})
+	assert.True(t, errors.Is(err, ErrInvalidPage), "err = %v", err)
+	_, err = s.GetMiniCode(context.Background(), MiniCodeOptions{Path: "pages/index/index", EnvVersion: "beta"})
+	assert.Equal(t, ErrInvalidEnvVersion, err)
+	assert.Len(t, client.requests, 2)
+
+	client = newStubHttp(`{"errcode":41030,"errmsg":"invalid page rid: 6385d3c4-0c7bbd3b-5e0d4f3b"}`)
+	_, err = newTestMini(client).GetMiniCode(context.Background(), MiniCodeOptions{Scene: "id=1", Page: "pages/none"})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "invalid page")
+}
+
+func TestWxMini_ReqWxCodeUnlimited_TooLarge(t *testing.T) {
+	s := newTestMini(newStubHttp("0123456789abcdef"))
+	s.SetMaxBodySize(8)
+	codeBuff, err := s.ReqWxCodeUnlimited(context.Background(), &WxCodeUnlimitedReq{Scene: "a=1"})
+	assert.Nil(t, codeBuff)
+	assert.True(t, errors.Is(err, ErrResponseTooLarge), "err = %v", err)
+
+	s.SetMaxBodySize(16)
+	codeBuff, err = s.ReqWxCodeUnlimited(context.Background(), &WxCodeUnlimitedReq{Scene: "a=1"})
+	assert.Nil(t, err)
+	assert.Len(t, codeBuff, 16)
+}
+
+func TestMiniConfig_Validate(t *testing.T) {
+	assert.Nil(t, (&MiniConfig{AppId: "wx2421b1c4370ec43b", AppSecret: "secret"}).Validate())
+	assert.True(t, errors.Is((&MiniConfig{AppSecret: "secret"}).Validate(), ErrInvalidConfig))
+	assert.True(t, errors.Is((&MiniConfig{AppId: "wx2421b1c4370ec43b"}).Validate(), ErrInvalidConfig))
+}
+
+func TestWxMini_ExpiredToken(t *testing.T) {
+	client := newStubHttp(`{"errcode":0,"errmsg":"ok"}`, `{"errcode":0,"errmsg":"ok"}`)
+	s := newTestMini(client)
+
+	s.SetAccessTokenWithExpiry("ACCESS_TOKEN", time.Now().Add(-time.Minute))
+	resp, err := s.CheckMessage(context.Background(), "hello")
+	assert.Nil(t, resp)
+	assert.True(t, errors.Is(err, ErrTokenExpired), "err = %v", err)
+	assert.Len(t, client.requests, 0, "no request is sent with an expired token")
+
+	s.SetAccessTokenWithExpiry("ACCESS_TOKEN", time.Now().Add(time.Hour))
+	_, err = s.CheckMessage(context.Background(), "hello")
+	assert.Nil(t, err)
+
+	// 旧的设置方法不知道过期时间，不做检查
+	s.SetAccessTokenWithExpiry("ACCESS_TOKEN", time.Now().Add(-time.Minute))
+	s.SetAccessToken("ACCESS_TOKEN")
+	_, err = s.CheckMessage(context.Background(), "hello")
+	assert.Nil(t, err)
+	assert.Len(t, client.requests, 2)
+}
+
+func TestWxMini_TokenStats(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	client := newStubHttp(`{"errcode":0,"errmsg":"ok"}`)
+	s := NewWxMiniService(&MiniConfig{AppId: "wx2421b1c4370ec43b", AppSecret: "secret"}, client)
+	s.SetClock(fixedClock(now))
+	assert.Equal(t, TokenStats{}, s.TokenStats())
+
+	// 没有token
+	_, err := s.CheckMessage(context.Background(), "hello")
+	assert.True(t, errors.Is(err, ErrTokenMissing))
+
+	s.SetAccessTokenWithExpiry("ACCESS_TOKEN", now.Add(2*time.Hour))
+	_, err = s.CheckMessage(context.Background(), "hello")
+	assert.Nil(t, err)
+	_, err = s.CheckMessage(context.Background(), "world")
+	assert.Nil(t, err)
+	assert.Equal(t, TokenStats{Hits: 2, Misses: 1, Refreshes: 1, ExpiresIn: 2 * time.Hour}, s.TokenStats())
+
+	// 过期
+	s.SetClock(fixedClock(now.Add(3 * time.Hour)))
+	_, err = s.CheckMessage(context.Background(), "hello")
+	assert.True(t, errors.Is(err, ErrTokenExpired))
+	assert.Equal(t, TokenStats{Hits: 2, Misses: 2, Refreshes: 1}, s.TokenStats())
+	assert.Len(t, client.requests, 2)
+}
+
+// 使用 go test -race 检查后台刷新token和调用接口之间的数据竞争
+func TestWxMini_AccessToken_Concurrent(t *testing.T) {
+	client := newStubHttp(`{"errcode":0,"errmsg":"ok"}`)
+	s := newTestMini(client)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			s.SetAccessTokenWithExpiry("TOKEN"+strconv.Itoa(i), time.Now().Add(time.Hour))
+		}
+	}()
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// 使用值接收者的方法时会复制服务，副本之间也要共享同一个token
+			mini := *s
+			for j := 0; j < 25; j++ {
+				_, err := mini.CheckMessage(context.Background(), "hello")
+				assert.Nil(t, err)
+				mini.TokenStats()
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Len(t, client.requests, 100)
+	for _, req := range client.requests {
+		assert.Regexp(t, `access_token=(ACCESS_TOKEN|TOKEN\d+)$`, req.url)
+	}
+	s.SetAccessToken("LATEST")
+	_, err := s.CheckMessage(context.Background(), "hello")
+	assert.Nil(t, err)
+	assert.Contains(t, client.last().url, "access_token=LATEST")
+}
+
+func TestWxMini_ReqWxCodeUnlimited_InvalidScene(t *testing.T) {
+	client := newStubHttp()
+	s := newTestMini(client)
+
+	_, err := s.ReqWxCodeUnlimited(context.Background(), &WxCodeUnlimitedReq{Scene: strings.Repeat("a", 33)})
+	assert.True(t, errors.Is(err, ErrInvalidScene), "err = %v", err)
+
+	_, err = s.ReqWxCodeUnlimited(context.Background(), &WxCodeUnlimitedReq{Scene: "id=1&name=张三"})
+	assert.True(t, errors.Is(err, ErrInvalidScene), "err = %v", err)
+
+	_, err = s.ReqWxCodeUnlimited(context.Background(), &WxCodeUnlimitedReq{Scene: "id=1", Page: "/pages/index/index"})
+	assert.True(t, errors.Is(err, ErrInvalidPage), "err = %v", err)
+
+	_, err = s.ReqWxCodeUnlimited(context.Background(), &WxCodeUnlimitedReq{Scene: "id=1", Page: "pages/index/index?id=1"})
+	assert.True(t, errors.Is(err, ErrInvalidPage), "err = %v", err)
+	assert.Len(t, client.requests, 0)
+}
+
+func TestWxMini_CheckMessage_InvalidContent(t *testing.T) {
+	client := newStubHttp(`{"errcode":0,"errmsg":"ok"}`)
+	s := newTestMini(client)
+
+	_, err := s.CheckMessage(context.Background(), strings.Repeat("字", 2501))
+	assert.True(t, errors.Is(err, ErrInvalidContent), "err = %v", err)
+
+	_, err = s.CheckMessage(context.Background(), "hello\xff\xfe")
+	assert.True(t, errors.Is(err, ErrInvalidContent), "err = %v", err)
+	assert.Len(t, client.requests, 0)
+
+	// 按字符而不是字节计算长度
+	_, err = s.CheckMessage(context.Background(), strings.Repeat("字", 2500))
+	assert.Nil(t, err)
+	assert.Len(t, client.requests, 1)
+}
+
+// 记录读取了多少字节
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func TestWxMini_CheckImageReader(t *testing.T) {
+	media := bytes.Repeat([]byte("\x89PNG\r\n\x1a\n"), 64<<10)
+	client := newStubHttp(`{"errcode":0,"errmsg":"ok"}`)
+	reader := &countingReader{r: bytes.NewReader(media)}
+	resp, err := newTestMini(client).CheckImageReader(context.Background(), reader, int64(len(media)))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, resp.ErrCode)
+	assert.EqualValues(t, len(media), reader.n, "image is read once while sending")
+
+	sent := client.last()
+	assert.Equal(t, strconv.Itoa(len(sent.body)), sent.headers["Content-Length"])
+	assert.True(t, len(sent.body)-len(media) < 1024, "only the multipart header and boundary are added")
+
+	_, params, err := mime.ParseMediaType(sent.headers["Content-Type"])
+	assert.Nil(t, err)
+	part, err := multipart.NewReader(bytes.NewReader(sent.body), params["boundary"]).NextPart()
+	assert.Nil(t, err)
+	assert.Equal(t, "media", part.FormName())
+	assert.NotEmpty(t, part.FileName())
+	uploaded, err := ioutil.ReadAll(part)
+	assert.Nil(t, err)
+	assert.Equal(t, media, uploaded)
+
+	_, err = newTestMini(client).CheckImage(context.Background(), []byte("GIF89a"))
+	assert.Nil(t, err)
+}
+
+func TestWxMini_SendSubscribeMessage_Validate(t *testing.T) {
+	tests := []struct {
+		Name  string
+		State string
+		Lang  string
+		Err   error
+		Sent  string
+	}{
+		{"default state", "", "", nil, MiniprogramStateFormal},
+		{"developer", MiniprogramStateDeveloper, LangZhCN, nil, MiniprogramStateDeveloper},
+		{"trial", MiniprogramStateTrial, LangEnUS, nil, MiniprogramStateTrial},
+		{"formal", MiniprogramStateFormal, LangZhTW, nil, MiniprogramStateFormal},
+		{"invalid state", "release", "", ErrInvalidState, ""},
+		{"upper case state", "FORMAL", "", ErrInvalidState, ""},
+		{"invalid lang", MiniprogramStateFormal, "en", ErrInvalidLang, ""},
+	}
+	for _, test := range tests {
+		client := newStubHttp(`{"errcode":0,"errmsg":"ok"}`)
+		_, err := newTestMini(client).SendSubscribeMessage(context.Background(), &SubscribeMessageReq{
+			Touser:           "OPENID",
+			TemplateId:       "TEMPLATE_ID",
+			MiniprogramState: test.State,
+			Lang:             test.Lang,
+		})
+		if test.Err != nil {
+			assert.True(t, errors.Is(err, test.Err), "%s: err = %v", test.Name, err)
+			assert.Len(t, client.requests, 0, test.Name)
+			continue
+		}
+		assert.Nil(t, err, test.Name)
+		var body map[string]interface{}
+		assert.Nil(t, json.Unmarshal(client.last().body, &body))
+		assert.Equal(t, test.Sent, body["miniprogram_state"], test.Name)
+	}
+}
+
+const testTemplateList = `{
+	"errcode": 0,
+	"errmsg": "ok",
+	"data": [
+		{"priTmplId": "9Aw5ZV1j9xdWTFEkqCpZ7mIBbSC34khK55OtzUPl0rU", "title": "报名结果通知", "content": "会议时间:{{date2.DATA}}\n会议地点:{{thing1.DATA}}\n", "example": "会议时间:2016年8月8日\n会议地点:TIT会议室\n", "type": 2},
+		{"priTmplId": "cy_DfOZL7lypxHh3ja3DyAUbn1GYQRGwezuy5LBTFME", "title": "洗衣机故障提醒", "content": "完成时间:{{time1.DATA}}\n", "example": "完成时间:2019年11月1日 14:00\n", "type": 3}
+	]
+}`
+
+func TestWxMini_GetTemplateList(t *testing.T) {
+	client := newStubHttp(testTemplateList)
+	templates, err := newTestMini(client).GetTemplateList(context.Background())
+	assert.Nil(t, err)
+	assert.Len(t, templates, 2)
+	assert.Equal(t, "9Aw5ZV1j9xdWTFEkqCpZ7mIBbSC34khK55OtzUPl0rU", templates[0].PriTmplId)
+	assert.Equal(t, "报名结果通知", templates[0].Title)
+	assert.Equal(t, 3, templates[1].Type)
+	assert.Contains(t, client.last().url, "access_token=ACCESS_TOKEN")
+
+	_, err = newTestMini(newStubHttp(`{"errcode":40001,"errmsg":"invalid credential"}`)).GetTemplateList(context.Background())
+	assert.NotNil(t, err)
+}
+
+func TestWxMini_SendSubscribeMessage_VerifyTemplate(t *testing.T) {
+	ok := `{"errcode":0,"errmsg":"ok"}`
+	client := newStubHttp(testTemplateList, ok, ok, testTemplateList)
+	s := newTestMini(client)
+	s.SetVerifyTemplate(true)
+
+	for i := 0; i < 2; i++ {
+		_, err := s.SendSubscribeMessage(context.Background(), &SubscribeMessageReq{Touser: "OPENID", TemplateId: "cy_DfOZL7lypxHh3ja3DyAUbn1GYQRGwezuy5LBTFME"})
+		assert.Nil(t, err)
+	}
+	assert.Len(t, client.requests, 3, "template list is fetched once and cached")
+	assert.Contains(t, client.requests[0].url, templateListUrl)
+
+	_, err := s.SendSubscribeMessage(context.Background(), &SubscribeMessageReq{Touser: "OPENID", TemplateId: "cy_DfOZL7lypxHh3ja3DyAUbn1GYQRGwezuy5LBTFM"})
+	assert.True(t, errors.Is(err, ErrTemplateNotFound), "err = %v", err)
+	assert.Len(t, client.requests, 4, "unknown template id refreshes the list but is not sent")
+}
+
+func TestDecryptMiniData(t *testing.T) {
+	// 微信开放数据校验与解密文档中的示例
+	data, err := DecryptMiniData("tiihtNczf5v6AKRyjwEUhQ==",
+		"CiyLU1Aw2KjvrjMdj8YKliAjtP4gsMZMQmRzooG2xrDcvSnxIMXFufNstNGTyaGS9uT5geRa0W4oTOb1WT7fJlAC+oNPdbB+3hVbJSRgv+4lGOETKUQz6OYStslQ142dNCuabNPGBzlooOmB231qMM85d2/fV6ChevvXvQP8Hkue1poOFtnEtpyxVLW1zAo6/1Xx1COxFvrc2d7UL/lmHInNlxuacJXwu0fjpXfz/YqYzBIBzD6WUfTIF9GRHpOn/Hz7saL8xz+W//FRAUid1OksQaQx4CMs8LOddcQhULW4ucetDf96JcR3g0gfRK4PC7E/r7Z6xNrXd2UIeorGj5Ef7b1pJAYB6Y5anaHqZ9J6nKEBvB4DnNLIVWSgARns/8wR2SiRS7MNACwTyrGvt9ts8p12PKFdlqYTopNHR1Vf7XjfhQlVsAJdNiKdYmYVoKlaRv85IfVunYzO0IKXsyl7JCUjCpoG20f0a04COwfneQAGGwd5oa+T8yO5hzuyDb/XcxxmK01EpqOyuxINew==",
+		"r7BXXKkLb8qrSNn05n0qiA==")
+	assert.Nil(t, err)
+	var user struct {
+		OpenId    string `json:"openId"`
+		NickName  string `json:"nickName"`
+		Watermark struct {
+			AppId string `json:"appid"`
+		} `json:"watermark"`
+	}
+	assert.Nil(t, json.Unmarshal(data, &user))
+	assert.Equal(t, "oGZUI0egBJY1zhBYw2KhdUfwVJJE", user.OpenId)
+	assert.Equal(t, "Band", user.NickName)
+	assert.Equal(t, "wx4f4bc4dec97d474b", user.Watermark.AppId)
+
+	_, err = DecryptMiniData("dGlpaHROY3pmNXY2", "CiyLU1Aw2KjvrjMdj8YKliAjtP4gsMZMQmRzooG2xrA=", "r7BXXKkLb8qrSNn05n0qiA==")
+	assert.True(t, errors.Is(err, ErrInvalidKeyLength), "err = %v", err)
+}
+
+func TestWxMini_CheckImageV2(t *testing.T) {
+	client := newStubHttp(`{
+"errcode":0,"errmsg":"ok","trace_id":"60ae120f-371d5872-7941a05b",
+"result":{"suggest":"risky","label":20001},
+"detail":[{"strategy":"content_model","errcode":0,"suggest":"risky","label":20001,"prob":90}]
+}`, `{"errcode":0,"errmsg":"ok","result":{"suggest":"pass","label":100},"detail":[]}`)
+	s := newTestMini(client)
+	media := []byte("\x89PNG\r\n\x1a\n")
+
+	resp, err := s.CheckImageV2(context.Background(), bytes.NewReader(media), int64(len(media)), SecCheckSceneComment, "OPENID")
+	assert.Nil(t, err)
+	assert.True(t, resp.Risky())
+	assert.Equal(t, "60ae120f-371d5872-7941a05b", resp.TraceId)
+	assert.Equal(t, 20001, resp.Result.Label)
+	assert.Len(t, resp.Detail, 1)
+	assert.Equal(t, "content_model", resp.Detail[0].Strategy)
+	assert.Equal(t, 90, resp.Detail[0].Prob)
+
+	sent := client.last()
+	_, params, err := mime.ParseMediaType(sent.headers["Content-Type"])
+	assert.Nil(t, err)
+	form, err := multipart.NewReader(bytes.NewReader(sent.body), params["boundary"]).ReadForm(1 << 20)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"2"}, form.Value["version"])
+	assert.Equal(t, []string{"2"}, form.Value["scene"])
+	assert.Equal(t, []string{"OPENID"}, form.Value["openid"])
+	assert.Len(t, form.File["media"], 1)
+
+	resp, err = s.CheckImageV2(context.Background(), bytes.NewReader(media), int64(len(media)), SecCheckSceneSocial, "OPENID")
+	assert.Nil(t, err)
+	assert.False(t, resp.Risky())
+	assert.Equal(t, SecCheckSuggestPass, resp.Result.Suggest)
+	assert.Equal(t, 100, resp.Result.Label)
+
+	_, err = s.CheckImageV2(context.Background(), bytes.NewReader(media), int64(len(media)), 5, "OPENID")
+	assert.True(t, errors.Is(err, ErrInvalidCheckScene))
+	_, err = s.CheckImageV2(context.Background(), bytes.NewReader(media), int64(len(media)), SecCheckSceneForum, "")
+	assert.True(t, errors.Is(err, ErrInvalidCheckScene))
+	assert.Len(t, client.requests, 2)
+}
@@ -2,9 +2,14 @@ package wechat
 
 import (
 	"context"
+	"crypto/x509"
+	"encoding/json"
 	"encoding/xml"
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"go.uber.org/zap"
@@ -14,6 +19,16 @@ const (
 	unifiedOrderUrl = "https://api.mch.weixin.qq.com/pay/unifiedorder"
 	closeOrderUrl   = "https://api.mch.weixin.qq.com/pay/closeorder"
 	queryOrderUrl   = "https://api.mch.weixin.qq.com/pay/orderquery"
+
+	// 订单优惠标记的最大长度
+	maxGoodsTagLength = 32
+)
+
+var (
+	ErrOrderNotClosed   = errors.New("[gowechat] order not closed")
+	ErrOrderAlreadyPaid = errors.New("[gowechat] order already paid")
+	ErrDuplicateOrder   = errors.New("[gowechat] duplicate out_trade_no")
+	ErrInvalidGoodsTag  = errors.New("[gowechat] invalid goods_tag")
 )
 
 type PayService interface {
@@ -21,10 +36,28 @@ type PayService interface {
 	ReqUnifiedOrder(ctx context.Context, req *UnifiedOrderReq) (*UnifiedOrderResp, error)
 	ReqQueryOrder(ctx context.Context, tradeNo string) (*QueryOrderResp, error)
 	ReqCloseOrder(ctx context.Context, tradeNo string) (*CloseOrderResp, error)
+	CloseAndConfirm(ctx context.Context, tradeNo string, attempts int, interval time.Duration) (TradeState, error)
+	BatchQueryOrders(ctx context.Context, tradeNos []string, budget *RetryBudget) []BatchQueryResult
+	ConfirmNotify(ctx context.Context, req *NotifyReq) (*QueryOrderResp, error)
+	ReqDownloadBillData(ctx context.Context, req *DownloadBillReq) ([]byte, error)
+	ReqDownloadBill(ctx context.Context, req *DownloadBillReq) (*BillResult, error)
+	ReqMicroPay(ctx context.Context, req *MicroPayReq) (*MicroPayResp, error)
+	ReqAuthCodeToOpenId(ctx context.Context, authCode string) (*AuthCodeToOpenIdResp, error)
+	QuerySettlement(ctx context.Context, req *SettlementQueryReq) (*SettlementResp, error)
+	QuerySettlementAccount(ctx context.Context, subMchId string) (*SettlementAccountResp, error)
+	CreateJSAPIOrderV3(ctx context.Context, req *OrderV3Req) (*OrderV3Resp, error)
+	QueryOrderV3(ctx context.Context, outTradeNo string) (*TransactionV3, error)
+	CloseOrderV3(ctx context.Context, outTradeNo string) error
+	CreateRefundV3(ctx context.Context, req *RefundV3Req) (*RefundV3Resp, error)
+	QueryRefundV3(ctx context.Context, outRefundNo string) (*RefundV3Resp, error)
 
 	// utils function
+	NewJSAPIOrder(ctx context.Context, r *http.Request, openid, outTradeNo, body string, totalFee int64) *UnifiedOrderReq
 	GenPrepay(ctx context.Context, prepayId, nonceStr string) (*PrepayReturn, error)
+	GenPrepayJSON(ctx context.Context, prepayId, nonceStr string) ([]byte, error)
 	VerifySign(ctx context.Context, req *NotifyReq) bool
+	AddPlatformCert(cert *x509.Certificate) error
+	GenPrepayV3(ctx context.Context, prepayId string) (*PrepayReturn, error)
 }
 
 type (
@@ -34,6 +67,11 @@ type (
 		ApiKey    string
 		SignType  string
 		TradeType string
+		NotifyUrl string //支付结果通知地址，NewJSAPIOrder 使用
+		// 信任的反向代理的IP或CIDR，NewJSAPIOrder 只在请求来自这些代理时使用 X-Forwarded-For 中的客户端IP
+		TrustedProxies []string
+		// v3接口的配置，为nil时v3接口返回 ErrMissingV3Config
+		V3 *V3Config
 	}
 
 	UnifiedOrderReq struct {
@@ -53,7 +91,7 @@ type (
 		SpbillCreateIp string   `json:"spbill_create_ip" xml:"spbill_create_ip"` //终端IP
 		TimeStart      string   `json:"time_start" xml:"time_start"`             //交易起始时间
 		TimeExpire     string   `json:"time_expire" xml:"time_expire"`           //交易结束时间
-		GoodsTag       string   `json:"goods_tag" xml:"goods_tag"`               //订单优惠标记
+		GoodsTag       string   `json:"goods_tag" xml:"goods_tag,omitempty"`     //订单优惠标记，使用代金券或立减优惠时设置，为空时不发送
 		NotifyUrl      string   `json:"notify_url" xml:"notify_url"`             //通知地址
 		TradeType      string   `json:"trade_type" xml:"trade_type"`             //交易类型
 		OpenId         string   `json:"openid" xml:"openid"`                     //用户标识,trade_type=JSAPI，此参数必传，用户在商户appid下的唯一标识
@@ -98,39 +136,44 @@ type (
 		ErrCodeDes string `xml:"err_code_des"`
 	}
 
+	// xml标签用于计算签名，签名参数名和json的字段名相同
 	PrepayReturn struct {
-		AppId     string `json:"appId"`
-		TimeStamp string `json:"timeStamp"`
-		NonceStr  string `json:"nonceStr"`
-		Package   string `json:"package"`
-		SignType  string `json:"signType"`
-		PaySign   string `json:"paySign"`
+		AppId     string `json:"appId" xml:"appId"`
+		TimeStamp string `json:"timeStamp" xml:"timeStamp"`
+		NonceStr  string `json:"nonceStr" xml:"nonceStr"`
+		Package   string `json:"package" xml:"package"`
+		SignType  string `json:"signType" xml:"signType"`
+		PaySign   string `json:"paySign" xml:"paySign"`
 	}
 
 	NotifyReq struct {
-		XMLName       xml.Name `xml:"xml" json:"-"`
-		ReturnCode    string   `xml:"return_code" json:"return_code"`
-		ReturnMsg     string   `xml:"return_msg" json:"return_msg"`
-		AppID         string   `xml:"appid" json:"appid"`
-		MchID         string   `xml:"mch_id" json:"mch_id"`
-		DeviceInfo    string   `xml:"device_info" json:"device_info"`
-		NonceStr      string   `xml:"nonce_str" json:"nonce_str"`
-		Sign          string   `xml:"sign" json:"sign"`
-		SignType      string   `xml:"sign_type" json:"sign_type"`
-		ResultCode    string   `xml:"result_code" json:"result_code"`
-		ErrCode       string   `xml:"err_code" json:"err_code"`
-		ErrCodeDes    string   `xml:"err_code_des" json:"err_code_des"`
-		OpenId        string   `xml:"openid" json:"openid"`
-		IsSubscribe   string   `xml:"is_subscribe" json:"is_subscribe"`
-		TradeType     string   `xml:"trade_type" json:"trade_type"`
-		BankType      string   `xml:"bank_type" json:"bank_type"`
-		TotalFee      string   `xml:"total_fee" json:"total_fee"`
-		FeeType       string   `xml:"fee_type" json:"fee_type"`
-		CashFee       string   `xml:"cash_fee" json:"cash_fee"`
-		CashFeeType   string   `xml:"cash_fee_type" json:"cash_fee_type"`
-		TransactionId string   `xml:"transaction_id" json:"transaction_id"`
-		OutTradeNo    string   `xml:"out_trade_no" json:"out_trade_no"`
-		TimeEnd       string   `xml:"time_end" json:"time_end"`
+		XMLName            xml.Name `xml:"xml" json:"-"`
+		ReturnCode         string   `xml:"return_code" json:"return_code"`
+		ReturnMsg          string   `xml:"return_msg" json:"return_msg"`
+		AppID              string   `xml:"appid" json:"appid"`
+		MchID              string   `xml:"mch_id" json:"mch_id"`
+		DeviceInfo         string   `xml:"device_info" json:"device_info"`
+		NonceStr           string   `xml:"nonce_str" json:"nonce_str"`
+		Sign               string   `xml:"sign" json:"sign"`
+		SignType           string   `xml:"sign_type" json:"sign_type"`
+		ResultCode         string   `xml:"result_code" json:"result_code"`
+		ErrCode            string   `xml:"err_code" json:"err_code"`
+		ErrCodeDes         string   `xml:"err_code_des" json:"err_code_des"`
+		OpenId             string   `xml:"openid" json:"openid"`
+		IsSubscribe        string   `xml:"is_subscribe" json:"is_subscribe"`
+		TradeType          string   `xml:"trade_type" json:"trade_type"`
+		BankType           string   `xml:"bank_type" json:"bank_type"`
+		TotalFee           string   `xml:"total_fee" json:"total_fee"`                       //订单金额，单位为分，使用 TotalFeeFen 获取
+		SettlementTotalFee string   `xml:"settlement_total_fee" json:"settlement_total_fee"` //应结订单金额，使用了非充值代金券时返回
+		FeeType            string   `xml:"fee_type" json:"fee_type"`
+		CashFee            string   `xml:"cash_fee" json:"cash_fee"`
+		CashFeeType        string   `xml:"cash_fee_type" json:"cash_fee_type"`
+		TransactionId      string   `xml:"transaction_id" json:"transaction_id"`
+		OutTradeNo         string   `xml:"out_trade_no" json:"out_trade_no"`
+		Attach             string   `xml:"attach" json:"attach"` //统一下单时传入的附加数据，原样返回
+		TimeEnd            string   `xml:"time_end" json:"time_end"`
+		// 通知中的所有字段，包括结构体中没有的代金券等字段，校验签名时使用
+		fields map[string]string
 	}
 
 	NotifyResp struct {
@@ -142,7 +185,7 @@ type (
 	QueryOrderReq struct {
 		XMLName    xml.Name `xml:"xml" json:"-"`
 		AppID      string   `xml:"appid" json:"appid"`
-		MchID      string   `xml:"mchid" json:"mchid"`
+		MchID      string   `xml:"mch_id" json:"mchid"`
 		OutTradeNo string   `xml:"out_trade_no" json:"out_trade_no"`
 		NonceStr   string   `xml:"nonce_str" json:"nonce_str"`
 		Sign       string   `xml:"sign" json:"sign"`
@@ -150,101 +193,255 @@ type (
 	}
 
 	QueryOrderResp struct {
-		XMLName     xml.Name `xml:"xml" json:"-"`
-		ReturnCode  string   `xml:"return_code" json:"return_code"`
-		ReturnMsg   string   `xml:"return_msg" json:"return_msg"`
-		AppID       string   `xml:"appid" json:"appid"`
-		MchID       string   `xml:"mch_id" json:"mch_id"`
-		NonceStr    string   `xml:"nonce_str" json:"nonce_str"`
-		Sign        string   `xml:"sign" json:"sign"`
-		ResultCode  string   `xml:"result_code" json:"result_code"`
-		ErrCode     string   `xml:"err_code" json:"err_code"`
-		ErrCodeDes  string   `xml:"err_code_des" json:"err_code_des"`
-		DeviceInfo  string   `xml:"device_info" json:"device_info"`
-		OpenId      string   `xml:"openid" json:"openid"`
-		IsSubscribe string   `xml:"is_subscribe" json:"is_subscribe"`
-		TradeType   string   `xml:"trade_type" json:"trade_type"`
-		//SUCCESS—支付成功
-		//REFUND—转入退款
-		//NOTPAY—未支付
-		//CLOSED—已关闭
-		//REVOKED—已撤销（刷卡支付）
-		//USERPAYING--用户支付中
-		//PAYERROR--支付失败(其他原因，如银行返回失败)
-		TradeState         string `xml:"trade_state" json:"trade_state"`           //交易状态
-		TradeStateDesc     string `xml:"trade_state_desc" json:"trade_state_desc"` //交易状态描述
-		BankType           string `xml:"bank_type" json:"bank_type"`
-		TotalFee           int64  `xml:"total_fee" json:"total_fee"`
-		SettlementTotalFee int64  `xml:"settlement_total_fee" json:"settlement_total_fee"`
-		FeeType            string `xml:"fee_type" json:"fee_type"`
-		CashFee            int64  `xml:"cash_fee" json:"cash_fee"`
-		CashFeeType        string `xml:"cash_fee_type" json:"cash_fee_type"`
-		TransactionId      string `xml:"transaction_id" json:"transaction_id"`
-		OutTradeNo         string `xml:"out_trade_no" json:"out_trade_no"`
-		TimeEnd            string `xml:"time_end" json:"time_end"`
+		XMLName            xml.Name   `xml:"xml" json:"-"`
+		ReturnCode         string     `xml:"return_code" json:"return_code"`
+		ReturnMsg          string     `xml:"return_msg" json:"return_msg"`
+		AppID              string     `xml:"appid" json:"appid"`
+		MchID              string     `xml:"mch_id" json:"mch_id"`
+		SubMchId           string     `xml:"sub_mch_id" json:"sub_mch_id"` //服务商模式下的子商户号
+		NonceStr           string     `xml:"nonce_str" json:"nonce_str"`
+		Sign               string     `xml:"sign" json:"sign"`
+		ResultCode         string     `xml:"result_code" json:"result_code"`
+		ErrCode            string     `xml:"err_code" json:"err_code"`
+		ErrCodeDes         string     `xml:"err_code_des" json:"err_code_des"`
+		DeviceInfo         string     `xml:"device_info" json:"device_info"`
+		OpenId             string     `xml:"openid" json:"openid"`
+		IsSubscribe        string     `xml:"is_subscribe" json:"is_subscribe"`
+		TradeType          string     `xml:"trade_type" json:"trade_type"`
+		TradeState         TradeState `xml:"trade_state" json:"trade_state"`           //交易状态，见 TradeState
+		TradeStateDesc     string     `xml:"trade_state_desc" json:"trade_state_desc"` //交易状态描述
+		BankType           string     `xml:"bank_type" json:"bank_type"`
+		TotalFee           int64      `xml:"total_fee" json:"total_fee"`
+		SettlementTotalFee int64      `xml:"settlement_total_fee" json:"settlement_total_fee"`
+		FeeType            string     `xml:"fee_type" json:"fee_type"`
+		CashFee            int64      `xml:"cash_fee" json:"cash_fee"`
+		CashFeeType        string     `xml:"cash_fee_type" json:"cash_fee_type"`
+		TransactionId      string     `xml:"transaction_id" json:"transaction_id"`
+		OutTradeNo         string     `xml:"out_trade_no" json:"out_trade_no"`
+		TimeEnd            string     `xml:"time_end" json:"time_end"`
+		CouponFee          int64      `xml:"coupon_fee" json:"coupon_fee"`     //代金券金额
+		CouponCount        int64      `xml:"coupon_count" json:"coupon_count"` //代金券使用数量
+		coupons            []Coupon
+	}
+
+	// 订单使用的一张代金券，对应响应中序号为$n的字段
+	Coupon struct {
+		CouponId   string //代金券ID
+		CouponType string //代金券类型：CASH、NO_CASH
+		CouponFee  int64  //单个代金券支付金额
 	}
 )
 
+// 校验配置中的必填项
+func (c *PayConfig) Validate() error {
+	if c.AppId == "" {
+		return fmt.Errorf("%w: app id is required", ErrInvalidConfig)
+	}
+	if err := ValidateTrustedProxies(c.TrustedProxies); err != nil {
+		return err
+	}
+	return validateMerchant(c.MchId, c.ApiKey)
+}
+
+func (r *UnifiedOrderReq) SetAppId(appId string)       { r.AppId = appId }
+func (r *UnifiedOrderReq) SetMchId(mchId string)       { r.MchId = mchId }
+func (r *UnifiedOrderReq) SetNonceStr(nonceStr string) { r.NonceStr = nonceStr }
+func (r *UnifiedOrderReq) SetSign(sign string)         { r.Sign = sign }
+func (r *UnifiedOrderReq) SetSignType(signType string) { r.SignType = signType }
+
+func (r *CloseOrderReq) SetAppId(appId string)       { r.AppId = appId }
+func (r *CloseOrderReq) SetMchId(mchId string)       { r.MchId = mchId }
+func (r *CloseOrderReq) SetNonceStr(nonceStr string) { r.NonceStr = nonceStr }
+func (r *CloseOrderReq) SetSign(sign string)         { r.Sign = sign }
+func (r *CloseOrderReq) SetSignType(signType string) { r.SignType = signType }
+
+func (r *QueryOrderReq) SetAppId(appId string)       { r.AppID = appId }
+func (r *QueryOrderReq) SetMchId(mchId string)       { r.MchID = mchId }
+func (r *QueryOrderReq) SetNonceStr(nonceStr string) { r.NonceStr = nonceStr }
+func (r *QueryOrderReq) SetSign(sign string)         { r.Sign = sign }
+func (r *QueryOrderReq) SetSignType(signType string) { r.SignType = signType }
+
+// 输出关键字段，签名用***代替，用于日志
+func (r UnifiedOrderReq) String() string {
+	return fmt.Sprintf("UnifiedOrderReq{out_trade_no=%s, total_fee=%d, trade_type=%s, openid=%s, sign_type=%s, sign=%s}",
+		r.OutTradeNo, r.TotalFee, r.TradeType, r.OpenId, r.SignType, maskSecret(r.Sign))
+}
+
+func (r QueryOrderResp) String() string {
+	return fmt.Sprintf("QueryOrderResp{return_code=%s, result_code=%s, out_trade_no=%s, transaction_id=%s, trade_state=%s, total_fee=%d, sign=%s}",
+		r.ReturnCode, r.ResultCode, r.OutTradeNo, r.TransactionId, r.TradeState, r.TotalFee, maskSecret(r.Sign))
+}
+
+func (r NotifyReq) String() string {
+	return fmt.Sprintf("NotifyReq{return_code=%s, result_code=%s, out_trade_no=%s, transaction_id=%s, total_fee=%s, sign=%s}",
+		r.ReturnCode, r.ResultCode, r.OutTradeNo, r.TransactionId, r.TotalFee, maskSecret(r.Sign))
+}
+
+func (r *UnifiedOrderResp) result() payResult {
+	return payResult{r.ReturnCode, r.ReturnMsg, r.ResultCode, r.ErrCode, r.ErrCodeDes, r.AppID, r.MchID}
+}
+
+func (r *CloseOrderResp) result() payResult {
+	return payResult{r.ReturnCode, r.ReturnMsg, r.ResultCode, r.ErrCode, r.ErrCodeDes, r.AppID, r.MchID}
+}
+
+func (r *QueryOrderResp) result() payResult {
+	return payResult{r.ReturnCode, r.ReturnMsg, r.ResultCode, r.ErrCode, r.ErrCodeDes, r.AppID, r.MchID}
+}
+
+// 解析普通字段的同时，把 coupon_id_$n 等带序号的字段整理成代金券列表
+func (r *QueryOrderResp) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	type plain QueryOrderResp
+	fields, err := decodeFlatXML(d, start, (*plain)(r))
+	if err != nil {
+		return err
+	}
+
+	r.coupons = nil
+	for n := 0; ; n++ {
+		suffix := "_" + strconv.Itoa(n)
+		couponId, ok := fields["coupon_id"+suffix]
+		if !ok {
+			return nil
+		}
+		coupon := Coupon{
+			CouponId:   couponId,
+			CouponType: fields["coupon_type"+suffix],
+		}
+		if value := fields["coupon_fee"+suffix]; value != "" {
+			if coupon.CouponFee, err = strconv.ParseInt(value, 10, 64); err != nil {
+				return fmt.Errorf("[gowechat] invalid coupon_fee%s: %w", suffix, err)
+			}
+		}
+		r.coupons = append(r.coupons, coupon)
+	}
+}
+
+// 订单使用的所有代金券，按序号排列
+func (r *QueryOrderResp) Coupons() []Coupon {
+	return r.coupons
+}
+
 type wxPay struct {
 	cfg *PayConfig
+	// 回复支付结果通知时使用的Content-Type，为空时不设置
+	notifyContentType string
+	// 保存通知原始内容，为nil时不保存
+	notifySink NotifySink
+	// v3接口使用的私钥和平台证书
+	v3Keys *v3Keys
 	wxService
 }
 
-func NewWxPayService(cfg *PayConfig, client Http) *wxPay {
+func NewWxPayService(cfg *PayConfig, client Http, opts ...ServiceOption) *wxPay {
 	s := &wxPay{
-		cfg,
-		wxService{
-			client: client,
-			key:    cfg.ApiKey,
-			logger: zapLogger,
+		cfg:               cfg,
+		notifyContentType: contentTypeXML,
+		v3Keys:            &v3Keys{},
+		wxService: wxService{
+			client:      client,
+			appId:       cfg.AppId,
+			mchId:       cfg.MchId,
+			key:         cfg.ApiKey,
+			logger:      zapLogger,
+			billRetries: defaultBillRetries,
 		},
 	}
-	zapLogger.Info("init wx pay service success...")
+	s.applyOptions(opts)
+	if err := cfg.Validate(); err != nil {
+		s.logger.Warn("init wx pay service with invalid config", zap.Error(err))
+	}
+	s.logger.Info("init wx pay service success...")
 	return s
 }
 
 // 统一下单接口
 // 接口文档：https://pay.weixin.qq.com/wiki/doc/api/jsapi.php?chapter=9_1
+// req.Sign不为空时认为请求已经由调用方签名，直接发送，不再填充公共参数和重新签名
 func (w wxPay) ReqUnifiedOrder(ctx context.Context, req *UnifiedOrderReq) (*UnifiedOrderResp, error) {
-	var resp UnifiedOrderResp
-	if err := w.PostXML(ctx, unifiedOrderUrl, &req, func(response *http.Response, err error) error {
-		if err != nil {
-			return err
+	if len(req.GoodsTag) > maxGoodsTagLength {
+		return nil, fmt.Errorf("%w: %q is longer than %d", ErrInvalidGoodsTag, req.GoodsTag, maxGoodsTagLength)
+	}
+	if req.Sign == "" {
+		if err := w.prepare(ctx, req); err != nil {
+			return nil, err
 		}
-		return xml.NewDecoder(response.Body).Decode(&resp)
-	}); err != nil {
+	} else {
+		w.logger.Info("[wxpay] unified order is signed by caller", zap.String("out_trade_no", req.OutTradeNo))
+	}
+
+	var resp UnifiedOrderResp
+	if err := w.postPayXML(ctx, unifiedOrderUrl, req, &resp); err != nil {
+		return nil, err
+	}
+	w.logger.Info("[wxpay] unified order", w.bodyField("resp", resp))
+	if err := checkUnifiedOrderResult(resp.result()); err != nil {
 		return nil, err
 	}
-	w.logger.Info("[wxpay] unified order", zap.Any("resp", resp))
 	return &resp, nil
 }
 
+// 请求使用的签名类型，context中指定的优先，其次是配置中的值，都没有时为MD5
+func (w wxPay) signType(ctx context.Context) string {
+	if signType, ok := SignTypeFromContext(ctx); ok {
+		return signType
+	}
+	if w.cfg.SignType != "" {
+		return w.cfg.SignType
+	}
+	return SignTypeMD5
+}
+
+// 生成JSAPI支付的统一下单请求，终端IP取自发起请求的客户端（见 ClientIP 和 PayConfig.TrustedProxies），通知地址取自配置
+// 签名类型使用配置中的值，未配置时为MD5，币种为CNY，其他字段可以在返回后再修改
+func (w wxPay) NewJSAPIOrder(ctx context.Context, r *http.Request, openid, outTradeNo, body string, totalFee int64) *UnifiedOrderReq {
+	return &UnifiedOrderReq{
+		SignType:       w.signType(ctx),
+		Body:           body,
+		OutTradeNo:     outTradeNo,
+		FeeType:        defaultFeeType,
+		TotalFee:       totalFee,
+		SpbillCreateIp: ClientIP(r, w.cfg.TrustedProxies...),
+		NotifyUrl:      w.cfg.NotifyUrl,
+		TradeType:      TradeType,
+		OpenId:         openid,
+	}
+}
+
+// 识别订单号重复使用的错误，调用方应该查询订单而不是重试下单
+func checkUnifiedOrderResult(r payResult) error {
+	if r.success() {
+		return nil
+	}
+	switch {
+	case r.ErrCode == ErrCodeOrderPaid:
+		return fmt.Errorf("%w: %s", ErrOrderAlreadyPaid, r.ErrCodeDes)
+	case r.ErrCode == ErrCodeOutTradeNoUsed,
+		// 同一个订单号参数不一致时返回：201 商户订单号重复
+		r.ErrCode == ErrCodeInvalidRequest && strings.Contains(r.ErrCodeDes, "订单号重复"):
+		return fmt.Errorf("%w: %s", ErrDuplicateOrder, r.ErrCodeDes)
+	}
+	return nil
+}
+
 // 订单查询接口
 // 接口文档：https://pay.weixin.qq.com/wiki/doc/api/jsapi.php?chapter=9_2
 func (w wxPay) ReqQueryOrder(ctx context.Context, tradeNo string) (*QueryOrderResp, error) {
+	if err := validateTradeNo(tradeNo); err != nil {
+		return nil, err
+	}
 	req := QueryOrderReq{
-		AppID:      w.cfg.AppId,
-		MchID:      w.cfg.MchId,
 		OutTradeNo: tradeNo,
-		NonceStr:   w.RandString(32),
-		Sign:       "",
 		SignType:   SignTypeMD5,
 	}
-	sign, err := w.sign(ctx, &req)
-	if err != nil {
+	if err := w.prepare(ctx, &req); err != nil {
 		return nil, err
 	}
-	req.Sign = sign
 	var resp QueryOrderResp
-	if err := w.PostXML(ctx, queryOrderUrl, &req, func(response *http.Response, err error) error {
-		if err != nil {
-			return err
-		}
-		return xml.NewDecoder(response.Body).Decode(&resp)
-	}); err != nil {
+	if err := w.postPayXML(ctx, queryOrderUrl, &req, &resp); err != nil {
 		return nil, err
 	}
-	w.logger.Info("[wxpay] query order", zap.Any("resp", resp))
+	w.logger.Info("[wxpay] query order", w.bodyField("resp", resp))
 	return &resp, nil
 }
 
@@ -252,47 +449,88 @@ func (w wxPay) ReqQueryOrder(ctx context.Context, tradeNo string) (*QueryOrderRe
 // 以下情况需要调用关单接口：商户订单支付失败需要生成新单号重新发起支付，要对原订单号调用关单，避免重复支付；系统下单后，用户支付超时，系统退出不再受理，避免用户继续，请调用关单接口。
 // 接口文档：https://pay.weixin.qq.com/wiki/doc/api/jsapi.php?chapter=9_3
 func (w wxPay) ReqCloseOrder(ctx context.Context, tradeNo string) (*CloseOrderResp, error) {
+	if err := validateTradeNo(tradeNo); err != nil {
+		return nil, err
+	}
 	req := CloseOrderReq{
-		AppId:      w.cfg.AppId,
-		MchId:      w.cfg.MchId,
-		NonceStr:   w.RandString(32),
 		OutTradeNo: tradeNo,
-		Sign:       "",
 		SignType:   SignTypeMD5,
 	}
-	sign, err := w.sign(ctx, &req)
-	if err != nil {
+	if err := w.prepare(ctx, &req); err != nil {
 		return nil, err
 	}
-	req.Sign = sign
 
 	var resp CloseOrderResp
-	if err := w.PostXML(ctx, closeOrderUrl, &req, func(response *http.Response, err error) error {
-		if err != nil {
-			return err
-		}
-		return xml.NewDecoder(response.Body).Decode(&resp)
-	}); err != nil {
+	if err := w.postPayXML(ctx, closeOrderUrl, &req, &resp); err != nil {
 		return nil, err
 	}
-	w.logger.Info("[wxpay] close order", zap.Any("resp", resp))
+	w.logger.Info("[wxpay] close order", w.bodyField("resp", resp))
 	return &resp, nil
 }
 
+// 关闭订单后重新查询确认订单已经是 CLOSED 状态
+// 关单成功后订单可能还会短暂处于 NOTPAY、USERPAYING 状态，最多查询attempts次，每次间隔interval
+// 返回最后一次查询到的状态，没有确认关闭（包括订单已支付）时返回 ErrOrderNotClosed
+func (w wxPay) CloseAndConfirm(ctx context.Context, tradeNo string, attempts int, interval time.Duration) (TradeState, error) {
+	closeResp, err := w.ReqCloseOrder(ctx, tradeNo)
+	if err != nil {
+		return "", err
+	}
+	if !closeResp.result().success() {
+		return "", fmt.Errorf("%w: %s %s", ErrOrderNotClosed, closeResp.ErrCode, closeResp.ErrCodeDes)
+	}
+
+	if attempts <= 0 {
+		attempts = 1
+	}
+	var state TradeState
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return state, ctx.Err()
+			case <-time.After(interval):
+			}
+		}
+		resp, err := w.ReqQueryOrder(ctx, tradeNo)
+		if err != nil {
+			return state, err
+		}
+		state = resp.TradeState
+		switch state {
+		case TradeStateClosed:
+			return state, nil
+		case TradeStateSuccess, TradeStateRefund:
+			// 订单已经支付，不会再变成关闭状态
+			return state, fmt.Errorf("%w: trade state %s", ErrOrderNotClosed, state)
+		}
+	}
+	return state, fmt.Errorf("%w: trade state %s after %d queries", ErrOrderNotClosed, state, attempts)
+}
+
 // 生成小程序预支付数据
+// 签名类型必须和统一下单时一致，使用context中指定的值，没有时使用配置中的值，都没有时为MD5
 func (w wxPay) GenPrepay(ctx context.Context, prepayId, nonceStr string) (*PrepayReturn, error) {
 	if nonceStr == "" {
-		nonceStr = w.RandString(32)
+		var err error
+		if nonceStr, err = randString(32); err != nil {
+			return nil, err
+		}
 	}
 	prepay := PrepayReturn{
 		AppId:     w.cfg.AppId,
-		TimeStamp: strconv.FormatInt(time.Now().Unix(), 10),
+		TimeStamp: strconv.FormatInt(w.now().Unix(), 10),
 		NonceStr:  nonceStr,
 		Package:   "prepay_id=" + prepayId,
-		SignType:  SignTypeMD5,
+		SignType:  w.signType(ctx),
 		PaySign:   "",
 	}
-	sign, err := w.sign(ctx, &prepay)
+	// 预支付数据的签名类型字段是signType，不会被当作sign_type识别，需要显式指定签名算法
+	paramStr, _, err := signString(ctx, &prepay)
+	if err != nil {
+		return nil, err
+	}
+	sign, err := w.signParamStr(ctx, paramStr, prepay.SignType)
 	if err != nil {
 		return nil, err
 	}
@@ -300,14 +538,47 @@ func (w wxPay) GenPrepay(ctx context.Context, prepayId, nonceStr string) (*Prepa
 	return &prepay, nil
 }
 
-// 校验签名
+// 同 GenPrepay，返回JSON编码的预支付数据，可以直接交给小程序的 wx.requestPayment
+func (w wxPay) GenPrepayJSON(ctx context.Context, prepayId, nonceStr string) ([]byte, error) {
+	prepay, err := w.GenPrepay(ctx, prepayId, nonceStr)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(prepay)
+}
+
+// 校验签名，设置了 SetPreviousKeys 时旧密钥签名的通知也校验通过
+// 通过 ParseNotify 解析的通知按原始内容中的所有字段校验，结构体中没有的字段（如coupon_id_$n）也参与签名
 func (w wxPay) VerifySign(ctx context.Context, req *NotifyReq) bool {
 	oldSign := req.Sign
-	req.Sign = ""
-	sign, err := w.sign(ctx, req)
+	var signed interface{} = req
+	if req.fields != nil {
+		signed = req.fields
+	}
+	paramStr, signType, err := signString(ctx, signed)
 	if err != nil {
 		w.logger.Error("[wxpay] verify sign", zap.Error(err))
 		return false
 	}
-	return oldSign == sign
+	if _, ok := SignerFromContext(ctx); ok {
+		sign, err := w.signParamStr(ctx, paramStr, signType)
+		if err != nil {
+			w.logger.Error("[wxpay] verify sign", zap.Error(err))
+			return false
+		}
+		return sign == oldSign
+	}
+	for i, key := range w.verifyKeys() {
+		if key == "" {
+			continue
+		}
+		if hashSignWithKey(paramStr, signType, key) != oldSign {
+			continue
+		}
+		if i > 0 {
+			w.logger.Warn("[wxpay] verify sign with previous key", zap.Int("index", i-1), zap.String("out_trade_no", req.OutTradeNo))
+		}
+		return true
+	}
+	return false
 }
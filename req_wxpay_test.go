@@ -1,6 +1,19 @@
 package wechat
 
-import "testing"
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
 
 var (
 	payService PayService
@@ -18,5 +31,453 @@ func init() {
 }
 
 func TestWxPay_GenPrepay(t *testing.T) {
+	s := newTestPay(nil)
+	s.SetClock(fixedClock(time.Unix(1414561699, 0)))
+	prepay, err := s.GenPrepay(context.Background(), "wx201410272009395522657a690389285100", "5K8264ILTKCH16CQ2502SI8ZNMTM67VS")
+	assert.Nil(t, err)
+	assert.Equal(t, "1414561699", prepay.TimeStamp)
+	assert.Equal(t, "prepay_id=wx201410272009395522657a690389285100", prepay.Package)
+	assert.Equal(t, expectedSign(map[string]string{
+		"appId":     "wx2421b1c4370ec43b",
+		"timeStamp": "1414561699",
+		"nonceStr":  "5K8264ILTKCH16CQ2502SI8ZNMTM67VS",
+		"package":   "prepay_id=wx201410272009395522657a690389285100",
+		"signType":  SignTypeMD5,
+	}, s.key), prepay.PaySign)
+
+	again, err := s.GenPrepay(context.Background(), "wx201410272009395522657a690389285100", "5K8264ILTKCH16CQ2502SI8ZNMTM67VS")
+	assert.Nil(t, err)
+	assert.Equal(t, prepay, again, "same clock and nonce give the same payload")
+}
+
+func TestWxPay_GenPrepay_HMACSHA256(t *testing.T) {
+	s := newTestPay(nil)
+	s.cfg.SignType = SignTypeHMACSHA256
+	s.SetClock(fixedClock(time.Unix(1414561699, 0)))
+	prepay, err := s.GenPrepay(context.Background(), "wx201410272009395522657a690389285100", "5K8264ILTKCH16CQ2502SI8ZNMTM67VS")
+	assert.Nil(t, err)
+	assert.Equal(t, SignTypeHMACSHA256, prepay.SignType)
+	paramStr := "appId=wx2421b1c4370ec43b&nonceStr=5K8264ILTKCH16CQ2502SI8ZNMTM67VS&package=prepay_id=wx201410272009395522657a690389285100&signType=HMAC-SHA256&timeStamp=1414561699"
+	assert.Equal(t, HashHmacSha256(paramStr+"&key="+s.key, s.key), prepay.PaySign)
+	assert.Equal(t, SignTypeHMACSHA256, s.NewJSAPIOrder(context.Background(), httptest.NewRequest(http.MethodGet, "/", nil), "OPENID", "T1", "body", 1).SignType)
+
+	// context中指定的签名类型优先
+	prepay, err = s.GenPrepay(WithSignType(context.Background(), SignTypeMD5), "wx201410272009395522657a690389285100", "5K8264ILTKCH16CQ2502SI8ZNMTM67VS")
+	assert.Nil(t, err)
+	assert.Equal(t, SignTypeMD5, prepay.SignType)
+	assert.Equal(t, HashMd5(strings.Replace(paramStr, SignTypeHMACSHA256, SignTypeMD5, 1)+"&key="+s.key), prepay.PaySign)
+}
+
+func TestWxPay_GenPrepayJSON(t *testing.T) {
+	s := newTestPay(nil)
+	s.SetClock(fixedClock(time.Unix(1414561699, 0)))
+	buf, err := s.GenPrepayJSON(context.Background(), "wx201410272009395522657a690389285100", "5K8264ILTKCH16CQ2502SI8ZNMTM67VS")
+	assert.Nil(t, err)
+
+	var params map[string]string
+	assert.Nil(t, json.Unmarshal(buf, &params))
+	assert.Equal(t, map[string]string{
+		"appId":     "wx2421b1c4370ec43b",
+		"timeStamp": "1414561699",
+		"nonceStr":  "5K8264ILTKCH16CQ2502SI8ZNMTM67VS",
+		"package":   "prepay_id=wx201410272009395522657a690389285100",
+		"signType":  SignTypeMD5,
+		"paySign":   params["paySign"],
+	}, params)
+	paySign := params["paySign"]
+	delete(params, "paySign")
+	assert.Equal(t, expectedSign(params, s.key), paySign)
+}
+
+func newTestPay(client Http) *wxPay {
+	return NewWxPayService(&PayConfig{
+		AppId:  "wx2421b1c4370ec43b",
+		MchId:  "10000100",
+		ApiKey: "192006250b4c09247ec02edce69f6a2d",
+	}, client)
+}
+
+func TestWxPay_ReqQueryOrder_IPNotWhitelisted(t *testing.T) {
+	client := newStubHttp(`<xml>
+<return_code><![CDATA[FAIL]]></return_code>
+<return_msg><![CDATA[该IP不在白名单中]]></return_msg>
+</xml>`)
+	resp, err := newTestPay(client).ReqQueryOrder(context.Background(), "T1")
+	assert.Nil(t, resp)
+	assert.True(t, errors.Is(err, ErrIPNotWhitelisted), "err = %v", err)
+}
+
+func TestPayConfig_Validate(t *testing.T) {
+	valid := PayConfig{AppId: "wx2421b1c4370ec43b", MchId: "10000100", ApiKey: "192006250b4c09247ec02edce69f6a2d"}
+	assert.Nil(t, valid.Validate())
+
+	tests := []struct {
+		Name   string
+		Modify func(c *PayConfig)
+	}{
+		{"missing app id", func(c *PayConfig) { c.AppId = "" }},
+		{"missing mch id", func(c *PayConfig) { c.MchId = "" }},
+		{"non-numeric mch id", func(c *PayConfig) { c.MchId = "1000a100" }},
+		{"missing api key", func(c *PayConfig) { c.ApiKey = "" }},
+		{"short api key", func(c *PayConfig) { c.ApiKey = "192006250b4c" }},
+		{"invalid trusted proxy", func(c *PayConfig) { c.TrustedProxies = []string{"10.0.0.0/8", "proxy.local"} }},
+	}
+	for _, test := range tests {
+		cfg := valid
+		test.Modify(&cfg)
+		assert.True(t, errors.Is(cfg.Validate(), ErrInvalidConfig), test.Name)
+	}
+}
+
+func TestWxPay_SignRequest(t *testing.T) {
+	s := newTestPay(nil)
+	signedXML, err := s.SignRequest(context.Background(), &UnifiedOrderReq{
+		Body:           "腾讯充值中心-QQ会员充值",
+		OutTradeNo:     "20150806125346",
+		TotalFee:       888,
+		SpbillCreateIp: "123.12.12.123",
+		NotifyUrl:      "https://example.com/notify",
+		TradeType:      TradeType,
+		OpenId:         "oUpF8uMuAJO_M2pxb1Q9zNjWeS6o",
+	})
+	assert.Nil(t, err)
+
+	params := parseXMLParams(t, signedXML)
+	assert.Equal(t, "wx2421b1c4370ec43b", params["appid"])
+	assert.Equal(t, "10000100", params["mch_id"])
+	assert.Len(t, params["nonce_str"], 32)
+	assert.Equal(t, expectedSign(params, "192006250b4c09247ec02edce69f6a2d"), params["sign"])
+
+	// 提交方直接发送导出的内容
+	client := newStubHttp(`<xml><return_code>SUCCESS</return_code><result_code>SUCCESS</result_code><prepay_id>wx201410272009395522657a690389285100</prepay_id></xml>`)
+	var resp UnifiedOrderResp
+	assert.Nil(t, newTestPay(client).ReqRaw(context.Background(), unifiedOrderUrl, signedXML, &resp))
+	assert.Equal(t, signedXML, client.last().body)
+	assert.Equal(t, "wx201410272009395522657a690389285100", resp.PrepayId)
+
+	_, err = s.SignRequest(context.Background(), PrepayReturn{})
+	assert.Equal(t, ErrNotSignable, err)
+}
+
+func TestWxPay_ReqQueryOrder_SignError(t *testing.T) {
+	client := newStubHttp(`<xml><return_code><![CDATA[FAIL]]></return_code><return_msg><![CDATA[签名错误]]></return_msg></xml>`)
+	s := newTestPay(client)
+	_, err := s.ReqQueryOrder(context.Background(), "T1")
+	assert.True(t, errors.Is(err, ErrSignError), "err = %v", err)
+	assert.NotContains(t, err.Error(), "sign string")
+
+	s.SetDebug(true)
+	_, err = s.ReqQueryOrder(context.Background(), "T1")
+	assert.True(t, errors.Is(err, ErrSignError), "err = %v", err)
+	assert.Contains(t, err.Error(), "appid=wx2421b1c4370ec43b&mch_id=10000100&nonce_str=")
+	assert.Contains(t, err.Error(), "&out_trade_no=T1&sign_type=MD5&key=***")
+	assert.NotContains(t, err.Error(), "192006250b4c09247ec02edce69f6a2d")
+}
+
+func TestWxPay_RandUnavailable(t *testing.T) {
+	defer useFailingRand()()
+	client := newStubHttp()
+	s := newTestPay(client)
+	_, err := s.ReqQueryOrder(context.Background(), "T1")
+	assert.True(t, errors.Is(err, ErrRandUnavailable), "err = %v", err)
+	assert.Empty(t, client.requests)
+
+	_, err = s.GenPrepay(context.Background(), "wx201410272009395522657a690389285100", "")
+	assert.True(t, errors.Is(err, ErrRandUnavailable), "err = %v", err)
+	// 传入随机串时不需要系统随机数
+	_, err = s.GenPrepay(context.Background(), "wx201410272009395522657a690389285100", "5K8264ILTKCH16CQ2502SI8ZNMTM67VS")
+	assert.Nil(t, err)
+}
+
+func TestWxPay_ReqQueryOrder_MerchantMismatch(t *testing.T) {
+	body := `<xml>
+<return_code><![CDATA[SUCCESS]]></return_code>
+<result_code><![CDATA[SUCCESS]]></result_code>
+<appid><![CDATA[wx0000000000000000]]></appid>
+<mch_id><![CDATA[10000100]]></mch_id>
+<trade_state><![CDATA[SUCCESS]]></trade_state>
+</xml>`
+	s := newTestPay(newStubHttp(body))
+	resp, err := s.ReqQueryOrder(context.Background(), "T1")
+	assert.Nil(t, err, "merchant check is opt-in")
+	assert.NotNil(t, resp)
+
+	s = newTestPay(newStubHttp(body))
+	s.SetVerifyMerchant(true)
+	resp, err = s.ReqQueryOrder(context.Background(), "T1")
+	assert.Nil(t, resp)
+	assert.True(t, errors.Is(err, ErrMerchantMismatch), "err = %v", err)
+
+	s = newTestPay(newStubHttp(strings.Replace(body, "wx0000000000000000", "wx2421b1c4370ec43b", 1)))
+	s.SetVerifyMerchant(true)
+	_, err = s.ReqQueryOrder(context.Background(), "T1")
+	assert.Nil(t, err)
+}
+
+func TestWxPay_String_MasksSign(t *testing.T) {
+	sign := "0CB01533B8C1EF103065174F50BCA001"
+	req := UnifiedOrderReq{OutTradeNo: "20150806125346", TotalFee: 888, TradeType: TradeType, Sign: sign}
+	assert.Contains(t, req.String(), "out_trade_no=20150806125346")
+	assert.Contains(t, req.String(), "total_fee=888")
+	assert.Contains(t, req.String(), "sign=***")
+	assert.NotContains(t, req.String(), sign)
+	assert.NotContains(t, fmt.Sprintf("%v", &req), sign)
+
+	resp := QueryOrderResp{OutTradeNo: "20150806125346", TransactionId: "1008450740201411110005820873", TradeState: TradeStateSuccess, Sign: sign}
+	assert.Contains(t, resp.String(), "out_trade_no=20150806125346")
+	assert.Contains(t, resp.String(), "transaction_id=1008450740201411110005820873")
+	assert.Contains(t, resp.String(), "trade_state=SUCCESS")
+	assert.NotContains(t, resp.String(), sign)
+
+	notify := NotifyReq{OutTradeNo: "20150806125346", TransactionId: "1008450740201411110005820873", Sign: sign}
+	assert.Contains(t, notify.String(), "out_trade_no=20150806125346")
+	assert.Contains(t, notify.String(), "transaction_id=1008450740201411110005820873")
+	assert.NotContains(t, notify.String(), sign)
+
+	assert.Contains(t, UnifiedOrderReq{}.String(), "sign=}")
+}
+
+func TestWxPay_CloseAndConfirm(t *testing.T) {
+	queryResp := func(state TradeState) string {
+		return `<xml><return_code>SUCCESS</return_code><result_code>SUCCESS</result_code><trade_state>` + string(state) + `</trade_state></xml>`
+	}
+	closeResp := `<xml><return_code>SUCCESS</return_code><result_code>SUCCESS</result_code></xml>`
+
+	client := newStubHttp(closeResp, queryResp(TradeStateNotPay), queryResp(TradeStateClosed))
+	state, err := newTestPay(client).CloseAndConfirm(context.Background(), "T1", 3, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, TradeStateClosed, state)
+	assert.Len(t, client.requests, 3)
+	assert.Equal(t, closeOrderUrl, client.requests[0].url)
+	assert.Equal(t, queryOrderUrl, client.requests[2].url)
+
+	client = newStubHttp(closeResp, queryResp(TradeStateUserPaying))
+	state, err = newTestPay(client).CloseAndConfirm(context.Background(), "T1", 2, 0)
+	assert.True(t, errors.Is(err, ErrOrderNotClosed), "err = %v", err)
+	assert.Equal(t, TradeStateUserPaying, state)
+	assert.Len(t, client.requests, 3)
+
+	client = newStubHttp(closeResp, queryResp(TradeStateSuccess))
+	state, err = newTestPay(client).CloseAndConfirm(context.Background(), "T1", 3, 0)
+	assert.True(t, errors.Is(err, ErrOrderNotClosed), "err = %v", err)
+	assert.Equal(t, TradeStateSuccess, state)
+	assert.Len(t, client.requests, 2, "paid orders are not queried again")
+
+	client = newStubHttp(`<xml><return_code>SUCCESS</return_code><result_code>FAIL</result_code><err_code>ORDERPAID</err_code></xml>`)
+	_, err = newTestPay(client).CloseAndConfirm(context.Background(), "T1", 3, 0)
+	assert.True(t, errors.Is(err, ErrOrderNotClosed), "err = %v", err)
+	assert.Len(t, client.requests, 1)
+}
+
+func TestWxPay_ReqUnifiedOrder_DuplicateOrder(t *testing.T) {
+	tests := []struct {
+		ErrCode    string
+		ErrCodeDes string
+		Err        error
+	}{
+		{"ORDERPAID", "该订单已支付", ErrOrderAlreadyPaid},
+		{"INVALID_REQUEST", "201 商户订单号重复", ErrDuplicateOrder},
+		{"OUT_TRADE_NO_USED", "商户订单号重复", ErrDuplicateOrder},
+	}
+	for _, test := range tests {
+		client := newStubHttp(`<xml>
+<return_code><![CDATA[SUCCESS]]></return_code>
+<result_code><![CDATA[FAIL]]></result_code>
+<err_code><![CDATA[` + test.ErrCode + `]]></err_code>
+<err_code_des><![CDATA[` + test.ErrCodeDes + `]]></err_code_des>
+</xml>`)
+		resp, err := newTestPay(client).ReqUnifiedOrder(context.Background(), &UnifiedOrderReq{OutTradeNo: "20150806125346", TotalFee: 1})
+		assert.Nil(t, resp, test.ErrCode)
+		assert.True(t, errors.Is(err, test.Err), "%s: err = %v", test.ErrCode, err)
+	}
+
+	// 其他参数错误不当作订单号重复
+	client := newStubHttp(`<xml><return_code>SUCCESS</return_code><result_code>FAIL</result_code><err_code>INVALID_REQUEST</err_code><err_code_des>参数格式校验错误</err_code_des></xml>`)
+	_, err := newTestPay(client).ReqUnifiedOrder(context.Background(), &UnifiedOrderReq{OutTradeNo: "20150806125346", TotalFee: 1})
+	assert.False(t, errors.Is(err, ErrDuplicateOrder))
+}
+
+func TestWxPay_NewJSAPIOrder(t *testing.T) {
+	s := NewWxPayService(&PayConfig{
+		AppId:     "wx2421b1c4370ec43b",
+		MchId:     "10000100",
+		ApiKey:    "192006250b4c09247ec02edce69f6a2d",
+		NotifyUrl: "https://example.com/wxpay/notify",
+		// 请求经过内网的反向代理
+		TrustedProxies: []string{"10.0.0.0/8"},
+	}, newStubHttp(`<xml><return_code>SUCCESS</return_code><result_code>SUCCESS</result_code><prepay_id>wx201410272009395522657a690389285100</prepay_id></xml>`))
+	r := httptest.NewRequest(http.MethodPost, "/pay", nil)
+	r.RemoteAddr = "10.0.0.2:52110"
+	r.Header.Set("X-Forwarded-For", "123.12.12.123, 10.0.0.1")
+
+	req := s.NewJSAPIOrder(context.Background(), r, "oUpF8uMuAJO_M2pxb1Q9zNjWeS6o", "1217752501201407033233368018", "腾讯充值中心-QQ会员充值", 888)
+	assert.Equal(t, "123.12.12.123", req.SpbillCreateIp)
+	assert.Equal(t, "https://example.com/wxpay/notify", req.NotifyUrl)
+	assert.Equal(t, TradeType, req.TradeType)
+	assert.Equal(t, SignTypeMD5, req.SignType)
+	assert.Equal(t, "CNY", req.FeeType)
+	assert.Equal(t, "oUpF8uMuAJO_M2pxb1Q9zNjWeS6o", req.OpenId)
+	assert.EqualValues(t, 888, req.TotalFee)
+
+	resp, err := s.ReqUnifiedOrder(context.Background(), req)
+	assert.Nil(t, err)
+	assert.Equal(t, "wx201410272009395522657a690389285100", resp.PrepayId)
+
+	r.Header.Del("X-Forwarded-For")
+	req = s.NewJSAPIOrder(WithSignType(context.Background(), SignTypeHMACSHA256), r, "OPENID", "T1", "body", 1)
+	assert.Equal(t, "10.0.0.2", req.SpbillCreateIp)
+	assert.Equal(t, SignTypeHMACSHA256, req.SignType)
+
+	// 没有配置信任的代理时使用连接的地址
+	s.cfg.TrustedProxies = nil
+	r.Header.Set("X-Forwarded-For", "123.12.12.123")
+	req = s.NewJSAPIOrder(context.Background(), r, "OPENID", "T1", "body", 1)
+	assert.Equal(t, "10.0.0.2", req.SpbillCreateIp)
+}
+
+func TestWxPay_ReqUnifiedOrder_PreSigned(t *testing.T) {
+	ok := `<xml><return_code>SUCCESS</return_code><result_code>SUCCESS</result_code><prepay_id>wx201410272009395522657a690389285100</prepay_id></xml>`
+	client := newStubHttp(ok, ok)
+	s := newTestPay(client)
+
+	// 没有签名的请求由服务填充公共参数并签名
+	_, err := s.ReqUnifiedOrder(context.Background(), &UnifiedOrderReq{OutTradeNo: "T1", TotalFee: 1, Body: "body"})
+	assert.Nil(t, err)
+	params := parseXMLParams(t, client.last().body)
+	assert.Equal(t, "10000100", params["mch_id"])
+	assert.Len(t, params["nonce_str"], 32)
+	assert.Equal(t, expectedSign(params, s.key), params["sign"])
+
+	// 已经签名的请求原样发送
+	signed := &UnifiedOrderReq{AppId: "wx2421b1c4370ec43b", MchId: "10000100", NonceStr: "5K8264ILTKCH16CQ2502SI8ZNMTM67VS", OutTradeNo: "T2", TotalFee: 1, Body: "body"}
+	sign, err := s.sign(context.Background(), signed)
+	assert.Nil(t, err)
+	signed.Sign = sign
+	_, err = s.ReqUnifiedOrder(context.Background(), signed)
+	assert.Nil(t, err)
+	params = parseXMLParams(t, client.last().body)
+	assert.Equal(t, "5K8264ILTKCH16CQ2502SI8ZNMTM67VS", params["nonce_str"])
+	assert.Equal(t, sign, params["sign"])
+	assert.Equal(t, expectedSign(params, s.key), params["sign"])
+}
+
+func TestWxPay_ReqUnifiedOrder_XMLRoot(t *testing.T) {
+	client := newStubHttp(`<xml><return_code>SUCCESS</return_code><result_code>SUCCESS</result_code><prepay_id>wx201410272009395522657a690389285100</prepay_id></xml>`)
+	s := newTestPay(client)
+	_, err := s.ReqUnifiedOrder(context.Background(), &UnifiedOrderReq{OutTradeNo: "T1", TotalFee: 888, Body: "body", TradeType: TradeType, OpenId: "OPENID"})
+	assert.Nil(t, err)
+
+	body := string(client.last().body)
+	assert.True(t, strings.HasPrefix(body, "<xml><appid>"), body)
+	assert.True(t, strings.HasSuffix(body, "</xml>"), body)
+	assert.Equal(t, 1, strings.Count(body, "<xml>"))
+	assert.NotContains(t, body, "UnifiedOrderReq")
+
+	var req UnifiedOrderReq
+	assert.Nil(t, xml.Unmarshal(client.last().body, &req))
+	assert.Equal(t, "xml", req.XMLName.Local)
+	assert.Equal(t, "T1", req.OutTradeNo)
+	assert.EqualValues(t, 888, req.TotalFee)
+	assert.Equal(t, "OPENID", req.OpenId)
+	assertSignedRequest(t, client.last(), s.key)
+}
+
+func TestWxPay_ResultCodeAbsent(t *testing.T) {
+	// 部分旧接口成功时只返回return_code
+	closed := `<xml><return_code><![CDATA[SUCCESS]]></return_code><return_msg><![CDATA[OK]]></return_msg></xml>`
+	query := `<xml><return_code>SUCCESS</return_code><result_code>SUCCESS</result_code><trade_state>CLOSED</trade_state></xml>`
+	client := newStubHttp(closed, query)
+	state, err := newTestPay(client).CloseAndConfirm(context.Background(), "T1", 1, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, TradeStateClosed, state)
+
+	assert.True(t, payResult{ReturnCode: "SUCCESS"}.success())
+	assert.Nil(t, checkPayResult(payResult{ReturnCode: "SUCCESS", ReturnMsg: "OK"}))
+	assert.False(t, payResult{ReturnCode: "SUCCESS", ErrCode: ErrCodeSystemError}.success())
+	assert.False(t, payResult{ReturnCode: "SUCCESS", ResultCode: "FAIL"}.success())
+	assert.False(t, payResult{ReturnCode: "FAIL"}.success())
+
+	client = newStubHttp(`<xml><return_code>SUCCESS</return_code><err_code>ORDERPAID</err_code><err_code_des>订单已支付</err_code_des></xml>`)
+	_, err = newTestPay(client).CloseAndConfirm(context.Background(), "T1", 1, 0)
+	assert.True(t, errors.Is(err, ErrOrderNotClosed), "err = %v", err)
+}
+
+func TestQueryOrderResp_Coupons(t *testing.T) {
+	body := `<xml>
+<return_code>SUCCESS</return_code>
+<result_code>SUCCESS</result_code>
+<out_trade_no>T1</out_trade_no>
+<trade_state>SUCCESS</trade_state>
+<total_fee>1000</total_fee>
+<cash_fee>700</cash_fee>
+<coupon_fee>300</coupon_fee>
+<coupon_count>2</coupon_count>
+<coupon_id_0>10000</coupon_id_0>
+<coupon_type_0>CASH</coupon_type_0>
+<coupon_fee_0>100</coupon_fee_0>
+<coupon_id_1><![CDATA[10001]]></coupon_id_1>
+<coupon_type_1>NO_CASH</coupon_type_1>
+<coupon_fee_1>200</coupon_fee_1>
+</xml>`
+	var resp QueryOrderResp
+	assert.Nil(t, xml.Unmarshal([]byte(body), &resp))
+	assert.Equal(t, TradeStateSuccess, resp.TradeState)
+	assert.EqualValues(t, 1000, resp.TotalFee)
+	assert.EqualValues(t, 300, resp.CouponFee)
+	assert.EqualValues(t, 2, resp.CouponCount)
+	assert.Equal(t, []Coupon{
+		{CouponId: "10000", CouponType: "CASH", CouponFee: 100},
+		{CouponId: "10001", CouponType: "NO_CASH", CouponFee: 200},
+	}, resp.Coupons())
+
+	assert.Nil(t, xml.Unmarshal([]byte(`<xml><return_code>SUCCESS</return_code></xml>`), &resp))
+	assert.Empty(t, resp.Coupons())
+
+	err := xml.Unmarshal([]byte(`<xml><coupon_id_0>1</coupon_id_0><coupon_fee_0>abc</coupon_fee_0></xml>`), &resp)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "coupon_fee_0")
+}
+
+func TestWxPay_InvalidTradeNo(t *testing.T) {
+	client := newStubHttp(`<xml><return_code>SUCCESS</return_code><result_code>SUCCESS</result_code><trade_state>SUCCESS</trade_state></xml>`)
+	s := newTestPay(client)
+	for _, tradeNo := range []string{"", "   ", "\t\n", strings.Repeat("1", 33)} {
+		_, err := s.ReqQueryOrder(context.Background(), tradeNo)
+		assert.True(t, errors.Is(err, ErrInvalidTradeNo), "query %q: err = %v", tradeNo, err)
+		_, err = s.ReqCloseOrder(context.Background(), tradeNo)
+		assert.True(t, errors.Is(err, ErrInvalidTradeNo), "close %q: err = %v", tradeNo, err)
+	}
+	assert.Len(t, client.requests, 0)
+
+	_, err := s.ReqQueryOrder(context.Background(), strings.Repeat("1", 32))
+	assert.Nil(t, err)
+	_, err = s.ReqCloseOrder(context.Background(), GenOutTradeNo("key"))
+	assert.Nil(t, err)
+	assert.Len(t, client.requests, 2)
+}
+
+func TestWxPay_ReqUnifiedOrder_GoodsTag(t *testing.T) {
+	ok := `<xml><return_code>SUCCESS</return_code><result_code>SUCCESS</result_code><prepay_id>wx201410272009395522657a690389285100</prepay_id></xml>`
+	client := newStubHttp(ok)
+	s := newTestPay(client)
+
+	// 为空时不发送也不参与签名
+	_, err := s.ReqUnifiedOrder(context.Background(), &UnifiedOrderReq{OutTradeNo: "T1", TotalFee: 888, Body: "body"})
+	assert.Nil(t, err)
+	assert.NotContains(t, string(client.last().body), "goods_tag")
+	params := assertSignedRequest(t, client.last(), s.key)
+	assert.NotContains(t, params, "goods_tag")
+
+	_, err = s.ReqUnifiedOrder(context.Background(), &UnifiedOrderReq{OutTradeNo: "T2", TotalFee: 888, Body: "body", GoodsTag: "WXG"})
+	assert.Nil(t, err)
+	assert.Contains(t, string(client.last().body), "<goods_tag>WXG</goods_tag>")
+	params = assertSignedRequest(t, client.last(), s.key)
+	assert.Equal(t, "WXG", params["goods_tag"])
+	signParams, err := SignParams(&UnifiedOrderReq{OutTradeNo: "T2", GoodsTag: "WXG"})
+	assert.Nil(t, err)
+	assert.Equal(t, "WXG", signParams["goods_tag"])
 
+	_, err = s.ReqUnifiedOrder(context.Background(), &UnifiedOrderReq{OutTradeNo: "T3", TotalFee: 888, Body: "body", GoodsTag: strings.Repeat("G", 33)})
+	assert.True(t, errors.Is(err, ErrInvalidGoodsTag), "err = %v", err)
+	assert.Len(t, client.requests, 2)
 }
@@ -0,0 +1,366 @@
+package wechat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	settlementPath        = "/v3/merchant-service/settlements"
+	settlementAccountPath = "/v3/apply4sub/sub_merchants/%s/settlement"
+	jsapiOrderPath        = "/v3/pay/transactions/jsapi"
+	queryOrderPath        = "/v3/pay/transactions/out-trade-no/%s?mchid=%s"
+	closeOrderPath        = "/v3/pay/transactions/out-trade-no/%s/close"
+	refundPath            = "/v3/refund/domestic/refunds"
+	queryRefundPath       = "/v3/refund/domestic/refunds/%s"
+
+	// v3预支付数据的签名类型
+	SignTypeRSA = "RSA"
+
+	// 结算记录的结算状态
+	SettlementSuccess    = "SUCCESS"
+	SettlementProcessing = "PROCESSING"
+	SettlementFail       = "FAIL"
+
+	// 结算日期的格式
+	settlementDateLayout = "2006-01-02"
+
+	// 结算账户的汇款验证结果
+	SettlementAccountVerifySuccess = "VERIFY_SUCCESS"
+	SettlementAccountVerifyFail    = "VERIFY_FAIL"
+	SettlementAccountVerifying     = "VERIFYING"
+
+	// v3的退款状态
+	RefundV3Success    = "SUCCESS"
+	RefundV3Closed     = "CLOSED"
+	RefundV3Processing = "PROCESSING"
+	RefundV3Abnormal   = "ABNORMAL"
+
+	// 微信要求商户退款单号不超过64个字符
+	maxRefundNoLength = 64
+)
+
+var (
+	ErrInvalidRefundNo       = errors.New("[gowechat] invalid out_refund_no")
+	ErrInvalidSettlementDate = errors.New("[gowechat] invalid settlement date")
+)
+
+type (
+	// 查询结算记录请求，日期格式为2006-01-02，EndDate为空时只查询StartDate当天
+	SettlementQueryReq struct {
+		SubMchId  string //特约商户号
+		StartDate string //开始日期
+		EndDate   string //结束日期
+		Offset    int    //分页的起始位置
+		Limit     int    //每页的记录数，为0时使用微信的默认值
+	}
+
+	SettlementResp struct {
+		TotalCount int64              `json:"total_count"` //符合条件的记录总数
+		Offset     int64              `json:"offset"`
+		Limit      int64              `json:"limit"`
+		Data       []SettlementRecord `json:"data"`
+	}
+
+	// 一个结算日的结算记录，金额单位为分
+	SettlementRecord struct {
+		SettlementDate     string `json:"settlement_date"`     //结算日期，格式：2006-01-02
+		SettlementAmount   int64  `json:"settlement_amount"`   //已结算金额
+		UnsettlementAmount int64  `json:"unsettlement_amount"` //未结算金额
+		Fee                int64  `json:"fee"`                 //手续费
+		Currency           string `json:"currency"`            //货币类型
+		Status             string `json:"status"`              //结算状态，见 SettlementSuccess
+		SuccessTime        string `json:"success_time"`        //结算完成时间，rfc3339格式
+	}
+
+	// 特约商户的结算账户
+	SettlementAccountResp struct {
+		AccountType      string `json:"account_type"`       //账户类型：ACCOUNT_TYPE_BUSINESS、ACCOUNT_TYPE_PRIVATE
+		AccountBank      string `json:"account_bank"`       //开户银行
+		BankName         string `json:"bank_name"`          //开户银行全称（含支行）
+		BankBranchId     string `json:"bank_branch_id"`     //开户银行联行号
+		AccountNumber    string `json:"account_number"`     //银行账号，掩码显示
+		VerifyResult     string `json:"verify_result"`      //汇款验证结果，见 SettlementAccountVerifySuccess
+		VerifyFailReason string `json:"verify_fail_reason"` //汇款验证失败原因
+	}
+
+	// v3的JSAPI下单请求，appid、mchid和notify_url为空时使用配置中的值
+	OrderV3Req struct {
+		AppId       string        `json:"appid"`                 //应用ID
+		MchId       string        `json:"mchid"`                 //直连商户号
+		Description string        `json:"description"`           //商品描述
+		OutTradeNo  string        `json:"out_trade_no"`          //商户订单号
+		TimeExpire  string        `json:"time_expire,omitempty"` //交易结束时间，rfc3339格式，如 2018-06-08T10:34:56+08:00
+		Attach      string        `json:"attach,omitempty"`      //附加数据
+		NotifyUrl   string        `json:"notify_url"`            //通知地址
+		GoodsTag    string        `json:"goods_tag,omitempty"`   //订单优惠标记
+		Amount      OrderV3Amount `json:"amount"`                //订单金额
+		Payer       OrderV3Payer  `json:"payer"`                 //支付者
+	}
+
+	OrderV3Amount struct {
+		Total    int64  `json:"total"`              //总金额，单位为分
+		Currency string `json:"currency,omitempty"` //货币类型，为空时为CNY
+	}
+
+	OrderV3Payer struct {
+		OpenId string `json:"openid"` //用户在appid下的唯一标识
+	}
+
+	OrderV3Resp struct {
+		PrepayId string `json:"prepay_id"` //预支付交易会话标识，有效期为2小时
+	}
+
+	// v3查询订单返回的交易信息
+	TransactionV3 struct {
+		AppId          string              `json:"appid"`
+		MchId          string              `json:"mchid"`
+		OutTradeNo     string              `json:"out_trade_no"`
+		TransactionId  string              `json:"transaction_id"`   //微信支付订单号，未支付时为空
+		TradeType      string              `json:"trade_type"`       //交易类型，如 JSAPI
+		TradeState     TradeState          `json:"trade_state"`      //交易状态，见 TradeState
+		TradeStateDesc string              `json:"trade_state_desc"` //交易状态描述
+		BankType       string              `json:"bank_type"`        //付款银行
+		Attach         string              `json:"attach"`           //附加数据
+		SuccessTime    string              `json:"success_time"`     //支付完成时间，rfc3339格式
+		Payer          OrderV3Payer        `json:"payer"`
+		Amount         TransactionV3Amount `json:"amount"`
+	}
+
+	TransactionV3Amount struct {
+		Total         int64  `json:"total"`          //订单总金额，单位为分
+		PayerTotal    int64  `json:"payer_total"`    //用户支付金额，单位为分
+		Currency      string `json:"currency"`       //货币类型
+		PayerCurrency string `json:"payer_currency"` //用户支付币种
+	}
+
+	closeOrderV3Req struct {
+		MchId string `json:"mchid"`
+	}
+
+	// v3申请退款请求，transaction_id和out_trade_no二选一，notify_url为空时不发送退款通知
+	RefundV3Req struct {
+		TransactionId string         `json:"transaction_id,omitempty"` //微信支付订单号
+		OutTradeNo    string         `json:"out_trade_no,omitempty"`   //商户订单号
+		OutRefundNo   string         `json:"out_refund_no"`            //商户退款单号，同一退款单号多次请求只退一笔
+		Reason        string         `json:"reason,omitempty"`         //退款原因
+		NotifyUrl     string         `json:"notify_url,omitempty"`     //退款结果回调地址
+		Amount        RefundV3Amount `json:"amount"`                   //退款金额
+	}
+
+	RefundV3Amount struct {
+		Refund   int64  `json:"refund"`             //退款金额，单位为分，不能超过原订单支付金额
+		Total    int64  `json:"total"`              //原订单金额，单位为分
+		Currency string `json:"currency,omitempty"` //货币类型，只支持CNY
+	}
+
+	// v3申请退款和查询退款返回的退款信息
+	RefundV3Resp struct {
+		RefundId            string             `json:"refund_id"`             //微信支付退款单号
+		OutRefundNo         string             `json:"out_refund_no"`         //商户退款单号
+		TransactionId       string             `json:"transaction_id"`        //微信支付订单号
+		OutTradeNo          string             `json:"out_trade_no"`          //商户订单号
+		Channel             string             `json:"channel"`               //退款渠道：ORIGINAL、BALANCE、OTHER_BALANCE、OTHER_BANKCARD
+		UserReceivedAccount string             `json:"user_received_account"` //退款入账账户
+		SuccessTime         string             `json:"success_time"`          //退款成功时间，rfc3339格式
+		CreateTime          string             `json:"create_time"`           //退款受理时间，rfc3339格式
+		Status              string             `json:"status"`                //退款状态，见 RefundV3Success
+		Amount              RefundV3RespAmount `json:"amount"`
+	}
+
+	RefundV3RespAmount struct {
+		Total       int64  `json:"total"`        //订单金额，单位为分
+		Refund      int64  `json:"refund"`       //退款金额，单位为分
+		PayerTotal  int64  `json:"payer_total"`  //用户支付金额，单位为分
+		PayerRefund int64  `json:"payer_refund"` //用户退款金额，单位为分
+		Currency    string `json:"currency"`     //货币类型
+	}
+)
+
+// 退款是否已经结束，PROCESSING时需要稍后再查询
+func (r *RefundV3Resp) Done() bool {
+	return r.Status != RefundV3Processing
+}
+
+// 结算是否已经完成，资金已经结算到结算账户
+func (r *SettlementRecord) Settled() bool {
+	return r.Status == SettlementSuccess
+}
+
+// 结算账户是否已经验证通过，验证通过后才能正常结算
+func (r *SettlementAccountResp) Verified() bool {
+	return r.VerifyResult == SettlementAccountVerifySuccess
+}
+
+// 查询特约商户每日的结算记录，确认资金是否已经结算，需要配置 PayConfig.V3
+// 服务商接口，按结算日期查询，每个结算日一条记录
+func (w wxPay) QuerySettlement(ctx context.Context, req *SettlementQueryReq) (*SettlementResp, error) {
+	if req.SubMchId == "" {
+		return nil, ErrMissingSubMchId
+	}
+	endDate := req.EndDate
+	if endDate == "" {
+		endDate = req.StartDate
+	}
+	start, err := time.Parse(settlementDateLayout, req.StartDate)
+	if err != nil {
+		return nil, fmt.Errorf("%w: start date %q", ErrInvalidSettlementDate, req.StartDate)
+	}
+	end, err := time.Parse(settlementDateLayout, endDate)
+	if err != nil {
+		return nil, fmt.Errorf("%w: end date %q", ErrInvalidSettlementDate, endDate)
+	}
+	if end.Before(start) {
+		return nil, fmt.Errorf("%w: end date %s is before start date %s", ErrInvalidSettlementDate, endDate, req.StartDate)
+	}
+
+	query := url.Values{}
+	query.Set("sub_mchid", req.SubMchId)
+	query.Set("start_date", req.StartDate)
+	query.Set("end_date", endDate)
+	if req.Offset > 0 {
+		query.Set("offset", strconv.Itoa(req.Offset))
+	}
+	if req.Limit > 0 {
+		query.Set("limit", strconv.Itoa(req.Limit))
+	}
+	var resp SettlementResp
+	if err := w.doV3(ctx, http.MethodGet, settlementPath+"?"+query.Encode(), nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// 查询特约商户的结算账户和验证状态，需要配置 PayConfig.V3
+// 服务商接口，subMchId为特约商户号
+// 接口文档：https://pay.weixin.qq.com/wiki/doc/apiv3_partner/apis/chapter11_1_5.shtml
+func (w wxPay) QuerySettlementAccount(ctx context.Context, subMchId string) (*SettlementAccountResp, error) {
+	if subMchId == "" {
+		return nil, ErrMissingSubMchId
+	}
+	var resp SettlementAccountResp
+	if err := w.doV3(ctx, http.MethodGet, fmt.Sprintf(settlementAccountPath, url.PathEscape(subMchId)), nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// v3的JSAPI下单，需要配置 PayConfig.V3，返回的prepay_id通过 GenPrepayV3 生成小程序的支付参数
+// 接口文档：https://pay.weixin.qq.com/wiki/doc/apiv3/apis/chapter3_5_1.shtml
+func (w wxPay) CreateJSAPIOrderV3(ctx context.Context, req *OrderV3Req) (*OrderV3Resp, error) {
+	if err := validateTradeNo(req.OutTradeNo); err != nil {
+		return nil, err
+	}
+	if req.AppId == "" {
+		req.AppId = w.cfg.AppId
+	}
+	if req.MchId == "" {
+		req.MchId = w.cfg.MchId
+	}
+	if req.NotifyUrl == "" {
+		req.NotifyUrl = w.cfg.NotifyUrl
+	}
+	var resp OrderV3Resp
+	if err := w.doV3(ctx, http.MethodPost, jsapiOrderPath, req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// 生成v3下单后小程序调用 wx.requestPayment 的支付参数，使用商户私钥签名，签名类型为RSA
+// 签名串为：appId\n时间戳\n随机串\nprepay_id=xxx\n
+func (w wxPay) GenPrepayV3(ctx context.Context, prepayId string) (*PrepayReturn, error) {
+	keys, err := w.v3()
+	if err != nil {
+		return nil, err
+	}
+	nonceStr, err := randString(32)
+	if err != nil {
+		return nil, err
+	}
+	prepay := PrepayReturn{
+		AppId:     w.cfg.AppId,
+		TimeStamp: strconv.FormatInt(w.now().Unix(), 10),
+		NonceStr:  nonceStr,
+		Package:   "prepay_id=" + prepayId,
+		SignType:  SignTypeRSA,
+	}
+	if prepay.PaySign, err = keys.sign(prepay.AppId + "\n" + prepay.TimeStamp + "\n" + prepay.NonceStr + "\n" + prepay.Package + "\n"); err != nil {
+		return nil, err
+	}
+	return &prepay, nil
+}
+
+// v3按商户订单号查询订单，需要配置 PayConfig.V3
+// 接口文档：https://pay.weixin.qq.com/wiki/doc/apiv3/apis/chapter3_5_2.shtml
+func (w wxPay) QueryOrderV3(ctx context.Context, outTradeNo string) (*TransactionV3, error) {
+	if err := validateTradeNo(outTradeNo); err != nil {
+		return nil, err
+	}
+	var resp TransactionV3
+	path := fmt.Sprintf(queryOrderPath, url.PathEscape(outTradeNo), url.QueryEscape(w.cfg.MchId))
+	if err := w.doV3(ctx, http.MethodGet, path, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// v3关闭订单，需要配置 PayConfig.V3，成功时微信返回204，没有响应内容
+// 接口文档：https://pay.weixin.qq.com/wiki/doc/apiv3/apis/chapter3_5_3.shtml
+func (w wxPay) CloseOrderV3(ctx context.Context, outTradeNo string) error {
+	if err := validateTradeNo(outTradeNo); err != nil {
+		return err
+	}
+	return w.doV3(ctx, http.MethodPost, fmt.Sprintf(closeOrderPath, url.PathEscape(outTradeNo)), &closeOrderV3Req{MchId: w.cfg.MchId}, nil)
+}
+
+// v3申请退款，需要配置 PayConfig.V3，v3接口使用签名认证，不需要商户API证书
+// 退款受理后状态一般为PROCESSING，退款结果通过 QueryRefundV3 查询或者退款通知获得
+// 接口文档：https://pay.weixin.qq.com/wiki/doc/apiv3/apis/chapter3_5_9.shtml
+func (w wxPay) CreateRefundV3(ctx context.Context, req *RefundV3Req) (*RefundV3Resp, error) {
+	if err := validateRefundNo(req.OutRefundNo); err != nil {
+		return nil, err
+	}
+	if req.TransactionId == "" {
+		if err := validateTradeNo(req.OutTradeNo); err != nil {
+			return nil, err
+		}
+	}
+	if req.Amount.Refund <= 0 || req.Amount.Refund > req.Amount.Total {
+		return nil, fmt.Errorf("%w: refund %d of total %d", ErrInvalidAmount, req.Amount.Refund, req.Amount.Total)
+	}
+	var resp RefundV3Resp
+	if err := w.doV3(ctx, http.MethodPost, refundPath, req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// v3按商户退款单号查询退款，需要配置 PayConfig.V3
+// 接口文档：https://pay.weixin.qq.com/wiki/doc/apiv3/apis/chapter3_5_10.shtml
+func (w wxPay) QueryRefundV3(ctx context.Context, outRefundNo string) (*RefundV3Resp, error) {
+	if err := validateRefundNo(outRefundNo); err != nil {
+		return nil, err
+	}
+	var resp RefundV3Resp
+	if err := w.doV3(ctx, http.MethodGet, fmt.Sprintf(queryRefundPath, url.PathEscape(outRefundNo)), nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func validateRefundNo(refundNo string) error {
+	if strings.TrimSpace(refundNo) == "" {
+		return fmt.Errorf("%w: empty", ErrInvalidRefundNo)
+	}
+	if len(refundNo) > maxRefundNoLength {
+		return fmt.Errorf("%w: %q is longer than %d", ErrInvalidRefundNo, refundNo, maxRefundNoLength)
+	}
+	return nil
+}
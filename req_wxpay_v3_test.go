@@ -0,0 +1,243 @@
+package wechat
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWxPay_QuerySettlement(t *testing.T) {
+	keys, cleanup := writeTestV3Keys(t)
+	defer cleanup()
+	body := `{"total_count":2,"offset":0,"limit":10,"data":[` +
+		`{"settlement_date":"2020-06-01","settlement_amount":128800,"unsettlement_amount":0,"fee":773,"currency":"CNY","status":"SUCCESS","success_time":"2020-06-02T10:00:00+08:00"},` +
+		`{"settlement_date":"2020-06-02","settlement_amount":0,"unsettlement_amount":56000,"fee":336,"currency":"CNY","status":"PROCESSING","success_time":""}]}`
+	client := newStubHttp(body)
+	client.header = keys.signResponse(t, body)
+	s := newTestV3Pay(client, keys)
+
+	resp, err := s.QuerySettlement(context.Background(), &SettlementQueryReq{SubMchId: "1900000109", StartDate: "2020-06-01", EndDate: "2020-06-02", Limit: 10})
+	assert.Nil(t, err)
+	assert.EqualValues(t, 2, resp.TotalCount)
+	if assert.Len(t, resp.Data, 2) {
+		settled := resp.Data[0]
+		assert.Equal(t, "2020-06-01", settled.SettlementDate)
+		assert.EqualValues(t, 128800, settled.SettlementAmount)
+		assert.EqualValues(t, 0, settled.UnsettlementAmount)
+		assert.EqualValues(t, 773, settled.Fee)
+		assert.True(t, settled.Settled())
+
+		pending := resp.Data[1]
+		assert.Equal(t, SettlementProcessing, pending.Status)
+		assert.EqualValues(t, 56000, pending.UnsettlementAmount)
+		assert.False(t, pending.Settled())
+	}
+	assert.Equal(t, http.MethodGet, client.last().method)
+	assert.Equal(t, v3BaseUrl+"/v3/merchant-service/settlements?end_date=2020-06-02&limit=10&start_date=2020-06-01&sub_mchid=1900000109", client.last().url)
+
+	// 没有结束日期时只查询开始日期当天
+	_, err = s.QuerySettlement(context.Background(), &SettlementQueryReq{SubMchId: "1900000109", StartDate: "2020-06-01"})
+	assert.Nil(t, err)
+	assert.Equal(t, v3BaseUrl+"/v3/merchant-service/settlements?end_date=2020-06-01&start_date=2020-06-01&sub_mchid=1900000109", client.last().url)
+
+	_, err = s.QuerySettlement(context.Background(), &SettlementQueryReq{StartDate: "2020-06-01"})
+	assert.True(t, errors.Is(err, ErrMissingSubMchId))
+	_, err = s.QuerySettlement(context.Background(), &SettlementQueryReq{SubMchId: "1900000109", StartDate: "20200601"})
+	assert.True(t, errors.Is(err, ErrInvalidSettlementDate), "err = %v", err)
+	_, err = s.QuerySettlement(context.Background(), &SettlementQueryReq{SubMchId: "1900000109", StartDate: "2020-06-02", EndDate: "2020-06-01"})
+	assert.True(t, errors.Is(err, ErrInvalidSettlementDate), "err = %v", err)
+	assert.Len(t, client.requests, 2)
+}
+
+func TestWxPay_QuerySettlementAccount(t *testing.T) {
+	keys, cleanup := writeTestV3Keys(t)
+	defer cleanup()
+	body := `{"account_type":"ACCOUNT_TYPE_BUSINESS","account_bank":"工商银行","bank_name":"中国工商银行股份有限公司北京市分行营业部","bank_branch_id":"402713354941","account_number":"62*************78","verify_result":"VERIFY_SUCCESS","verify_fail_reason":""}`
+	client := newStubHttp(body)
+	client.header = keys.signResponse(t, body)
+	s := newTestV3Pay(client, keys)
+
+	resp, err := s.QuerySettlementAccount(context.Background(), "1900000109")
+	assert.Nil(t, err)
+	assert.Equal(t, "ACCOUNT_TYPE_BUSINESS", resp.AccountType)
+	assert.Equal(t, "工商银行", resp.AccountBank)
+	assert.Equal(t, "402713354941", resp.BankBranchId)
+	assert.Equal(t, "62*************78", resp.AccountNumber)
+	assert.True(t, resp.Verified())
+	assert.Equal(t, http.MethodGet, client.last().method)
+	assert.Equal(t, v3BaseUrl+"/v3/apply4sub/sub_merchants/1900000109/settlement", client.last().url)
+	assert.NotContains(t, client.last().headers, "Content-Type")
+
+	body = `{"account_type":"ACCOUNT_TYPE_PRIVATE","verify_result":"VERIFY_FAIL","verify_fail_reason":"银行账户户名与商户主体名称不一致"}`
+	client = newStubHttp(body)
+	client.header = keys.signResponse(t, body)
+	resp, err = newTestV3Pay(client, keys).QuerySettlementAccount(context.Background(), "1900000109")
+	assert.Nil(t, err)
+	assert.False(t, resp.Verified())
+	assert.Equal(t, "银行账户户名与商户主体名称不一致", resp.VerifyFailReason)
+
+	_, err = s.QuerySettlementAccount(context.Background(), "")
+	assert.True(t, errors.Is(err, ErrMissingSubMchId))
+}
+
+func TestWxPay_CreateJSAPIOrderV3(t *testing.T) {
+	keys, cleanup := writeTestV3Keys(t)
+	defer cleanup()
+	body := `{"prepay_id":"wx201410272009395522657a690389285100"}`
+	client := newStubHttp(body)
+	client.header = keys.signResponse(t, body)
+	s := newTestV3Pay(client, keys)
+	s.cfg.NotifyUrl = "https://example.com/wxpay/notify"
+	s.SetClock(fixedClock(time.Unix(1554208460, 0)))
+
+	resp, err := s.CreateJSAPIOrderV3(context.Background(), &OrderV3Req{
+		Description: "Image形象店-深圳腾大-QQ公仔",
+		OutTradeNo:  "1217752501201407033233368018",
+		Amount:      OrderV3Amount{Total: 100, Currency: "CNY"},
+		Payer:       OrderV3Payer{OpenId: "oUpF8uMuAJO_M2pxb1Q9zNjWeS6o"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "wx201410272009395522657a690389285100", resp.PrepayId)
+
+	sent := client.last()
+	assert.Equal(t, http.MethodPost, sent.method)
+	assert.Equal(t, v3BaseUrl+"/v3/pay/transactions/jsapi", sent.url)
+	assert.Equal(t, `{"appid":"wx2421b1c4370ec43b","mchid":"10000100","description":"Image形象店-深圳腾大-QQ公仔","out_trade_no":"1217752501201407033233368018","notify_url":"https://example.com/wxpay/notify","amount":{"total":100,"currency":"CNY"},"payer":{"openid":"oUpF8uMuAJO_M2pxb1Q9zNjWeS6o"}}`, string(sent.body))
+	match := authorizationPattern.FindStringSubmatch(sent.headers["Authorization"])
+	if assert.NotNil(t, match, sent.headers["Authorization"]) {
+		message := "POST\n/v3/pay/transactions/jsapi\n1554208460\n" + match[2] + "\n" + string(sent.body) + "\n"
+		assert.Nil(t, verifyTestSignature(&keys.merchantKey.PublicKey, message, match[3]))
+	}
+
+	_, err = s.CreateJSAPIOrderV3(context.Background(), &OrderV3Req{})
+	assert.True(t, errors.Is(err, ErrInvalidTradeNo), "err = %v", err)
+	assert.Len(t, client.requests, 1)
+}
+
+func TestWxPay_GenPrepayV3(t *testing.T) {
+	keys, cleanup := writeTestV3Keys(t)
+	defer cleanup()
+	s := newTestV3Pay(nil, keys)
+	s.SetClock(fixedClock(time.Unix(1414561699, 0)))
+
+	prepay, err := s.GenPrepayV3(context.Background(), "wx201410272009395522657a690389285100")
+	assert.Nil(t, err)
+	assert.Equal(t, "wx2421b1c4370ec43b", prepay.AppId)
+	assert.Equal(t, "1414561699", prepay.TimeStamp)
+	assert.Len(t, prepay.NonceStr, 32)
+	assert.Equal(t, "prepay_id=wx201410272009395522657a690389285100", prepay.Package)
+	assert.Equal(t, SignTypeRSA, prepay.SignType)
+	message := "wx2421b1c4370ec43b\n1414561699\n" + prepay.NonceStr + "\nprepay_id=wx201410272009395522657a690389285100\n"
+	assert.Nil(t, verifyTestSignature(&keys.merchantKey.PublicKey, message, prepay.PaySign))
+
+	_, err = newTestPay(nil).GenPrepayV3(context.Background(), "wx201410272009395522657a690389285100")
+	assert.Equal(t, ErrMissingV3Config, err)
+}
+
+func TestWxPay_QueryOrderV3(t *testing.T) {
+	keys, cleanup := writeTestV3Keys(t)
+	defer cleanup()
+	body := `{"appid":"wx2421b1c4370ec43b","mchid":"10000100","out_trade_no":"1217752501201407033233368018","transaction_id":"1217752501201407033233368018","trade_type":"JSAPI","trade_state":"SUCCESS","trade_state_desc":"支付成功","bank_type":"CMC","attach":"自定义数据","success_time":"2018-06-08T10:34:56+08:00","payer":{"openid":"oUpF8uMuAJO_M2pxb1Q9zNjWeS6o"},"amount":{"total":100,"payer_total":90,"currency":"CNY","payer_currency":"CNY"}}`
+	client := newStubHttp(body)
+	client.header = keys.signResponse(t, body)
+	s := newTestV3Pay(client, keys)
+
+	resp, err := s.QueryOrderV3(context.Background(), "1217752501201407033233368018")
+	assert.Nil(t, err)
+	assert.Equal(t, TradeStateSuccess, resp.TradeState)
+	assert.Equal(t, "1217752501201407033233368018", resp.TransactionId)
+	assert.Equal(t, "oUpF8uMuAJO_M2pxb1Q9zNjWeS6o", resp.Payer.OpenId)
+	assert.EqualValues(t, 100, resp.Amount.Total)
+	assert.EqualValues(t, 90, resp.Amount.PayerTotal)
+	assert.Equal(t, "2018-06-08T10:34:56+08:00", resp.SuccessTime)
+	assert.Equal(t, http.MethodGet, client.last().method)
+	assert.Equal(t, v3BaseUrl+"/v3/pay/transactions/out-trade-no/1217752501201407033233368018?mchid=10000100", client.last().url)
+
+	_, err = s.QueryOrderV3(context.Background(), " ")
+	assert.True(t, errors.Is(err, ErrInvalidTradeNo), "err = %v", err)
+	assert.Len(t, client.requests, 1)
+}
+
+func TestWxPay_CloseOrderV3(t *testing.T) {
+	keys, cleanup := writeTestV3Keys(t)
+	defer cleanup()
+	client := newStubHttp("")
+	client.status = http.StatusNoContent
+	client.header = keys.signResponse(t, "")
+	s := newTestV3Pay(client, keys)
+
+	assert.Nil(t, s.CloseOrderV3(context.Background(), "1217752501201407033233368018"))
+	assert.Equal(t, http.MethodPost, client.last().method)
+	assert.Equal(t, v3BaseUrl+"/v3/pay/transactions/out-trade-no/1217752501201407033233368018/close", client.last().url)
+	assert.Equal(t, `{"mchid":"10000100"}`, string(client.last().body))
+
+	// 订单已支付时不能关闭
+	client = newStubHttp(`{"code":"ORDERPAID","message":"订单已支付"}`)
+	client.status = http.StatusBadRequest
+	err := newTestV3Pay(client, keys).CloseOrderV3(context.Background(), "1217752501201407033233368018")
+	var v3Err *V3Error
+	if assert.True(t, errors.As(err, &v3Err), "err = %v", err) {
+		assert.Equal(t, "ORDERPAID", v3Err.Code)
+	}
+}
+
+func TestWxPay_CreateRefundV3(t *testing.T) {
+	keys, cleanup := writeTestV3Keys(t)
+	defer cleanup()
+	body := `{"refund_id":"50000000382019052709732678859","out_refund_no":"1217752501201407033233368018","transaction_id":"1217752501201407033233368018","out_trade_no":"1217752501201407033233368018","channel":"ORIGINAL","user_received_account":"招商银行信用卡0403","create_time":"2020-12-01T16:18:12+08:00","status":"PROCESSING","amount":{"total":100,"refund":50,"payer_total":100,"payer_refund":50,"currency":"CNY"}}`
+	client := newStubHttp(body)
+	client.header = keys.signResponse(t, body)
+	s := newTestV3Pay(client, keys)
+
+	resp, err := s.CreateRefundV3(context.Background(), &RefundV3Req{
+		OutTradeNo:  "1217752501201407033233368018",
+		OutRefundNo: "1217752501201407033233368018",
+		Reason:      "商品已售完",
+		Amount:      RefundV3Amount{Refund: 50, Total: 100, Currency: "CNY"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "50000000382019052709732678859", resp.RefundId)
+	assert.Equal(t, RefundV3Processing, resp.Status)
+	assert.False(t, resp.Done())
+	assert.EqualValues(t, 50, resp.Amount.PayerRefund)
+
+	sent := client.last()
+	assert.Equal(t, http.MethodPost, sent.method)
+	assert.Equal(t, v3BaseUrl+"/v3/refund/domestic/refunds", sent.url)
+	assert.Equal(t, `{"out_trade_no":"1217752501201407033233368018","out_refund_no":"1217752501201407033233368018","reason":"商品已售完","amount":{"refund":50,"total":100,"currency":"CNY"}}`, string(sent.body))
+
+	// 参数错误时不发请求
+	_, err = s.CreateRefundV3(context.Background(), &RefundV3Req{OutTradeNo: "1217752501201407033233368018", Amount: RefundV3Amount{Refund: 50, Total: 100}})
+	assert.True(t, errors.Is(err, ErrInvalidRefundNo), "err = %v", err)
+	_, err = s.CreateRefundV3(context.Background(), &RefundV3Req{OutRefundNo: "1217752501201407033233368018", Amount: RefundV3Amount{Refund: 50, Total: 100}})
+	assert.True(t, errors.Is(err, ErrInvalidTradeNo), "err = %v", err)
+	_, err = s.CreateRefundV3(context.Background(), &RefundV3Req{TransactionId: "1217752501201407033233368018", OutRefundNo: "1217752501201407033233368018", Amount: RefundV3Amount{Refund: 101, Total: 100}})
+	assert.True(t, errors.Is(err, ErrInvalidAmount), "err = %v", err)
+	assert.Len(t, client.requests, 1)
+}
+
+func TestWxPay_QueryRefundV3(t *testing.T) {
+	keys, cleanup := writeTestV3Keys(t)
+	defer cleanup()
+	body := `{"refund_id":"50000000382019052709732678859","out_refund_no":"1217752501201407033233368018","transaction_id":"1217752501201407033233368018","out_trade_no":"1217752501201407033233368018","channel":"ORIGINAL","success_time":"2020-12-01T16:18:12+08:00","create_time":"2020-12-01T16:18:10+08:00","status":"SUCCESS","amount":{"total":100,"refund":100,"payer_total":100,"payer_refund":100,"currency":"CNY"}}`
+	client := newStubHttp(body)
+	client.header = keys.signResponse(t, body)
+	s := newTestV3Pay(client, keys)
+
+	resp, err := s.QueryRefundV3(context.Background(), "1217752501201407033233368018")
+	assert.Nil(t, err)
+	assert.Equal(t, RefundV3Success, resp.Status)
+	assert.True(t, resp.Done())
+	assert.Equal(t, "2020-12-01T16:18:12+08:00", resp.SuccessTime)
+	assert.EqualValues(t, 100, resp.Amount.Refund)
+	assert.Equal(t, http.MethodGet, client.last().method)
+	assert.Equal(t, v3BaseUrl+"/v3/refund/domestic/refunds/1217752501201407033233368018", client.last().url)
+
+	_, err = s.QueryRefundV3(context.Background(), "")
+	assert.True(t, errors.Is(err, ErrInvalidRefundNo), "err = %v", err)
+	assert.Len(t, client.requests, 1)
+}
@@ -0,0 +1,213 @@
+package wechat
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+)
+
+const (
+	profitSharingAddReceiverUrl = "https://api.mch.weixin.qq.com/pay/profitsharingaddreceiver"
+	profitSharingFinishUrl      = "https://api.mch.weixin.qq.com/secapi/pay/profitsharingfinish"
+	profitSharingReturnUrl      = "https://api.mch.weixin.qq.com/secapi/pay/profitsharingreturn"
+)
+
+// 分账接收方类型
+const (
+	ReceiverTypeMerchantId     = "MERCHANT_ID"
+	ReceiverTypePersonalWechat = "PERSONAL_WECHATID"
+	ReceiverTypePersonalOpenId = "PERSONAL_OPENID"
+)
+
+type (
+	ProfitSharingReceiver struct {
+		Type           string `json:"type"`                      //分账接收方类型
+		Account        string `json:"account"`                   //分账接收方帐号
+		Name           string `json:"name,omitempty"`            //分账接收方全称
+		RelationType   string `json:"relation_type,omitempty"`   //与分账方的关系类型，添加接收方时必填
+		CustomRelation string `json:"custom_relation,omitempty"` //自定义的分账关系，relation_type为CUSTOM时必填
+	}
+
+	ProfitSharingAddReceiverReq struct {
+		XMLName  xml.Name `xml:"xml" json:"-"`
+		MchId    string   `xml:"mch_id" json:"mch_id"`
+		AppId    string   `xml:"appid" json:"appid"`
+		NonceStr string   `xml:"nonce_str" json:"nonce_str"`
+		Sign     string   `xml:"sign" json:"sign"`
+		SignType string   `xml:"sign_type" json:"sign_type"`
+		Receiver string   `xml:"receiver" json:"receiver"` //分账接收方，JSON格式，使用 SetReceiver 设置
+	}
+
+	ProfitSharingAddReceiverResp struct {
+		XMLName    xml.Name `xml:"xml"`
+		ReturnCode string   `xml:"return_code"`
+		ReturnMsg  string   `xml:"return_msg"`
+		ResultCode string   `xml:"result_code"`
+		ErrCode    string   `xml:"err_code"`
+		ErrCodeDes string   `xml:"err_code_des"`
+		MchId      string   `xml:"mch_id"`
+		AppId      string   `xml:"appid"`
+		NonceStr   string   `xml:"nonce_str"`
+		Sign       string   `xml:"sign"`
+		Receiver   string   `xml:"receiver"`
+	}
+
+	ProfitSharingFinishReq struct {
+		XMLName       xml.Name `xml:"xml" json:"-"`
+		MchId         string   `xml:"mch_id" json:"mch_id"`
+		AppId         string   `xml:"appid" json:"appid"`
+		NonceStr      string   `xml:"nonce_str" json:"nonce_str"`
+		Sign          string   `xml:"sign" json:"sign"`
+		SignType      string   `xml:"sign_type" json:"sign_type"`
+		TransactionId string   `xml:"transaction_id" json:"transaction_id"` //微信支付订单号
+		OutOrderNo    string   `xml:"out_order_no" json:"out_order_no"`     //商户分账单号
+		Description   string   `xml:"description" json:"description"`       //分账完结描述
+	}
+
+	ProfitSharingFinishResp struct {
+		XMLName       xml.Name `xml:"xml"`
+		ReturnCode    string   `xml:"return_code"`
+		ReturnMsg     string   `xml:"return_msg"`
+		ResultCode    string   `xml:"result_code"`
+		ErrCode       string   `xml:"err_code"`
+		ErrCodeDes    string   `xml:"err_code_des"`
+		MchId         string   `xml:"mch_id"`
+		AppId         string   `xml:"appid"`
+		NonceStr      string   `xml:"nonce_str"`
+		Sign          string   `xml:"sign"`
+		TransactionId string   `xml:"transaction_id"`
+		OutOrderNo    string   `xml:"out_order_no"`
+		OrderId       string   `xml:"order_id"` //微信分账单号
+	}
+
+	ProfitSharingReturnReq struct {
+		XMLName           xml.Name `xml:"xml" json:"-"`
+		MchId             string   `xml:"mch_id" json:"mch_id"`
+		AppId             string   `xml:"appid" json:"appid"`
+		NonceStr          string   `xml:"nonce_str" json:"nonce_str"`
+		Sign              string   `xml:"sign" json:"sign"`
+		SignType          string   `xml:"sign_type" json:"sign_type"`
+		OrderId           string   `xml:"order_id" json:"order_id"`                       //微信分账单号，和商户分账单号二选一
+		OutOrderNo        string   `xml:"out_order_no" json:"out_order_no"`               //商户分账单号
+		OutReturnNo       string   `xml:"out_return_no" json:"out_return_no"`             //商户回退单号
+		ReturnAccountType string   `xml:"return_account_type" json:"return_account_type"` //回退方类型，暂时只支持MERCHANT_ID
+		ReturnAccount     string   `xml:"return_account" json:"return_account"`           //回退方账号
+		ReturnAmount      int64    `xml:"return_amount" json:"return_amount,string"`      //回退金额，单位为分
+		Description       string   `xml:"description" json:"description"`                 //回退描述
+	}
+
+	ProfitSharingReturnResp struct {
+		XMLName           xml.Name `xml:"xml"`
+		ReturnCode        string   `xml:"return_code"`
+		ReturnMsg         string   `xml:"return_msg"`
+		ResultCode        string   `xml:"result_code"`
+		ErrCode           string   `xml:"err_code"`
+		ErrCodeDes        string   `xml:"err_code_des"`
+		MchId             string   `xml:"mch_id"`
+		AppId             string   `xml:"appid"`
+		NonceStr          string   `xml:"nonce_str"`
+		Sign              string   `xml:"sign"`
+		OrderId           string   `xml:"order_id"`
+		OutOrderNo        string   `xml:"out_order_no"`
+		OutReturnNo       string   `xml:"out_return_no"`
+		ReturnNo          string   `xml:"return_no"` //微信回退单号
+		ReturnAccountType string   `xml:"return_account_type"`
+		ReturnAccount     string   `xml:"return_account"`
+		ReturnAmount      int64    `xml:"return_amount"`
+		Description       string   `xml:"description"`
+		Result            string   `xml:"result"` //回退结果：PROCESSING、SUCCESS、FAIL
+		FailReason        string   `xml:"fail_reason"`
+		FinishTime        string   `xml:"finish_time"`
+	}
+)
+
+// 将分账接收方编码成接口需要的JSON字符串
+func (r *ProfitSharingAddReceiverReq) SetReceiver(receiver ProfitSharingReceiver) error {
+	buf, err := json.Marshal(receiver)
+	if err != nil {
+		return err
+	}
+	r.Receiver = string(buf)
+	return nil
+}
+
+func (r *ProfitSharingAddReceiverReq) SetAppId(appId string)       { r.AppId = appId }
+func (r *ProfitSharingAddReceiverReq) SetMchId(mchId string)       { r.MchId = mchId }
+func (r *ProfitSharingAddReceiverReq) SetNonceStr(nonceStr string) { r.NonceStr = nonceStr }
+func (r *ProfitSharingAddReceiverReq) SetSign(sign string)         { r.Sign = sign }
+
+func (r *ProfitSharingFinishReq) SetAppId(appId string)       { r.AppId = appId }
+func (r *ProfitSharingFinishReq) SetMchId(mchId string)       { r.MchId = mchId }
+func (r *ProfitSharingFinishReq) SetNonceStr(nonceStr string) { r.NonceStr = nonceStr }
+func (r *ProfitSharingFinishReq) SetSign(sign string)         { r.Sign = sign }
+
+func (r *ProfitSharingReturnReq) SetAppId(appId string)       { r.AppId = appId }
+func (r *ProfitSharingReturnReq) SetMchId(mchId string)       { r.MchId = mchId }
+func (r *ProfitSharingReturnReq) SetNonceStr(nonceStr string) { r.NonceStr = nonceStr }
+func (r *ProfitSharingReturnReq) SetSign(sign string)         { r.Sign = sign }
+
+func (r *ProfitSharingAddReceiverResp) result() payResult {
+	return payResult{r.ReturnCode, r.ReturnMsg, r.ResultCode, r.ErrCode, r.ErrCodeDes, r.AppId, r.MchId}
+}
+
+func (r *ProfitSharingFinishResp) result() payResult {
+	return payResult{r.ReturnCode, r.ReturnMsg, r.ResultCode, r.ErrCode, r.ErrCodeDes, r.AppId, r.MchId}
+}
+
+func (r *ProfitSharingReturnResp) result() payResult {
+	return payResult{r.ReturnCode, r.ReturnMsg, r.ResultCode, r.ErrCode, r.ErrCodeDes, r.AppId, r.MchId}
+}
+
+// 添加分账接收方，分账接口只支持HMAC-SHA256签名
+// 接口文档：https://pay.weixin.qq.com/wiki/doc/api/allocation.php?chapter=27_3&index=4
+func (w wxMch) ReqProfitSharingAddReceiver(ctx context.Context, req *ProfitSharingAddReceiverReq) (*ProfitSharingAddReceiverResp, error) {
+	req.SignType = SignTypeHMACSHA256
+	if err := w.prepare(ctx, req); err != nil {
+		return nil, err
+	}
+
+	var resp ProfitSharingAddReceiverResp
+	if err := w.postPayXML(ctx, profitSharingAddReceiverUrl, req, &resp); err != nil {
+		return nil, err
+	}
+	w.logger.Info("[wxmch] req profit sharing add receiver", w.bodyField("body", resp))
+	return &resp, nil
+}
+
+// 完结分账，不需要继续分账的订单解冻剩余的资金给商户
+// 接口文档：https://pay.weixin.qq.com/wiki/doc/api/allocation.php?chapter=27_5&index=6
+func (w wxMch) ReqProfitSharingFinish(ctx context.Context, req *ProfitSharingFinishReq) (*ProfitSharingFinishResp, error) {
+	if err := w.requireCert(); err != nil {
+		return nil, err
+	}
+	req.SignType = SignTypeHMACSHA256
+	if err := w.prepare(ctx, req); err != nil {
+		return nil, err
+	}
+
+	var resp ProfitSharingFinishResp
+	if err := w.postPayXML(ctx, profitSharingFinishUrl, req, &resp); err != nil {
+		return nil, err
+	}
+	w.logger.Info("[wxmch] req profit sharing finish", w.bodyField("body", resp))
+	return &resp, nil
+}
+
+// 分账回退，将已经分给接收方的资金退回给分账方
+// 接口文档：https://pay.weixin.qq.com/wiki/doc/api/allocation.php?chapter=27_7&index=7
+func (w wxMch) ReqProfitSharingReturn(ctx context.Context, req *ProfitSharingReturnReq) (*ProfitSharingReturnResp, error) {
+	if err := w.requireCert(); err != nil {
+		return nil, err
+	}
+	req.SignType = SignTypeHMACSHA256
+	if err := w.prepare(ctx, req); err != nil {
+		return nil, err
+	}
+
+	var resp ProfitSharingReturnResp
+	if err := w.postPayXML(ctx, profitSharingReturnUrl, req, &resp); err != nil {
+		return nil, err
+	}
+	w.logger.Info("[wxmch] req profit sharing return", w.bodyField("body", resp))
+	return &resp, nil
+}
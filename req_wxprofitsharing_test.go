@@ -0,0 +1,100 @@
+package wechat
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var _ MchService = (*wxMch)(nil)
+
+func TestWxMch_ReqProfitSharingAddReceiver(t *testing.T) {
+	client := newStubHttp(`<xml>
+<return_code><![CDATA[SUCCESS]]></return_code>
+<result_code><![CDATA[SUCCESS]]></result_code>
+<mch_id><![CDATA[10000100]]></mch_id>
+<appid><![CDATA[wx2421b1c4370ec43b]]></appid>
+<receiver><![CDATA[{"type":"MERCHANT_ID","account":"190001001"}]]></receiver>
+</xml>`)
+	req := &ProfitSharingAddReceiverReq{}
+	assert.Nil(t, req.SetReceiver(ProfitSharingReceiver{
+		Type:         ReceiverTypeMerchantId,
+		Account:      "190001001",
+		Name:         "示例商户全称",
+		RelationType: "STORE_OWNER",
+	}))
+	resp, err := newTestMch(client).ReqProfitSharingAddReceiver(context.Background(), req)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"type":"MERCHANT_ID","account":"190001001"}`, resp.Receiver)
+
+	params := parseXMLParams(t, client.last().body)
+	assert.Equal(t, SignTypeHMACSHA256, params["sign_type"])
+	assert.Equal(t, expectedSign(params, "192006250b4c09247ec02edce69f6a2d"), params["sign"])
+	var receiver ProfitSharingReceiver
+	assert.Nil(t, json.Unmarshal([]byte(params["receiver"]), &receiver))
+	assert.Equal(t, "STORE_OWNER", receiver.RelationType)
+}
+
+func TestWxMch_ReqProfitSharingFinish(t *testing.T) {
+	client := newStubHttp(`<xml>
+<return_code><![CDATA[SUCCESS]]></return_code>
+<result_code><![CDATA[SUCCESS]]></result_code>
+<mch_id><![CDATA[10000100]]></mch_id>
+<appid><![CDATA[wx2421b1c4370ec43b]]></appid>
+<nonce_str><![CDATA[1ebf349b94fcbdb0834f6bbf2afb5b15]]></nonce_str>
+<sign><![CDATA[2E426E88A8A7C2F7C6A5E6D0D9C3A0C1]]></sign>
+<transaction_id><![CDATA[4208450740201411110007820472]]></transaction_id>
+<out_order_no><![CDATA[P20150806125346]]></out_order_no>
+<order_id><![CDATA[3008450740201411110007820472]]></order_id>
+</xml>`)
+	resp, err := newTestMch(client).ReqProfitSharingFinish(context.Background(), &ProfitSharingFinishReq{
+		TransactionId: "4208450740201411110007820472",
+		OutOrderNo:    "P20150806125346",
+		Description:   "分账已完成",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "3008450740201411110007820472", resp.OrderId)
+	assert.Equal(t, profitSharingFinishUrl, client.last().url)
+
+	params := parseXMLParams(t, client.last().body)
+	assert.Equal(t, SignTypeHMACSHA256, params["sign_type"])
+	assert.Equal(t, "4208450740201411110007820472", params["transaction_id"])
+	assert.Equal(t, expectedSign(params, "192006250b4c09247ec02edce69f6a2d"), params["sign"])
+}
+
+func TestWxMch_ReqProfitSharingReturn(t *testing.T) {
+	client := newStubHttp(`<xml>
+<return_code><![CDATA[SUCCESS]]></return_code>
+<result_code><![CDATA[SUCCESS]]></result_code>
+<mch_id><![CDATA[10000100]]></mch_id>
+<appid><![CDATA[wx2421b1c4370ec43b]]></appid>
+<order_id><![CDATA[3008450740201411110007820472]]></order_id>
+<out_order_no><![CDATA[P20150806125346]]></out_order_no>
+<out_return_no><![CDATA[R20190516001]]></out_return_no>
+<return_no><![CDATA[394567567567567]]></return_no>
+<return_account_type><![CDATA[MERCHANT_ID]]></return_account_type>
+<return_account><![CDATA[86693852]]></return_account>
+<return_amount>888</return_amount>
+<description><![CDATA[用户退款]]></description>
+<result><![CDATA[SUCCESS]]></result>
+<finish_time><![CDATA[20180608170132]]></finish_time>
+</xml>`)
+	resp, err := newTestMch(client).ReqProfitSharingReturn(context.Background(), &ProfitSharingReturnReq{
+		OutOrderNo:        "P20150806125346",
+		OutReturnNo:       "R20190516001",
+		ReturnAccountType: ReceiverTypeMerchantId,
+		ReturnAccount:     "86693852",
+		ReturnAmount:      888,
+		Description:       "用户退款",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "SUCCESS", resp.Result)
+	assert.Equal(t, int64(888), resp.ReturnAmount)
+	assert.Equal(t, "394567567567567", resp.ReturnNo)
+
+	params := parseXMLParams(t, client.last().body)
+	assert.Equal(t, "888", params["return_amount"])
+	assert.Equal(t, expectedSign(params, "192006250b4c09247ec02edce69f6a2d"), params["sign"])
+}
@@ -0,0 +1,151 @@
+package wechat
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+const (
+	sendRedPackUrl      = "https://api.mch.weixin.qq.com/mmpaymkttransfers/sendredpack"
+	sendGroupRedPackUrl = "https://api.mch.weixin.qq.com/mmpaymkttransfers/sendgroupredpack"
+
+	// 裂变红包的金额设置方式，目前只有全部随机
+	AmtTypeAllRand = "ALL_RAND"
+
+	// 每个红包的金额范围，单位为分
+	minRedPackAmount = 100
+	maxRedPackAmount = 20000
+	// 裂变红包的个数范围
+	minGroupRedPackNum = 3
+	maxGroupRedPackNum = 20
+)
+
+var (
+	ErrInvalidRedPack = errors.New("[gowechat] invalid red pack")
+)
+
+type (
+	// 发放普通红包或者裂变红包，AmtType不为空时为裂变红包
+	SendRedPackReq struct {
+		XMLName     xml.Name `xml:"xml" json:"-"`
+		NonceStr    string   `xml:"nonce_str" json:"nonce_str"`
+		Sign        string   `xml:"sign" json:"sign"`
+		MchBillNo   string   `xml:"mch_billno" json:"mch_billno"`            //商户订单号
+		MchId       string   `xml:"mch_id" json:"mch_id"`                    //商户号
+		WxAppId     string   `xml:"wxappid" json:"wxappid"`                  //公众账号appid
+		SendName    string   `xml:"send_name" json:"send_name"`              //商户名称，最多32个字符
+		ReOpenId    string   `xml:"re_openid" json:"re_openid"`              //接受红包的用户openid，裂变红包为种子用户
+		TotalAmount int64    `xml:"total_amount" json:"total_amount,string"` //付款金额，单位为分
+		TotalNum    int      `xml:"total_num" json:"total_num,string"`       //红包发放总人数，普通红包为1，裂变红包为3-20
+		AmtType     string   `xml:"amt_type,omitempty" json:"amt_type"`      //红包金额设置方式，裂变红包传 ALL_RAND
+		Wishing     string   `xml:"wishing" json:"wishing"`                  //红包祝福语，最多128个字符
+		ClientIp    string   `xml:"client_ip,omitempty" json:"client_ip"`    //调用接口的机器IP，普通红包必填
+		ActName     string   `xml:"act_name" json:"act_name"`                //活动名称，最多32个字符
+		Remark      string   `xml:"remark" json:"remark"`                    //备注，最多256个字符
+		SceneId     string   `xml:"scene_id,omitempty" json:"scene_id"`      //发放红包使用场景，如：PRODUCT_1
+	}
+
+	SendRedPackResp struct {
+		XMLName     xml.Name `xml:"xml"`
+		ReturnCode  string   `xml:"return_code"`
+		ReturnMsg   string   `xml:"return_msg"`
+		ResultCode  string   `xml:"result_code"`
+		ErrCode     string   `xml:"err_code"`
+		ErrCodeDes  string   `xml:"err_code_des"`
+		MchBillNo   string   `xml:"mch_billno"`
+		MchId       string   `xml:"mch_id"`
+		WxAppId     string   `xml:"wxappid"`
+		ReOpenId    string   `xml:"re_openid"`
+		TotalAmount int64    `xml:"total_amount"`
+		SendListId  string   `xml:"send_listid"` //微信红包订单号
+	}
+)
+
+func (r *SendRedPackReq) SetAppId(appId string)       { r.WxAppId = appId }
+func (r *SendRedPackReq) SetMchId(mchId string)       { r.MchId = mchId }
+func (r *SendRedPackReq) SetNonceStr(nonceStr string) { r.NonceStr = nonceStr }
+func (r *SendRedPackReq) SetSign(sign string)         { r.Sign = sign }
+
+func (r *SendRedPackResp) result() payResult {
+	return payResult{r.ReturnCode, r.ReturnMsg, r.ResultCode, r.ErrCode, r.ErrCodeDes, r.WxAppId, r.MchId}
+}
+
+// 是否为裂变红包
+func (r *SendRedPackReq) IsGroup() bool {
+	return r.AmtType != ""
+}
+
+// 按微信的红包规则检查参数，不满足时返回 ErrInvalidRedPack
+// 每个红包的金额在1元到200元之间，普通红包只能发给1个人，裂变红包为3到20人
+func (r *SendRedPackReq) Validate() error {
+	for _, field := range []struct {
+		name  string
+		value string
+		max   int
+	}{
+		{"mch_billno", r.MchBillNo, 28},
+		{"send_name", r.SendName, 32},
+		{"re_openid", r.ReOpenId, 32},
+		{"wishing", r.Wishing, 128},
+		{"act_name", r.ActName, 32},
+		{"remark", r.Remark, 256},
+	} {
+		if field.value == "" {
+			return fmt.Errorf("%w: %s is required", ErrInvalidRedPack, field.name)
+		}
+		if n := utf8.RuneCountInString(field.value); n > field.max {
+			return fmt.Errorf("%w: %s length %d exceeds %d", ErrInvalidRedPack, field.name, n, field.max)
+		}
+	}
+
+	if r.IsGroup() {
+		if r.AmtType != AmtTypeAllRand {
+			return fmt.Errorf("%w: amt_type must be %s", ErrInvalidRedPack, AmtTypeAllRand)
+		}
+		if r.TotalNum < minGroupRedPackNum || r.TotalNum > maxGroupRedPackNum {
+			return fmt.Errorf("%w: total_num of group red pack must be between %d and %d", ErrInvalidRedPack, minGroupRedPackNum, maxGroupRedPackNum)
+		}
+	} else {
+		if r.TotalNum != 1 {
+			return fmt.Errorf("%w: total_num must be 1", ErrInvalidRedPack)
+		}
+		if r.ClientIp == "" {
+			return fmt.Errorf("%w: client_ip is required", ErrInvalidRedPack)
+		}
+	}
+
+	// 裂变红包按平均金额检查，每个红包至少1元
+	if r.TotalAmount < int64(r.TotalNum)*minRedPackAmount || r.TotalAmount > int64(r.TotalNum)*maxRedPackAmount {
+		return fmt.Errorf("%w: amount of each red pack must be between %d and %d fen", ErrInvalidRedPack, minRedPackAmount, maxRedPackAmount)
+	}
+	return nil
+}
+
+// 发放红包，AmtType为空时发放普通红包，否则发放裂变红包
+// 接口文档：https://pay.weixin.qq.com/wiki/doc/api/tools/cash_coupon.php?chapter=13_4&index=3
+// 裂变红包：https://pay.weixin.qq.com/wiki/doc/api/tools/cash_coupon.php?chapter=13_5&index=4
+func (w wxMch) ReqSendRedPack(ctx context.Context, req *SendRedPackReq) (*SendRedPackResp, error) {
+	if err := w.requireCert(); err != nil {
+		return nil, err
+	}
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+	if err := w.prepare(ctx, req); err != nil {
+		return nil, err
+	}
+
+	url := sendRedPackUrl
+	if req.IsGroup() {
+		url = sendGroupRedPackUrl
+	}
+	var resp SendRedPackResp
+	if err := w.postPayXML(ctx, url, req, &resp); err != nil {
+		return nil, err
+	}
+	w.logger.Info("[wxmch] req send red pack", w.bodyField("body", resp))
+	return &resp, nil
+}
@@ -0,0 +1,102 @@
+package wechat
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRedPack() SendRedPackReq {
+	return SendRedPackReq{
+		MchBillNo:   "10000098201411111234567890",
+		SendName:    "天虹百货",
+		ReOpenId:    "oxTWIuGaIt6gTKsQRLau2M0yL16E",
+		TotalAmount: 1000,
+		TotalNum:    1,
+		Wishing:     "感谢您参加猜灯谜活动，祝您元宵节快乐！",
+		ClientIp:    "192.168.0.1",
+		ActName:     "猜灯谜抢红包活动",
+		Remark:      "猜越多得越多，快来抢！",
+	}
+}
+
+func TestSendRedPackReq_Validate(t *testing.T) {
+	tests := []struct {
+		Name   string
+		Modify func(r *SendRedPackReq)
+		Valid  bool
+	}{
+		{"valid", func(r *SendRedPackReq) {}, true},
+		{"min amount", func(r *SendRedPackReq) { r.TotalAmount = 100 }, true},
+		{"max amount", func(r *SendRedPackReq) { r.TotalAmount = 20000 }, true},
+		{"below min amount", func(r *SendRedPackReq) { r.TotalAmount = 99 }, false},
+		{"above max amount", func(r *SendRedPackReq) { r.TotalAmount = 20001 }, false},
+		{"normal total num", func(r *SendRedPackReq) { r.TotalNum = 2 }, false},
+		{"missing client ip", func(r *SendRedPackReq) { r.ClientIp = "" }, false},
+		{"missing mch billno", func(r *SendRedPackReq) { r.MchBillNo = "" }, false},
+		{"missing send name", func(r *SendRedPackReq) { r.SendName = "" }, false},
+		{"missing openid", func(r *SendRedPackReq) { r.ReOpenId = "" }, false},
+		{"missing wishing", func(r *SendRedPackReq) { r.Wishing = "" }, false},
+		{"missing act name", func(r *SendRedPackReq) { r.ActName = "" }, false},
+		{"missing remark", func(r *SendRedPackReq) { r.Remark = "" }, false},
+		{"max wishing", func(r *SendRedPackReq) { r.Wishing = strings.Repeat("福", 128) }, true},
+		{"long wishing", func(r *SendRedPackReq) { r.Wishing = strings.Repeat("福", 129) }, false},
+		{"long act name", func(r *SendRedPackReq) { r.ActName = strings.Repeat("a", 33) }, false},
+		{"long remark", func(r *SendRedPackReq) { r.Remark = strings.Repeat("a", 257) }, false},
+		{"group", func(r *SendRedPackReq) { r.AmtType, r.TotalNum, r.TotalAmount = AmtTypeAllRand, 3, 300 }, true},
+		{"group without client ip", func(r *SendRedPackReq) {
+			r.AmtType, r.TotalNum, r.TotalAmount, r.ClientIp = AmtTypeAllRand, 20, 2000, ""
+		}, true},
+		{"group below min amount", func(r *SendRedPackReq) { r.AmtType, r.TotalNum, r.TotalAmount = AmtTypeAllRand, 3, 299 }, false},
+		{"group above max amount", func(r *SendRedPackReq) { r.AmtType, r.TotalNum, r.TotalAmount = AmtTypeAllRand, 3, 60001 }, false},
+		{"group too few", func(r *SendRedPackReq) { r.AmtType, r.TotalNum = AmtTypeAllRand, 2 }, false},
+		{"group too many", func(r *SendRedPackReq) { r.AmtType, r.TotalNum, r.TotalAmount = AmtTypeAllRand, 21, 2100 }, false},
+		{"invalid amt type", func(r *SendRedPackReq) { r.AmtType, r.TotalNum, r.TotalAmount = "FIXED", 3, 300 }, false},
+	}
+	for _, test := range tests {
+		req := newTestRedPack()
+		test.Modify(&req)
+		err := req.Validate()
+		if test.Valid {
+			assert.Nil(t, err, test.Name)
+		} else {
+			assert.True(t, errors.Is(err, ErrInvalidRedPack), "%s: err = %v", test.Name, err)
+		}
+	}
+}
+
+func TestWxMch_ReqSendRedPack(t *testing.T) {
+	client := newStubHttp(`<xml>
+<return_code><![CDATA[SUCCESS]]></return_code>
+<result_code><![CDATA[SUCCESS]]></result_code>
+<mch_billno><![CDATA[10000098201411111234567890]]></mch_billno>
+<send_listid><![CDATA[100000000020150520314766074200]]></send_listid>
+</xml>`)
+	s := newTestMch(client)
+
+	req := newTestRedPack()
+	resp, err := s.ReqSendRedPack(context.Background(), &req)
+	assert.Nil(t, err)
+	assert.Equal(t, "100000000020150520314766074200", resp.SendListId)
+	assert.Equal(t, sendRedPackUrl, client.last().url)
+	params := parseXMLParams(t, client.last().body)
+	assert.Equal(t, "wx2421b1c4370ec43b", params["wxappid"])
+	assert.Equal(t, "1000", params["total_amount"])
+	assert.NotContains(t, params, "amt_type")
+	assert.Equal(t, expectedSign(params, s.key), params["sign"])
+
+	group := newTestRedPack()
+	group.AmtType, group.TotalNum, group.TotalAmount = AmtTypeAllRand, 3, 300
+	_, err = s.ReqSendRedPack(context.Background(), &group)
+	assert.Nil(t, err)
+	assert.Equal(t, sendGroupRedPackUrl, client.last().url)
+
+	invalid := newTestRedPack()
+	invalid.TotalAmount = 50
+	_, err = s.ReqSendRedPack(context.Background(), &invalid)
+	assert.True(t, errors.Is(err, ErrInvalidRedPack))
+	assert.Len(t, client.requests, 2)
+}
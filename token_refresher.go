@@ -0,0 +1,114 @@
+package wechat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// 在token过期前多久刷新
+	tokenRefreshAhead = 5 * time.Minute
+	// 刷新失败后重试的间隔
+	tokenRetryInterval = 30 * time.Second
+)
+
+var (
+	ErrAccessToken = errors.New("[gowechat] get access token failed")
+)
+
+// TokenStore 多个实例共享的access_token存储
+// 获取新的access_token会使之前的失效，多个实例各自刷新时会互相覆盖，刷新前先从存储中读取其他实例刷新的结果
+type TokenStore interface {
+	// 读取共享的token，没有时返回空字符串
+	Load(ctx context.Context) (token string, expiresAt time.Time, err error)
+	// 保存刷新后的token
+	Save(ctx context.Context, token string, expiresAt time.Time) error
+}
+
+// timerClock 可以等待的时钟，SetClock 设置的时钟实现了这个接口时，后台刷新也使用它等待
+type timerClock interface {
+	Clock
+	After(d time.Duration) <-chan time.Time
+}
+
+// 设置多个实例共享的access_token存储，用于 StartTokenRefresher
+func (w *wxMini) SetTokenStore(store TokenStore) {
+	w.tokenStore = store
+}
+
+// 启动后台刷新access_token的goroutine，在token过期前5分钟刷新，刷新失败时每30秒重试
+// ctx取消后goroutine退出，返回的channel在退出后关闭
+// 刷新的同时不要在其他goroutine中调用 SetAccessToken
+func (w *wxMini) StartTokenRefresher(ctx context.Context) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var lastErr error
+		for {
+			wait := w.nextRefresh()
+			if lastErr != nil {
+				wait = tokenRetryInterval
+			}
+			select {
+			case <-ctx.Done():
+				w.logger.Info("[wx] token refresher stopped")
+				return
+			case <-w.after(wait):
+			}
+			if lastErr = w.refreshToken(ctx); lastErr != nil && ctx.Err() == nil {
+				w.logger.Error("[wx] refresh access token", zap.Error(lastErr))
+			}
+		}
+	}()
+	return done
+}
+
+// 距离下次刷新的时间，没有token或者过期时间未知时立即刷新
+func (w *wxMini) nextRefresh() time.Duration {
+	token, expiresAt := w.token.get()
+	if token == "" || expiresAt.IsZero() {
+		return 0
+	}
+	if wait := expiresAt.Add(-tokenRefreshAhead).Sub(w.now()); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+func (w *wxMini) after(d time.Duration) <-chan time.Time {
+	if clock, ok := w.clock.(timerClock); ok {
+		return clock.After(d)
+	}
+	return time.After(d)
+}
+
+// 刷新access_token，存储中有其他实例刷新的有效token时直接使用
+func (w *wxMini) refreshToken(ctx context.Context) error {
+	if w.tokenStore != nil {
+		token, expiresAt, err := w.tokenStore.Load(ctx)
+		if err != nil {
+			return err
+		}
+		if token != "" && expiresAt.Sub(w.now()) > tokenRefreshAhead {
+			w.SetAccessTokenWithExpiry(token, expiresAt)
+			return nil
+		}
+	}
+	resp, err := w.ReqAccessToken(ctx)
+	if err != nil {
+		return err
+	}
+	if resp.ErrCode != 0 || resp.AccessToken == "" {
+		return fmt.Errorf("%w: errcode %d, %s", ErrAccessToken, resp.ErrCode, resp.ErrMsg)
+	}
+	expiresAt := w.now().Add(time.Duration(resp.ExpiresIn) * time.Second)
+	w.SetAccessTokenWithExpiry(resp.AccessToken, expiresAt)
+	if w.tokenStore != nil {
+		return w.tokenStore.Save(ctx, resp.AccessToken, expiresAt)
+	}
+	return nil
+}
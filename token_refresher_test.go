@@ -0,0 +1,124 @@
+package wechat
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// manualClock 由测试控制的时钟，After记录等待的时长并在测试调用fire后返回
+type manualClock struct {
+	mu    sync.Mutex
+	now   time.Time
+	waits chan time.Duration
+	fired chan time.Time
+}
+
+func newManualClock(now time.Time) *manualClock {
+	return &manualClock{now: now, waits: make(chan time.Duration), fired: make(chan time.Time)}
+}
+
+func (c *manualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *manualClock) After(d time.Duration) <-chan time.Time {
+	c.waits <- d
+	return c.fired
+}
+
+// 等待下一次After调用，时间前进d后唤醒
+func (c *manualClock) expectWait(t *testing.T) time.Duration {
+	select {
+	case d := <-c.waits:
+		c.mu.Lock()
+		c.now = c.now.Add(d)
+		now := c.now
+		c.mu.Unlock()
+		c.fired <- now
+		return d
+	case <-time.After(time.Second):
+		t.Fatal("refresher is not waiting")
+		return 0
+	}
+}
+
+type memoryTokenStore struct {
+	token     string
+	expiresAt time.Time
+	saved     int
+}
+
+func (s *memoryTokenStore) Load(ctx context.Context) (string, time.Time, error) {
+	return s.token, s.expiresAt, nil
+}
+
+func (s *memoryTokenStore) Save(ctx context.Context, token string, expiresAt time.Time) error {
+	s.token, s.expiresAt = token, expiresAt
+	s.saved++
+	return nil
+}
+
+func TestWxMini_StartTokenRefresher(t *testing.T) {
+	client := newStubHttp(
+		`{"access_token":"TOKEN1","expires_in":7200}`,
+		`{"access_token":"TOKEN2","expires_in":7200}`,
+		`{"errcode":-1,"errmsg":"system error"}`,
+		`{"access_token":"TOKEN3","expires_in":7200}`,
+	)
+	s := NewWxMiniService(&MiniConfig{AppId: "wx2421b1c4370ec43b", AppSecret: "secret"}, client)
+	clock := newManualClock(time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC))
+	s.SetClock(clock)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := s.StartTokenRefresher(ctx)
+	// 没有token时立即刷新，之后在过期前5分钟刷新，失败后30秒重试
+	assert.Equal(t, time.Duration(0), clock.expectWait(t))
+	assert.Equal(t, 7200*time.Second-tokenRefreshAhead, clock.expectWait(t))
+	assert.Equal(t, 7200*time.Second-tokenRefreshAhead, clock.expectWait(t))
+	assert.Equal(t, tokenRetryInterval, clock.expectWait(t))
+
+	// 等待下一次刷新时退出
+	d := <-clock.waits
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("refresher did not stop")
+	}
+	assert.Equal(t, 7200*time.Second-tokenRefreshAhead, d)
+	assert.Len(t, client.requests, 4)
+	token, expiresAt := s.token.get()
+	assert.Equal(t, "TOKEN3", token)
+	assert.Equal(t, clock.Now().Add(7200*time.Second), expiresAt)
+	assert.EqualValues(t, 3, s.TokenStats().Refreshes)
+}
+
+func TestWxMini_StartTokenRefresher_Store(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	client := newStubHttp(`{"access_token":"TOKEN2","expires_in":7200}`)
+	s := NewWxMiniService(&MiniConfig{AppId: "wx2421b1c4370ec43b", AppSecret: "secret"}, client)
+	clock := newManualClock(now)
+	s.SetClock(clock)
+	// 其他实例已经刷新过
+	store := &memoryTokenStore{token: "TOKEN1", expiresAt: now.Add(time.Hour)}
+	s.SetTokenStore(store)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := s.StartTokenRefresher(ctx)
+	assert.Equal(t, time.Duration(0), clock.expectWait(t))
+	// 使用存储中的token，不请求微信
+	assert.Equal(t, time.Hour-tokenRefreshAhead, clock.expectWait(t))
+	<-clock.waits
+	cancel()
+	<-done
+	assert.Len(t, client.requests, 1)
+	assert.Equal(t, "TOKEN2", store.token)
+	assert.Equal(t, 1, store.saved)
+	assert.Equal(t, "TOKEN2", s.accessToken())
+}
@@ -0,0 +1,97 @@
+package wechat
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// RequestTrace 一次请求各阶段的耗时，用于区分是微信接口慢还是网络慢
+// 通过 WithRequestTrace 放入context，使用 NewCtxHttp 创建的Http发出请求后填充
+type RequestTrace struct {
+	DNS          time.Duration //DNS解析
+	Connect      time.Duration //建立TCP连接
+	TLSHandshake time.Duration //TLS握手
+	FirstByte    time.Duration //从开始请求到收到响应的第一个字节
+	Reused       bool          //是否复用了已有的连接，复用时没有DNS、连接和握手的耗时
+}
+
+type requestTraceCtxKey struct{}
+
+// 返回带有RequestTrace的context，使用该context发出的请求收到响应后会填充返回的RequestTrace
+// 同一个context发出多个请求时，RequestTrace记录的是最后一个请求
+func WithRequestTrace(ctx context.Context) (context.Context, *RequestTrace) {
+	t := &RequestTrace{}
+	return context.WithValue(ctx, requestTraceCtxKey{}, t), t
+}
+
+func requestTraceFromContext(ctx context.Context) *RequestTrace {
+	t, _ := ctx.Value(requestTraceCtxKey{}).(*RequestTrace)
+	return t
+}
+
+// 记录httptrace的回调，回调可能在其他goroutine中执行，请求结束后复制到 RequestTrace
+type traceRecorder struct {
+	mu                                      sync.Mutex
+	start, dnsStart, connectStart, tlsStart time.Time
+	trace                                   RequestTrace
+}
+
+func newTraceRecorder() *traceRecorder {
+	return &traceRecorder{start: time.Now()}
+}
+
+func (r *traceRecorder) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			r.mu.Lock()
+			r.trace.Reused = info.Reused
+			r.mu.Unlock()
+		},
+		DNSStart: func(httptrace.DNSStartInfo) {
+			r.mu.Lock()
+			r.dnsStart = time.Now()
+			r.mu.Unlock()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			r.mu.Lock()
+			r.trace.DNS = time.Since(r.dnsStart)
+			r.mu.Unlock()
+		},
+		ConnectStart: func(network, addr string) {
+			r.mu.Lock()
+			r.connectStart = time.Now()
+			r.mu.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			r.mu.Lock()
+			if err == nil {
+				r.trace.Connect = time.Since(r.connectStart)
+			}
+			r.mu.Unlock()
+		},
+		TLSHandshakeStart: func() {
+			r.mu.Lock()
+			r.tlsStart = time.Now()
+			r.mu.Unlock()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			r.mu.Lock()
+			r.trace.TLSHandshake = time.Since(r.tlsStart)
+			r.mu.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			r.mu.Lock()
+			r.trace.FirstByte = time.Since(r.start)
+			r.mu.Unlock()
+		},
+	}
+}
+
+func (r *traceRecorder) copyTo(t *RequestTrace) {
+	r.mu.Lock()
+	*t = r.trace
+	r.mu.Unlock()
+}
@@ -0,0 +1,67 @@
+package wechat
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCtxHttp_RequestTrace(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte(`{"errcode":0}`))
+	}))
+	defer server.Close()
+	client := NewCtxHttpWithClient(server.Client())
+	// 读完并关闭响应，连接才能复用
+	drain := func(response *http.Response, err error) error {
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+		_, err = ioutil.ReadAll(response.Body)
+		return err
+	}
+
+	ctx, trace := WithRequestTrace(context.Background())
+	var seen RequestTrace
+	assert.Nil(t, client.Get(ctx, server.URL, func(response *http.Response, err error) error {
+		// 处理响应时已经可以读取
+		seen = *trace
+		return drain(response, err)
+	}))
+	assert.Equal(t, *trace, seen)
+	assert.False(t, trace.Reused)
+	assert.True(t, trace.Connect > 0, "connect = %s", trace.Connect)
+	assert.True(t, trace.TLSHandshake > 0, "tls = %s", trace.TLSHandshake)
+	assert.True(t, trace.FirstByte >= trace.TLSHandshake, "first byte = %s", trace.FirstByte)
+
+	// 复用连接时没有连接和握手的耗时
+	ctx, trace = WithRequestTrace(context.Background())
+	assert.Nil(t, client.Get(ctx, server.URL, drain))
+	assert.True(t, trace.Reused)
+	assert.Zero(t, trace.Connect)
+	assert.Zero(t, trace.TLSHandshake)
+	assert.True(t, trace.FirstByte > 0)
+
+	// 没有RequestTrace时不记录
+	assert.Nil(t, client.Get(context.Background(), server.URL, drain))
+}
+
+func TestCtxHttp_RequestTrace_DNS(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	ctx, trace := WithRequestTrace(context.Background())
+	url := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+	assert.Nil(t, NewCtxHttpWithClient(&http.Client{}).Get(ctx, url, func(response *http.Response, err error) error {
+		return err
+	}))
+	assert.True(t, trace.DNS > 0, "dns = %s", trace.DNS)
+	assert.True(t, trace.Connect > 0)
+	assert.Zero(t, trace.TLSHandshake)
+}
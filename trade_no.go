@@ -0,0 +1,60 @@
+package wechat
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// 商户订单号中时间和随机部分的长度：14位时间 + 10位随机字符串
+	tradeNoBaseLength = 24
+	// 校验码长度，加上校验码后总长度为32，不超过微信的限制
+	tradeNoChecksumLength = 8
+	// 微信要求商户订单号不超过32个字符
+	maxTradeNoLength = 32
+)
+
+var (
+	ErrInvalidTradeNo = errors.New("[gowechat] invalid out_trade_no")
+)
+
+// 生成商户订单号，格式为 yyyyMMddHHmmss（北京时间） + 10位随机字符串
+// key不为空时在末尾追加8位HMAC校验码，可用 VerifyOutTradeNo 快速识别不是本系统生成的订单号
+func GenOutTradeNo(key string) string {
+	base := FormatWxTime(time.Now()) + RandStringBytesMaskImprSrc(tradeNoBaseLength-14)
+	if key == "" {
+		return base
+	}
+	return base + tradeNoChecksum(base, key)
+}
+
+// 校验商户订单号末尾的校验码，只是轻量的完整性检查，不能代替向微信查询订单
+func VerifyOutTradeNo(s, key string) bool {
+	if key == "" || len(s) != tradeNoBaseLength+tradeNoChecksumLength {
+		return false
+	}
+	base, checksum := s[:tradeNoBaseLength], s[tradeNoBaseLength:]
+	return hmac.Equal([]byte(checksum), []byte(tradeNoChecksum(base, key)))
+}
+
+func tradeNoChecksum(base, key string) string {
+	h := hmac.New(sha256.New, []byte(key))
+	h.Write([]byte(base))
+	return hex.EncodeToString(h.Sum(nil))[:tradeNoChecksumLength]
+}
+
+// 检查商户订单号不为空并且没有超过长度限制，避免发出必然失败的请求
+func validateTradeNo(tradeNo string) error {
+	if strings.TrimSpace(tradeNo) == "" {
+		return fmt.Errorf("%w: empty", ErrInvalidTradeNo)
+	}
+	if len(tradeNo) > maxTradeNoLength {
+		return fmt.Errorf("%w: %q is longer than %d", ErrInvalidTradeNo, tradeNo, maxTradeNoLength)
+	}
+	return nil
+}
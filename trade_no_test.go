@@ -0,0 +1,35 @@
+package wechat
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenOutTradeNo(t *testing.T) {
+	key := "192006250b4c09247ec02edce69f6a2d"
+
+	plain := GenOutTradeNo("")
+	assert.Len(t, plain, 24)
+	assert.False(t, VerifyOutTradeNo(plain, key))
+
+	tradeNo := GenOutTradeNo(key)
+	assert.Len(t, tradeNo, 32)
+	assert.NotEqual(t, tradeNo, GenOutTradeNo(key))
+	assert.True(t, VerifyOutTradeNo(tradeNo, key))
+	assert.False(t, VerifyOutTradeNo(tradeNo, "other key"))
+	assert.False(t, VerifyOutTradeNo(tradeNo, ""))
+
+	// 修改订单号或校验码的任意一位都校验失败
+	for i := 0; i < len(tradeNo); i++ {
+		tampered := []byte(tradeNo)
+		if tampered[i] == '0' {
+			tampered[i] = '1'
+		} else {
+			tampered[i] = '0'
+		}
+		assert.False(t, VerifyOutTradeNo(string(tampered), key), "tampered at %d", i)
+	}
+	assert.False(t, VerifyOutTradeNo(tradeNo[:31], key))
+	assert.False(t, VerifyOutTradeNo(tradeNo+"0", key))
+}
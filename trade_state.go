@@ -0,0 +1,84 @@
+package wechat
+
+import "time"
+
+// 订单的交易状态
+type TradeState string
+
+const (
+	TradeStateSuccess    TradeState = "SUCCESS"    //支付成功
+	TradeStateRefund     TradeState = "REFUND"     //转入退款
+	TradeStateNotPay     TradeState = "NOTPAY"     //未支付
+	TradeStateClosed     TradeState = "CLOSED"     //已关闭
+	TradeStateRevoked    TradeState = "REVOKED"    //已撤销（刷卡支付）
+	TradeStateUserPaying TradeState = "USERPAYING" //用户支付中
+	TradeStatePayError   TradeState = "PAYERROR"   //支付失败(其他原因，如银行返回失败)
+)
+
+// 根据查询结果判断的订单结果，用于决定是否继续轮询
+type OrderStatus string
+
+const (
+	OrderStatusPaid    OrderStatus = "PAID"    //已支付，包括转入退款
+	OrderStatusPending OrderStatus = "PENDING" //未支付或支付中，需要继续查询
+	OrderStatusExpired OrderStatus = "EXPIRED" //超过time_expire仍未支付，可以关闭订单，不用继续查询
+	OrderStatusClosed  OrderStatus = "CLOSED"  //已关闭、已撤销或支付失败
+)
+
+// 支持的描述语言
+const (
+	LangZh = "zh"
+	LangEn = "en"
+)
+
+var tradeStateDescriptions = map[string]map[TradeState]string{
+	LangZh: {
+		TradeStateSuccess:    "支付成功",
+		TradeStateRefund:     "转入退款",
+		TradeStateNotPay:     "未支付",
+		TradeStateClosed:     "已关闭",
+		TradeStateRevoked:    "已撤销",
+		TradeStateUserPaying: "用户支付中",
+		TradeStatePayError:   "支付失败",
+	},
+	LangEn: {
+		TradeStateSuccess:    "Payment successful",
+		TradeStateRefund:     "Transferred to refund",
+		TradeStateNotPay:     "Not paid",
+		TradeStateClosed:     "Closed",
+		TradeStateRevoked:    "Revoked",
+		TradeStateUserPaying: "User paying",
+		TradeStatePayError:   "Payment failed",
+	},
+}
+
+// 交易状态的本地化描述，与微信返回的 trade_state_desc 无关
+// lang 为 zh 或 en，不支持的语言使用中文，未知的状态原样返回
+func (s TradeState) Description(lang string) string {
+	descriptions, ok := tradeStateDescriptions[lang]
+	if !ok {
+		descriptions = tradeStateDescriptions[LangZh]
+	}
+	if desc, ok := descriptions[s]; ok {
+		return desc
+	}
+	return string(s)
+}
+
+// 结合下单时的time_expire判断订单结果
+// 订单过期后微信自动关闭订单前，查询仍然返回NOTPAY，此时返回 OrderStatusExpired
+// timeExpire为零值时表示不知道过期时间，NOTPAY始终返回 OrderStatusPending
+func (r *QueryOrderResp) Status(timeExpire, now time.Time) OrderStatus {
+	switch r.TradeState {
+	case TradeStateSuccess, TradeStateRefund:
+		return OrderStatusPaid
+	case TradeStateClosed, TradeStateRevoked, TradeStatePayError:
+		return OrderStatusClosed
+	case TradeStateNotPay:
+		if !timeExpire.IsZero() && now.After(timeExpire) {
+			return OrderStatusExpired
+		}
+	}
+	// 用户支付中时即使过期也可能支付成功，需要继续查询
+	return OrderStatusPending
+}
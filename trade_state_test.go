@@ -0,0 +1,58 @@
+package wechat
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTradeState_Description(t *testing.T) {
+	tests := []struct {
+		State TradeState
+		Zh    string
+		En    string
+	}{
+		{TradeStateSuccess, "支付成功", "Payment successful"},
+		{TradeStateRefund, "转入退款", "Transferred to refund"},
+		{TradeStateNotPay, "未支付", "Not paid"},
+		{TradeStateClosed, "已关闭", "Closed"},
+		{TradeStateRevoked, "已撤销", "Revoked"},
+		{TradeStateUserPaying, "用户支付中", "User paying"},
+		{TradeStatePayError, "支付失败", "Payment failed"},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.Zh, test.State.Description(LangZh), string(test.State))
+		assert.Equal(t, test.En, test.State.Description(LangEn), string(test.State))
+	}
+
+	assert.Equal(t, "支付成功", TradeStateSuccess.Description("fr"))
+	assert.Equal(t, "UNKNOWN", TradeState("UNKNOWN").Description(LangEn))
+}
+
+func TestQueryOrderResp_Status(t *testing.T) {
+	timeExpire, err := ParseWxTime("20201010120000")
+	assert.Nil(t, err)
+	before := timeExpire.Add(-time.Minute)
+	after := timeExpire.Add(time.Minute)
+
+	tests := []struct {
+		State      TradeState
+		TimeExpire time.Time
+		Now        time.Time
+		Status     OrderStatus
+	}{
+		{TradeStateNotPay, timeExpire, after, OrderStatusExpired},
+		{TradeStateNotPay, timeExpire, before, OrderStatusPending},
+		{TradeStateNotPay, time.Time{}, after, OrderStatusPending},
+		{TradeStateUserPaying, timeExpire, after, OrderStatusPending},
+		{TradeStateSuccess, timeExpire, after, OrderStatusPaid},
+		{TradeStateRefund, timeExpire, after, OrderStatusPaid},
+		{TradeStateClosed, timeExpire, before, OrderStatusClosed},
+		{TradeStatePayError, timeExpire, before, OrderStatusClosed},
+	}
+	for _, test := range tests {
+		resp := &QueryOrderResp{TradeState: test.State}
+		assert.Equal(t, test.Status, resp.Status(test.TimeExpire, test.Now), "state %s", test.State)
+	}
+}
@@ -1,38 +1,60 @@
 package wechat
 
 import (
+	"bytes"
+	"crypto/hmac"
 	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
-	"math/rand"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
 	"net/url"
+	"sort"
 	"strings"
-	"time"
 )
 
 const (
 	letterBytes   = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
 	letterIdxBits = 6                    // 6 bits to represent a letter index
 	letterIdxMask = 1<<letterIdxBits - 1 // All 1-bits, as many as letterIdxBits
-	letterIdxMax  = 63 / letterIdxBits   // # of letter indices fitting in 63 bits
 )
 
-var src = rand.NewSource(time.Now().UnixNano())
+// 随机数来源，测试中可以替换成会失败的Reader
+var randReader io.Reader = rand.Reader
 
+// 生成n位由数字和大小写字母组成的随机字符串，用于nonce_str等
+// 系统随机数不可用时panic，下单、签名等内部调用使用返回error的版本，不会panic
 func RandStringBytesMaskImprSrc(n int) string {
+	s, err := randString(n)
+	if err != nil {
+		panic(err.Error())
+	}
+	return s
+}
+
+// 使用crypto/rand，不可预测并且可以并发调用；每个随机字节取低6位，超出字母表的丢弃重取，保证分布均匀
+// 系统随机数不可用时无法生成安全的随机串，返回error，不能退化成可预测的值
+func randString(n int) (string, error) {
 	b := make([]byte, n)
-	for i, cache, remain := n-1, src.Int63(), letterIdxMax; i >= 0; {
-		if remain == 0 {
-			cache, remain = src.Int63(), letterIdxMax
+	buf := make([]byte, n+n/4+1)
+	for i := 0; i < n; {
+		if _, err := io.ReadFull(randReader, buf); err != nil {
+			return "", fmt.Errorf("%w: %v", ErrRandUnavailable, err)
 		}
-		if idx := int(cache & letterIdxMask); idx < len(letterBytes) {
-			b[i] = letterBytes[idx]
-			i--
+		for _, c := range buf {
+			if idx := int(c & letterIdxMask); idx < len(letterBytes) {
+				b[i] = letterBytes[idx]
+				if i++; i == n {
+					break
+				}
+			}
 		}
-		cache >>= letterIdxBits
-		remain--
 	}
-
-	return string(b)
+	return string(b), nil
 }
 
 func GenParamStr(params map[string]string) (string, error) {
@@ -47,9 +69,212 @@ func GenParamStr(params map[string]string) (string, error) {
 	return url.QueryUnescape(escapedString)
 }
 
+// 比较两组签名参数，返回值不同的参数名，按字母排序
+// 和签名一样忽略sign和空值，用于对照微信签名校验工具的结果排查签名错误
+func DiffSignParams(a, b map[string]string) []string {
+	keys := make(map[string]bool, len(a)+len(b))
+	for k := range a {
+		keys[k] = true
+	}
+	for k := range b {
+		keys[k] = true
+	}
+	var diff []string
+	for k := range keys {
+		if k != "sign" && a[k] != b[k] {
+			diff = append(diff, k)
+		}
+	}
+	sort.Strings(diff)
+	return diff
+}
+
+// 日志中隐藏签名等敏感内容，只表示是否有值
+func maskSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "***"
+}
+
 func HashMd5(signStr string) string {
 	hasher := md5.New()
 	hasher.Write([]byte(signStr))
 	sign := strings.ToUpper(hex.EncodeToString(hasher.Sum(nil)))
 	return sign
 }
+
+func HashHmacSha256(signStr, key string) string {
+	hasher := hmac.New(sha256.New, []byte(key))
+	hasher.Write([]byte(signStr))
+	sign := strings.ToUpper(hex.EncodeToString(hasher.Sum(nil)))
+	return sign
+}
+
+// 规范化IP地址，去掉端口、IPv6的方括号和zone，无法解析时返回空字符串
+// 如：1.2.3.4:80 => 1.2.3.4，[::1]:8080 => ::1
+func NormalizeIP(addr string) string {
+	addr = strings.TrimSpace(addr)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	addr = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	if i := strings.IndexByte(addr, '%'); i >= 0 {
+		addr = addr[:i]
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return ""
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return v4.String()
+	}
+	return ip.String()
+}
+
+// 获取发起请求的客户端IP，默认使用连接的地址 RemoteAddr
+// trustedProxies为信任的反向代理的IP或CIDR，只有请求来自这些代理时才使用 X-Forwarded-For、X-Real-IP
+// X-Forwarded-For从右往左跳过信任的代理，取第一个不是代理的地址，客户端伪造的地址在左边，不会被使用
+func ClientIP(r *http.Request, trustedProxies ...string) string {
+	remote := NormalizeIP(r.RemoteAddr)
+	proxies := parseTrustedProxies(trustedProxies)
+	if !ipInNets(remote, proxies) {
+		return remote
+	}
+	if forwarded := r.Header["X-Forwarded-For"]; len(forwarded) > 0 {
+		hops := strings.Split(strings.Join(forwarded, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := NormalizeIP(hops[i])
+			if ip == "" {
+				break
+			}
+			if !ipInNets(ip, proxies) {
+				return ip
+			}
+		}
+	}
+	if ip := NormalizeIP(r.Header.Get("X-Real-IP")); ip != "" {
+		return ip
+	}
+	return remote
+}
+
+// 解析IP或CIDR格式的代理地址，无法解析的忽略，可以先用 ValidateTrustedProxies 检查
+func parseTrustedProxies(proxies []string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, p := range proxies {
+		if n, err := parseTrustedProxy(p); err == nil {
+			nets = append(nets, n)
+		}
+	}
+	return nets
+}
+
+func parseTrustedProxy(p string) (*net.IPNet, error) {
+	p = strings.TrimSpace(p)
+	if strings.Contains(p, "/") {
+		_, n, err := net.ParseCIDR(p)
+		return n, err
+	}
+	ip := net.ParseIP(p)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid ip %q", p)
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// 检查代理地址的格式，每一项是IP或CIDR
+func ValidateTrustedProxies(proxies []string) error {
+	for _, p := range proxies {
+		if _, err := parseTrustedProxy(p); err != nil {
+			return fmt.Errorf("%w: trusted proxy: %v", ErrInvalidConfig, err)
+		}
+	}
+	return nil
+}
+
+func ipInNets(addr string, nets []*net.IPNet) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// 获取本机访问外网时使用的IP，用于服务端发起调用时的 spbill_create_ip
+// udp的Dial不会真正发送数据，只是借此拿到路由选择的本地地址
+func OutboundIP() (string, error) {
+	conn, err := net.Dial("udp", "8.8.8.8:80")
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	return NormalizeIP(conn.LocalAddr().String()), nil
+}
+
+// 返回只有一层的XML中根元素下所有子元素的值
+func xmlFields(buf []byte) (map[string]string, error) {
+	d := xml.NewDecoder(bytes.NewReader(buf))
+	fields := make(map[string]string)
+	root := false
+	for {
+		token, err := d.Token()
+		if err == io.EOF {
+			return fields, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		tok, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if !root {
+			root = true
+			continue
+		}
+		var value string
+		if err := d.DecodeElement(&value, &tok); err != nil {
+			return nil, err
+		}
+		fields[tok.Name.Local] = value
+	}
+}
+
+// 读取只有一层的XML元素，返回所有子元素的值，同时按普通结构体的方式解析到v中
+// 用于解析微信响应中 refund_fee_$n 这类带序号的字段，v不能再实现 xml.Unmarshaler
+func decodeFlatXML(d *xml.Decoder, start xml.StartElement, v interface{}) (map[string]string, error) {
+	fields := make(map[string]string)
+	var buf bytes.Buffer
+	buf.WriteString("<xml>")
+	for {
+		token, err := d.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch tok := token.(type) {
+		case xml.StartElement:
+			var value string
+			if err := d.DecodeElement(&value, &tok); err != nil {
+				return nil, err
+			}
+			fields[tok.Name.Local] = value
+			buf.WriteString("<" + tok.Name.Local + ">")
+			if err := xml.EscapeText(&buf, []byte(value)); err != nil {
+				return nil, err
+			}
+			buf.WriteString("</" + tok.Name.Local + ">")
+		case xml.EndElement:
+			buf.WriteString("</xml>")
+			return fields, xml.Unmarshal(buf.Bytes(), v)
+		}
+	}
+}
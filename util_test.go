@@ -0,0 +1,162 @@
+package wechat
+
+import (
+	"crypto/rand"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRandStringBytesMaskImprSrc(t *testing.T) {
+	assert.Equal(t, "", RandStringBytesMaskImprSrc(0))
+	const goroutines, count = 8, 1000
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		seen = make(map[string]bool)
+	)
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < count; i++ {
+				s := RandStringBytesMaskImprSrc(32)
+				mu.Lock()
+				seen[s] = true
+				mu.Unlock()
+				if len(s) != 32 || strings.Trim(s, letterBytes) != "" {
+					t.Errorf("invalid nonce %q", s)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Len(t, seen, goroutines*count)
+	for _, n := range []int{1, 10, 100} {
+		assert.Len(t, RandStringBytesMaskImprSrc(n), n)
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) { return 0, errors.New("entropy exhausted") }
+
+// 替换随机数来源，返回恢复函数
+func useFailingRand() func() {
+	randReader = failingReader{}
+	return func() { randReader = rand.Reader }
+}
+
+func TestRandString_Unavailable(t *testing.T) {
+	defer useFailingRand()()
+	_, err := randString(32)
+	assert.True(t, errors.Is(err, ErrRandUnavailable), "err = %v", err)
+	assert.Contains(t, err.Error(), "entropy exhausted")
+	assert.Panics(t, func() { RandStringBytesMaskImprSrc(32) })
+}
+
+func TestNormalizeIP(t *testing.T) {
+	tests := []struct {
+		Addr string
+		IP   string
+	}{
+		{"1.2.3.4", "1.2.3.4"},
+		{"1.2.3.4:8080", "1.2.3.4"},
+		{"2001:DB8::1", "2001:db8::1"},
+		{"[2001:db8::1]:443", "2001:db8::1"},
+		{"[::1]:8080", "::1"},
+		{"[::1]", "::1"},
+		{"fe80::1%eth0", "fe80::1"},
+		{"::ffff:10.0.0.1", "10.0.0.1"},
+		{" 10.0.0.1 ", "10.0.0.1"},
+		{"localhost:80", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.IP, NormalizeIP(test.Addr), "addr = %q", test.Addr)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "[2001:db8::2]:51234"
+	assert.Equal(t, "2001:db8::2", ClientIP(r))
+
+	// 没有配置信任的代理时不使用客户端可以伪造的请求头
+	r.Header.Set("X-Real-IP", "10.0.0.2")
+	r.Header.Set("X-Forwarded-For", "1.2.3.4")
+	assert.Equal(t, "2001:db8::2", ClientIP(r))
+	assert.Equal(t, "2001:db8::2", ClientIP(r, "10.0.0.0/8"))
+
+	// 请求来自信任的代理
+	r.RemoteAddr = "10.0.0.1:51234"
+	r.Header.Del("X-Forwarded-For")
+	assert.Equal(t, "10.0.0.2", ClientIP(r, "10.0.0.1"))
+
+	// 从右往左跳过信任的代理，客户端在最左边伪造的地址不会被使用
+	r.Header.Set("X-Forwarded-For", "1.2.3.4, [2001:db8::3]:80, 10.0.0.3")
+	assert.Equal(t, "2001:db8::3", ClientIP(r, "10.0.0.0/8"))
+	r.Header.Add("X-Forwarded-For", "10.0.0.4")
+	assert.Equal(t, "2001:db8::3", ClientIP(r, "10.0.0.0/8"))
+	assert.Equal(t, "10.0.0.1", ClientIP(r, "192.168.0.0/16"))
+
+	// 无法解析的地址不再往左取
+	r.Header.Set("X-Forwarded-For", "1.2.3.4, unknown")
+	assert.Equal(t, "10.0.0.2", ClientIP(r, "10.0.0.0/8"))
+
+	assert.Nil(t, ValidateTrustedProxies([]string{"10.0.0.1", "172.16.0.0/12", "2001:db8::/32"}))
+	assert.True(t, errors.Is(ValidateTrustedProxies([]string{"10.0.0.256"}), ErrInvalidConfig))
+	assert.True(t, errors.Is(ValidateTrustedProxies([]string{"10.0.0.0/33"}), ErrInvalidConfig))
+}
+
+func TestHashHmacSha256(t *testing.T) {
+	// 微信支付签名文档中的示例
+	signStr := "appid=wxd930ea5d5a258f4f&body=test&device_info=1000&mch_id=10000100&nonce_str=ibuaiVcKdpRxkhJA&key=192006250b4c09247ec02edce69f6a2d"
+	assert.Equal(t, "9A0A8659F005D6984697E2CA0A9CF3B7", HashMd5(signStr))
+	assert.Equal(t, "6A9AE1657590FD6257D693A078E1C3E4BB6BA4DC30B23E0EE2496E54170DACD6", HashHmacSha256(signStr, "192006250b4c09247ec02edce69f6a2d"))
+}
+
+func TestDiffSignParams(t *testing.T) {
+	req := &UnifiedOrderReq{
+		AppId:          "wxd930ea5d5a258f4f",
+		MchId:          "10000100",
+		NonceStr:       "ibuaiVcKdpRxkhJA",
+		Sign:           "9A0A8659F005D6984697E2CA0A9CF3B7",
+		Body:           "test",
+		OutTradeNo:     "T1",
+		TotalFee:       100,
+		SpbillCreateIp: "127.0.0.1",
+		TradeType:      "JSAPI",
+	}
+	ours, err := SignParams(req)
+	assert.Nil(t, err)
+	assert.Equal(t, "100", ours["total_fee"])
+	assert.NotContains(t, ours, "sign")
+	assert.NotContains(t, ours, "detail")
+
+	// 签名校验工具中的参数，金额写成了元
+	theirs := map[string]string{
+		"appid":            "wxd930ea5d5a258f4f",
+		"mch_id":           "10000100",
+		"nonce_str":        "ibuaiVcKdpRxkhJA",
+		"body":             "test",
+		"out_trade_no":     "T1",
+		"total_fee":        "1",
+		"spbill_create_ip": "127.0.0.1",
+		"trade_type":       "JSAPI",
+		"detail":           "",
+		"sign":             "C380BEC2BFD727A4B6845133519F3AD6",
+	}
+	assert.Equal(t, []string{"total_fee"}, DiffSignParams(ours, theirs))
+
+	theirs["total_fee"] = "100"
+	assert.Empty(t, DiffSignParams(ours, theirs))
+
+	delete(theirs, "out_trade_no")
+	theirs["openid"] = "OPENID"
+	assert.Equal(t, []string{"openid", "out_trade_no"}, DiffSignParams(ours, theirs))
+}
@@ -0,0 +1,285 @@
+package wechat
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	v3BaseUrl    = "https://api.mch.weixin.qq.com"
+	v3AuthSchema = "WECHATPAY2-SHA256-RSA2048"
+
+	// v3接口响应和回调通知中的签名信息
+	headerWechatpayTimestamp = "Wechatpay-Timestamp"
+	headerWechatpayNonce     = "Wechatpay-Nonce"
+	headerWechatpaySignature = "Wechatpay-Signature"
+	headerWechatpaySerial    = "Wechatpay-Serial"
+
+	// 响应和通知的时间戳和本地时间相差超过5分钟时拒绝，防止重放
+	v3TimestampSkew = 5 * time.Minute
+)
+
+var (
+	ErrMissingV3Config      = errors.New("[gowechat] missing v3 config")
+	ErrInvalidV3Signature   = errors.New("[gowechat] invalid v3 signature")
+	ErrPlatformCertNotFound = errors.New("[gowechat] platform certificate not found")
+	ErrV3Request            = errors.New("[gowechat] v3 request failed")
+	ErrV3TimestampExpired   = errors.New("[gowechat] v3 timestamp expired")
+)
+
+type (
+	// v3接口的配置，v3接口使用商户API证书的私钥签名，不需要双向TLS
+	// 文档地址：https://pay.weixin.qq.com/wiki/doc/apiv3/wechatpay/wechatpay4_0.shtml
+	V3Config struct {
+		SerialNo          string   //商户API证书序列号
+		PrivateKeyFile    string   //商户API证书私钥，apiclient_key.pem
+		ApiV3Key          string   //APIv3密钥，用于解密回调通知
+		PlatformCertFiles []string //微信支付平台证书，用于验证响应和回调通知的签名
+	}
+
+	// v3接口失败时返回的错误，errors.Is(err, ErrV3Request) 为true
+	V3Error struct {
+		StatusCode int    `json:"-"`
+		Code       string `json:"code"`
+		Message    string `json:"message"`
+	}
+
+	// 首次使用时加载私钥和平台证书，之后复用
+	v3Keys struct {
+		once       sync.Once
+		err        error
+		privateKey *rsa.PrivateKey
+		mu         sync.RWMutex
+		certs      map[string]*rsa.PublicKey
+	}
+)
+
+func (e *V3Error) Error() string {
+	return fmt.Sprintf("%s: %d %s %s", ErrV3Request, e.StatusCode, e.Code, e.Message)
+}
+
+func (e *V3Error) Unwrap() error {
+	return ErrV3Request
+}
+
+func (k *v3Keys) load(cfg *V3Config) error {
+	k.once.Do(func() {
+		if k.privateKey, k.err = loadPrivateKey(cfg.PrivateKeyFile); k.err != nil {
+			return
+		}
+		for _, file := range cfg.PlatformCertFiles {
+			certPEM, err := readFile(file)
+			if err != nil {
+				k.err = fmt.Errorf("[wx] read PlatformCertFile: %w", err)
+				return
+			}
+			cert, err := parseCertificate(certPEM)
+			if err != nil {
+				k.err = err
+				return
+			}
+			if k.err = k.addCert(cert); k.err != nil {
+				return
+			}
+		}
+	})
+	return k.err
+}
+
+func (k *v3Keys) addCert(cert *x509.Certificate) error {
+	pub, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("[gowechat] platform certificate %s is not rsa", cert.SerialNumber.Text(16))
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.certs == nil {
+		k.certs = make(map[string]*rsa.PublicKey)
+	}
+	k.certs[strings.ToUpper(cert.SerialNumber.Text(16))] = pub
+	return nil
+}
+
+func (k *v3Keys) cert(serialNo string) (*rsa.PublicKey, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	pub, ok := k.certs[strings.ToUpper(strings.TrimLeft(serialNo, "0"))]
+	return pub, ok
+}
+
+// 使用商户私钥签名，返回base64编码的签名
+func (k *v3Keys) sign(message string) (string, error) {
+	hashed := sha256.Sum256([]byte(message))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, k.privateKey, crypto.SHA256, hashed[:])
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(signature), nil
+}
+
+// 验证v3响应或回调通知的签名，签名串为：时间戳\n随机串\nbody\n
+// 时间戳和now相差超过 v3TimestampSkew 时返回 ErrV3TimestampExpired
+func (k *v3Keys) verify(header http.Header, body []byte, now time.Time) error {
+	timestamp := header.Get(headerWechatpayTimestamp)
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: %q", ErrV3TimestampExpired, timestamp)
+	}
+	if skew := now.Sub(time.Unix(sec, 0)); skew > v3TimestampSkew || skew < -v3TimestampSkew {
+		return fmt.Errorf("%w: %s differs from local time by %s", ErrV3TimestampExpired, timestamp, skew)
+	}
+	serialNo := header.Get(headerWechatpaySerial)
+	pub, ok := k.cert(serialNo)
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrPlatformCertNotFound, serialNo)
+	}
+	signature, err := base64.StdEncoding.DecodeString(header.Get(headerWechatpaySignature))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidV3Signature, err)
+	}
+	message := timestamp + "\n" + header.Get(headerWechatpayNonce) + "\n" + string(body) + "\n"
+	hashed := sha256.Sum256([]byte(message))
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, hashed[:], signature); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidV3Signature, err)
+	}
+	return nil
+}
+
+// 读取PKCS#8或PKCS#1格式的RSA私钥
+func loadPrivateKey(file string) (*rsa.PrivateKey, error) {
+	keyPEM, err := readFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("[wx] read PrivateKeyFile: %w", err)
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("[gowechat] invalid private key pem")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("[gowechat] parse private key: %w", err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("[gowechat] private key is not rsa")
+	}
+	return rsaKey, nil
+}
+
+func parseCertificate(certPEM []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, errors.New("[gowechat] invalid certificate pem")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("[gowechat] parse certificate: %w", err)
+	}
+	return cert, nil
+}
+
+// 加载v3接口使用的私钥和平台证书，没有配置时返回 ErrMissingV3Config
+func (w wxPay) v3() (*v3Keys, error) {
+	cfg := w.cfg.V3
+	if cfg == nil || cfg.SerialNo == "" || cfg.PrivateKeyFile == "" {
+		return nil, ErrMissingV3Config
+	}
+	if err := w.v3Keys.load(cfg); err != nil {
+		return nil, err
+	}
+	return w.v3Keys, nil
+}
+
+// 添加平台证书，平台证书更换期间可以同时存在新旧两个证书
+func (w wxPay) AddPlatformCert(cert *x509.Certificate) error {
+	return w.v3Keys.addCert(cert)
+}
+
+// 生成v3接口的Authorization请求头，签名串为：请求方法\nURL\n时间戳\n随机串\nbody\n
+// url是不含域名的绝对路径，带查询参数
+func (w wxPay) v3Authorization(keys *v3Keys, method, url string, body []byte) (string, error) {
+	timestamp := strconv.FormatInt(w.now().Unix(), 10)
+	nonceStr, err := randString(32)
+	if err != nil {
+		return "", err
+	}
+	signature, err := keys.sign(method + "\n" + url + "\n" + timestamp + "\n" + nonceStr + "\n" + string(body) + "\n")
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(`%s mchid="%s",nonce_str="%s",signature="%s",timestamp="%s",serial_no="%s"`,
+		v3AuthSchema, w.mchId, nonceStr, signature, timestamp, w.cfg.V3.SerialNo), nil
+}
+
+// 调用v3接口，req不为nil时编码成JSON发送
+// 成功的响应验证签名后解析到resp中，resp为nil或者响应为空（如204）时不解析
+// 失败时返回 *V3Error，失败的响应不验证签名
+func (w wxPay) doV3(ctx context.Context, method, path string, req, resp interface{}) error {
+	keys, err := w.v3()
+	if err != nil {
+		return err
+	}
+	var (
+		body        []byte
+		payload     interface{}
+		contentType string
+	)
+	if req != nil {
+		if body, err = json.Marshal(req); err != nil {
+			return err
+		}
+		payload, contentType = body, contentTypeJSON
+	}
+	authorization, err := w.v3Authorization(keys, method, path, body)
+	if err != nil {
+		return err
+	}
+	headers := map[string]string{
+		"Authorization": authorization,
+		"Accept":        contentTypeJSON,
+	}
+	// v3接口支持压缩的请求内容，签名使用压缩前的body
+	return w.doReq(withGzipRequest(ctx), method, v3BaseUrl+path, contentType, payload, headers, func(response *http.Response, err error) error {
+		if err != nil {
+			return err
+		}
+		data, err := w.readBody(response)
+		if err != nil {
+			return err
+		}
+		if response.StatusCode < 200 || response.StatusCode >= 300 {
+			v3Err := &V3Error{StatusCode: response.StatusCode}
+			if err := json.Unmarshal(data, v3Err); err != nil {
+				v3Err.Message = bodySnippet(data, 256)
+			}
+			w.logger.Error("[wxpay] v3 request", zap.String("path", path), zap.Error(v3Err))
+			return v3Err
+		}
+		if err := keys.verify(response.Header, data, w.now()); err != nil {
+			return err
+		}
+		if resp == nil || len(data) == 0 {
+			return nil
+		}
+		return json.Unmarshal(data, resp)
+	})
+}
@@ -0,0 +1,248 @@
+package wechat
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testPlatformSerial = "5157F09EFDC096DE15EBE81A47057A7232F1B8E1"
+
+// v3测试用的商户私钥和平台证书
+type testV3Keys struct {
+	merchantKey *rsa.PrivateKey
+	platformKey *rsa.PrivateKey
+	cfg         *V3Config
+}
+
+func writeTestV3Keys(t *testing.T) (*testV3Keys, func()) {
+	dir, err := ioutil.TempDir("", "wxv3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	merchantKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	platformKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := new(big.Int).SetString(testPlatformSerial, 16)
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "Tenpay.com Root CA"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &platformKey.PublicKey, platformKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(merchantKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyFile := filepath.Join(dir, "apiclient_key.pem")
+	certFile := filepath.Join(dir, "wechatpay_cert.pem")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return &testV3Keys{
+		merchantKey: merchantKey,
+		platformKey: platformKey,
+		cfg: &V3Config{
+			SerialNo:          "1DDE55AD98ED71D6EDD4A4A16996DE7B47773A8C",
+			PrivateKeyFile:    keyFile,
+			ApiV3Key:          "a7cde1ef41dd4a8bb1e4a1e4b5bb6a3e",
+			PlatformCertFiles: []string{certFile},
+		},
+	}, func() { os.RemoveAll(dir) }
+}
+
+func newTestV3Pay(client Http, keys *testV3Keys) *wxPay {
+	s := newTestPay(client)
+	s.cfg.V3 = keys.cfg
+	// 和 signResponse 的时间戳一致
+	s.SetClock(fixedClock(time.Unix(1554208460, 0)))
+	return s
+}
+
+// 用平台私钥给响应签名，返回微信支付的签名响应头
+func (k *testV3Keys) signResponse(t *testing.T, body string) http.Header {
+	timestamp := "1554208460"
+	nonce := "c5ac7061fccab6bf3e254dcf98995b8c"
+	hashed := sha256.Sum256([]byte(timestamp + "\n" + nonce + "\n" + body + "\n"))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, k.platformKey, crypto.SHA256, hashed[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return http.Header{
+		headerWechatpayTimestamp: []string{timestamp},
+		headerWechatpayNonce:     []string{nonce},
+		headerWechatpaySignature: []string{base64.StdEncoding.EncodeToString(signature)},
+		headerWechatpaySerial:    []string{testPlatformSerial},
+	}
+}
+
+// 用商户公钥验证base64编码的签名
+func verifyTestSignature(pub *rsa.PublicKey, message, signature string) error {
+	buf, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return err
+	}
+	hashed := sha256.Sum256([]byte(message))
+	return rsa.VerifyPKCS1v15(pub, crypto.SHA256, hashed[:], buf)
+}
+
+var authorizationPattern = regexp.MustCompile(`^WECHATPAY2-SHA256-RSA2048 mchid="(\w+)",nonce_str="(\w+)",signature="([\w+/=]+)",timestamp="(\d+)",serial_no="(\w+)"$`)
+
+func TestWxPay_V3Authorization(t *testing.T) {
+	keys, cleanup := writeTestV3Keys(t)
+	defer cleanup()
+	body := `{"code":"OK"}`
+	client := newStubHttp(body)
+	client.header = keys.signResponse(t, body)
+	s := newTestV3Pay(client, keys)
+	s.SetClock(fixedClock(time.Unix(1554208460, 0)))
+
+	var resp map[string]string
+	assert.Nil(t, s.doV3(context.Background(), http.MethodPost, "/v3/pay/transactions/jsapi", map[string]string{"appid": "wx2421b1c4370ec43b"}, &resp))
+	assert.Equal(t, "OK", resp["code"])
+
+	sent := client.last()
+	assert.Equal(t, v3BaseUrl+"/v3/pay/transactions/jsapi", sent.url)
+	assert.Equal(t, contentTypeJSON, sent.headers["Content-Type"])
+	assert.Equal(t, contentTypeJSON, sent.headers["Accept"])
+	match := authorizationPattern.FindStringSubmatch(sent.headers["Authorization"])
+	if !assert.NotNil(t, match, sent.headers["Authorization"]) {
+		return
+	}
+	assert.Equal(t, "10000100", match[1])
+	assert.Equal(t, "1554208460", match[4])
+	assert.Equal(t, keys.cfg.SerialNo, match[5])
+
+	// 签名串：请求方法\nURL\n时间戳\n随机串\nbody\n
+	message := "POST\n/v3/pay/transactions/jsapi\n1554208460\n" + match[2] + "\n" + string(sent.body) + "\n"
+	hashed := sha256.Sum256([]byte(message))
+	signature, err := base64.StdEncoding.DecodeString(match[3])
+	assert.Nil(t, err)
+	assert.Nil(t, rsa.VerifyPKCS1v15(&keys.merchantKey.PublicKey, crypto.SHA256, hashed[:], signature))
+}
+
+func TestWxPay_V3GzipRequest(t *testing.T) {
+	keys, cleanup := writeTestV3Keys(t)
+	defer cleanup()
+	body := `{"code":"OK"}`
+	client := newStubHttp(body, body)
+	client.header = keys.signResponse(t, body)
+	s := newTestV3Pay(client, keys)
+	s.SetGzipThreshold(1024)
+
+	req := map[string]string{"appid": "wx2421b1c4370ec43b", "description": strings.Repeat("示例商品", 100)}
+	assert.Nil(t, s.doV3(context.Background(), http.MethodPost, "/v3/pay/transactions/jsapi", req, nil))
+	sent := client.last()
+	assert.Equal(t, "gzip", sent.headers["Content-Encoding"])
+	assert.Equal(t, strconv.Itoa(len(sent.body)), sent.headers["Content-Length"], "length of the compressed body")
+	zr, err := gzip.NewReader(bytes.NewReader(sent.body))
+	assert.Nil(t, err)
+	plain, err := ioutil.ReadAll(zr)
+	assert.Nil(t, err)
+	assert.True(t, len(plain) > len(sent.body))
+
+	// 签名基于压缩前的内容
+	match := authorizationPattern.FindStringSubmatch(sent.headers["Authorization"])
+	if assert.NotNil(t, match, sent.headers["Authorization"]) {
+		message := "POST\n/v3/pay/transactions/jsapi\n1554208460\n" + match[2] + "\n" + string(plain) + "\n"
+		assert.Nil(t, verifyTestSignature(&keys.merchantKey.PublicKey, message, match[3]))
+	}
+
+	// 未达到阈值的请求不压缩
+	assert.Nil(t, s.doV3(context.Background(), http.MethodPost, "/v3/pay/transactions/jsapi", map[string]string{"appid": "wx2421b1c4370ec43b"}, nil))
+	sent = client.last()
+	assert.NotContains(t, sent.headers, "Content-Encoding")
+	assert.Equal(t, `{"appid":"wx2421b1c4370ec43b"}`, string(sent.body))
+}
+
+func TestWxPay_V3VerifyResponse(t *testing.T) {
+	keys, cleanup := writeTestV3Keys(t)
+	defer cleanup()
+	body := `{"code":"OK"}`
+
+	// 响应内容被篡改
+	client := newStubHttp(`{"code":"FAKE"}`)
+	client.header = keys.signResponse(t, body)
+	err := newTestV3Pay(client, keys).doV3(context.Background(), http.MethodGet, "/v3/certificates", nil, nil)
+	assert.True(t, errors.Is(err, ErrInvalidV3Signature), "err = %v", err)
+
+	// 没有对应的平台证书
+	client = newStubHttp(body)
+	client.header = keys.signResponse(t, body)
+	client.header.Set(headerWechatpaySerial, "7132D72A03E93CDDF8C03BBD1F37EEDF")
+	err = newTestV3Pay(client, keys).doV3(context.Background(), http.MethodGet, "/v3/certificates", nil, nil)
+	assert.True(t, errors.Is(err, ErrPlatformCertNotFound), "err = %v", err)
+
+	// 失败的响应返回 V3Error
+	client = newStubHttp(`{"code":"PARAM_ERROR","message":"参数错误"}`)
+	client.status = http.StatusBadRequest
+	err = newTestV3Pay(client, keys).doV3(context.Background(), http.MethodGet, "/v3/certificates", nil, nil)
+	assert.True(t, errors.Is(err, ErrV3Request), "err = %v", err)
+	var v3Err *V3Error
+	if assert.True(t, errors.As(err, &v3Err)) {
+		assert.Equal(t, http.StatusBadRequest, v3Err.StatusCode)
+		assert.Equal(t, "PARAM_ERROR", v3Err.Code)
+		assert.Equal(t, "参数错误", v3Err.Message)
+	}
+
+	// 没有配置v3时不发送请求
+	client = newStubHttp(body)
+	err = newTestPay(client).doV3(context.Background(), http.MethodGet, "/v3/certificates", nil, nil)
+	assert.Equal(t, ErrMissingV3Config, err)
+	assert.Len(t, client.requests, 0)
+}
+
+func TestWxPay_AddPlatformCert(t *testing.T) {
+	keys, cleanup := writeTestV3Keys(t)
+	defer cleanup()
+	body := `{"code":"OK"}`
+	client := newStubHttp(body)
+	client.header = keys.signResponse(t, body)
+	keys.cfg.PlatformCertFiles = nil
+	s := newTestV3Pay(client, keys)
+	err := s.doV3(context.Background(), http.MethodGet, "/v3/certificates", nil, nil)
+	assert.True(t, errors.Is(err, ErrPlatformCertNotFound), "err = %v", err)
+
+	serial, _ := new(big.Int).SetString(strings.ToLower(testPlatformSerial), 16)
+	tmpl := &x509.Certificate{SerialNumber: serial, NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &keys.platformKey.PublicKey, keys.platformKey)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	assert.Nil(t, s.AddPlatformCert(cert))
+	assert.Nil(t, s.doV3(context.Background(), http.MethodGet, "/v3/certificates", nil, nil))
+}
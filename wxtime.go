@@ -0,0 +1,36 @@
+package wechat
+
+import (
+	"time"
+)
+
+const (
+	// 微信接口中time_start、time_end等时间字段的格式，使用北京时间
+	wxTimeLayout = "20060102150405"
+)
+
+var (
+	// 加载时区的方法，测试中替换以模拟缺少tzdata的环境
+	loadLocation = time.LoadLocation
+	// 缺少tzdata时使用的固定时区，中国没有夏令时，与Asia/Shanghai等价
+	chinaFixedZone = time.FixedZone("CST", 8*3600)
+)
+
+// 微信接口使用的北京时间时区，系统没有tzdata（如精简的容器镜像）时使用固定的UTC+8
+func wxLocation() *time.Location {
+	loc, err := loadLocation("Asia/Shanghai")
+	if err != nil {
+		return chinaFixedZone
+	}
+	return loc
+}
+
+// 解析微信接口返回的时间，如 time_end，格式为 yyyyMMddHHmmss（北京时间）
+func ParseWxTime(s string) (time.Time, error) {
+	return time.ParseInLocation(wxTimeLayout, s, wxLocation())
+}
+
+// 将时间格式化成微信接口要求的 yyyyMMddHHmmss（北京时间），如 time_start、time_expire
+func FormatWxTime(t time.Time) string {
+	return t.In(wxLocation()).Format(wxTimeLayout)
+}
@@ -0,0 +1,36 @@
+package wechat
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWxTime(t *testing.T) {
+	end, err := ParseWxTime("20141030133525")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2014, 10, 30, 5, 35, 25, 0, time.UTC), end.UTC())
+	assert.Equal(t, "20141030133525", FormatWxTime(end.UTC()))
+
+	_, err = ParseWxTime("2014-10-30 13:35:25")
+	assert.NotNil(t, err)
+}
+
+func TestWxTime_MissingTZData(t *testing.T) {
+	defer func(f func(string) (*time.Location, error)) { loadLocation = f }(loadLocation)
+	loadLocation = func(name string) (*time.Location, error) {
+		return nil, errors.New("unknown time zone " + name)
+	}
+
+	assert.Equal(t, chinaFixedZone, wxLocation())
+	end, err := ParseWxTime("20141030133525")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2014, 10, 30, 5, 35, 25, 0, time.UTC), end.UTC())
+	assert.Equal(t, "20141030133525", FormatWxTime(time.Date(2014, 10, 30, 5, 35, 25, 0, time.UTC)))
+
+	billDate, err := NormalizeBillDate(time.Now().AddDate(0, 0, -1))
+	assert.Nil(t, err)
+	assert.Equal(t, time.Now().In(chinaFixedZone).AddDate(0, 0, -1).Format(billDateLayout), billDate)
+}